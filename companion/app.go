@@ -13,6 +13,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,9 +24,26 @@ func InitialiseApp(client *firestore.Client, config LocalConfiguration) (*App, e
 	log.Info().Msg("Creating Companion App Instance")
 
 	app := &App{
-		Version:   AppVersion,
-		Reference: config.AppId,
-		firestore: client,
+		Version:         AppVersion,
+		Reference:       config.AppId,
+		firestore:       client,
+		activePrintJobs: make(map[string]*PrintJob),
+		localRoleRules:  compileRoleRules(config.Printers.RoleRules),
+		discovery:       !config.Printers.DisableDiscovery,
+		scaleOptions:    config.Scales.StableOptions(),
+		allowedOrigins:  config.Server.AllowedOrigins,
+	}
+
+	app.scaleStream = NewScaleStream(func() Scale { return app.Scale }, app.scaleOptions)
+	app.scaleStreamInterval = config.Scales.StreamInterval()
+
+	app.OpenLocalStores(config)
+
+	// The service is the only one to trim the history, the CLI may have it open too
+	if app.history != nil {
+		if err := app.history.Compact(); err != nil {
+			log.Warn().Err(err).Msg("Failed to trim the local history")
+		}
 	}
 
 	isNew, err := app.loadInitialConfigFromFirestore()
@@ -51,6 +69,9 @@ func InitialiseApp(client *firestore.Client, config LocalConfiguration) (*App, e
 		return nil, err
 	}
 
+	// Get the list of attached scales, not being able to is no reason to stop printing
+	_ = app.updateAvailableScales()
+
 	// Remove logs from any previous sessions
 	err = app.deleteOldLogs(time.Now().Add(time.Minute * -1))
 
@@ -65,14 +86,47 @@ func InitialiseApp(client *firestore.Client, config LocalConfiguration) (*App, e
 		return nil, err
 	}
 
+	pollInterval := time.Duration(config.Printers.PollIntervalSeconds) * time.Second
+
+	if pollInterval <= 0 {
+		pollInterval = DefaultPrinterPollIntervalSeconds * time.Second
+	}
+
+	log.Info().Str("Interval", pollInterval.String()).Msg("Polling for printer changes")
+
 	go func() {
-		for range time.Tick(time.Second * 15) {
+		for range time.Tick(pollInterval) {
 			if app.IsStarted {
 				_ = app.updateAvailablePrinters()
 			}
 		}
 	}()
 
+	// Queues added, changed or removed in CUPS are picked up straight away rather than at the next poll
+	if runtime.GOOS != "windows" {
+		go watchModTimes(cupsConfigPaths, printerWatchInterval, nil, func() {
+			if app.IsStarted {
+				log.Info().Msg("The CUPS configuration has changed, refreshing the printers")
+				_ = app.updateAvailablePrinters()
+			}
+		})
+	}
+
+	// Other platforms list scales with ScaleTools, which is too slow to poll
+	if runtime.GOOS == "linux" {
+		scalePollInterval := config.Scales.PollInterval()
+
+		log.Info().Str("Interval", scalePollInterval.String()).Msg("Polling for scale changes")
+
+		go func() {
+			for range time.Tick(scalePollInterval) {
+				if app.IsStarted {
+					_ = app.updateAvailableScales()
+				}
+			}
+		}()
+	}
+
 	go func() {
 		for range time.Tick(time.Hour * 1) {
 			if app.IsStarted {
@@ -99,6 +153,9 @@ func (app *App) Start() {
 	// Deal with the incoming scale jobs
 	go app.startReceivingScaleJobs()
 
+	// Set up printer queues when asked to
+	go app.startReceivingPrinterCommands()
+
 	log.Info().Msg("Companion App is listening for new print & scales jobs to process.")
 
 	_ = app.startWebServer()
@@ -122,6 +179,12 @@ func (app *App) Stop() error {
 		log.Info().Msg("Stopped listening to scale jobs")
 	}
 
+	if app.firestoreCommandIterator != nil {
+		app.firestoreCommandIterator.Stop()
+		app.firestoreCommandIterator = nil
+		log.Info().Msg("Stopped listening to printer commands")
+	}
+
 	if app.firestoreConfigIterator != nil {
 		app.firestoreConfigIterator.Stop()
 		app.firestoreConfigIterator = nil
@@ -142,24 +205,77 @@ func (app *App) Stop() error {
 	return nil
 }
 
-func (app *App) getPrinterReference(printerType PrinterType) (*PrinterReference, error) {
+// OpenLocalStores opens the spool cache & local history. The app still runs without them.
+func (app *App) OpenLocalStores(config LocalConfiguration) {
+
+	spoolCache, err := OpenSpoolCache(config.SpoolCache)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to open the spool cache, reprints will not be available")
+	}
+
+	app.spoolCache = spoolCache
+
+	history, err := OpenHistory(config.History)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to open the local history, jobs will not be recorded")
+		history = nil
+	}
+
+	app.history = history
+}
+
+// FetchApp loads the app document from firestore without starting the app.
+func FetchApp(client *firestore.Client, appId string) (*App, error) {
+
+	document, err := client.Collection("CompanionApps").Doc(appId).Get(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
 
-	var reference *PrinterReference
+	app := &App{}
+	err = document.DataTo(app)
 
+	if err != nil {
+		return nil, err
+	}
+
+	app.Reference = appId
+
+	return app, nil
+}
+
+// FindPrinterRole returns the role the printer is assigned to, or nil when it has no role.
+func (app *App) FindPrinterRole(printerName string) (PrinterType, *PrinterReference) {
+
+	for _, printerType := range []PrinterType{Document, LabelSmall, LabelLarge, GiftNote} {
+		reference, err := app.getPrinterReference(printerType)
+
+		if err == nil && reference.Reference == printerName {
+			return printerType, reference
+		}
+	}
+
+	return Document, nil
+}
+
+func (app *App) printerReferenceFor(printerType PrinterType) *PrinterReference {
 	switch printerType {
-	case Document:
-		reference = &app.Printers.Document
 	case LabelSmall:
-		reference = &app.Printers.LabelSmall
+		return &app.Printers.LabelSmall
 	case LabelLarge:
-		reference = &app.Printers.LabelLarge
+		return &app.Printers.LabelLarge
 	case GiftNote:
-		reference = &app.Printers.GiftNote
+		return &app.Printers.GiftNote
 	}
+	return &app.Printers.Document
+}
 
-	if reference == nil {
-		return nil, errors.New("no printer has been configured for this document type")
-	}
+func (app *App) getPrinterReference(printerType PrinterType) (*PrinterReference, error) {
+
+	reference := app.printerReferenceFor(printerType)
 
 	// Check the reference is able to print somewhere
 	if reference.Reference == "" && reference.Forwarding == "" {
@@ -224,9 +340,49 @@ func (app *App) startReceivingScaleJobs() {
 	}
 }
 
+func (app *App) startReceivingPrinterCommands() {
+	app.firestoreCommandIterator = app.firestore.Collection("CompanionApps").Doc(app.Reference).Collection("PrinterCommands").OrderBy("created", firestore.Asc).StartAfter(time.Now().Unix()).Snapshots(context.Background())
+
+	log.Info().Msg("Started listening for inbound printer commands.")
+
+	for {
+		if app.firestoreCommandIterator == nil {
+			return
+		}
+
+		snap, err := app.firestoreCommandIterator.Next()
+
+		// Ignore errors related to the end of the iterator. These are expected on shutdown.
+		if err != nil && errors.Is(iterator.Done, err) == false {
+			log.Warn().Err(err).Msg("Error receiving printer command")
+			continue
+		}
+
+		if errors.Is(iterator.Done, err) {
+			log.Info().Msg("Printer command iterator is complete")
+			return
+		}
+
+		app.handlePrinterCommandCollectionChanges(snap.Changes)
+	}
+}
+
 func (app *App) handlePrintJobCollectionChanges(changes []firestore.DocumentChange) {
 
 	for _, change := range changes {
+		if change.Kind == firestore.DocumentRemoved {
+			app.cancelPrintJob(change.Doc.Ref, false)
+			continue
+		}
+
+		if change.Kind == firestore.DocumentModified {
+			jobStatus, _ := change.Doc.Data()["status"].(string)
+			if jobStatus == PrintJobStatusCancelRequested {
+				app.cancelPrintJob(change.Doc.Ref, true)
+			}
+			continue
+		}
+
 		if change.Kind != firestore.DocumentAdded {
 			continue
 		}
@@ -235,9 +391,22 @@ func (app *App) handlePrintJobCollectionChanges(changes []firestore.DocumentChan
 
 		record := change.Doc.Data()
 
+		if action, _ := record["action"].(string); action == PrintJobActionReprint {
+			app.reprint(change.Doc)
+			continue
+		}
+
 		var printerType PrinterType
 
-		printerTypeRaw := (record["printer_type"]).(string)
+		templateName, _ := record["template"].(string)
+
+		printerTypeRaw, _ := record["printer_type"].(string)
+
+		// Templates are ZPL so default to the label printer
+		if printerTypeRaw == "" && templateName != "" {
+			printerTypeRaw = "label_small"
+		}
+
 		switch printerTypeRaw {
 		case "document":
 			printerType = Document
@@ -257,27 +426,315 @@ func (app *App) handlePrintJobCollectionChanges(changes []firestore.DocumentChan
 
 		if err != nil {
 			log.Error().Err(err).Caller().Msg("Failed to get the printer reference")
-			return
+			failPrintJobDocument(change.Doc.Ref, err)
+			continue
+		}
+
+		quantity, err := printJobQuantity(record["quantity"])
+
+		if err != nil {
+			log.Error().Err(err).Caller().Msg("Failed to read the print job quantity")
+			failPrintJobDocument(change.Doc.Ref, err)
+			continue
+		}
+
+		created, ok := record["created"].(int64)
+
+		if !ok {
+			log.Error().Caller().Msg("Print job has no created time")
+			failPrintJobDocument(change.Doc.Ref, errors.New("the print job's created time must be a unix timestamp"))
+			continue
 		}
 
-		quantity, _ := strconv.Atoi((record["quantity"]).(string))
+		url, _ := record["url"].(string)
+		content, _ := record["content"].(string)
+		rawContentType, _ := record["content_type"].(string)
+
+		if url == "" && content == "" && templateName == "" {
+			log.Error().Caller().Msg("Print job has neither a url, inline content or a template")
+			failPrintJobDocument(change.Doc.Ref, errors.New("the print job has neither a url, inline content or a template"))
+			continue
+		}
 
-		printJob := PrintJob{
+		if templateName != "" {
+			rawContentType = ContentTypeZpl
+		}
+
+		contentType, err := NormaliseContentType(rawContentType)
+
+		if err != nil {
+			log.Error().Err(err).Caller().Msg("Failed to read the print job content type")
+			failPrintJobDocument(change.Doc.Ref, err)
+			continue
+		}
+
+		var templateSource string
+		var fields map[string]interface{}
+
+		if templateName != "" {
+			fields, _ = record["fields"].(map[string]interface{})
+			templateSource, err = LoadZplTemplate(templateName, app.LabelTemplates)
+
+			if err != nil {
+				log.Error().Err(err).Caller().Msg("Failed to load the label template")
+				failPrintJobDocument(change.Doc.Ref, err)
+				continue
+			}
+		}
+
+		sourceDpi, _ := record["source_dpi"].(int64)
+		jobReference, _ := record["reference"].(string)
+
+		jobOptions, err := ParsePrintOptions(record["options"])
+
+		if err != nil {
+			log.Error().Err(err).Caller().Msg("Failed to read the print job options")
+			failPrintJobDocument(change.Doc.Ref, err)
+			continue
+		}
+
+		printJob := &PrintJob{
+			Id:                 change.Doc.Ref.ID,
 			PrinterType:        printerType,
 			Quantity:           quantity,
-			Created:            time.Unix((record["created"]).(int64), 0),
-			Url:                (record["url"]).(string),
+			Created:            time.Unix(created, 0),
+			Url:                url,
+			ContentType:        contentType,
+			Content:            content,
+			Template:           templateName,
+			Reference:          jobReference,
+			SourceDpi:          int(sourceDpi),
+			Fields:             fields,
+			templateSource:     templateSource,
+			cache:              app.spoolCache,
+			Options:            reference.Options.Merge(jobOptions),
+			Status:             PrintJobStatusQueued,
 			Printer:            reference,
 			FirestoreReference: change.Doc.Ref,
 		}
 
-		// Keep record of our recent print job
-		app.LastPrintJob = &printJob
+		app.startPrintJob(printJob)
+	}
+}
 
-		app.SyncBackToFirestore()
+// preparePrintJob gives the job what it needs to record its history and reach network printers.
+func (app *App) preparePrintJob(printJob *PrintJob) {
 
-		// Do the print
-		go printJob.Handle()
+	printJob.history = app.history
+	printJob.user = app.User.Name
+	printJob.bay = app.Bay.Name
+
+	if printJob.Printer != nil {
+		printJob.network = app.findDiscoveredPrinter(printJob.Printer.Reference)
+	}
+}
+
+// printJobQuantity reads the quantity, Blade sends it as a string but templates & inline content
+// are often written with a number.
+func printJobQuantity(value interface{}) (int, error) {
+
+	switch quantity := value.(type) {
+	case string:
+		if parsed, err := strconv.Atoi(quantity); err == nil {
+			return parsed, nil
+		}
+	case int64:
+		return int(quantity), nil
+	case float64:
+		if quantity == float64(int(quantity)) {
+			return int(quantity), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid print quantity %v", value)
+}
+
+// failPrintJobDocument reports why a job couldn't be started back on its document.
+func failPrintJobDocument(ref *firestore.DocumentRef, err error) {
+
+	_, updateErr := ref.Update(context.Background(), []firestore.Update{
+		{
+			Path:  "message",
+			Value: err.Error(),
+		},
+		{
+			Path:  "status",
+			Value: PrintJobStatusError,
+		},
+	})
+
+	if updateErr != nil {
+		log.Error().Err(updateErr).Msg("Failed to save the print job error back to firestore")
+	}
+}
+
+// startPrintJob records the job as our most recent one and prints it in the background.
+func (app *App) startPrintJob(printJob *PrintJob) {
+
+	app.preparePrintJob(printJob)
+
+	// Keep record of our recent print job, a copy as the job changes while it prints
+	app.LastPrintJob = printJob.Snapshot()
+
+	app.SyncBackToFirestore()
+
+	app.activePrintJobsMutex.Lock()
+	app.activePrintJobs[printJob.Id] = printJob
+	app.activePrintJobsMutex.Unlock()
+
+	// Do the print
+	go func() {
+		printJob.Handle()
+
+		app.activePrintJobsMutex.Lock()
+		delete(app.activePrintJobs, printJob.Id)
+		app.activePrintJobsMutex.Unlock()
+	}()
+}
+
+// reprint prints a previous job again from the spool cache. Without a job_id the last
+// print job is used.
+func (app *App) reprint(doc *firestore.DocumentSnapshot) {
+
+	record := doc.Data()
+
+	fail := func(err error) {
+		log.Error().Err(err).Caller().Msg("Failed to reprint")
+		_, _ = doc.Ref.Update(context.Background(), []firestore.Update{
+			{
+				Path:  "message",
+				Value: err.Error(),
+			},
+			{
+				Path:  "status",
+				Value: PrintJobStatusError,
+			},
+		})
+	}
+
+	jobId, _ := record["job_id"].(string)
+
+	entry, err := app.findReprint(jobId)
+
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// Use the printer currently configured for the role rather than the one it was printed on
+	reference, err := app.getPrinterReference(entry.PrinterType)
+
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	printJob := NewReprintJob(doc.Ref.ID, entry, reference, app.spoolCache)
+	printJob.FirestoreReference = doc.Ref
+
+	if quantity, ok := record["quantity"].(int64); ok && quantity > 0 {
+		printJob.Quantity = int(quantity)
+	}
+
+	log.Info().Str("Job", entry.JobId).Msg("Reprinting job from the spool cache")
+
+	app.startPrintJob(printJob)
+}
+
+// Reprint prints a previous job again from the spool cache and waits for it, recording it in
+// the local history as Blade's reprint action does. Without a job id the last print job is used.
+// When the job's role has no printer configured it is printed where it was before.
+func (app *App) Reprint(jobId string) (*PrintJob, error) {
+
+	entry, err := app.findReprint(jobId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reference, err := app.getPrinterReference(entry.PrinterType)
+
+	if err != nil {
+		log.Warn().Err(err).Str("Printer", entry.Printer.Reference).Msg("Reprinting on the printer the job was printed on")
+		reference = &entry.Printer
+	}
+
+	printJob := NewReprintJob("reprint-"+entry.JobId, entry, reference, app.spoolCache)
+
+	log.Info().Str("Job", entry.JobId).Str("Printer", reference.Reference).Msg("Reprinting job from the spool cache")
+
+	app.preparePrintJob(printJob)
+	printJob.Handle()
+
+	return printJob, nil
+}
+
+// findReprint finds the job in the spool cache, or the last print job without a job id.
+func (app *App) findReprint(jobId string) (SpoolEntry, error) {
+
+	if app.spoolCache == nil {
+		return SpoolEntry{}, errors.New("the spool cache is not available")
+	}
+
+	if jobId != "" {
+		return app.spoolCache.FindByJob(jobId)
+	}
+
+	if app.LastPrintJob != nil && app.LastPrintJob.cached != nil {
+		return *app.LastPrintJob.cached, nil
+	}
+
+	if app.LastPrintJob != nil {
+		if entry, err := app.spoolCache.FindByJob(app.LastPrintJob.Id); err == nil {
+			return entry, nil
+		}
+	}
+
+	return app.spoolCache.Latest()
+}
+
+// cancelPrintJob stops an in progress print job that Blade has asked to cancel,
+// either by removing its document or by flagging it as cancel_requested.
+func (app *App) cancelPrintJob(ref *firestore.DocumentRef, documentExists bool) {
+
+	app.activePrintJobsMutex.Lock()
+	printJob, ok := app.activePrintJobs[ref.ID]
+	app.activePrintJobsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	log.Info().Str("Job", ref.ID).Msg("Cancellation requested for print job")
+
+	err := printJob.Cancel()
+
+	message := "Print job cancelled."
+	jobStatus := PrintJobStatusCancelled
+
+	if err != nil {
+		log.Error().Err(err).Str("Job", ref.ID).Msg("Failed to cancel the print job")
+		message = err.Error()
+		jobStatus = PrintJobStatusError
+	}
+
+	if !documentExists {
+		return
+	}
+
+	_, err = ref.Update(context.Background(), []firestore.Update{
+		{
+			Path:  "message",
+			Value: message,
+		},
+		{
+			Path:  "status",
+			Value: jobStatus,
+		},
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save the cancellation back to firestore")
 	}
 }
 
@@ -292,9 +749,26 @@ func (app *App) handleScaleJobCollectionChanges(changes []firestore.DocumentChan
 
 		record := change.Doc.Data()
 
+		jobReference, _ := record["reference"].(string)
+		action, _ := record["action"].(string)
+		toleranceType, _ := record["tolerance_type"].(string)
+		created, _ := record["created"].(int64)
+
 		scaleJob := ScaleJob{
-			Created:            time.Unix((record["created"]).(int64), 0),
+			Id:                 change.Doc.Ref.ID,
+			Reference:          jobReference,
+			Action:             action,
+			ExpectedWeight:     numberField(record, "expected_weight"),
+			Tolerance:          numberField(record, "tolerance"),
+			ToleranceType:      toleranceType,
+			Created:            time.Unix(created, 0),
 			FirestoreReference: change.Doc.Ref,
+			history:            app.history,
+			scale:              app.Scale,
+			options:            app.scaleOptions,
+			stream:             app.scaleStream,
+			user:               app.User.Name,
+			bay:                app.Bay.Name,
 		}
 
 		// Do the print
@@ -302,6 +776,54 @@ func (app *App) handleScaleJobCollectionChanges(changes []firestore.DocumentChan
 	}
 }
 
+func (app *App) handlePrinterCommandCollectionChanges(changes []firestore.DocumentChange) {
+
+	for _, change := range changes {
+		if change.Kind != firestore.DocumentAdded {
+			continue
+		}
+
+		log.Info().Interface("command", change.Doc.Data()).Msg("New document added to the printer commands collection")
+
+		var command PrinterCommand
+
+		err := change.Doc.DataTo(&command)
+
+		command.Id = change.Doc.Ref.ID
+		command.FirestoreReference = change.Doc.Ref
+
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read the printer command")
+			command.saveResult(PrinterCommandStatusError, err.Error())
+			continue
+		}
+
+		go app.runPrinterCommand(&command)
+	}
+}
+
+// runPrinterCommand applies the command then refreshes the printers so Blade sees the result.
+func (app *App) runPrinterCommand(command *PrinterCommand) {
+
+	err := command.Run()
+
+	if err != nil {
+		command.saveResult(PrinterCommandStatusError, err.Error())
+		return
+	}
+
+	log.Info().Str("Printer", command.Name).Str("Action", command.Action).Msg("Printer queue updated")
+
+	err = app.updateAvailablePrinters()
+
+	if err != nil {
+		command.saveResult(PrinterCommandStatusComplete, "The queue was updated but the printers could not be refreshed: "+err.Error())
+		return
+	}
+
+	command.saveResult(PrinterCommandStatusComplete, fmt.Sprintf("Printer %s %sd okay.", command.Name, command.Action))
+}
+
 func (app *App) stopReceivingPrintJobs() {
 	if app.firestorePrintJobIterator != nil {
 		app.firestorePrintJobIterator.Stop()
@@ -354,6 +876,9 @@ func (app *App) loadInitialConfigFromFirestore() (bool, error) {
 
 	app.updateAppFromFirestoreData(record)
 
+	// The app owns the printer list, but needs the last one to tell which printers are new since it last ran
+	app.AvailablePrinters = record.AvailablePrinters
+
 	return false, nil
 }
 
@@ -370,10 +895,23 @@ func (app *App) comparePrinter(current *PrinterReference, compare PrinterReferen
 	if current.Name != compare.Name {
 		current.Name = compare.Name
 	}
+	if current.NormaliseTo != compare.NormaliseTo {
+		current.NormaliseTo = compare.NormaliseTo
+	}
+	if current.ZplImage != compare.ZplImage {
+		current.ZplImage = compare.ZplImage
+	}
+	if !current.Options.Equal(compare.Options) {
+		current.Options = compare.Options
+	}
 }
 
 func (app *App) updateAppFromFirestoreData(record *App) {
 
+	// The printer poll reads the roles, rules & decisions while deciding roles for new printers
+	app.stateMutex.Lock()
+	defer app.stateMutex.Unlock()
+
 	if app.User.Id == "" {
 		app.User.Id = record.User.Id
 		app.User.Name = record.User.Name
@@ -410,6 +948,25 @@ func (app *App) updateAppFromFirestoreData(record *App) {
 		app.Scale.ProductId = record.Scale.ProductId
 	}
 
+	if app.Scale.Driver != record.Scale.Driver {
+		app.Scale.Driver = record.Scale.Driver
+	}
+
+	if app.Scale.Serial != record.Scale.Serial {
+		app.Scale.Serial = record.Scale.Serial
+	}
+
+	app.LabelTemplates = record.LabelTemplates
+
+	app.allowedOriginsMutex.Lock()
+	app.AllowedOrigins = record.AllowedOrigins
+	app.allowedOriginsMutex.Unlock()
+
+	// Admins confirm or override role decisions in Blade
+	app.RoleRules = record.RoleRules
+	app.RoleDecisions = record.RoleDecisions
+	app.roleRules = compileRoleRules(record.RoleRules)
+
 	app.comparePrinter(&app.Printers.Document, record.Printers.Document)
 	app.comparePrinter(&app.Printers.GiftNote, record.Printers.GiftNote)
 	app.comparePrinter(&app.Printers.LabelLarge, record.Printers.LabelLarge)
@@ -497,6 +1054,11 @@ func (app *App) deleteOldPrintJobs() error {
 
 func (app *App) updateAvailablePrinters() error {
 
+	// Printer commands refresh the printers as soon as they're done, which can be while the poll is running.
+	// Firestore updates change the roles & rules, so they wait too
+	app.stateMutex.Lock()
+	defer app.stateMutex.Unlock()
+
 	printers, err := ListAvailablePrinters()
 
 	if err != nil {
@@ -504,28 +1066,41 @@ func (app *App) updateAvailablePrinters() error {
 		return err
 	}
 
-	isDirty := len(app.AvailablePrinters) != len(printers)
+	printers = append(printers, app.discoverNetworkPrinters(printers)...)
 
-	if !isDirty {
-		for _, availablePrinter := range app.AvailablePrinters {
-			match := false
-			for _, printer := range printers {
-				if printer.Name == availablePrinter.Name {
-					match = true
-					break
-				}
-			}
+	// Check the health of each printer so Blade can warn before anyone prints to it
+	probeConcurrently(len(printers), func(i int) {
+		printers[i].Health = app.probePrinterHealth(printers[i])
+	})
 
-			if match == false {
-				isDirty = true
-				break
-			}
+	changes := DiffPrinters(app.AvailablePrinters, printers)
+
+	// Printers we have not seen before may match a role
+	decided := app.applyRoleRules(printers, changes.Added)
+
+	warnings := app.printerWarnings(printers)
+
+	isDirty := !changes.IsEmpty() || decided || !equalWarnings(app.Warnings, warnings)
+
+	if !changes.IsEmpty() {
+		log.Info().Strs("Added", changes.Added).Strs("Removed", changes.Removed).Str("Changes", changes.String()).Msg("Available printers have changed")
+	}
+
+	for _, warning := range warnings {
+		if !containsWarning(app.Warnings, warning) {
+			log.Warn().Str("Role", warning.Role).Str("Printer", warning.Printer).Msg(warning.Message)
+		}
+	}
+
+	for _, warning := range app.Warnings {
+		if !containsWarning(warnings, warning) {
+			log.Info().Str("Role", warning.Role).Str("Printer", warning.Printer).Str("Code", warning.Code).Msg("Printer warning has been resolved")
 		}
 	}
 
 	if isDirty {
-		log.Info().Msg("Available printers have changed")
 		app.AvailablePrinters = printers
+		app.Warnings = warnings
 		err = app.SyncBackToFirestore()
 
 		if err != nil {
@@ -536,6 +1111,111 @@ func (app *App) updateAvailablePrinters() error {
 	return nil
 }
 
+func (app *App) updateAvailableScales() error {
+
+	scales, err := ListAvailableScales()
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to fetch the list of available scales")
+		return err
+	}
+
+	app.stateMutex.Lock()
+	defer app.stateMutex.Unlock()
+
+	if equalScales(app.AvailableScales, scales) {
+		return nil
+	}
+
+	names := make([]string, 0, len(scales))
+	for _, scale := range scales {
+		names = append(names, scale.Name)
+	}
+
+	log.Info().Strs("Scales", names).Msg("Available scales have changed")
+
+	app.AvailableScales = scales
+
+	return app.SyncBackToFirestore()
+}
+
+// probePrinterHealth checks the printer, keeping the time of the last change when nothing is different.
+func (app *App) probePrinterHealth(printer Printer) *PrinterHealth {
+
+	previous := app.availablePrinterHealth(printer.Name)
+
+	health, err := printer.ProbeHealth()
+
+	if err != nil {
+		log.Warn().Err(err).Str("Printer", printer.Name).Msg("Failed to check the printer health")
+		return previous
+	}
+
+	if health == nil || health.Equal(previous) {
+		return previous
+	}
+
+	event := log.Info()
+	if !health.Healthy {
+		event = log.Warn()
+	}
+
+	event.Str("Printer", printer.Name).Str("State", health.State).Bool("Accepting Jobs", health.AcceptingJobs).Strs("Reasons", health.Reasons).Int("Queue Length", health.QueueLength).Msg("Printer health has changed")
+
+	return health
+}
+
+// discoverNetworkPrinters browses for printers on the network that are not installed. Browsing
+// takes a few seconds so the results are reused between polls.
+func (app *App) discoverNetworkPrinters(installed []Printer) []Printer {
+
+	if !app.discovery {
+		return nil
+	}
+
+	if time.Now().Sub(app.discoveredAt) > DiscoveryInterval {
+		discovered, err := DiscoverNetworkPrinters(DefaultDiscoveryTimeout)
+
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to discover network printers")
+		} else {
+			app.discoveredPrinters = discovered
+		}
+
+		app.discoveredAt = time.Now()
+	}
+
+	printers := make([]Printer, 0)
+
+	for _, printer := range app.discoveredPrinters {
+		if !isInstalledQueue(printer, installed) {
+			printers = append(printers, printer)
+		}
+	}
+
+	return printers
+}
+
+// findDiscoveredPrinter returns the discovered printer with the name, or nil for installed printers.
+func (app *App) findDiscoveredPrinter(printerName string) *Printer {
+	for _, printer := range app.AvailablePrinters {
+		if printer.Discovered && printer.Name == printerName {
+			found := printer
+			return &found
+		}
+	}
+	return nil
+}
+
+func (app *App) availablePrinterHealth(printerName string) *PrinterHealth {
+	for _, printer := range app.AvailablePrinters {
+		if printer.Name == printerName {
+			return printer.Health
+		}
+	}
+	return nil
+}
+
 func (app *App) startWebServer() error {
 
 	mux := http.NewServeMux()
@@ -543,6 +1223,8 @@ func (app *App) startWebServer() error {
 
 	mux.HandleFunc("/info", app.infoEndpoint)
 	mux.HandleFunc("/logged_in", app.loginEndpoint)
+	mux.HandleFunc("/history", app.historyEndpoint)
+	mux.HandleFunc("/scale/live", app.scaleLiveEndpoint)
 
 	log.Info().Int("Port", 62222).Msg("Starting Local Server")
 
@@ -557,24 +1239,46 @@ func (app *App) startWebServer() error {
 }
 
 type App struct {
-	Version                   string    `json:"version" firestore:"version"`
-	Reference                 string    `json:"-" firestore:"-"`
-	Bay                       Bay       `json:"bay" firestore:"bay"`
-	Paused                    bool      `json:"paused" firestore:"paused"`
-	Printers                  Printers  `json:"printers" firestore:"printers"`
-	Scale                     Scale     `json:"scale" firestore:"scale"`
-	User                      User      `json:"user" firestore:"user"`
-	JavaVersion               string    `json:"java_version" firestore:"java_version"`
-	OperatingSystem           string    `json:"operating_system" firestore:"operating_system"`
-	Hostname                  string    `json:"hostname" firestore:"hostname"`
-	AvailablePrinters         []Printer `json:"available_printers" firestore:"available_printers"`
-	LastPrintJob              *PrintJob `json:"last_print_job" firestore:"last_print_job"`
-	IsStarted                 bool      `json:"is_started" firestore:"is_started"`
+	Version                   string            `json:"version" firestore:"version"`
+	Reference                 string            `json:"-" firestore:"-"`
+	Bay                       Bay               `json:"bay" firestore:"bay"`
+	Paused                    bool              `json:"paused" firestore:"paused"`
+	Printers                  Printers          `json:"printers" firestore:"printers"`
+	Scale                     Scale             `json:"scale" firestore:"scale"`
+	User                      User              `json:"user" firestore:"user"`
+	JavaVersion               string            `json:"java_version" firestore:"java_version"`
+	OperatingSystem           string            `json:"operating_system" firestore:"operating_system"`
+	Hostname                  string            `json:"hostname" firestore:"hostname"`
+	AvailablePrinters         []Printer         `json:"available_printers" firestore:"available_printers"`
+	AvailableScales           []AvailableScale  `json:"available_scales" firestore:"available_scales"`
+	Warnings                  []AppWarning      `json:"warnings" firestore:"warnings"`
+	RoleRules                 []RoleRule        `json:"role_rules" firestore:"role_rules"`
+	RoleDecisions             []RoleDecision    `json:"role_decisions" firestore:"role_decisions"`
+	LastPrintJob              *PrintJob         `json:"last_print_job" firestore:"last_print_job"`
+	LabelTemplates            map[string]string `json:"label_templates" firestore:"label_templates"`
+	AllowedOrigins            []string          `json:"allowed_origins" firestore:"allowed_origins"`
+	IsStarted                 bool              `json:"is_started" firestore:"is_started"`
 	firestore                 *firestore.Client
 	firestorePrintJobIterator *firestore.QuerySnapshotIterator
 	firestoreScaleJobIterator *firestore.QuerySnapshotIterator
+	firestoreCommandIterator  *firestore.QuerySnapshotIterator
 	firestoreConfigIterator   *firestore.DocumentSnapshotIterator
 	server                    *http.Server
+	activePrintJobs           map[string]*PrintJob
+	activePrintJobsMutex      sync.Mutex
+	stateMutex                sync.Mutex
+	allowedOriginsMutex       sync.Mutex
+	spoolCache                *SpoolCache
+	history                   *History
+	roleRules                 []compiledRoleRule
+	localRoleRules            []compiledRoleRule
+	discovery                 bool
+	discoveredPrinters        []Printer
+	discoveredAt              time.Time
+	scaleOptions              StableOptions
+	allowedOrigins            []string
+	scaleStream               *ScaleStream
+	scaleStreamInterval       time.Duration
 }
 
 type Printers struct {
@@ -585,10 +1289,15 @@ type Printers struct {
 }
 
 type PrinterReference struct {
-	Forwarding string `json:"forwarding" firestore:"forwarding"`
-	Name       string `json:"name" firestore:"name"`
-	Reference  string `json:"reference" firestore:"reference"`
-	Tray       string `json:"tray" firestore:"tray"`
+	Forwarding string       `json:"forwarding" firestore:"forwarding"`
+	Name       string       `json:"name" firestore:"name"`
+	Reference  string       `json:"reference" firestore:"reference"`
+	Tray       string       `json:"tray" firestore:"tray"`
+	Options    PrintOptions `json:"options" firestore:"options"`
+	// Media size pdf pages are rotated, cropped & scaled to before printing. e.g. 4x6in, 62mm
+	NormaliseTo string `json:"normalise_to" firestore:"normalise_to"`
+	// How images are converted to ZPL for printers without pdf support
+	ZplImage ZplImageOptions `json:"zpl_image" firestore:"zpl_image"`
 }
 
 type User struct {
@@ -610,6 +1319,9 @@ type Scale struct {
 	Name       string `json:"name" firestore:"name"`
 	ProductId  int `json:"product_id" firestore:"product_id"`
 	VendorId   int `json:"vendor_id" firestore:"vendor_id"`
+	// hid (the default) for USB scales, or continuous, mt_sics or regex for serial scales
+	Driver string      `json:"driver" firestore:"driver"`
+	Serial SerialScale `json:"serial" firestore:"serial"`
 }
 
 type PrinterType int
@@ -620,3 +1332,17 @@ const (
 	LabelLarge
 	GiftNote
 )
+
+func (printerType PrinterType) String() string {
+	switch printerType {
+	case Document:
+		return "document"
+	case LabelSmall:
+		return "label_small"
+	case LabelLarge:
+		return "label_large"
+	case GiftNote:
+		return "gift_note"
+	}
+	return "unknown"
+}
@@ -0,0 +1,67 @@
+package companion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrintJobQuantity(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    int
+		wantErr bool
+	}{
+		{name: "string", value: "2", want: 2},
+		{name: "integer", value: int64(3), want: 3},
+		{name: "whole float", value: float64(4), want: 4},
+		{name: "fractional float", value: 1.5, wantErr: true},
+		{name: "not a number", value: "two", wantErr: true},
+		{name: "missing", value: nil, wantErr: true},
+		{name: "map", value: map[string]interface{}{"n": 1}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := printJobQuantity(test.value)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("printJobQuantity() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("printJobQuantity() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// Role decisions are made while the printers refresh, firestore updates must not change the rules underneath them.
+func TestUpdateAppWaitsForPrinterRefresh(t *testing.T) {
+
+	app := &App{}
+
+	app.stateMutex.Lock()
+
+	updated := make(chan struct{})
+
+	go func() {
+		app.updateAppFromFirestoreData(&App{RoleRules: []RoleRule{{Role: "label_small", Mode: RoleRuleModeAssign}}})
+		close(updated)
+	}()
+
+	select {
+	case <-updated:
+		t.Fatal("the app was updated during the printer refresh")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	app.stateMutex.Unlock()
+	<-updated
+
+	if len(app.RoleRules) != 1 {
+		t.Errorf("role rules = %v, want the rule from firestore", app.RoleRules)
+	}
+}
@@ -0,0 +1,209 @@
+package companion
+
+import (
+	"net/url"
+	"runtime"
+	"strings"
+)
+
+// PrinterCapabilities describe what a printer supports, so Blade can validate role
+// assignments and pick sensible defaults.
+type PrinterCapabilities struct {
+	MakeAndModel    string   `json:"make_and_model" firestore:"make_and_model"`
+	DeviceUri       string   `json:"device_uri" firestore:"device_uri"`
+	MediaSizes      []string `json:"media_sizes" firestore:"media_sizes"`
+	Resolutions     []string `json:"resolutions" firestore:"resolutions"`
+	Duplex          bool     `json:"duplex" firestore:"duplex"`
+	Colour          bool     `json:"colour" firestore:"colour"`
+	DocumentFormats []string `json:"document_formats" firestore:"document_formats"`
+}
+
+var cupsCapabilityAttributes = []string{
+	"printer-make-and-model",
+	"device-uri",
+	"media-supported",
+	"printer-resolution-supported",
+	"sides-supported",
+	"color-supported",
+	"document-format-supported",
+}
+
+// merge fills anything missing from the other capabilities.
+func (capabilities *PrinterCapabilities) merge(other *PrinterCapabilities) {
+
+	if other == nil {
+		return
+	}
+
+	if capabilities.MakeAndModel == "" {
+		capabilities.MakeAndModel = other.MakeAndModel
+	}
+
+	if capabilities.DeviceUri == "" {
+		capabilities.DeviceUri = other.DeviceUri
+	}
+
+	if len(capabilities.MediaSizes) == 0 {
+		capabilities.MediaSizes = other.MediaSizes
+	}
+
+	if len(capabilities.Resolutions) == 0 {
+		capabilities.Resolutions = other.Resolutions
+	}
+
+	if len(capabilities.DocumentFormats) == 0 {
+		capabilities.DocumentFormats = other.DocumentFormats
+	}
+
+	capabilities.Duplex = capabilities.Duplex || other.Duplex
+	capabilities.Colour = capabilities.Colour || other.Colour
+}
+
+// discoverCapabilities adds what CUPS knows about each printer to what PrinterTools.jar
+// reported. CUPS is preferred as its IPP attributes are more complete than the java print service.
+func discoverCapabilities(printers []Printer) {
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	for i := range printers {
+		capabilities := cupsCapabilities(printers[i].Name)
+
+		if capabilities == nil {
+			continue
+		}
+
+		capabilities.merge(printers[i].Capabilities)
+		printers[i].Capabilities = capabilities
+	}
+}
+
+// cupsCapabilities asks the local CUPS server for the printer attributes over IPP, falling
+// back to the options lpoptions reports when the server is not listening on localhost.
+func cupsCapabilities(printerName string) *PrinterCapabilities {
+
+	response, err := GetPrinterAttributes("ipp://localhost/printers/"+url.PathEscape(printerName), cupsCapabilityAttributes...)
+
+	if err == nil {
+		return ippCapabilities(response.Attributes)
+	}
+
+	capabilities, err := lpOptionsCapabilities(printerName)
+
+	if err != nil {
+		return nil
+	}
+
+	return capabilities
+}
+
+// ippCapabilities reads the capabilities from the printer attributes.
+func ippCapabilities(attributes IppAttributes) *PrinterCapabilities {
+
+	capabilities := &PrinterCapabilities{
+		MakeAndModel:    attributes.Value("printer-make-and-model"),
+		DeviceUri:       attributes.Value("device-uri"),
+		MediaSizes:      attributes["media-supported"],
+		Resolutions:     attributes["printer-resolution-supported"],
+		Colour:          attributes.Value("color-supported") == "true",
+		DocumentFormats: attributes["document-format-supported"],
+	}
+
+	for _, sides := range attributes["sides-supported"] {
+		if strings.HasPrefix(sides, "two-sided") {
+			capabilities.Duplex = true
+		}
+	}
+
+	return capabilities
+}
+
+// lpOptionsCapabilities reads the capabilities from the printer's driver options.
+func lpOptionsCapabilities(printerName string) (*PrinterCapabilities, error) {
+
+	output, err := runCupsCommand("lpoptions", "-p", printerName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := parseLpOptions(output)
+
+	// lpoptions can't say which formats are accepted, left empty rather than null like the other lists
+	capabilities := &PrinterCapabilities{
+		MakeAndModel:    attributes["printer-make-and-model"],
+		DeviceUri:       attributes["device-uri"],
+		MediaSizes:      make([]string, 0),
+		Resolutions:     make([]string, 0),
+		DocumentFormats: make([]string, 0),
+	}
+
+	output, err = runCupsCommand("lpoptions", "-p", printerName, "-l")
+
+	if err != nil {
+		return nil, err
+	}
+
+	options := parseLpOptionChoices(output)
+
+	capabilities.MediaSizes = append(capabilities.MediaSizes, options["PageSize"]...)
+
+	for _, resolution := range options["Resolution"] {
+		capabilities.Resolutions = append(capabilities.Resolutions, ppdResolution(resolution))
+	}
+
+	for _, choice := range options["Duplex"] {
+		if choice != "None" {
+			capabilities.Duplex = true
+		}
+	}
+
+	for _, choice := range append(options["ColorModel"], options["OutputMode"]...) {
+		switch strings.ToLower(choice) {
+		case "rgb", "cmyk", "color", "colour":
+			capabilities.Colour = true
+		}
+	}
+
+	return capabilities, nil
+}
+
+// ppdResolution writes a driver's resolution the way IPP & PrinterTools.jar do, e.g. 600dpi as 600x600dpi.
+func ppdResolution(resolution string) string {
+
+	for _, units := range []string{"dpi", "dpcm"} {
+		if strings.HasSuffix(resolution, units) && !strings.Contains(resolution, "x") {
+			return strings.TrimSuffix(resolution, units) + "x" + resolution
+		}
+	}
+
+	return resolution
+}
+
+// parseLpOptionChoices reads the driver options printed by lpoptions -l, e.g.
+// "PageSize/Media Size: Letter *A4", returning the choices for each option.
+func parseLpOptionChoices(output string) map[string][]string {
+
+	options := make(map[string][]string)
+
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		name := strings.SplitN(parts[0], "/", 2)[0]
+		choices := make([]string, 0)
+
+		for _, choice := range strings.Fields(parts[1]) {
+			// The default choice is marked with an asterisk
+			choices = append(choices, strings.TrimPrefix(choice, "*"))
+		}
+
+		options[strings.TrimSpace(name)] = choices
+	}
+
+	return options
+}
@@ -0,0 +1,129 @@
+package companion
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Check weigh verdicts
+const (
+	CheckWeighPass  = "pass"
+	CheckWeighUnder = "under"
+	CheckWeighOver  = "over"
+	// CheckWeighError is recorded when the parcel should have been check weighed but couldn't be
+	CheckWeighError = "error"
+)
+
+// How the tolerance of a check weigh is given
+const (
+	ToleranceTypeGrams   = "grams"
+	ToleranceTypePercent = "percent"
+)
+
+// CheckWeigh is the weight a parcel should be, so a scale job can verify it was packed correctly.
+type CheckWeigh struct {
+	// ExpectedGrams is the weight the parcel should be, nothing is checked when it is 0
+	ExpectedGrams float64
+	// Tolerance is how far either side of the expected weight still passes, in grams or as a percentage
+	Tolerance     float64
+	ToleranceType string
+}
+
+// CheckWeighResult is the verdict with how far the weight was from the expected weight.
+type CheckWeighResult struct {
+	Verdict string
+	// Variance is the weight less the expected weight, negative when under
+	VarianceGrams   float64
+	VariancePercent float64
+	// AllowedGrams is the tolerance in grams
+	AllowedGrams float64
+}
+
+// IsSet is true when the job should be check weighed.
+func (check CheckWeigh) IsSet() bool {
+	return check.ExpectedGrams != 0
+}
+
+func (check CheckWeigh) Validate() error {
+
+	if check.ExpectedGrams < 0 {
+		return fmt.Errorf("the expected weight can not be negative, got %g", check.ExpectedGrams)
+	}
+
+	if check.Tolerance < 0 {
+		return fmt.Errorf("the tolerance can not be negative, got %g", check.Tolerance)
+	}
+
+	switch check.ToleranceType {
+	case "", ToleranceTypeGrams, ToleranceTypePercent:
+		return nil
+	}
+
+	return fmt.Errorf("unknown tolerance type %q, expected %s or %s", check.ToleranceType, ToleranceTypeGrams, ToleranceTypePercent)
+}
+
+// AllowedGrams is the tolerance in grams, a percentage being of the expected weight.
+func (check CheckWeigh) AllowedGrams() float64 {
+
+	if check.ToleranceType == ToleranceTypePercent {
+		return check.ExpectedGrams * check.Tolerance / 100
+	}
+
+	return check.Tolerance
+}
+
+// Check gives the verdict for the weight. Weights on the edge of the tolerance pass.
+func (check CheckWeigh) Check(grams float64) CheckWeighResult {
+
+	result := CheckWeighResult{
+		VarianceGrams: grams - check.ExpectedGrams,
+		AllowedGrams:  check.AllowedGrams(),
+		Verdict:       CheckWeighPass,
+	}
+
+	result.VariancePercent = result.VarianceGrams / check.ExpectedGrams * 100
+
+	// Allow for the rounding of the scale's own units, e.g. ounces in to grams
+	const epsilon = 1e-9
+
+	if result.VarianceGrams < -result.AllowedGrams-epsilon {
+		result.Verdict = CheckWeighUnder
+	} else if result.VarianceGrams > result.AllowedGrams+epsilon {
+		result.Verdict = CheckWeighOver
+	}
+
+	return result
+}
+
+// Message explains the verdict, e.g. "Under the expected 1250g by 40g, 20g is allowed."
+func (result CheckWeighResult) Message(check CheckWeigh) string {
+
+	variance := formatGrams(math.Abs(result.VarianceGrams))
+	expected := formatGrams(check.ExpectedGrams)
+	allowed := formatGrams(result.AllowedGrams)
+
+	switch result.Verdict {
+	case CheckWeighUnder:
+		return fmt.Sprintf("Under the expected %s by %s, %s is allowed.", expected, variance, allowed)
+	case CheckWeighOver:
+		return fmt.Sprintf("Over the expected %s by %s, %s is allowed.", expected, variance, allowed)
+	}
+
+	return fmt.Sprintf("Within %s of the expected %s.", allowed, expected)
+}
+
+func formatGrams(grams float64) string {
+	return strconv.FormatFloat(math.Round(grams*100)/100, 'f', -1, 64) + "g"
+}
+
+// numberField reads a number from a firestore document, which may be stored as an integer or a float.
+func numberField(record map[string]interface{}, key string) float64 {
+	switch value := record[key].(type) {
+	case int64:
+		return float64(value)
+	case float64:
+		return value
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package companion
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCheckWeighAllowedGrams(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		check CheckWeigh
+		want  float64
+	}{
+		{name: "grams", check: CheckWeigh{ExpectedGrams: 1250, Tolerance: 20, ToleranceType: ToleranceTypeGrams}, want: 20},
+		{name: "grams by default", check: CheckWeigh{ExpectedGrams: 1250, Tolerance: 20}, want: 20},
+		{name: "percent", check: CheckWeigh{ExpectedGrams: 1250, Tolerance: 2, ToleranceType: ToleranceTypePercent}, want: 25},
+		{name: "none", check: CheckWeigh{ExpectedGrams: 1250, ToleranceType: ToleranceTypePercent}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.check.AllowedGrams(); got != test.want {
+				t.Errorf("AllowedGrams() = %g, want %g", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckWeighCheck(t *testing.T) {
+
+	// A pound read in tenths of an ounce, which doesn't come out at exactly 453.59237g
+	pound, err := newScaleReading(ScaleStatusStable, 11, -1, 160)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grams := CheckWeigh{ExpectedGrams: 1250, Tolerance: 20}
+	percent := CheckWeigh{ExpectedGrams: 1250, Tolerance: 2, ToleranceType: ToleranceTypePercent}
+
+	tests := []struct {
+		name         string
+		check        CheckWeigh
+		grams        float64
+		want         string
+		wantVariance float64
+	}{
+		{name: "exact", check: grams, grams: 1250, want: CheckWeighPass},
+		{name: "on the lower edge", check: grams, grams: 1230, want: CheckWeighPass, wantVariance: -20},
+		{name: "on the upper edge", check: grams, grams: 1270, want: CheckWeighPass, wantVariance: 20},
+		{name: "just under", check: grams, grams: 1229.99, want: CheckWeighUnder, wantVariance: -20.01},
+		{name: "just over", check: grams, grams: 1270.01, want: CheckWeighOver, wantVariance: 20.01},
+		{name: "percent edge", check: percent, grams: 1275, want: CheckWeighPass, wantVariance: 25},
+		{name: "percent over", check: percent, grams: 1276, want: CheckWeighOver, wantVariance: 26},
+		{name: "percent under", check: percent, grams: 1224, want: CheckWeighUnder, wantVariance: -26},
+		{name: "no tolerance", check: CheckWeigh{ExpectedGrams: 500}, grams: 500.5, want: CheckWeighOver, wantVariance: 0.5},
+		{name: "ounces in grams", check: CheckWeigh{ExpectedGrams: 453.59237}, grams: pound.Grams, want: CheckWeighPass},
+		{name: "ounces a gram over", check: CheckWeigh{ExpectedGrams: 452.59237}, grams: pound.Grams, want: CheckWeighOver, wantVariance: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got := test.check.Check(test.grams)
+
+			if got.Verdict != test.want {
+				t.Errorf("Check() verdict = %s, want %s", got.Verdict, test.want)
+			}
+
+			if math.Abs(got.VarianceGrams-test.wantVariance) > 1e-6 {
+				t.Errorf("Check() variance = %g, want %g", got.VarianceGrams, test.wantVariance)
+			}
+
+			if got.AllowedGrams != test.check.AllowedGrams() {
+				t.Errorf("Check() allowed = %g, want %g", got.AllowedGrams, test.check.AllowedGrams())
+			}
+		})
+	}
+}
+
+func TestCheckWeighMessage(t *testing.T) {
+
+	check := CheckWeigh{ExpectedGrams: 1250, Tolerance: 20}
+
+	tests := []struct {
+		grams float64
+		want  string
+	}{
+		{grams: 1210, want: "Under the expected 1250g by 40g, 20g is allowed."},
+		{grams: 1300.126, want: "Over the expected 1250g by 50.13g, 20g is allowed."},
+		{grams: 1255, want: "Within 20g of the expected 1250g."},
+	}
+
+	for _, test := range tests {
+		if got := check.Check(test.grams).Message(check); got != test.want {
+			t.Errorf("Message() = %q for %gg, want %q", got, test.grams, test.want)
+		}
+	}
+}
+
+// Parcels that couldn't be weighed are kept in the history with the error verdict, so they can be found.
+func TestCheckWeighErrorVerdict(t *testing.T) {
+
+	history := newHistory(t.TempDir(), HistoryConfiguration{})
+	job := &ScaleJob{Id: "parcel", ExpectedWeight: 1250, history: history}
+
+	job.recordHistory(time.Now(), "error", "timed out waiting for the scales", 0, &CheckWeighResult{Verdict: CheckWeighError})
+	job.recordHistory(time.Now(), "complete", "", 1250, &CheckWeighResult{Verdict: CheckWeighPass})
+
+	filter, err := NewHistoryFilter(map[string]string{"verdict": CheckWeighError})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := history.Query(filter)
+
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	if len(records) != 1 || records[0].Verdict != CheckWeighError || records[0].ExpectedWeight != 1250 {
+		t.Errorf("Query() = %+v, want the parcel that couldn't be weighed", records)
+	}
+}
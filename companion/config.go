@@ -12,7 +12,43 @@ import (
 )
 
 type LocalConfiguration struct {
-	AppId string `json:"appId"`
+	AppId      string                  `json:"appId"`
+	SpoolCache SpoolCacheConfiguration `json:"spoolCache"`
+	History    HistoryConfiguration    `json:"history"`
+	Printers   PrintersConfiguration   `json:"printers"`
+	Scales     ScalesConfiguration     `json:"scales"`
+	Server     ServerConfiguration     `json:"server"`
+}
+
+type PrintersConfiguration struct {
+	PollIntervalSeconds int        `json:"pollIntervalSeconds"`
+	RoleRules           []RoleRule `json:"roleRules"`
+	DisableDiscovery    bool       `json:"disableDiscovery"`
+}
+
+type ScalesConfiguration struct {
+	StableReadings int     `json:"stableReadings"`
+	ToleranceGrams float64 `json:"toleranceGrams"`
+	TimeoutSeconds float64 `json:"timeoutSeconds"`
+	// How often live readings are sent to Blade
+	StreamIntervalMs int `json:"streamIntervalMs"`
+	// How often the attached USB scales are listed
+	PollIntervalSeconds int `json:"pollIntervalSeconds"`
+}
+
+type ServerConfiguration struct {
+	// Web origins allowed to read private data from the local server, e.g. https://*.example.com
+	AllowedOrigins []string `json:"allowedOrigins"`
+}
+
+type HistoryConfiguration struct {
+	MaxAgeDays int `json:"maxAgeDays"`
+	MaxRecords int `json:"maxRecords"`
+}
+
+type SpoolCacheConfiguration struct {
+	MaxSizeMb   int `json:"maxSizeMb"`
+	MaxAgeHours int `json:"maxAgeHours"`
 }
 
 func GetConfig() (LocalConfiguration, error) {
@@ -0,0 +1,116 @@
+package companion
+
+import (
+	"errors"
+	"strings"
+)
+
+// CupsServerUri is the local CUPS scheduler.
+const CupsServerUri = "ipp://localhost/"
+
+// listCupsPrinters lists the local CUPS queues without starting a JVM. The scheduler is
+// asked over IPP first as a single request returns everything, falling back to lpstat &
+// lpoptions when it is not listening on localhost.
+func listCupsPrinters() ([]Printer, error) {
+
+	printers, ippErr := ippCupsPrinters()
+
+	if ippErr == nil {
+		return printers, nil
+	}
+
+	printers, err := lpstatPrinters()
+
+	if err != nil {
+		return nil, errors.New(ippErr.Error() + ", " + err.Error())
+	}
+
+	return printers, nil
+}
+
+func ippCupsPrinters() ([]Printer, error) {
+
+	request := ippRequest{
+		operation:  ippOperationCupsGetPrinters,
+		printerUri: CupsServerUri,
+		operationExtras: []ippAttribute{
+			{tag: ippTagKeyword, name: "requested-attributes", values: append([]string{"printer-name", "media-source-supported"}, cupsCapabilityAttributes...)},
+		},
+	}
+
+	response, err := sendIppRequest(request, nil)
+
+	printers := make([]Printer, 0)
+
+	// client-error-not-found, there are no queues
+	if response != nil && response.Status == 0x0406 {
+		return printers, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range response.Groups {
+		if group.Tag != ippTagPrinter || group.Attributes.Value("printer-name") == "" {
+			continue
+		}
+
+		printers = append(printers, Printer{
+			Name:         group.Attributes.Value("printer-name"),
+			Trays:        cupsTrays(group.Attributes["media-source-supported"]),
+			Capabilities: ippCapabilities(group.Attributes),
+		})
+	}
+
+	return printers, nil
+}
+
+func lpstatPrinters() ([]Printer, error) {
+
+	// One destination name per line
+	output, err := runCupsCommand("lpstat", "-e")
+
+	if err != nil {
+		return nil, err
+	}
+
+	printers := make([]Printer, 0)
+
+	for _, name := range strings.Split(output, "\n") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		printer := Printer{Name: name, Trays: make([]Tray, 0)}
+
+		choices, err := runCupsCommand("lpoptions", "-p", name, "-l")
+
+		if err == nil {
+			printer.Trays = cupsTrays(parseLpOptionChoices(choices)["InputSlot"])
+		}
+
+		printer.Capabilities, _ = lpOptionsCapabilities(name)
+
+		printers = append(printers, printer)
+	}
+
+	return printers, nil
+}
+
+// cupsTrays turns the media sources in to trays. Automatic selection is not a tray.
+func cupsTrays(sources []string) []Tray {
+
+	trays := make([]Tray, 0)
+
+	for _, source := range sources {
+		if strings.EqualFold(source, "auto") {
+			continue
+		}
+		trays = append(trays, Tray{Name: source})
+	}
+
+	return trays
+}
@@ -0,0 +1,192 @@
+package companion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// stubCups puts lpstat & lpoptions scripts first on the PATH, printing the fixtures in testdata/cups
+// as CUPS would for the queues there.
+func stubCups(t *testing.T) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("CUPS is only used on linux & mac")
+	}
+
+	fixtures, err := filepath.Abs(filepath.Join("testdata", "cups"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+
+	scripts := map[string]string{
+		"lpstat": "cat '" + fixtures + "/lpstat.txt'",
+		// lpoptions -p NAME prints the queue's options, lpoptions -p NAME -l its driver's choices
+		"lpoptions": "if [ \"$3\" = \"-l\" ]; then cat \"" + fixtures + "/$2.choices\"; else cat \"" + fixtures + "/$2.options\"; fi",
+	}
+
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", directory+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+// readPrinterToolsFixture is what PrinterTools.jar prints for the same queues, as raw JSON & printers.
+func readPrinterToolsFixture(t *testing.T) ([]map[string]interface{}, []Printer) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "cups", "printer-tools.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw []map[string]interface{}
+	var printers []Printer
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(data, &printers); err != nil {
+		t.Fatal(err)
+	}
+
+	return raw, printers
+}
+
+// TestLpstatPrintersMatchPrinterTools keeps the native listing consistent with the jar it replaces.
+// Media sizes are left out as each names them its own way, PPD names from CUPS & Java names from the jar.
+func TestLpstatPrintersMatchPrinterTools(t *testing.T) {
+
+	stubCups(t)
+
+	got, err := lpstatPrinters()
+
+	if err != nil {
+		t.Fatalf("lpstatPrinters() error = %v", err)
+	}
+
+	_, want := readPrinterToolsFixture(t)
+
+	if len(got) != len(want) {
+		t.Fatalf("lpstatPrinters() = %d printers, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		t.Run(want[i].Name, func(t *testing.T) {
+
+			if got[i].Name != want[i].Name {
+				t.Errorf("name = %q, want %q", got[i].Name, want[i].Name)
+			}
+
+			if !reflect.DeepEqual(got[i].Trays, want[i].Trays) {
+				t.Errorf("trays = %v, want %v", got[i].Trays, want[i].Trays)
+			}
+
+			if got[i].Capabilities == nil {
+				t.Fatal("capabilities are missing")
+			}
+
+			gotCapabilities, wantCapabilities := *got[i].Capabilities, *want[i].Capabilities
+
+			if gotCapabilities.MakeAndModel != wantCapabilities.MakeAndModel || gotCapabilities.DeviceUri != wantCapabilities.DeviceUri {
+				t.Errorf("make & model, uri = %q, %q, want %q, %q", gotCapabilities.MakeAndModel, gotCapabilities.DeviceUri, wantCapabilities.MakeAndModel, wantCapabilities.DeviceUri)
+			}
+
+			if !reflect.DeepEqual(gotCapabilities.Resolutions, wantCapabilities.Resolutions) {
+				t.Errorf("resolutions = %v, want %v", gotCapabilities.Resolutions, wantCapabilities.Resolutions)
+			}
+
+			if gotCapabilities.Duplex != wantCapabilities.Duplex || gotCapabilities.Colour != wantCapabilities.Colour {
+				t.Errorf("duplex, colour = %v, %v, want %v, %v", gotCapabilities.Duplex, gotCapabilities.Colour, wantCapabilities.Duplex, wantCapabilities.Colour)
+			}
+
+			if len(gotCapabilities.MediaSizes) == 0 {
+				t.Error("media sizes are missing")
+			}
+		})
+	}
+}
+
+// TestLpstatPrintersJson checks every field the jar writes is written natively with the same JSON type,
+// so Blade never sees null where it used to see a list.
+func TestLpstatPrintersJson(t *testing.T) {
+
+	stubCups(t)
+
+	printers, err := lpstatPrinters()
+
+	if err != nil {
+		t.Fatalf("lpstatPrinters() error = %v", err)
+	}
+
+	data, err := json.Marshal(printers)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []map[string]interface{}
+
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := readPrinterToolsFixture(t)
+
+	if len(got) != len(want) {
+		t.Fatalf("lpstatPrinters() = %d printers, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		compareJsonTypes(t, want[i]["name"].(string), got[i], want[i])
+
+		gotCapabilities, _ := got[i]["capabilities"].(map[string]interface{})
+		compareJsonTypes(t, want[i]["name"].(string)+" capabilities", gotCapabilities, want[i]["capabilities"].(map[string]interface{}))
+	}
+}
+
+func compareJsonTypes(t *testing.T, name string, got map[string]interface{}, want map[string]interface{}) {
+	t.Helper()
+
+	for key, value := range want {
+		if reflect.TypeOf(got[key]) != reflect.TypeOf(value) {
+			t.Errorf("%s %s = %#v, want the same type as %#v", name, key, got[key], value)
+		}
+	}
+}
+
+func TestPpdResolution(t *testing.T) {
+
+	tests := []struct {
+		resolution string
+		want       string
+	}{
+		{resolution: "600dpi", want: "600x600dpi"},
+		{resolution: "300x600dpi", want: "300x600dpi"},
+		{resolution: "118dpcm", want: "118x118dpcm"},
+		{resolution: "Normal", want: "Normal"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.resolution, func(t *testing.T) {
+			if got := ppdResolution(test.resolution); got != test.want {
+				t.Errorf("ppdResolution() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package companion
+
+import (
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mdnsAddress = "224.0.0.251:5353"
+
+	ServiceIpps          = "_ipps._tcp.local."
+	ServiceIpp           = "_ipp._tcp.local."
+	ServicePdlDatastream = "_pdl-datastream._tcp.local."
+
+	DefaultDiscoveryTimeout = time.Second * 3
+	DiscoveryInterval       = time.Minute
+)
+
+// Services are listed in the order they are preferred for printing.
+var NetworkPrinterServices = []string{ServiceIpps, ServiceIpp, ServicePdlDatastream}
+
+// mdnsService is a single advertised service instance, e.g. "Office Laser._ipp._tcp.local."
+type mdnsService struct {
+	Instance string
+	Service  string
+	Host     string
+	Port     uint16
+	Text     map[string]string
+	Address  net.IP
+}
+
+// DiscoverNetworkPrinters browses the LAN for printers advertised over DNS-SD. Printers
+// advertising several protocols are listed once, using the most preferred protocol.
+func DiscoverNetworkPrinters(timeout time.Duration) ([]Printer, error) {
+
+	services, err := browseMdns(mdnsAddress, NetworkPrinterServices, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return networkPrinters(services), nil
+}
+
+func networkPrinters(services []mdnsService) []Printer {
+
+	preference := make(map[string]int, len(NetworkPrinterServices))
+	for i, service := range NetworkPrinterServices {
+		preference[service] = i
+	}
+
+	sort.SliceStable(services, func(i, j int) bool {
+		return preference[services[i].Service] < preference[services[j].Service]
+	})
+
+	printers := make([]Printer, 0)
+	seen := make(map[string]bool)
+
+	for _, service := range services {
+		name := strings.TrimSuffix(service.Instance, "."+service.Service)
+
+		if seen[name] || service.Address == nil || service.Port == 0 {
+			continue
+		}
+
+		seen[name] = true
+
+		capabilities := &PrinterCapabilities{
+			MakeAndModel: service.Text["ty"],
+			DeviceUri:    serviceUri(service),
+			Duplex:       strings.EqualFold(service.Text["Duplex"], "T"),
+			Colour:       strings.EqualFold(service.Text["Color"], "T"),
+		}
+
+		if formats := service.Text["pdl"]; formats != "" {
+			capabilities.DocumentFormats = strings.Split(formats, ",")
+		}
+
+		printers = append(printers, Printer{
+			Name:         name,
+			Trays:        make([]Tray, 0),
+			Capabilities: capabilities,
+			Discovered:   true,
+		})
+	}
+
+	sort.SliceStable(printers, func(i, j int) bool {
+		return printers[i].Name < printers[j].Name
+	})
+
+	return printers
+}
+
+// serviceUri is where the printer accepts jobs, ipp(s)://host:port/rp or socket://host:port
+func serviceUri(service mdnsService) string {
+
+	host := net.JoinHostPort(service.Address.String(), strconv.Itoa(int(service.Port)))
+
+	switch service.Service {
+	case ServiceIpps:
+		return fmt.Sprintf("ipps://%s/%s", host, strings.TrimPrefix(service.Text["rp"], "/"))
+	case ServiceIpp:
+		return fmt.Sprintf("ipp://%s/%s", host, strings.TrimPrefix(service.Text["rp"], "/"))
+	}
+
+	return "socket://" + host
+}
+
+// browseMdns sends one-shot queries (RFC 6762 section 5.1) from an ephemeral port, so it
+// works alongside avahi or bonjour which own port 5353. Responders answer by unicast.
+func browseMdns(address string, serviceTypes []string, timeout time.Duration) ([]mdnsService, error) {
+
+	destination, err := net.ResolveUDPAddr("udp4", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+
+	if err != nil {
+		return nil, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	records := newMdnsRecords()
+
+	questions := make([]dnsmessage.Question, 0)
+	for _, serviceType := range serviceTypes {
+		question, err := mdnsQuestion(serviceType, dnsmessage.TypePTR)
+		if err != nil {
+			return nil, err
+		}
+		questions = append(questions, question)
+	}
+
+	err = sendMdnsQuery(conn, destination, questions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Responders normally include everything as additional records, when they do not
+	// ask again for what is missing, which may take a couple of rounds to reach the address
+	deadline := time.Now().Add(timeout)
+	nextFollowUp := time.Now().Add(timeout / 4)
+	buffer := make([]byte, 9000)
+
+	for time.Now().Before(deadline) {
+		readUntil := nextFollowUp
+		if readUntil.After(deadline) {
+			readUntil = deadline
+		}
+
+		_ = conn.SetReadDeadline(readUntil)
+
+		n, _, err := conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				nextFollowUp = time.Now().Add(timeout / 4)
+				if missing := records.missing(); len(missing) > 0 {
+					_ = sendMdnsQuery(conn, destination, missing)
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		records.add(buffer[:n])
+	}
+
+	return records.services(serviceTypes), nil
+}
+
+func mdnsQuestion(name string, recordType dnsmessage.Type) (dnsmessage.Question, error) {
+
+	questionName, err := dnsmessage.NewName(name)
+
+	if err != nil {
+		return dnsmessage.Question{}, err
+	}
+
+	return dnsmessage.Question{Name: questionName, Type: recordType, Class: dnsmessage.ClassINET}, nil
+}
+
+func sendMdnsQuery(conn *net.UDPConn, destination *net.UDPAddr, questions []dnsmessage.Question) error {
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	builder.EnableCompression()
+
+	err := builder.StartQuestions()
+
+	if err != nil {
+		return err
+	}
+
+	for _, question := range questions {
+		if err = builder.Question(question); err != nil {
+			return err
+		}
+	}
+
+	message, err := builder.Finish()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.WriteToUDP(message, destination)
+
+	return err
+}
+
+// mdnsRecords collects the records from every response, answers & additionals alike.
+type mdnsRecords struct {
+	instances map[string]map[string]bool
+	srv       map[string]dnsmessage.SRVResource
+	txt       map[string][]string
+	addresses map[string]net.IP
+}
+
+func newMdnsRecords() *mdnsRecords {
+	return &mdnsRecords{
+		instances: make(map[string]map[string]bool),
+		srv:       make(map[string]dnsmessage.SRVResource),
+		txt:       make(map[string][]string),
+		addresses: make(map[string]net.IP),
+	}
+}
+
+func (records *mdnsRecords) add(message []byte) {
+
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(message)
+
+	if err != nil || !header.Response {
+		return
+	}
+
+	if err = parser.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	// Answers, then authorities & additionals once the answers run out
+	section := 0
+	for section < 3 {
+		var resourceHeader dnsmessage.ResourceHeader
+
+		switch section {
+		case 0:
+			resourceHeader, err = parser.AnswerHeader()
+		case 1:
+			resourceHeader, err = parser.AuthorityHeader()
+		case 2:
+			resourceHeader, err = parser.AdditionalHeader()
+		}
+
+		if err == dnsmessage.ErrSectionDone {
+			section++
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		if err = records.addResource(&parser, section, resourceHeader); err != nil {
+			return
+		}
+	}
+}
+
+func (records *mdnsRecords) addResource(parser *dnsmessage.Parser, section int, header dnsmessage.ResourceHeader) error {
+
+	name := strings.ToLower(header.Name.String())
+
+	switch header.Type {
+	case dnsmessage.TypePTR:
+		resource, err := parser.PTRResource()
+		if err != nil {
+			return err
+		}
+		if records.instances[name] == nil {
+			records.instances[name] = make(map[string]bool)
+		}
+		records.instances[name][resource.PTR.String()] = true
+		return nil
+	case dnsmessage.TypeSRV:
+		resource, err := parser.SRVResource()
+		if err != nil {
+			return err
+		}
+		records.srv[name] = resource
+		return nil
+	case dnsmessage.TypeTXT:
+		resource, err := parser.TXTResource()
+		if err != nil {
+			return err
+		}
+		records.txt[name] = resource.TXT
+		return nil
+	case dnsmessage.TypeA:
+		resource, err := parser.AResource()
+		if err != nil {
+			return err
+		}
+		records.addresses[name] = net.IP(resource.A[:])
+		return nil
+	case dnsmessage.TypeAAAA:
+		resource, err := parser.AAAAResource()
+		if err != nil {
+			return err
+		}
+		// Prefer IPv4 as link local IPv6 addresses need a zone to be usable
+		if _, ok := records.addresses[name]; !ok {
+			records.addresses[name] = net.IP(resource.AAAA[:])
+		}
+		return nil
+	}
+
+	switch section {
+	case 0:
+		return parser.SkipAnswer()
+	case 1:
+		return parser.SkipAuthority()
+	}
+	return parser.SkipAdditional()
+}
+
+// missing lists questions for the instances & hosts we do not have everything for yet.
+func (records *mdnsRecords) missing() []dnsmessage.Question {
+
+	questions := make([]dnsmessage.Question, 0)
+
+	ask := func(name string, recordType dnsmessage.Type) {
+		if question, err := mdnsQuestion(name, recordType); err == nil {
+			questions = append(questions, question)
+		}
+	}
+
+	for _, instances := range records.instances {
+		for instance := range instances {
+			key := strings.ToLower(instance)
+
+			srv, hasSrv := records.srv[key]
+
+			if !hasSrv {
+				ask(instance, dnsmessage.TypeSRV)
+			}
+
+			if _, hasTxt := records.txt[key]; !hasTxt {
+				ask(instance, dnsmessage.TypeTXT)
+			}
+
+			if hasSrv {
+				if _, hasAddress := records.addresses[strings.ToLower(srv.Target.String())]; !hasAddress {
+					ask(srv.Target.String(), dnsmessage.TypeA)
+				}
+			}
+		}
+	}
+
+	return questions
+}
+
+func (records *mdnsRecords) services(serviceTypes []string) []mdnsService {
+
+	services := make([]mdnsService, 0)
+
+	for _, serviceType := range serviceTypes {
+		for instance := range records.instances[strings.ToLower(serviceType)] {
+			key := strings.ToLower(instance)
+
+			service := mdnsService{
+				Instance: instance,
+				Service:  serviceType,
+				Text:     parseTxtRecord(records.txt[key]),
+			}
+
+			if srv, ok := records.srv[key]; ok {
+				service.Host = srv.Target.String()
+				service.Port = srv.Port
+				service.Address = records.addresses[strings.ToLower(service.Host)]
+			}
+
+			services = append(services, service)
+		}
+	}
+
+	return services
+}
+
+// parseTxtRecord reads the key=value strings of a TXT record. Keys are case insensitive
+// so they are stored as the printer DNS-SD spec writes them.
+func parseTxtRecord(values []string) map[string]string {
+
+	keys := map[string]string{"ty": "ty", "rp": "rp", "pdl": "pdl", "color": "Color", "duplex": "Duplex", "note": "note"}
+
+	text := make(map[string]string)
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := parts[0]
+		if known, ok := keys[strings.ToLower(key)]; ok {
+			key = known
+		}
+
+		text[key] = parts[1]
+	}
+
+	return text
+}
@@ -0,0 +1,306 @@
+package companion
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMdnsResponder answers queries on localhost from a fixed set of records, as a printer's responder would.
+type fakeMdnsResponder struct {
+	conn      *net.UDPConn
+	resources []dnsmessage.Resource
+	// Include every other record as additionals, as most responders do, otherwise only what was asked for
+	additionals bool
+
+	mutex     sync.Mutex
+	questions []string
+}
+
+func newFakeMdnsResponder(t *testing.T, resources []dnsmessage.Resource, additionals bool) *fakeMdnsResponder {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := &fakeMdnsResponder{conn: conn, resources: resources, additionals: additionals}
+
+	go responder.serve()
+
+	t.Cleanup(func() { conn.Close() })
+
+	return responder
+}
+
+func (responder *fakeMdnsResponder) Address() string {
+	return responder.conn.LocalAddr().String()
+}
+
+// Questions are every question asked, as name & type.
+func (responder *fakeMdnsResponder) Questions() []string {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	return append([]string{}, responder.questions...)
+}
+
+func (responder *fakeMdnsResponder) serve() {
+
+	buffer := make([]byte, 9000)
+
+	for {
+		n, from, err := responder.conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			return
+		}
+
+		var query dnsmessage.Message
+
+		if query.Unpack(buffer[:n]) != nil || query.Header.Response {
+			continue
+		}
+
+		response := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+		answered := make(map[int]bool)
+
+		for _, question := range query.Questions {
+			responder.mutex.Lock()
+			responder.questions = append(responder.questions, question.Name.String()+" "+question.Type.String())
+			responder.mutex.Unlock()
+
+			for i, resource := range responder.resources {
+				if !answered[i] && strings.EqualFold(resource.Header.Name.String(), question.Name.String()) && resource.Header.Type == question.Type {
+					response.Answers = append(response.Answers, resource)
+					answered[i] = true
+				}
+			}
+		}
+
+		if len(response.Answers) == 0 {
+			continue
+		}
+
+		if responder.additionals {
+			for i, resource := range responder.resources {
+				if !answered[i] {
+					response.Additionals = append(response.Additionals, resource)
+				}
+			}
+		}
+
+		message, err := response.Pack()
+
+		if err != nil {
+			return
+		}
+
+		_, _ = responder.conn.WriteToUDP(message, from)
+	}
+}
+
+func mdnsName(t *testing.T, name string) dnsmessage.Name {
+	t.Helper()
+
+	parsed, err := dnsmessage.NewName(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func mdnsResource(t *testing.T, name string, recordType dnsmessage.Type, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	t.Helper()
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mdnsName(t, name), Type: recordType, Class: dnsmessage.ClassINET, TTL: 120},
+		Body:   body,
+	}
+}
+
+// printerRecords advertises an office printer over ipp & ipps and a label printer over a raw socket only.
+func printerRecords(t *testing.T) []dnsmessage.Resource {
+	t.Helper()
+
+	office := "Office Laser." + ServiceIpp
+	officeSecure := "Office Laser." + ServiceIpps
+	zebra := "Zebra ZD420." + ServicePdlDatastream
+
+	officeText := &dnsmessage.TXTResource{TXT: []string{"txtvers=1", "ty=HP LaserJet Pro M404", "rp=ipp/print", "pdl=application/pdf,image/urf", "Duplex=T", "color=F"}}
+
+	return []dnsmessage.Resource{
+		mdnsResource(t, ServiceIpp, dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: mdnsName(t, office)}),
+		mdnsResource(t, ServiceIpps, dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: mdnsName(t, officeSecure)}),
+		mdnsResource(t, ServicePdlDatastream, dnsmessage.TypePTR, &dnsmessage.PTRResource{PTR: mdnsName(t, zebra)}),
+		mdnsResource(t, office, dnsmessage.TypeSRV, &dnsmessage.SRVResource{Port: 631, Target: mdnsName(t, "office-laser.local.")}),
+		mdnsResource(t, officeSecure, dnsmessage.TypeSRV, &dnsmessage.SRVResource{Port: 631, Target: mdnsName(t, "office-laser.local.")}),
+		mdnsResource(t, zebra, dnsmessage.TypeSRV, &dnsmessage.SRVResource{Port: 9100, Target: mdnsName(t, "ZD420.local.")}),
+		mdnsResource(t, office, dnsmessage.TypeTXT, officeText),
+		mdnsResource(t, officeSecure, dnsmessage.TypeTXT, officeText),
+		mdnsResource(t, zebra, dnsmessage.TypeTXT, &dnsmessage.TXTResource{TXT: []string{"ty=Zebra ZD420"}}),
+		mdnsResource(t, "office-laser.local.", dnsmessage.TypeAAAA, &dnsmessage.AAAAResource{AAAA: [16]byte{0xfe, 0x80, 15: 5}}),
+		mdnsResource(t, "office-laser.local.", dnsmessage.TypeA, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 5}}),
+		mdnsResource(t, "zd420.local.", dnsmessage.TypeA, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 9}}),
+	}
+}
+
+var wantDiscoveredPrinters = []Printer{
+	{
+		Name:  "Office Laser",
+		Trays: []Tray{},
+		Capabilities: &PrinterCapabilities{
+			MakeAndModel:    "HP LaserJet Pro M404",
+			DeviceUri:       "ipps://10.0.0.5:631/ipp/print",
+			Duplex:          true,
+			DocumentFormats: []string{"application/pdf", "image/urf"},
+		},
+		Discovered: true,
+	},
+	{
+		Name:         "Zebra ZD420",
+		Trays:        []Tray{},
+		Capabilities: &PrinterCapabilities{MakeAndModel: "Zebra ZD420", DeviceUri: "socket://10.0.0.9:9100"},
+		Discovered:   true,
+	},
+}
+
+func TestBrowseMdns(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		additionals bool
+		// Whether the records had to be asked for one by one
+		wantFollowUp bool
+	}{
+		{name: "everything as additionals", additionals: true},
+		{name: "only what was asked for", wantFollowUp: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			responder := newFakeMdnsResponder(t, printerRecords(t), test.additionals)
+
+			services, err := browseMdns(responder.Address(), NetworkPrinterServices, 600*time.Millisecond)
+
+			if err != nil {
+				t.Fatalf("browseMdns() error = %v", err)
+			}
+
+			if got := networkPrinters(services); !reflect.DeepEqual(got, wantDiscoveredPrinters) {
+				t.Errorf("networkPrinters() = %s, want %s", describePrinters(got), describePrinters(wantDiscoveredPrinters))
+			}
+
+			questions := responder.Questions()
+			followUp := len(questions) > len(NetworkPrinterServices)
+
+			if followUp != test.wantFollowUp {
+				t.Errorf("asked %v, want follow up questions %v", questions, test.wantFollowUp)
+			}
+		})
+	}
+}
+
+func TestBrowseMdnsWithoutPrinters(t *testing.T) {
+
+	responder := newFakeMdnsResponder(t, nil, true)
+
+	services, err := browseMdns(responder.Address(), NetworkPrinterServices, 100*time.Millisecond)
+
+	if err != nil || len(services) != 0 {
+		t.Errorf("browseMdns() = %v, %v, want no services", services, err)
+	}
+}
+
+func TestNetworkPrinters(t *testing.T) {
+
+	address := net.IPv4(10, 0, 0, 5)
+
+	tests := []struct {
+		name     string
+		services []mdnsService
+		want     []string
+	}{
+		{
+			name: "prefers ipps",
+			services: []mdnsService{
+				{Instance: "Office." + ServicePdlDatastream, Service: ServicePdlDatastream, Port: 9100, Address: address},
+				{Instance: "Office." + ServiceIpp, Service: ServiceIpp, Port: 631, Address: address, Text: map[string]string{"rp": "ipp/print"}},
+				{Instance: "Office." + ServiceIpps, Service: ServiceIpps, Port: 443, Address: address, Text: map[string]string{"rp": "/ipp/print"}},
+			},
+			want: []string{"Office ipps://10.0.0.5:443/ipp/print"},
+		},
+		{
+			name: "skips services without an address or port",
+			services: []mdnsService{
+				{Instance: "Office." + ServiceIpps, Service: ServiceIpps, Port: 443},
+				{Instance: "Office." + ServiceIpp, Service: ServiceIpp, Address: address},
+				{Instance: "Office." + ServicePdlDatastream, Service: ServicePdlDatastream, Port: 9100, Address: address},
+			},
+			want: []string{"Office socket://10.0.0.5:9100"},
+		},
+		{
+			name: "brackets ipv6 addresses",
+			services: []mdnsService{
+				{Instance: "Office." + ServiceIpp, Service: ServiceIpp, Port: 631, Address: net.ParseIP("fd00::5")},
+			},
+			want: []string{"Office ipp://[fd00::5]:631/"},
+		},
+		{
+			name: "sorts by name",
+			services: []mdnsService{
+				{Instance: "Zebra." + ServicePdlDatastream, Service: ServicePdlDatastream, Port: 9100, Address: address},
+				{Instance: "Brother." + ServicePdlDatastream, Service: ServicePdlDatastream, Port: 9100, Address: address},
+			},
+			want: []string{"Brother socket://10.0.0.5:9100", "Zebra socket://10.0.0.5:9100"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got := make([]string, 0)
+			for _, printer := range networkPrinters(test.services) {
+				got = append(got, printer.Name+" "+printer.Capabilities.DeviceUri)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("networkPrinters() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTxtRecord(t *testing.T) {
+
+	got := parseTxtRecord([]string{"txtvers=1", "TY=Brother HL", "PDL=application/pdf", "COLOR=T", "duplex=F", "flag", "note=Back office=left"})
+
+	want := map[string]string{"txtvers": "1", "ty": "Brother HL", "pdl": "application/pdf", "Color": "T", "Duplex": "F", "note": "Back office=left"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTxtRecord() = %v, want %v", got, want)
+	}
+}
+
+func describePrinters(printers []Printer) string {
+
+	descriptions := make([]string, 0, len(printers))
+
+	for _, printer := range printers {
+		description := printer.Name
+		if printer.Capabilities != nil {
+			description += " " + printer.Capabilities.DeviceUri + " " + printer.Capabilities.MakeAndModel + " " + strings.Join(printer.Capabilities.DocumentFormats, ",")
+		}
+		descriptions = append(descriptions, description)
+	}
+
+	return strings.Join(descriptions, "; ")
+}
@@ -2,8 +2,11 @@ package companion
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -89,6 +92,214 @@ func (app *App) loginEndpoint(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (app *App) historyEndpoint(res http.ResponseWriter, req *http.Request) {
+	log.Info().Msg("Handling history request")
+
+	// The history has order references & user names, only Blade may read it
+	if !app.allowPrivateOrigin(res, req) {
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+
+	if app.history == nil {
+		http.Error(res, "the local history is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	values := make(map[string]string)
+	for key := range req.URL.Query() {
+		values[key] = req.URL.Query().Get(key)
+	}
+
+	if values["limit"] == "" {
+		values["limit"] = "100"
+	}
+
+	filter, err := NewHistoryFilter(values)
+
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := app.history.Query(filter)
+
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(HistoryResponse{Records: records})
+
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+
+	_, err = res.Write(data)
+
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to send the response")
+	}
+}
+
+// scaleLiveEndpoint streams readings as server-sent events until the client goes away.
+// The rate can be changed with the interval query parameter in milliseconds.
+func (app *App) scaleLiveEndpoint(res http.ResponseWriter, req *http.Request) {
+	log.Info().Msg("Handling live scale request")
+
+	if !app.allowPrivateOrigin(res, req) {
+		return
+	}
+
+	if req.Method == "OPTIONS" {
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	flusher, ok := res.(http.Flusher)
+
+	if !ok {
+		http.Error(res, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	interval := app.scaleStreamInterval
+
+	if value := req.URL.Query().Get("interval"); value != "" {
+		milliseconds, err := strconv.Atoi(value)
+
+		if err != nil || milliseconds < MinScaleStreamIntervalMs {
+			http.Error(res, fmt.Sprintf("interval must be at least %d milliseconds", MinScaleStreamIntervalMs), http.StatusBadRequest)
+			return
+		}
+
+		interval = time.Duration(milliseconds) * time.Millisecond
+	}
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	subscriber := app.scaleStream.Subscribe(interval)
+	defer app.scaleStream.Unsubscribe(subscriber)
+
+	for {
+		select {
+		case <-req.Context().Done():
+			log.Info().Msg("Live scale client disconnected")
+			return
+		case reading := <-subscriber.readings:
+			event := "reading"
+			var payload interface{} = reading
+
+			if reading.Error != "" {
+				event = "error"
+				payload = map[string]string{"error": reading.Error}
+			}
+
+			data, err := json.Marshal(payload)
+
+			if err != nil {
+				log.Error().Caller().Err(err).Msg("Failed to encode the live reading")
+				return
+			}
+
+			_, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event, data)
+
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to send the live reading")
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// allowPrivateOrigin sets the CORS headers for endpoints returning private data. Only the origins in
+// the config file or the app document & pages served from this machine may read them, anything else
+// is refused. Requests without an origin don't come from a browser page so are allowed.
+func (app *App) allowPrivateOrigin(res http.ResponseWriter, req *http.Request) bool {
+
+	origin := req.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	if !isLocalOrigin(origin) && !app.isAllowedOrigin(origin) {
+		log.Warn().Str("Origin", origin).Str("Path", req.URL.Path).Msg("Refused a request from an unknown origin")
+		http.Error(res, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	res.Header().Set("Access-Control-Allow-Origin", origin)
+	res.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	res.Header().Set("Vary", "Origin")
+
+	return true
+}
+
+// isAllowedOrigin checks the origins from the config file, then the ones Blade set on the app document.
+func (app *App) isAllowedOrigin(origin string) bool {
+
+	if matchesOrigin(app.allowedOrigins, origin) {
+		return true
+	}
+
+	app.allowedOriginsMutex.Lock()
+	defer app.allowedOriginsMutex.Unlock()
+
+	return matchesOrigin(app.AllowedOrigins, origin)
+}
+
+// matchesOrigin compares the origin with each allowed one, where *. matches any subdomain.
+func matchesOrigin(allowed []string, origin string) bool {
+
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "/"))
+
+		if pattern == origin {
+			return true
+		}
+
+		if wildcard := strings.Index(pattern, "*."); wildcard >= 0 {
+			prefix, suffix := pattern[:wildcard], pattern[wildcard+1:]
+
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) && len(origin) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isLocalOrigin(origin string) bool {
+
+	parsed, err := url.Parse(origin)
+
+	if err != nil {
+		return false
+	}
+
+	switch parsed.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+
+	return false
+}
+
 type InfoResponse struct {
 	CompanionAppId string `json:"CompanionAppId"`
 }
@@ -103,3 +314,7 @@ type LoggedInRequest struct {
 	Id          string `json:"id" firestore:"id"`
 	Name        string `json:"name" firestore:"name"`
 }
+
+type HistoryResponse struct {
+	Records []HistoryRecord `json:"records"`
+}
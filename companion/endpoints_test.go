@@ -0,0 +1,53 @@
+package companion
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowPrivateOrigin(t *testing.T) {
+
+	app := &App{
+		allowedOrigins: []string{"https://*.example.com"},
+		// Set by Blade on the app document
+		AllowedOrigins: []string{"https://blade.example.org"},
+	}
+
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{name: "not from a browser", want: true},
+		{name: "this machine", origin: "http://localhost:3000", want: true},
+		{name: "the config file", origin: "https://packing.example.com", want: true},
+		{name: "the app document", origin: "https://blade.example.org", want: true},
+		{name: "unknown", origin: "https://evil.example.net"},
+		{name: "lookalike", origin: "https://blade.example.org.evil.net"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodGet, "/scale/live", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+
+			res := httptest.NewRecorder()
+
+			if got := app.allowPrivateOrigin(res, req); got != test.want {
+				t.Fatalf("allowPrivateOrigin() = %v, want %v", got, test.want)
+			}
+
+			if !test.want && res.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want %d", res.Code, http.StatusForbidden)
+			}
+
+			if test.want && res.Header().Get("Access-Control-Allow-Origin") != test.origin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", res.Header().Get("Access-Control-Allow-Origin"), test.origin)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package companion
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits for a lock on the whole file, shared or exclusive. Closing the file releases it.
+func lockFile(file *os.File, exclusive bool) error {
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	return syscall.Flock(int(file.Fd()), how)
+}
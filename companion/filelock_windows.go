@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package companion
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = kernel32.NewProc("LockFileEx")
+
+const lockfileExclusiveLock = 0x00000002
+
+// lockFile waits for a lock on the whole file, shared or exclusive. Closing the file releases it.
+func lockFile(file *os.File, exclusive bool) error {
+
+	var flags uintptr
+	if exclusive {
+		flags = lockfileExclusiveLock
+	}
+
+	var overlapped syscall.Overlapped
+
+	r, _, err := procLockFileEx.Call(file.Fd(), flags, 0, maxDword, maxDword, uintptr(unsafe.Pointer(&overlapped)))
+
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
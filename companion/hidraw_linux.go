@@ -0,0 +1,422 @@
+//go:build linux
+// +build linux
+
+package companion
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Where the kernel lists hidraw devices & their nodes, can be pointed at a fake device.
+var (
+	hidrawSysPath = "/sys/class/hidraw"
+	hidrawDevPath = "/dev"
+)
+
+// hidrawDevice is a HID device found in sysfs.
+type hidrawDevice struct {
+	Path      string
+	VendorId  int
+	ProductId int
+	Name      string
+	Serial    string
+	IsScale   bool
+}
+
+// The HID POS scale usage page & the Zero Scale control in its Scale Control Report
+const (
+	hidPosScalePage        = 0x8d
+	hidPosZeroScaleControl = 0x80
+)
+
+// hidrawConnection keeps the scale open so readings can be sampled as they arrive.
+type hidrawConnection struct {
+	file  *os.File
+	model ScaleModel
+	// The feature reports for the actions the scale can carry out
+	commands map[string][]byte
+}
+
+func openHidrawScale(scale Scale) (scaleConnection, error) {
+
+	scales, err := listHidrawScales()
+
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := selectScale(scales, scale)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Sending feature reports needs write access, reading the weight doesn't
+	file, err := os.OpenFile(device.Path, os.O_RDWR, 0)
+
+	if err != nil {
+		log.Debug().Err(err).Str("Device", device.Path).Msg("Opening the scale read only")
+		file, err = os.OpenFile(device.Path, os.O_RDONLY, 0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	model := FindScaleModel(device.VendorId, device.ProductId)
+	descriptor, _ := ioutil.ReadFile(filepath.Join(hidrawSysPath, filepath.Base(device.Path), "device", "report_descriptor"))
+
+	return &hidrawConnection{file: file, model: model, commands: scaleCommandReports(model, descriptor)}, nil
+}
+
+// scaleCommandReports are the model's feature reports, with the descriptor's Zero Scale control
+// when the model has no report to zero the scale.
+func scaleCommandReports(model ScaleModel, descriptor []byte) map[string][]byte {
+
+	commands := make(map[string][]byte)
+
+	for action, report := range model.Commands {
+		commands[action] = report
+	}
+
+	if _, ok := commands[ScaleActionZero]; !ok {
+		if report, ok := hidFeatureControlReport(descriptor, hidPosScalePage, hidPosZeroScaleControl); ok {
+			commands[ScaleActionZero] = report
+		}
+	}
+
+	return commands
+}
+
+// Read waits for the next input report. Scales send one whenever they are asked or the
+// weight changes, so give up after the timeout.
+func (connection *hidrawConnection) Read(timeout time.Duration) (ScaleReading, error) {
+
+	_ = connection.file.SetReadDeadline(time.Now().Add(timeout))
+
+	report := make([]byte, 64)
+
+	n, err := connection.file.Read(report)
+
+	if os.IsTimeout(err) {
+		return ScaleReading{}, errScaleReadTimeout
+	}
+
+	if err != nil {
+		return ScaleReading{}, err
+	}
+
+	log.Debug().Str("Device", connection.file.Name()).Hex("Report", report[:n]).Msg("Read a scale report")
+
+	return decodeScaleReport(report[:n], connection.model)
+}
+
+// Command sends the feature report for the action.
+func (connection *hidrawConnection) Command(action string, timeout time.Duration) error {
+
+	report, ok := connection.commands[action]
+
+	if !ok || len(report) == 0 {
+		return fmt.Errorf("%w: the %s can not %s over USB", errScaleActionUnsupported, connection.model.Name, strings.ReplaceAll(action, "_", " "))
+	}
+
+	conn, err := connection.file.SyscallConn()
+
+	if err != nil {
+		return err
+	}
+
+	report = append([]byte{}, report...)
+	request := hidiocSFeature(len(report))
+
+	var errno syscall.Errno
+
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(&report[0])))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if errno != 0 {
+		return fmt.Errorf("failed to send the %s report to the scale: %w", action, errno)
+	}
+
+	log.Debug().Str("Device", connection.file.Name()).Hex("Report", report).Msg("Sent a feature report to the scale")
+
+	return nil
+}
+
+// hidiocSFeature is the HIDIOCSFEATURE ioctl for a report of the length, _IOC(_IOC_WRITE|_IOC_READ, 'H', 0x06, len)
+func hidiocSFeature(length int) uintptr {
+	return uintptr(3<<30 | length<<16 | 'H'<<8 | 0x06)
+}
+
+func (connection *hidrawConnection) Close() error {
+	return connection.file.Close()
+}
+
+// listHidrawScales lists the HID devices that are known scales or use the scale usage page.
+func listHidrawScales() ([]AvailableScale, error) {
+
+	devices, err := listHidrawDevices()
+
+	if err != nil {
+		return nil, err
+	}
+
+	scales := make([]AvailableScale, 0)
+
+	for _, device := range devices {
+		if !device.IsScale {
+			continue
+		}
+
+		scales = append(scales, newAvailableScale(device.Name, device.VendorId, device.ProductId, device.Serial, device.Path))
+	}
+
+	return scales, nil
+}
+
+func listHidrawDevices() ([]hidrawDevice, error) {
+
+	entries, err := ioutil.ReadDir(hidrawSysPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]hidrawDevice, 0)
+
+	for _, entry := range entries {
+		uevent, err := ioutil.ReadFile(filepath.Join(hidrawSysPath, entry.Name(), "device", "uevent"))
+
+		if err != nil {
+			continue
+		}
+
+		device, ok := parseHidUevent(string(uevent))
+
+		if !ok {
+			continue
+		}
+
+		device.Path = filepath.Join(hidrawDevPath, entry.Name())
+
+		descriptor, _ := ioutil.ReadFile(filepath.Join(hidrawSysPath, entry.Name(), "device", "report_descriptor"))
+		_, known := knownScaleModel(device.VendorId, device.ProductId)
+		device.IsScale = known || usesScalePage(descriptor)
+
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Path < devices[j].Path
+	})
+
+	return devices, nil
+}
+
+// parseHidUevent reads the ids from the HID device's uevent, e.g. HID_ID=0003:00000922:00008003
+func parseHidUevent(uevent string) (hidrawDevice, bool) {
+
+	var device hidrawDevice
+	found := false
+
+	for _, line := range strings.Split(uevent, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "HID_ID":
+			ids := strings.Split(parts[1], ":")
+
+			if len(ids) != 3 {
+				return device, false
+			}
+
+			vendorId, vendorErr := strconv.ParseUint(ids[1], 16, 32)
+			productId, productErr := strconv.ParseUint(ids[2], 16, 32)
+
+			if vendorErr != nil || productErr != nil {
+				return device, false
+			}
+
+			device.VendorId = int(vendorId)
+			device.ProductId = int(productId)
+			found = true
+		case "HID_NAME":
+			device.Name = parts[1]
+		case "HID_UNIQ":
+			device.Serial = parts[1]
+		}
+	}
+
+	return device, found
+}
+
+// usesScalePage looks for the scale usage page (0x8D) in a HID report descriptor.
+func usesScalePage(descriptor []byte) bool {
+
+	for i := 0; i < len(descriptor); {
+		prefix := descriptor[i]
+
+		// Long items are never usage pages
+		if prefix == 0xfe {
+			if i+1 >= len(descriptor) {
+				return false
+			}
+			i += 3 + int(descriptor[i+1])
+			continue
+		}
+
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+
+		if i+1+size > len(descriptor) {
+			return false
+		}
+
+		// Global Usage Page item, of any size
+		if prefix&0xfc == 0x04 && size > 0 {
+			page := 0
+			for b := size; b > 0; b-- {
+				page = page<<8 | int(descriptor[i+b])
+			}
+			if page == 0x8d {
+				return true
+			}
+		}
+
+		i += 1 + size
+	}
+
+	return false
+}
+
+// hidDescriptorGlobals are the global items that carry over from one main item to the next.
+type hidDescriptorGlobals struct {
+	usagePage   uint32
+	reportId    byte
+	reportSize  int
+	reportCount int
+}
+
+// hidFeatureControlReport finds the feature report holding the control in a HID report descriptor, and
+// returns it with only that control set, starting with the report ID (0 when the device numbers none).
+func hidFeatureControlReport(descriptor []byte, page uint32, control uint32) ([]byte, bool) {
+
+	want := page<<16 | control
+
+	var globals hidDescriptorGlobals
+	var stack []hidDescriptorGlobals
+	var usages []uint32
+	var usageMinimum uint32
+
+	// How many bits of each feature report come before the next field
+	featureBits := make(map[byte]int)
+
+	found := false
+	var foundId byte
+	var foundBit int
+
+	for i := 0; i < len(descriptor); {
+		prefix := descriptor[i]
+
+		if prefix == 0xfe {
+			if i+1 >= len(descriptor) {
+				return nil, false
+			}
+			i += 3 + int(descriptor[i+1])
+			continue
+		}
+
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+
+		if i+1+size > len(descriptor) {
+			return nil, false
+		}
+
+		var value uint32
+		for b := size; b > 0; b-- {
+			value = value<<8 | uint32(descriptor[i+b])
+		}
+
+		// Usages without a page of their own are on the current usage page
+		usage := value
+		if size < 4 {
+			usage = globals.usagePage<<16 | value
+		}
+
+		switch prefix & 0xfc {
+		case 0x04:
+			globals.usagePage = value
+		case 0x74:
+			globals.reportSize = int(value)
+		case 0x84:
+			globals.reportId = byte(value)
+		case 0x94:
+			globals.reportCount = int(value)
+		case 0xa4:
+			stack = append(stack, globals)
+		case 0xb4:
+			if len(stack) > 0 {
+				globals = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case 0x08:
+			usages = append(usages, usage)
+		case 0x18:
+			usageMinimum = usage
+		case 0x28:
+			// Ranges are kept small, they only need to reach as far as the fields in the report
+			for u := usageMinimum; u <= usage && u-usageMinimum < 256; u++ {
+				usages = append(usages, u)
+			}
+		case 0xb0:
+			// Each field takes the next usage, the last one repeating for any fields left
+			for field := 0; field < globals.reportCount && len(usages) > 0 && !found; field++ {
+				if usages[minInt(field, len(usages)-1)] == want {
+					found = true
+					foundId = globals.reportId
+					foundBit = featureBits[globals.reportId] + field*globals.reportSize
+				}
+			}
+			featureBits[globals.reportId] += globals.reportCount * globals.reportSize
+			usages = nil
+		case 0x80, 0x90, 0xa0, 0xc0:
+			usages = nil
+		}
+
+		i += 1 + size
+	}
+
+	if !found {
+		return nil, false
+	}
+
+	report := make([]byte, 1+(featureBits[foundId]+7)/8)
+	report[0] = foundId
+	report[1+foundBit/8] |= 1 << (foundBit % 8)
+
+	return report, true
+}
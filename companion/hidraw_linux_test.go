@@ -0,0 +1,344 @@
+//go:build linux
+// +build linux
+
+package companion
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeHidrawDevice is a hidraw device as sysfs lists it, an empty uevent leaves it out.
+type fakeHidrawDevice struct {
+	name       string
+	uevent     string
+	descriptor []byte
+}
+
+// fakeHidraw points hidrawSysPath & hidrawDevPath at a fake sysfs & /dev holding the devices.
+func fakeHidraw(t *testing.T, devices []fakeHidrawDevice) {
+	t.Helper()
+
+	root := t.TempDir()
+	sys := filepath.Join(root, "sys")
+	dev := filepath.Join(root, "dev")
+
+	for _, device := range devices {
+		directory := filepath.Join(sys, device.name, "device")
+
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if device.uevent != "" {
+			if err := ioutil.WriteFile(filepath.Join(directory, "uevent"), []byte(device.uevent), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if device.descriptor != nil {
+			if err := ioutil.WriteFile(filepath.Join(directory, "report_descriptor"), device.descriptor, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previousSys, previousDev := hidrawSysPath, hidrawDevPath
+	hidrawSysPath, hidrawDevPath = sys, dev
+
+	t.Cleanup(func() {
+		hidrawSysPath, hidrawDevPath = previousSys, previousDev
+	})
+}
+
+// A HID POS scale's report descriptor starts with its usage page
+var scaleDescriptor = []byte{0x05, 0x8d, 0x09, 0x01, 0xa1, 0x01}
+
+func TestParseHidUevent(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		uevent string
+		want   hidrawDevice
+		wantOk bool
+	}{
+		{
+			name:   "scale",
+			uevent: "DRIVER=hid-generic\nHID_ID=0003:00000922:00008003\nHID_NAME=DYMO M10 10 Kg Digital Postal Scale\nHID_PHYS=usb-0000:00:14.0-1/input0\nHID_UNIQ=0071234567\nMODALIAS=hid:b0003g0001v00000922p00008003\n",
+			want:   hidrawDevice{VendorId: 0x0922, ProductId: 0x8003, Name: "DYMO M10 10 Kg Digital Postal Scale", Serial: "0071234567"},
+			wantOk: true,
+		},
+		{
+			name:   "no serial",
+			uevent: "HID_ID=0003:00001446:00006A73\nHID_NAME=Stamps.com Scale\nHID_UNIQ=\n",
+			want:   hidrawDevice{VendorId: 0x1446, ProductId: 0x6a73, Name: "Stamps.com Scale"},
+			wantOk: true,
+		},
+		{name: "no ids", uevent: "DRIVER=hid-generic\nHID_NAME=Keyboard\n"},
+		{name: "malformed ids", uevent: "HID_ID=0003:00000922\n"},
+		{name: "ids not hex", uevent: "HID_ID=0003:0000XYZ:00008003\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, ok := parseHidUevent(test.uevent)
+
+			if ok != test.wantOk {
+				t.Fatalf("parseHidUevent() ok = %v, want %v", ok, test.wantOk)
+			}
+
+			if ok && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseHidUevent() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUsesScalePage(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		descriptor []byte
+		want       bool
+	}{
+		{name: "one byte page", descriptor: scaleDescriptor, want: true},
+		{name: "two byte page", descriptor: []byte{0x06, 0x8d, 0x00, 0x09, 0x01}, want: true},
+		{name: "after other items", descriptor: []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0xc0, 0x05, 0x8d}, want: true},
+		{name: "after a long item", descriptor: []byte{0xfe, 0x02, 0x00, 0x05, 0x8d, 0x05, 0x8d}, want: true},
+		{name: "keyboard", descriptor: []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0x05, 0x07}},
+		{name: "usage rather than page", descriptor: []byte{0x09, 0x8d}},
+		{name: "vendor page", descriptor: []byte{0x06, 0x8d, 0xff}},
+		{name: "truncated", descriptor: []byte{0x06, 0x8d}},
+		{name: "empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := usesScalePage(test.descriptor); got != test.want {
+				t.Errorf("usesScalePage() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestListHidrawScales(t *testing.T) {
+
+	fakeHidraw(t, []fakeHidrawDevice{
+		{name: "hidraw2", uevent: "HID_ID=0003:000004D9:00001702\nHID_NAME=USB Keyboard\n", descriptor: []byte{0x05, 0x01, 0x09, 0x06}},
+		{name: "hidraw0", uevent: "HID_ID=0003:00000922:00008003\nHID_NAME=DYMO M10\nHID_UNIQ=0071234567\n"},
+		{name: "hidraw1", uevent: "HID_ID=0003:00001234:00005678\n", descriptor: scaleDescriptor},
+		{name: "hidraw3"},
+	})
+
+	got, err := listHidrawScales()
+
+	if err != nil {
+		t.Fatalf("listHidrawScales() error = %v", err)
+	}
+
+	want := []AvailableScale{
+		newAvailableScale("DYMO M10", 0x0922, 0x8003, "0071234567", filepath.Join(hidrawDevPath, "hidraw0")),
+		newAvailableScale("", 0x1234, 0x5678, "", filepath.Join(hidrawDevPath, "hidraw1")),
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listHidrawScales() = %+v, want %+v", got, want)
+	}
+}
+
+func TestListHidrawScalesWithoutHidraw(t *testing.T) {
+
+	fakeHidraw(t, nil)
+	hidrawSysPath = filepath.Join(hidrawSysPath, "missing")
+
+	if _, err := listHidrawScales(); err == nil {
+		t.Error("listHidrawScales() succeeded, want an error when hidraw isn't there")
+	}
+}
+
+func TestHidrawScaleRead(t *testing.T) {
+
+	fakeHidraw(t, []fakeHidrawDevice{
+		{name: "hidraw0", uevent: "HID_ID=0003:00000922:00008003\nHID_NAME=DYMO M10\nHID_UNIQ=0071234567\n"},
+	})
+
+	// A fifo stands in for the device node, so reports arrive one at a time & reads can time out
+	node := filepath.Join(hidrawDevPath, "hidraw0")
+
+	if err := syscall.Mkfifo(node, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opened for writing first so opening the scale doesn't wait for a writer
+	device, err := os.OpenFile(node, os.O_RDWR, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer device.Close()
+
+	connection, err := openHidrawScale(Scale{VendorId: 0x0922, ProductId: 0x8003})
+
+	if err != nil {
+		t.Fatalf("openHidrawScale() error = %v", err)
+	}
+
+	defer connection.Close()
+
+	reports := []struct {
+		name    string
+		report  []byte
+		want    ScaleReading
+		wantErr error
+	}{
+		{name: "weight", report: []byte{3, 4, 2, 0, 0xe8, 0x03}, want: ScaleReading{Raw: 1000, Unit: "g", Grams: 1000, Status: ScaleStatusStable}},
+		{name: "scaled weight", report: []byte{3, 3, 12, 0xff, 0x19, 0x00}, want: ScaleReading{Raw: 25, Scaling: -1, Unit: "lb", Grams: 1133.981, Status: ScaleStatusInMotion}},
+		{name: "another report", report: []byte{5, 0, 0, 0, 0, 0}, wantErr: errScaleBusy},
+	}
+
+	for _, test := range reports {
+		t.Run(test.name, func(t *testing.T) {
+
+			if _, err := device.Write(test.report); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := connection.Read(time.Second)
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, test.wantErr)
+			}
+
+			if err == nil {
+				checkScaleReading(t, got, test.want)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		if _, err := connection.Read(50 * time.Millisecond); err != errScaleReadTimeout {
+			t.Errorf("Read() error = %v, want %v", err, errScaleReadTimeout)
+		}
+	})
+}
+
+func TestOpenHidrawScaleNotFound(t *testing.T) {
+
+	fakeHidraw(t, []fakeHidrawDevice{
+		{name: "hidraw0", uevent: "HID_ID=0003:00000922:00008003\nHID_NAME=DYMO M10\n"},
+	})
+
+	if _, err := openHidrawScale(Scale{VendorId: 0x0922, ProductId: 0x8004}); err == nil {
+		t.Error("openHidrawScale() succeeded, want an error for a scale that isn't attached")
+	}
+}
+
+// A scale with its weight in input report 3 and Enforced Zero Return & Zero Scale in feature report 2,
+// padded out to a byte
+var zeroingScaleDescriptor = []byte{
+	0x05, 0x8d, 0x09, 0x01, 0xa1, 0x01,
+	0x85, 0x03, 0x09, 0x32, 0x15, 0x00, 0x26, 0xff, 0x00, 0x75, 0x08, 0x95, 0x05, 0x81, 0x02,
+	0x85, 0x02, 0x09, 0x31, 0xa1, 0x02, 0x09, 0x81, 0x09, 0x80, 0x25, 0x01, 0x75, 0x01, 0x95, 0x02, 0xb1, 0x02,
+	0x75, 0x06, 0x95, 0x01, 0xb1, 0x03, 0xc0,
+	0xc0,
+}
+
+func TestHidFeatureControlReport(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		descriptor []byte
+		want       []byte
+	}{
+		{name: "scale control report", descriptor: zeroingScaleDescriptor, want: []byte{2, 0x02}},
+		{name: "without report ids", descriptor: []byte{0x05, 0x8d, 0x09, 0x80, 0x25, 0x01, 0x75, 0x01, 0x95, 0x01, 0xb1, 0x02, 0x75, 0x07, 0xb1, 0x03}, want: []byte{0, 0x01}},
+		{name: "after other fields", descriptor: []byte{0x05, 0x8d, 0x85, 0x04, 0x09, 0x50, 0x75, 0x08, 0x95, 0x01, 0xb1, 0x02, 0x09, 0x80, 0x75, 0x01, 0xb1, 0x02}, want: []byte{4, 0x00, 0x01}},
+		{name: "extended usage", descriptor: []byte{0x05, 0x01, 0x85, 0x01, 0x0b, 0x80, 0x00, 0x8d, 0x00, 0x75, 0x01, 0x95, 0x01, 0xb1, 0x02}, want: []byte{1, 0x01}},
+		{name: "usage range", descriptor: []byte{0x05, 0x8d, 0x85, 0x02, 0x19, 0x7f, 0x29, 0x81, 0x75, 0x01, 0x95, 0x03, 0xb1, 0x02}, want: []byte{2, 0x02}},
+		{name: "report id pushed & popped", descriptor: []byte{0x05, 0x8d, 0x85, 0x02, 0x95, 0x01, 0xa4, 0x85, 0x05, 0x09, 0x70, 0x75, 0x08, 0xb1, 0x02, 0xb4, 0x09, 0x80, 0x75, 0x01, 0xb1, 0x02}, want: []byte{2, 0x01}},
+		{name: "input only", descriptor: []byte{0x05, 0x8d, 0x09, 0x80, 0x75, 0x01, 0x95, 0x01, 0x81, 0x02}},
+		{name: "usage cleared by a collection", descriptor: []byte{0x05, 0x8d, 0x09, 0x80, 0xa1, 0x02, 0x75, 0x01, 0x95, 0x01, 0xb1, 0x02}},
+		{name: "another page", descriptor: []byte{0x05, 0x8c, 0x09, 0x80, 0x75, 0x01, 0x95, 0x01, 0xb1, 0x02}},
+		{name: "weight only", descriptor: scaleDescriptor},
+		{name: "truncated", descriptor: []byte{0x05, 0x8d, 0x09, 0x80, 0x75, 0x01, 0x95, 0x01, 0xb2, 0x02}},
+		{name: "empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, ok := hidFeatureControlReport(test.descriptor, hidPosScalePage, hidPosZeroScaleControl)
+
+			if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("hidFeatureControlReport() = %v, %v, want %v", got, ok, test.want)
+			}
+		})
+	}
+}
+
+func TestScaleCommandReports(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		model      ScaleModel
+		descriptor []byte
+		want       map[string][]byte
+	}{
+		{name: "zero from the descriptor", descriptor: zeroingScaleDescriptor, want: map[string][]byte{ScaleActionZero: {2, 0x02}}},
+		{
+			name:       "the model's reports first",
+			model:      ScaleModel{Commands: map[string][]byte{ScaleActionTare: {5, 1}, ScaleActionZero: {5, 2}}},
+			descriptor: zeroingScaleDescriptor,
+			want:       map[string][]byte{ScaleActionTare: {5, 1}, ScaleActionZero: {5, 2}},
+		},
+		{name: "no controls", descriptor: scaleDescriptor, want: map[string][]byte{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := scaleCommandReports(test.model, test.descriptor); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("scaleCommandReports() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHidrawScaleCommand(t *testing.T) {
+
+	fakeHidraw(t, []fakeHidrawDevice{
+		{name: "hidraw0", uevent: "HID_ID=0003:00000922:00008003\nHID_NAME=DYMO M10\n", descriptor: zeroingScaleDescriptor},
+	})
+
+	// A regular file has no feature reports, so sending one fails as it would for a scale that rejected it
+	if err := ioutil.WriteFile(filepath.Join(hidrawDevPath, "hidraw0"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	connection, err := openHidrawScale(Scale{VendorId: 0x0922, ProductId: 0x8003})
+
+	if err != nil {
+		t.Fatalf("openHidrawScale() error = %v", err)
+	}
+
+	defer connection.Close()
+
+	if err := runScaleCommand(connection, ScaleActionTare, time.Second); !errors.Is(err, errScaleActionUnsupported) {
+		t.Errorf("tare error = %v, want %v", err, errScaleActionUnsupported)
+	}
+
+	if err := runScaleCommand(connection, ScaleActionZero, time.Second); err == nil || errors.Is(err, errScaleActionUnsupported) {
+		t.Errorf("zero error = %v, want the feature report to be sent", err)
+	}
+}
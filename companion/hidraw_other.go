@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package companion
+
+import "errors"
+
+// openHidrawScale is only available on linux, other platforms use ScaleTools.
+func openHidrawScale(scale Scale) (scaleConnection, error) {
+	return nil, errors.New("reading scales via hidraw is only supported on linux")
+}
+
+// listHidrawScales is only available on linux, other platforms use ScaleTools.
+func listHidrawScales() ([]AvailableScale, error) {
+	return nil, errors.New("listing scales via hidraw is only supported on linux")
+}
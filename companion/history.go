@@ -0,0 +1,468 @@
+package companion
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultHistoryMaxAgeDays = 90
+const DefaultHistoryMaxRecords = 100000
+
+const (
+	HistoryKindPrint = "print"
+	HistoryKindScale = "scale"
+)
+
+// HistoryRecord is a single print or scale job in the local history ledger.
+type HistoryRecord struct {
+	Id          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	JobId       string    `json:"job_id"`
+	Reference   string    `json:"reference,omitempty"`
+	Started     time.Time `json:"started"`
+	Completed   time.Time `json:"completed"`
+	Role        string    `json:"role,omitempty"`
+	Printer     string    `json:"printer,omitempty"`
+	Quantity    int       `json:"quantity,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Weight      float64   `json:"weight,omitempty"`
+	// The check weigh, when the scale job had an expected weight
+	ExpectedWeight float64 `json:"expected_weight,omitempty"`
+	Verdict        string  `json:"verdict,omitempty"`
+	Variance       float64 `json:"variance,omitempty"`
+	User           string  `json:"user,omitempty"`
+	Bay            string  `json:"bay,omitempty"`
+	Outcome        string  `json:"outcome"`
+	Message        string  `json:"message,omitempty"`
+	DownloadMs     int64   `json:"download_ms,omitempty"`
+	ProcessMs      int64   `json:"process_ms,omitempty"`
+	PrintMs        int64   `json:"print_ms,omitempty"`
+	TotalMs        int64   `json:"total_ms"`
+}
+
+// HistoryFilter narrows a history query. Empty values match everything.
+type HistoryFilter struct {
+	Since     time.Time
+	Until     time.Time
+	Kind      string
+	JobId     string
+	Reference string
+	Role      string
+	Printer   string
+	Outcome   string
+	Verdict   string
+	User      string
+	Limit     int
+}
+
+// ParseHistoryTime accepts RFC3339 timestamps, dates (2006-01-02) or a duration
+// before now such as "24h".
+func ParseHistoryTime(value string) (time.Time, error) {
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+
+	if parsed, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return parsed, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	return time.Time{}, fmt.Errorf("could not understand the time %q", value)
+}
+
+// NewHistoryFilter builds a filter from string values, as used by the CLI flags and the local server.
+func NewHistoryFilter(values map[string]string) (HistoryFilter, error) {
+
+	filter := HistoryFilter{
+		Kind:      values["kind"],
+		JobId:     values["job_id"],
+		Reference: values["reference"],
+		Role:      values["role"],
+		Printer:   values["printer"],
+		Outcome:   values["outcome"],
+		Verdict:   values["verdict"],
+		User:      values["user"],
+	}
+
+	var err error
+
+	filter.Since, err = ParseHistoryTime(values["since"])
+
+	if err != nil {
+		return filter, err
+	}
+
+	filter.Until, err = ParseHistoryTime(values["until"])
+
+	if err != nil {
+		return filter, err
+	}
+
+	if values["limit"] != "" {
+		filter.Limit, err = strconv.Atoi(values["limit"])
+
+		if err != nil {
+			return filter, fmt.Errorf("invalid limit %q", values["limit"])
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter HistoryFilter) matches(record HistoryRecord) bool {
+
+	if !filter.Since.IsZero() && record.Started.Before(filter.Since) {
+		return false
+	}
+
+	if !filter.Until.IsZero() && record.Started.After(filter.Until) {
+		return false
+	}
+
+	if filter.Kind != "" && record.Kind != filter.Kind {
+		return false
+	}
+
+	if filter.JobId != "" && record.JobId != filter.JobId {
+		return false
+	}
+
+	if filter.Reference != "" && !strings.Contains(strings.ToLower(record.Reference), strings.ToLower(filter.Reference)) {
+		return false
+	}
+
+	if filter.Role != "" && record.Role != filter.Role {
+		return false
+	}
+
+	if filter.Printer != "" && !strings.EqualFold(record.Printer, filter.Printer) {
+		return false
+	}
+
+	if filter.Outcome != "" && record.Outcome != filter.Outcome {
+		return false
+	}
+
+	if filter.Verdict != "" && record.Verdict != filter.Verdict {
+		return false
+	}
+
+	if filter.User != "" && !strings.EqualFold(record.User, filter.User) {
+		return false
+	}
+
+	return true
+}
+
+// errHistoryReadOnly is returned when recording to a ledger that was opened to be queried.
+var errHistoryReadOnly = errors.New("the local history was opened read only")
+
+// History is a rolling ledger of jobs stored as JSON lines in the config directory. The service & the
+// CLI can both have it open, so only the service trims it, see Compact.
+type History struct {
+	path       string
+	maxAge     time.Duration
+	maxRecords int
+	count      int
+	readOnly   bool
+	// Set once the service has taken over trimming the ledger
+	compacts bool
+	mutex    sync.Mutex
+}
+
+// OpenHistory opens the history ledger to record & query jobs.
+func OpenHistory(config HistoryConfiguration) (*History, error) {
+
+	dir, err := GetConfigDirectory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, os.ModePerm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newHistory(dir, config), nil
+}
+
+// OpenHistoryReadOnly opens the history ledger to query it, it is never written to.
+func OpenHistoryReadOnly(config HistoryConfiguration) (*History, error) {
+
+	dir, err := GetConfigDirectory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	history := newHistory(dir, config)
+	history.readOnly = true
+
+	return history, nil
+}
+
+func newHistory(dir string, config HistoryConfiguration) *History {
+
+	history := &History{
+		path:       filepath.Join(dir, "history.jsonl"),
+		maxAge:     time.Duration(config.MaxAgeDays) * time.Hour * 24,
+		maxRecords: config.MaxRecords,
+	}
+
+	if history.maxAge <= 0 {
+		history.maxAge = DefaultHistoryMaxAgeDays * time.Hour * 24
+	}
+
+	if history.maxRecords <= 0 {
+		history.maxRecords = DefaultHistoryMaxRecords
+	}
+
+	return history
+}
+
+// Compact trims the ledger to the configured limits now & whenever enough jobs have been recorded
+// since. Only the service calls it, anything else would lose records written while it rewrites the file.
+func (history *History) Compact() error {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if history.readOnly {
+		return errHistoryReadOnly
+	}
+
+	history.compacts = true
+
+	return history.compact()
+}
+
+// Record appends the record to the ledger.
+func (history *History) Record(record HistoryRecord) error {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if history.readOnly {
+		return errHistoryReadOnly
+	}
+
+	if record.Id == "" {
+		record.Id = uuid.New().String()
+	}
+
+	if record.Completed.IsZero() {
+		record.Completed = time.Now()
+	}
+
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	// Shared with anyone else appending, but not while the service is rewriting the ledger
+	lock, err := history.lock(false)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(history.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	_ = lock.Close()
+
+	if err != nil {
+		return err
+	}
+
+	history.count++
+
+	// Allow some slack so we are not rewriting the file on every job
+	if history.compacts && history.count > history.maxRecords+history.maxRecords/10 {
+		return history.compact()
+	}
+
+	return nil
+}
+
+// lock takes the ledger's lock file, which is released by closing it.
+func (history *History) lock(exclusive bool) (*os.File, error) {
+
+	file, err := os.OpenFile(history.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file, exclusive)
+
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to lock the local history: %w", err)
+	}
+
+	return file, nil
+}
+
+// Query returns the records matching the filter, newest first.
+func (history *History) Query(filter HistoryFilter) ([]HistoryRecord, error) {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	records, err := history.readAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]HistoryRecord, 0)
+
+	for i := len(records) - 1; i >= 0; i-- {
+		if !filter.matches(records[i]) {
+			continue
+		}
+
+		results = append(results, records[i])
+
+		if filter.Limit > 0 && len(results) >= filter.Limit {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+func (history *History) readAll() ([]HistoryRecord, error) {
+
+	records := make([]HistoryRecord, 0)
+
+	file, err := os.Open(history.path)
+
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var record HistoryRecord
+
+		// Skip anything partially written rather than losing the whole ledger
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// compact drops records beyond the age and count limits. Nobody can append while it rewrites the ledger.
+func (history *History) compact() error {
+
+	lock, err := history.lock(true)
+
+	if err != nil {
+		return err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer lock.Close()
+
+	records, err := history.readAll()
+
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-history.maxAge)
+
+	kept := make([]HistoryRecord, 0, len(records))
+	for _, record := range records {
+		if record.Started.After(cutoff) {
+			kept = append(kept, record)
+		}
+	}
+
+	if len(kept) > history.maxRecords {
+		kept = kept[len(kept)-history.maxRecords:]
+	}
+
+	history.count = len(kept)
+
+	if len(kept) == len(records) {
+		return nil
+	}
+
+	log.Info().Int("Removed", len(records)-len(kept)).Msg("Trimming the local history")
+
+	file, err := os.Create(history.path + ".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+
+	for _, record := range kept {
+		data, err := json.Marshal(record)
+
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		_, _ = writer.Write(append(data, '\n'))
+	}
+
+	err = writer.Flush()
+	closeErr := file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(history.path+".tmp", history.path)
+}
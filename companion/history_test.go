@@ -0,0 +1,128 @@
+package companion
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func recordHistory(t *testing.T, history *History, jobs ...string) {
+	t.Helper()
+
+	for _, job := range jobs {
+		if err := history.Record(HistoryRecord{Kind: HistoryKindPrint, JobId: job, Started: time.Now(), Outcome: "complete"}); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+}
+
+func queryHistoryJobs(t *testing.T, history *History) []string {
+	t.Helper()
+
+	records, err := history.Query(HistoryFilter{})
+
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	jobs := make([]string, 0, len(records))
+	for _, record := range records {
+		jobs = append(jobs, record.JobId)
+	}
+
+	return jobs
+}
+
+func TestHistoryCompact(t *testing.T) {
+
+	dir := t.TempDir()
+	config := HistoryConfiguration{MaxRecords: 2}
+
+	// The CLI records reprints, but leaves trimming the ledger to the service
+	cli := newHistory(dir, config)
+	recordHistory(t, cli, "1", "2", "3", "4")
+
+	if got := queryHistoryJobs(t, cli); len(got) != 4 {
+		t.Fatalf("the CLI trimmed the history to %v", got)
+	}
+
+	service := newHistory(dir, config)
+
+	if err := service.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	if got := queryHistoryJobs(t, service); len(got) != 2 || got[0] != "4" || got[1] != "3" {
+		t.Errorf("Query() = %v after compacting, want [4 3]", got)
+	}
+
+	// Only trimmed again once there are enough new records
+	recordHistory(t, service, "5", "6")
+
+	if got := queryHistoryJobs(t, service); len(got) != 2 || got[0] != "6" {
+		t.Errorf("Query() = %v after recording, want [6 5]", got)
+	}
+}
+
+func TestHistoryReadOnly(t *testing.T) {
+
+	dir := t.TempDir()
+
+	recordHistory(t, newHistory(dir, HistoryConfiguration{}), "1")
+
+	history := newHistory(dir, HistoryConfiguration{})
+	history.readOnly = true
+
+	if got := queryHistoryJobs(t, history); len(got) != 1 || got[0] != "1" {
+		t.Errorf("Query() = %v, want [1]", got)
+	}
+
+	if err := history.Record(HistoryRecord{JobId: "2"}); !errors.Is(err, errHistoryReadOnly) {
+		t.Errorf("Record() error = %v, want %v", err, errHistoryReadOnly)
+	}
+
+	if err := history.Compact(); !errors.Is(err, errHistoryReadOnly) {
+		t.Errorf("Compact() error = %v, want %v", err, errHistoryReadOnly)
+	}
+}
+
+// Records written while the service compacts must wait for it rather than being lost with the old ledger.
+func TestHistoryRecordWaitsForCompaction(t *testing.T) {
+
+	dir := t.TempDir()
+	service := newHistory(dir, HistoryConfiguration{})
+	cli := newHistory(dir, HistoryConfiguration{})
+
+	lock, err := service.lock(true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := make(chan error, 1)
+
+	go func() {
+		recorded <- cli.Record(HistoryRecord{JobId: "reprint", Started: time.Now()})
+	}()
+
+	select {
+	case err := <-recorded:
+		t.Fatalf("Record() = %v while the ledger was locked, want it to wait", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := os.Stat(service.path); !os.IsNotExist(err) {
+		t.Errorf("the ledger was written while locked, %v", err)
+	}
+
+	lock.Close()
+
+	if err := <-recorded; err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	if got := queryHistoryJobs(t, service); len(got) != 1 {
+		t.Errorf("Query() = %v, want the reprint", got)
+	}
+}
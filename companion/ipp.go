@@ -0,0 +1,488 @@
+package companion
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+A small IPP/1.1 client (RFC 8010 & 8011), enough to read printer attributes and
+send documents to printers that are not installed as a local queue.
+*/
+
+const (
+	ippOperationPrintJob             uint16 = 0x0002
+	ippOperationCancelJob            uint16 = 0x0008
+	ippOperationGetJobAttributes     uint16 = 0x0009
+	ippOperationGetPrinterAttributes uint16 = 0x000b
+	ippOperationCupsGetPrinters      uint16 = 0x4002
+
+	ippTagOperation byte = 0x01
+	ippTagJob       byte = 0x02
+	ippTagEnd       byte = 0x03
+	ippTagPrinter   byte = 0x04
+
+	ippTagInteger         byte = 0x21
+	ippTagBoolean         byte = 0x22
+	ippTagEnum            byte = 0x23
+	ippTagResolution      byte = 0x32
+	ippTagRange           byte = 0x33
+	ippTagBeginCollection byte = 0x34
+	ippTagTextLanguage    byte = 0x35
+	ippTagNameLanguage    byte = 0x36
+	ippTagEndCollection   byte = 0x37
+	ippTagName            byte = 0x42
+	ippTagKeyword         byte = 0x44
+	ippTagUri             byte = 0x45
+	ippTagCharset         byte = 0x47
+	ippTagLanguage        byte = 0x48
+	ippTagMimeType        byte = 0x49
+)
+
+var ippRequestId uint32
+
+var ippClient = &http.Client{
+	Timeout: time.Minute * 2,
+}
+
+// Printers almost always use self signed certificates, ipps still keeps the job private on the network.
+// Only printers on the local network are trusted without a valid certificate.
+var ippLocalClient = &http.Client{
+	Timeout: time.Minute * 2,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+type ippAttribute struct {
+	tag    byte
+	name   string
+	values []string
+}
+
+type ippRequest struct {
+	operation       uint16
+	printerUri      string
+	operationExtras []ippAttribute
+	jobAttributes   []ippAttribute
+}
+
+// IppAttributes are attribute values formatted as strings, keyed by name.
+type IppAttributes map[string][]string
+
+// Value returns the first value of the attribute.
+func (attributes IppAttributes) Value(name string) string {
+	if values := attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// IppGroup is a single attribute group, e.g. one printer in a CUPS-Get-Printers response.
+type IppGroup struct {
+	Tag        byte
+	Attributes IppAttributes
+}
+
+// IppResponse holds the status and every attribute returned. Attributes has the values
+// from all groups, Groups keeps them apart.
+type IppResponse struct {
+	Status     uint16
+	Attributes IppAttributes
+	Groups     []IppGroup
+}
+
+// Successful reports whether the IPP status code is in the successful range.
+func (response *IppResponse) Successful() bool {
+	return response.Status < 0x0100
+}
+
+// Value returns the first value of the attribute.
+func (response *IppResponse) Value(name string) string {
+	return response.Attributes.Value(name)
+}
+
+// GetPrinterAttributes requests the named attributes from the printer, or all of them when none are given.
+func GetPrinterAttributes(printerUri string, requested ...string) (*IppResponse, error) {
+	return getPrinterAttributes(context.Background(), printerUri, requested...)
+}
+
+func getPrinterAttributes(ctx context.Context, printerUri string, requested ...string) (*IppResponse, error) {
+
+	request := ippRequest{
+		operation:  ippOperationGetPrinterAttributes,
+		printerUri: printerUri,
+	}
+
+	if len(requested) > 0 {
+		request.operationExtras = append(request.operationExtras, ippAttribute{tag: ippTagKeyword, name: "requested-attributes", values: requested})
+	}
+
+	return sendIppRequestContext(ctx, request, nil)
+}
+
+func sendIppRequest(request ippRequest, document io.Reader) (*IppResponse, error) {
+	return sendIppRequestContext(context.Background(), request, document)
+}
+
+// sendIppRequestContext gives up on the request once the context is done.
+func sendIppRequestContext(ctx context.Context, request ippRequest, document io.Reader) (*IppResponse, error) {
+
+	endpoint, err := ippHttpUrl(request.printerUri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = bytes.NewReader(request.encode())
+
+	if document != nil {
+		body = io.MultiReader(body, document)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/ipp")
+
+	client := ippClient
+	if isLocalNetworkHost(req.URL.Hostname()) {
+		client = ippLocalClient
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("printer responded with http status %d", res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := decodeIppResponse(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Successful() {
+		message := response.Value("status-message")
+		if message == "" {
+			message = "request was not successful"
+		}
+		return response, fmt.Errorf("ipp status 0x%04x: %s", response.Status, message)
+	}
+
+	return response, nil
+}
+
+// privateNetworks are the address ranges of local networks (RFC 1918 & RFC 4193).
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// isLocalNetworkHost is true for loopback, link local & private addresses, mDNS .local names and
+// single label names, which only resolve on the local network.
+func isLocalNetworkHost(host string) bool {
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return host == "localhost" || strings.HasSuffix(host, ".local") || (host != "" && !strings.Contains(host, "."))
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ippHttpUrl converts ipp:// and ipps:// uris to the http url the request is posted to.
+func ippHttpUrl(printerUri string) (string, error) {
+
+	parsed, err := url.Parse(printerUri)
+
+	if err != nil {
+		return "", err
+	}
+
+	switch parsed.Scheme {
+	case "ipp":
+		parsed.Scheme = "http"
+		if parsed.Port() == "" {
+			parsed.Host += ":631"
+		}
+	case "ipps":
+		parsed.Scheme = "https"
+		if parsed.Port() == "" {
+			parsed.Host += ":443"
+		}
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported printer uri %q", printerUri)
+	}
+
+	return parsed.String(), nil
+}
+
+func (request ippRequest) encode() []byte {
+
+	var buffer bytes.Buffer
+
+	// Version 1.1, operation & request id
+	buffer.Write([]byte{1, 1})
+	_ = binary.Write(&buffer, binary.BigEndian, request.operation)
+	_ = binary.Write(&buffer, binary.BigEndian, atomic.AddUint32(&ippRequestId, 1))
+
+	buffer.WriteByte(ippTagOperation)
+
+	// These must come first & in this order
+	operation := []ippAttribute{
+		{tag: ippTagCharset, name: "attributes-charset", values: []string{"utf-8"}},
+		{tag: ippTagLanguage, name: "attributes-natural-language", values: []string{"en"}},
+		{tag: ippTagUri, name: "printer-uri", values: []string{request.printerUri}},
+		{tag: ippTagName, name: "requesting-user-name", values: []string{"companion-app"}},
+	}
+
+	// CUPS operations are sent to the server rather than a printer
+	if request.operation >= 0x4000 {
+		operation = append(operation[:2], operation[3])
+	}
+
+	for _, attribute := range append(operation, request.operationExtras...) {
+		attribute.encode(&buffer)
+	}
+
+	if len(request.jobAttributes) > 0 {
+		buffer.WriteByte(ippTagJob)
+		for _, attribute := range request.jobAttributes {
+			attribute.encode(&buffer)
+		}
+	}
+
+	buffer.WriteByte(ippTagEnd)
+
+	return buffer.Bytes()
+}
+
+func (attribute ippAttribute) encode(buffer *bytes.Buffer) {
+	for i, value := range attribute.values {
+		name := attribute.name
+
+		// Additional values of the same attribute have no name
+		if i > 0 {
+			name = ""
+		}
+
+		var data []byte
+
+		switch attribute.tag {
+		case ippTagInteger, ippTagEnum:
+			number, _ := strconv.Atoi(value)
+			data = make([]byte, 4)
+			binary.BigEndian.PutUint32(data, uint32(int32(number)))
+		case ippTagBoolean:
+			data = []byte{0}
+			if value == "true" {
+				data[0] = 1
+			}
+		case ippTagRange:
+			// "5" or "1-3"
+			bounds := strings.SplitN(value, "-", 2)
+			lower, _ := strconv.Atoi(bounds[0])
+			upper := lower
+			if len(bounds) == 2 {
+				upper, _ = strconv.Atoi(bounds[1])
+			}
+			data = make([]byte, 8)
+			binary.BigEndian.PutUint32(data, uint32(int32(lower)))
+			binary.BigEndian.PutUint32(data[4:], uint32(int32(upper)))
+		default:
+			data = []byte(value)
+		}
+
+		buffer.WriteByte(attribute.tag)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(len(name)))
+		buffer.WriteString(name)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(len(data)))
+		buffer.Write(data)
+	}
+}
+
+func decodeIppResponse(data []byte) (*IppResponse, error) {
+
+	if len(data) < 9 {
+		return nil, errors.New("ipp response is too short")
+	}
+
+	response := &IppResponse{
+		Status:     binary.BigEndian.Uint16(data[2:4]),
+		Attributes: make(IppAttributes),
+	}
+
+	offset := 8
+	name := ""
+	collectionDepth := 0
+	var group *IppGroup
+
+	for offset < len(data) {
+		tag := data[offset]
+		offset++
+
+		if tag == ippTagEnd {
+			return response, nil
+		}
+
+		// Delimiters start a new attribute group
+		if tag < 0x10 {
+			response.Groups = append(response.Groups, IppGroup{Tag: tag, Attributes: make(IppAttributes)})
+			group = &response.Groups[len(response.Groups)-1]
+			continue
+		}
+
+		if offset+2 > len(data) {
+			break
+		}
+		nameLength := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+
+		if offset+nameLength+2 > len(data) {
+			break
+		}
+		attributeName := string(data[offset : offset+nameLength])
+		offset += nameLength
+
+		valueLength := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+
+		if offset+valueLength > len(data) {
+			break
+		}
+		value := data[offset : offset+valueLength]
+		offset += valueLength
+
+		// Collections such as media-col-database are not needed, skip over their members
+		switch tag {
+		case ippTagBeginCollection:
+			collectionDepth++
+			continue
+		case ippTagEndCollection:
+			collectionDepth--
+			continue
+		}
+
+		if collectionDepth > 0 {
+			continue
+		}
+
+		if attributeName != "" {
+			name = attributeName
+		}
+
+		formatted, ok := formatIppValue(tag, value)
+
+		if ok {
+			response.Attributes[name] = append(response.Attributes[name], formatted)
+
+			if group != nil {
+				group.Attributes[name] = append(group.Attributes[name], formatted)
+			}
+		}
+	}
+
+	return nil, errors.New("ipp response is truncated")
+}
+
+func formatIppValue(tag byte, value []byte) (string, bool) {
+
+	switch {
+	case tag < 0x20:
+		// Out of band values such as unknown or no-value
+		return "", false
+	case tag == ippTagInteger || tag == ippTagEnum:
+		if len(value) != 4 {
+			return "", false
+		}
+		return strconv.Itoa(int(int32(binary.BigEndian.Uint32(value)))), true
+	case tag == ippTagBoolean:
+		if len(value) != 1 {
+			return "", false
+		}
+		return strconv.FormatBool(value[0] != 0), true
+	case tag == ippTagResolution:
+		if len(value) != 9 {
+			return "", false
+		}
+		units := "dpi"
+		if value[8] == 4 {
+			units = "dpcm"
+		}
+		return fmt.Sprintf("%dx%d%s", int32(binary.BigEndian.Uint32(value[0:4])), int32(binary.BigEndian.Uint32(value[4:8])), units), true
+	case tag == ippTagRange:
+		if len(value) != 8 {
+			return "", false
+		}
+		return fmt.Sprintf("%d-%d", int32(binary.BigEndian.Uint32(value[0:4])), int32(binary.BigEndian.Uint32(value[4:8]))), true
+	case tag == ippTagTextLanguage || tag == ippTagNameLanguage:
+		// Language length & language, then the text
+		if len(value) < 2 {
+			return "", false
+		}
+		languageLength := int(binary.BigEndian.Uint16(value))
+		if len(value) < 4+languageLength {
+			return "", false
+		}
+		return string(value[4+languageLength:]), true
+	case tag >= 0x30 && tag < 0x40:
+		// Other binary values such as dateTime
+		return "", false
+	}
+
+	return strings.TrimSpace(string(value)), true
+}
@@ -0,0 +1,291 @@
+package companion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errDocumentFormatUnsupported is returned when a network printer can't print the content type of a job.
+var errDocumentFormatUnsupported = errors.New("the printer does not support the document format")
+
+// networkDocumentFormats are the IPP document formats for our content types. ZPL has no
+// registered type so it is sent as a raw stream.
+var networkDocumentFormats = map[string]string{
+	ContentTypePdf:  "application/pdf",
+	ContentTypeZpl:  "application/octet-stream",
+	ContentTypePng:  "image/png",
+	ContentTypeJpeg: "image/jpeg",
+	ContentTypeGif:  "image/gif",
+}
+
+// PrintNetworkFile sends the file to a discovered printer that has no local queue, over IPP
+// or straight to its raw socket. The IPP job id is returned so the job can be cancelled.
+func PrintNetworkFile(printer Printer, file *os.File, quantity int, contentType string, options PrintOptions) (string, error) {
+
+	if printer.Capabilities == nil || printer.Capabilities.DeviceUri == "" {
+		return "", fmt.Errorf("no address is known for the network printer %s", printer.Name)
+	}
+
+	if quantity <= 0 {
+		return "", errors.New("invalid print quantity specified")
+	}
+
+	if file == nil {
+		return "", errors.New("no file to print specified")
+	}
+
+	uri := printer.Capabilities.DeviceUri
+
+	parsed, err := url.Parse(uri)
+
+	if err != nil {
+		return "", err
+	}
+
+	format, err := networkDocumentFormat(printer, parsed.Scheme, contentType)
+
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Scheme == "socket" {
+		return "", printRawSocket(parsed.Host, file, quantity)
+	}
+
+	err = options.Validate()
+
+	if err != nil {
+		return "", err
+	}
+
+	request := ippRequest{
+		operation:  ippOperationPrintJob,
+		printerUri: uri,
+		operationExtras: []ippAttribute{
+			{tag: ippTagName, name: "job-name", values: []string{"Companion App"}},
+			{tag: ippTagMimeType, name: "document-format", values: []string{format}},
+		},
+		jobAttributes: options.ippJobAttributes(),
+	}
+
+	if quantity > 1 {
+		request.jobAttributes = append(request.jobAttributes, ippAttribute{tag: ippTagInteger, name: "copies", values: []string{strconv.Itoa(quantity)}})
+	}
+
+	source, err := os.Open(file.Name())
+
+	if err != nil {
+		return "", err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer source.Close()
+
+	log.Info().Str("Printer", printer.Name).Str("Uri", uri).Str("Format", format).Msg("Printing to network printer over IPP")
+
+	response, err := sendIppRequest(request, source)
+
+	if err != nil {
+		return "", err
+	}
+
+	return response.Value("job-id"), nil
+}
+
+// networkDocumentFormat is the document format to send the content as, checked against the formats the
+// printer accepts. Printers can't be relied on to reject what they don't understand, a raw socket printer
+// sent a PDF prints pages of PDF source, so anything not accepted fails before it is sent.
+func networkDocumentFormat(printer Printer, scheme string, contentType string) (string, error) {
+
+	format, ok := networkDocumentFormats[contentType]
+
+	// Raw data such as ZPL is the printer's own language
+	if !ok || format == "application/octet-stream" {
+		return "application/octet-stream", nil
+	}
+
+	formats := printer.Capabilities.DocumentFormats
+
+	// DNS-SD doesn't always list the formats, IPP printers can be asked
+	if len(formats) == 0 && scheme != "socket" {
+		response, err := GetPrinterAttributes(printer.Capabilities.DeviceUri, "document-format-supported")
+
+		if err != nil {
+			log.Warn().Err(err).Str("Printer", printer.Name).Msg("Failed to fetch the document formats of the network printer")
+		} else {
+			formats = response.Attributes["document-format-supported"]
+		}
+	}
+
+	// The printer says nothing about its formats, IPP printers will refuse the job if they can't print it
+	if len(formats) == 0 {
+		if scheme == "socket" {
+			return "", fmt.Errorf("%w: %s does not say which formats it accepts, %s can not be sent to its raw socket", errDocumentFormatUnsupported, printer.Name, format)
+		}
+		return format, nil
+	}
+
+	for _, supported := range formats {
+		if strings.EqualFold(strings.TrimSpace(supported), format) {
+			return format, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s does not accept %s, only %s", errDocumentFormatUnsupported, printer.Name, format, strings.Join(formats, ", "))
+}
+
+// CancelNetworkPrintFile cancels a job sent to a discovered printer over IPP.
+func CancelNetworkPrintFile(printer Printer, jobId string) error {
+
+	if printer.Capabilities == nil || !strings.HasPrefix(printer.Capabilities.DeviceUri, "ipp") {
+		return errors.New("jobs sent to a raw printer socket can not be cancelled")
+	}
+
+	if jobId == "" {
+		return errors.New("no job id was recorded for the print job")
+	}
+
+	request := ippRequest{
+		operation:  ippOperationCancelJob,
+		printerUri: printer.Capabilities.DeviceUri,
+		operationExtras: []ippAttribute{
+			{tag: ippTagInteger, name: "job-id", values: []string{jobId}},
+		},
+	}
+
+	_, err := sendIppRequest(request, nil)
+
+	return err
+}
+
+// NetworkPrintJobPending reports whether a job sent to a discovered printer over IPP is
+// still waiting or printing. Raw socket jobs are finished once they are sent.
+func NetworkPrintJobPending(printer Printer, jobId string) (bool, error) {
+
+	if printer.Capabilities == nil || !strings.HasPrefix(printer.Capabilities.DeviceUri, "ipp") || jobId == "" {
+		return false, nil
+	}
+
+	request := ippRequest{
+		operation:  ippOperationGetJobAttributes,
+		printerUri: printer.Capabilities.DeviceUri,
+		operationExtras: []ippAttribute{
+			{tag: ippTagInteger, name: "job-id", values: []string{jobId}},
+			{tag: ippTagKeyword, name: "requested-attributes", values: []string{"job-state"}},
+		},
+	}
+
+	response, err := sendIppRequest(request, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	// pending, pending-held, processing & processing-stopped, the rest are finished
+	state, _ := strconv.Atoi(response.Value("job-state"))
+
+	return state >= 3 && state <= 6, nil
+}
+
+// printRawSocket writes the file to the printer's port 9100 style socket, once per copy.
+func printRawSocket(address string, file *os.File, quantity int) error {
+
+	log.Info().Str("Address", address).Msg("Printing to network printer over a raw socket")
+
+	conn, err := net.DialTimeout("tcp", address, time.Second*10)
+
+	if err != nil {
+		return err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Minute * 2))
+
+	for i := 0; i < quantity; i++ {
+		source, err := os.Open(file.Name())
+
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(conn, source)
+		_ = source.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// networkPrinterHealth reads the state of a discovered IPP printer. Raw socket printers
+// have no way to report their state so have no health.
+func networkPrinterHealth(ctx context.Context, printer Printer) (*PrinterHealth, error) {
+
+	if printer.Capabilities == nil || !strings.HasPrefix(printer.Capabilities.DeviceUri, "ipp") {
+		return nil, nil
+	}
+
+	response, err := getPrinterAttributes(ctx, printer.Capabilities.DeviceUri, "printer-state", "printer-state-reasons", "printer-is-accepting-jobs", "queued-job-count")
+
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{
+		"printer-state":             response.Value("printer-state"),
+		"printer-state-reasons":     strings.Join(response.Attributes["printer-state-reasons"], ","),
+		"printer-is-accepting-jobs": response.Value("printer-is-accepting-jobs"),
+	}
+
+	health := ippPrinterHealth(attributes)
+	health.QueueLength, _ = strconv.Atoi(response.Value("queued-job-count"))
+	health.Since = time.Now()
+
+	return health, nil
+}
+
+// isInstalledQueue reports whether the discovered printer already has a local queue, going
+// by the queue's device uri pointing at the same address or DNS-SD instance.
+func isInstalledQueue(discovered Printer, installed []Printer) bool {
+
+	if discovered.Capabilities == nil {
+		return false
+	}
+
+	parsed, err := url.Parse(discovered.Capabilities.DeviceUri)
+
+	if err != nil {
+		return false
+	}
+
+	for _, printer := range installed {
+		if printer.Capabilities == nil || printer.Capabilities.DeviceUri == "" {
+			continue
+		}
+
+		deviceUri, err := url.PathUnescape(printer.Capabilities.DeviceUri)
+
+		if err != nil {
+			deviceUri = printer.Capabilities.DeviceUri
+		}
+
+		if strings.Contains(deviceUri, "//"+parsed.Hostname()) || strings.Contains(deviceUri, "//"+discovered.Name+".") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,256 @@
+package companion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const pointsPerInch = 72.0
+const pointsPerMillimetre = pointsPerInch / 25.4
+
+// Pages within this many points of the target are left untouched
+const pageSizeTolerance = 1.0
+
+var mediaSizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(?:x(\d+(?:\.\d+)?))?(mm|cm|in|pt)$`)
+
+var namedMediaSizes = map[string]MediaSize{
+	"a4":     {Width: 595.28, Height: 841.89},
+	"a5":     {Width: 419.53, Height: 595.28},
+	"a6":     {Width: 297.64, Height: 419.53},
+	"letter": {Width: 612, Height: 792},
+	"legal":  {Width: 612, Height: 1008},
+}
+
+// MediaSize is a page size in PDF points. A zero Height describes continuous
+// media where only the width is fixed.
+type MediaSize struct {
+	Width  float64
+	Height float64
+}
+
+func (size MediaSize) IsContinuous() bool {
+	return size.Height == 0
+}
+
+// ParseMediaSize reads sizes such as "4x6in", "100x150mm", "62mm" (continuous) or "A6".
+func ParseMediaSize(value string) (MediaSize, error) {
+
+	normalised := strings.ToLower(strings.ReplaceAll(value, " ", ""))
+
+	if size, ok := namedMediaSizes[normalised]; ok {
+		return size, nil
+	}
+
+	matches := mediaSizePattern.FindStringSubmatch(normalised)
+
+	if matches == nil {
+		return MediaSize{}, fmt.Errorf("unrecognised media size %q", value)
+	}
+
+	var unit float64
+	switch matches[3] {
+	case "mm":
+		unit = pointsPerMillimetre
+	case "cm":
+		unit = pointsPerMillimetre * 10
+	case "in":
+		unit = pointsPerInch
+	case "pt":
+		unit = 1
+	}
+
+	width, _ := strconv.ParseFloat(matches[1], 64)
+	size := MediaSize{Width: width * unit}
+
+	if matches[2] != "" {
+		height, _ := strconv.ParseFloat(matches[2], 64)
+		size.Height = height * unit
+	}
+
+	if size.Width <= 0 || (!size.IsContinuous() && size.Height <= 0) {
+		return MediaSize{}, fmt.Errorf("invalid media size %q", value)
+	}
+
+	return size, nil
+}
+
+// NormalisePdfFile rewrites the PDF so every page matches the target media size.
+// A new temp file is returned, or nil when the pages already match.
+func NormalisePdfFile(file *os.File, mediaSize string) (*os.File, error) {
+
+	size, err := ParseMediaSize(mediaSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file.Name())
+
+	if err != nil {
+		return nil, err
+	}
+
+	normalised, changed, err := NormalisePdf(data, size)
+
+	if err != nil || !changed {
+		return nil, err
+	}
+
+	output, err := ioutil.TempFile("", "print_job_*.pdf")
+
+	if err != nil {
+		return nil, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer output.Close()
+
+	_, err = output.Write(normalised)
+
+	if err != nil {
+		_ = os.Remove(output.Name())
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// NormalisePdf rotates, crops and scales each page of the PDF on to the target media size.
+// Pages are rotated to match the media orientation, cropped to their crop box and scaled
+// to fit while keeping their aspect ratio.
+func NormalisePdf(data []byte, size MediaSize) ([]byte, bool, error) {
+
+	doc, err := parsePdf(data)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	pages, err := doc.Pages()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	update := doc.NewUpdate()
+	changed := false
+
+	for _, number := range pages {
+		page := doc.objects[number].(*pdfDict)
+
+		mediaBox, ok := doc.Rect(doc.Inherited(page, "MediaBox"))
+
+		if !ok {
+			return nil, false, ErrUnsupportedPdf
+		}
+
+		contentBox := mediaBox
+		if cropBox, ok := doc.Rect(doc.Inherited(page, "CropBox")); ok {
+			contentBox = intersectRect(mediaBox, cropBox)
+		}
+
+		rotate := 0
+		if value, ok := doc.Inherited(page, "Rotate").(pdfNumber); ok {
+			rotate = ((int(value) % 360) + 360) % 360
+		}
+
+		width := contentBox[2] - contentBox[0]
+		height := contentBox[3] - contentBox[1]
+
+		if width <= 0 || height <= 0 {
+			return nil, false, ErrUnsupportedPdf
+		}
+
+		// The size of the page as it is displayed, after its own rotation
+		displayWidth, displayHeight := width, height
+		if rotate%180 == 90 {
+			displayWidth, displayHeight = height, width
+		}
+
+		target := size
+		if target.IsContinuous() {
+			target.Height = displayHeight * (target.Width / displayWidth)
+		}
+
+		// Turn the page when its orientation does not match the media
+		finalRotate := rotate
+		if (displayWidth > displayHeight) != (target.Width > target.Height) && displayWidth != displayHeight && !size.IsContinuous() {
+			finalRotate = (rotate + 90) % 360
+		}
+
+		// The media box lives in unrotated page space
+		mediaWidth, mediaHeight := target.Width, target.Height
+		if finalRotate%180 == 90 {
+			mediaWidth, mediaHeight = target.Height, target.Width
+		}
+
+		if finalRotate == rotate && contentBox == mediaBox && math.Abs(mediaWidth-width) <= pageSizeTolerance && math.Abs(mediaHeight-height) <= pageSizeTolerance && mediaBox[0] == 0 && mediaBox[1] == 0 {
+			continue
+		}
+
+		scale := math.Min(mediaWidth/width, mediaHeight/height)
+		offsetX := (mediaWidth-width*scale)/2 - contentBox[0]*scale
+		offsetY := (mediaHeight-height*scale)/2 - contentBox[1]*scale
+
+		prefix := update.AddStream(fmt.Sprintf("q %s 0 0 %s %s %s cm %s %s %s %s re W n",
+			formatPdfValue(pdfNumber(roundPoints(scale))), formatPdfValue(pdfNumber(roundPoints(scale))),
+			formatPdfValue(pdfNumber(roundPoints(offsetX))), formatPdfValue(pdfNumber(roundPoints(offsetY))),
+			formatPdfValue(pdfNumber(roundPoints(contentBox[0]))), formatPdfValue(pdfNumber(roundPoints(contentBox[1]))),
+			formatPdfValue(pdfNumber(roundPoints(width))), formatPdfValue(pdfNumber(roundPoints(height)))))
+		suffix := update.AddStream("Q")
+
+		contents := pdfArray{prefix}
+		switch existing := page.values["Contents"].(type) {
+		case pdfRef:
+			if array, ok := doc.Resolve(existing).(pdfArray); ok {
+				contents = append(contents, array...)
+			} else {
+				contents = append(contents, existing)
+			}
+		case pdfArray:
+			contents = append(contents, existing...)
+		}
+		contents = append(contents, suffix)
+
+		box := pdfArray{pdfNumber(0), pdfNumber(0), pdfNumber(roundPoints(mediaWidth)), pdfNumber(roundPoints(mediaHeight))}
+
+		replacement := page.Copy()
+		replacement.Set("MediaBox", box)
+		replacement.Set("CropBox", box)
+		replacement.Set("Rotate", pdfNumber(finalRotate))
+		replacement.Set("Contents", contents)
+
+		for _, key := range []string{"BleedBox", "TrimBox", "ArtBox"} {
+			if _, ok := replacement.Get(key); ok {
+				replacement.Set(key, box)
+			}
+		}
+
+		update.Replace(number, replacement)
+		changed = true
+	}
+
+	if !changed {
+		return data, false, nil
+	}
+
+	return update.Bytes(), true, nil
+}
+
+func intersectRect(a [4]float64, b [4]float64) [4]float64 {
+	return [4]float64{
+		math.Max(a[0], b[0]),
+		math.Max(a[1], b[1]),
+		math.Min(a[2], b[2]),
+		math.Min(a[3], b[3]),
+	}
+}
+
+func roundPoints(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
@@ -0,0 +1,188 @@
+package companion
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseMediaSize(t *testing.T) {
+
+	tests := []struct {
+		value   string
+		want    MediaSize
+		wantErr bool
+	}{
+		{value: "4x6in", want: MediaSize{Width: 288, Height: 432}},
+		{value: "100x150mm", want: MediaSize{Width: 283.465, Height: 425.197}},
+		{value: "62mm", want: MediaSize{Width: 175.748}},
+		{value: "A6", want: MediaSize{Width: 297.64, Height: 419.53}},
+		{value: "10 x 15 cm", want: MediaSize{Width: 283.465, Height: 425.197}},
+		{value: "4x6", wantErr: true},
+		{value: "0x6in", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+
+			got, err := ParseMediaSize(test.value)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseMediaSize() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if math.Abs(got.Width-test.want.Width) > 0.001 || math.Abs(got.Height-test.want.Height) > 0.001 {
+				t.Errorf("ParseMediaSize() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalisePdf(t *testing.T) {
+
+	sample := readSamplePdf(t)
+	packed := packPdfObjects(t, sample)
+
+	tests := []struct {
+		name        string
+		size        string
+		wantChanged bool
+		wantBox     [4]float64
+		wantRotate  int
+	}{
+		{name: "shrinks on to a portrait label", size: "4x6in", wantChanged: true, wantBox: [4]float64{0, 0, 288, 432}},
+		{name: "rotates on to a landscape label", size: "6x4in", wantChanged: true, wantBox: [4]float64{0, 0, 288, 432}, wantRotate: 90},
+		{name: "scales the height for continuous media", size: "62mm", wantChanged: true, wantBox: [4]float64{0, 0, 175.748, 248.55}},
+		{name: "leaves pages that already match", size: "A4"},
+	}
+
+	for _, source := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "classic", data: sample},
+		{name: "object streams", data: packed},
+	} {
+		for _, test := range tests {
+			t.Run(source.name+"/"+test.name, func(t *testing.T) {
+
+				size, err := ParseMediaSize(test.size)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				output, changed, err := NormalisePdf(source.data, size)
+
+				if err != nil {
+					t.Fatalf("NormalisePdf() error = %v", err)
+				}
+
+				if changed != test.wantChanged {
+					t.Fatalf("NormalisePdf() changed = %v, want %v", changed, test.wantChanged)
+				}
+
+				if !changed {
+					return
+				}
+
+				checkNormalisedPdf(t, source.data, output, test.wantBox, test.wantRotate)
+
+				// Normalising the result again has nothing left to do
+				_, changed, err = NormalisePdf(output, size)
+
+				if err != nil || changed {
+					t.Errorf("NormalisePdf() of the output changed = %v, error = %v, want no change", changed, err)
+				}
+			})
+		}
+	}
+}
+
+// checkNormalisedPdf reads the update back through its own cross references, checking the page was
+// replaced and the original is still there untouched.
+func checkNormalisedPdf(t *testing.T, original []byte, output []byte, wantBox [4]float64, wantRotate int) {
+	t.Helper()
+
+	if string(output[:len(original)]) != string(original) {
+		t.Fatal("the update did not keep the original file intact")
+	}
+
+	before, err := parsePdf(original)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := parsePdf(output)
+
+	if err != nil {
+		t.Fatalf("parsePdf() of the output error = %v", err)
+	}
+
+	// Reading the update through the cross references rather than by scanning the file
+	if _, err := after.readXref(); err != nil {
+		t.Fatalf("the update's cross references can not be read: %v", err)
+	}
+
+	if after.xrefStream != before.xrefStream {
+		t.Errorf("update xrefStream = %v, want %v to match the original", after.xrefStream, before.xrefStream)
+	}
+
+	if prev, _ := after.trailer.values["Prev"].(pdfNumber); int(prev) != before.xref {
+		t.Errorf("update Prev = %v, want %d", prev, before.xref)
+	}
+
+	pages, err := after.Pages()
+
+	if err != nil || len(pages) != 1 {
+		t.Fatalf("Pages() = %v, %v, want 1 page", pages, err)
+	}
+
+	if entry := after.entries[pages[0]]; entry.compressed || entry.offset < len(original) {
+		t.Errorf("page entry = %+v, want it to point at the update", entry)
+	}
+
+	page := after.objects[pages[0]].(*pdfDict)
+
+	for _, key := range []string{"MediaBox", "CropBox"} {
+		box, ok := after.Rect(page.values[key])
+
+		if !ok || math.Abs(box[2]-wantBox[2]) > 0.001 || math.Abs(box[3]-wantBox[3]) > 0.001 || box[0] != 0 || box[1] != 0 {
+			t.Errorf("%s = %v, want %v", key, box, wantBox)
+		}
+	}
+
+	if rotate, _ := page.values["Rotate"].(pdfNumber); int(rotate) != wantRotate {
+		t.Errorf("Rotate = %v, want %d", rotate, wantRotate)
+	}
+
+	contents, ok := page.values["Contents"].(pdfArray)
+
+	if !ok || len(contents) != 3 {
+		t.Fatalf("Contents = %v, want the original wrapped in two streams", page.values["Contents"])
+	}
+
+	originalPage := before.objects[pages[0]].(*pdfDict)
+
+	if contents[1] != originalPage.values["Contents"] {
+		t.Errorf("Contents = %v, want the original %v in the middle", contents, originalPage.values["Contents"])
+	}
+
+	for _, item := range []interface{}{contents[0], contents[2]} {
+		ref, ok := item.(pdfRef)
+
+		if !ok {
+			t.Fatalf("Contents item %v is not a reference", item)
+		}
+
+		stream, err := after.streamAt(after.entries[ref.Number].offset)
+
+		if err != nil {
+			t.Fatalf("Contents stream %d can not be read: %v", ref.Number, err)
+		}
+
+		if item == contents[2] && string(stream.data) != "Q" {
+			t.Errorf("last Contents stream = %q, want Q", stream.data)
+		}
+	}
+}
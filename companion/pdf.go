@@ -0,0 +1,700 @@
+package companion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+A deliberately small PDF reader/writer. It only understands enough of the format to
+find the page objects, including those packed into object streams, read their boxes
+and append an incremental update that replaces them. Anything it cannot understand is
+reported as ErrUnsupportedPdf so the caller can fall back to printing the original file.
+*/
+
+var ErrUnsupportedPdf = errors.New("pdf structure is not supported for normalisation")
+
+var pdfObjectHeaderPattern = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+var pdfStartXrefPattern = regexp.MustCompile(`startxref\s+(\d+)`)
+
+type pdfName string
+
+type pdfRef struct {
+	Number     int
+	Generation int
+}
+
+type pdfNumber float64
+
+// pdfRaw holds values that are passed through untouched (strings, booleans, null).
+type pdfRaw string
+
+type pdfArray []interface{}
+
+type pdfDict struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newPdfDict() *pdfDict {
+	return &pdfDict{values: make(map[string]interface{})}
+}
+
+func (dict *pdfDict) Get(key string) (interface{}, bool) {
+	value, ok := dict.values[key]
+	return value, ok
+}
+
+func (dict *pdfDict) Set(key string, value interface{}) {
+	if _, ok := dict.values[key]; !ok {
+		dict.keys = append(dict.keys, key)
+	}
+	dict.values[key] = value
+}
+
+func (dict *pdfDict) Copy() *pdfDict {
+	copied := newPdfDict()
+	for _, key := range dict.keys {
+		copied.Set(key, dict.values[key])
+	}
+	return copied
+}
+
+type pdfDocument struct {
+	data    []byte
+	objects map[int]interface{}
+	entries map[int]pdfXrefEntry
+	trailer *pdfDict
+	xref    int
+	// xrefStream is set when the newest cross reference section is a stream, updates must then use one too
+	xrefStream bool
+}
+
+func parsePdf(data []byte) (*pdfDocument, error) {
+
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil, errors.New("file is not a pdf")
+	}
+
+	doc := &pdfDocument{
+		data:    data,
+		objects: make(map[int]interface{}),
+	}
+
+	offsets := make(map[int]int)
+
+	// Later definitions win, which matches how incremental updates are applied
+	for _, match := range pdfObjectHeaderPattern.FindAllSubmatchIndex(data, -1) {
+
+		// Object headers always start a line, which avoids matches inside binary streams
+		if match[0] > 0 && data[match[0]-1] != '\n' && data[match[0]-1] != '\r' {
+			continue
+		}
+
+		number, _ := strconv.Atoi(string(data[match[2]:match[3]]))
+
+		parser := &pdfParser{data: data, position: match[1]}
+		value, err := parser.parseObject()
+
+		if err != nil {
+			continue
+		}
+
+		doc.objects[number] = value
+		offsets[number] = match[0]
+	}
+
+	startXrefMatches := pdfStartXrefPattern.FindAllSubmatch(data, -1)
+
+	if len(startXrefMatches) == 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	doc.xref, _ = strconv.Atoi(string(startXrefMatches[len(startXrefMatches)-1][1]))
+
+	trailer, err := doc.readXref()
+
+	if err == nil {
+		scanned := doc.objects
+		err = doc.loadXrefObjects()
+
+		if err != nil {
+			doc.objects = scanned
+		}
+	}
+
+	// Files with broken cross references are common enough, fall back to the objects found by scanning
+	if err != nil {
+		doc.expandObjectStreams(offsets)
+
+		trailer, err = doc.findTrailer()
+
+		if err != nil {
+			trailer, err = doc.scanTrailer(offsets)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, encrypted := trailer.Get("Encrypt"); encrypted {
+		return nil, ErrUnsupportedPdf
+	}
+
+	doc.trailer = trailer
+
+	return doc, nil
+}
+
+func (doc *pdfDocument) findTrailer() (*pdfDict, error) {
+
+	if doc.xref <= 0 || doc.xref >= len(doc.data) {
+		return nil, ErrUnsupportedPdf
+	}
+
+	doc.xrefStream = !bytes.HasPrefix(doc.data[doc.xref:], []byte("xref"))
+
+	// Classic cross reference tables are followed by a trailer dictionary
+	if !doc.xrefStream {
+		index := bytes.Index(doc.data[doc.xref:], []byte("trailer"))
+
+		if index < 0 {
+			return nil, ErrUnsupportedPdf
+		}
+
+		parser := &pdfParser{data: doc.data, position: doc.xref + index + len("trailer")}
+		value, err := parser.parseObject()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if trailer, ok := value.(*pdfDict); ok {
+			return trailer, nil
+		}
+
+		return nil, ErrUnsupportedPdf
+	}
+
+	// Cross reference streams carry the trailer keys in their own dictionary
+	match := pdfObjectHeaderPattern.FindSubmatchIndex(doc.data[doc.xref:])
+
+	if match == nil || match[0] != 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	number, _ := strconv.Atoi(string(doc.data[doc.xref+match[2] : doc.xref+match[3]]))
+
+	if trailer, ok := doc.objects[number].(*pdfDict); ok {
+		return trailer, nil
+	}
+
+	return nil, ErrUnsupportedPdf
+}
+
+// scanTrailer finds the last trailer in the file when startxref doesn't point at one, which is either
+// a classic trailer dictionary or the last cross reference stream.
+func (doc *pdfDocument) scanTrailer(offsets map[int]int) (*pdfDict, error) {
+
+	trailerAt := bytes.LastIndex(doc.data, []byte("trailer"))
+	streamAt, stream := -1, 0
+
+	for number, offset := range offsets {
+		dict, ok := doc.objects[number].(*pdfDict)
+
+		if !ok {
+			continue
+		}
+
+		if kind, _ := dict.values["Type"].(pdfName); kind == "XRef" && offset > streamAt {
+			streamAt, stream = offset, number
+		}
+	}
+
+	if streamAt > trailerAt {
+		doc.xref = streamAt
+		doc.xrefStream = true
+		return doc.objects[stream].(*pdfDict), nil
+	}
+
+	if trailerAt < 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	parser := &pdfParser{data: doc.data, position: trailerAt + len("trailer")}
+	value, err := parser.parseObject()
+
+	if err != nil {
+		return nil, err
+	}
+
+	trailer, ok := value.(*pdfDict)
+
+	if !ok {
+		return nil, ErrUnsupportedPdf
+	}
+
+	// Point the update back at the table this trailer belongs to
+	if table := bytes.LastIndex(doc.data[:trailerAt], []byte("xref")); table >= 0 {
+		doc.xref = table
+	}
+
+	doc.xrefStream = false
+
+	return trailer, nil
+}
+
+// Resolve follows indirect references until a direct value is found.
+func (doc *pdfDocument) Resolve(value interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		value = doc.objects[ref.Number]
+	}
+	return nil
+}
+
+// Pages returns the object numbers of every page object in the file, in order.
+func (doc *pdfDocument) Pages() ([]int, error) {
+
+	root, ok := doc.Resolve(doc.trailer.values["Root"]).(*pdfDict)
+
+	if !ok {
+		return nil, ErrUnsupportedPdf
+	}
+
+	pagesRef, ok := root.values["Pages"].(pdfRef)
+
+	if !ok {
+		return nil, ErrUnsupportedPdf
+	}
+
+	pages := make([]int, 0)
+	err := doc.collectPages(pagesRef, &pages, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pages) == 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	return pages, nil
+}
+
+func (doc *pdfDocument) collectPages(ref pdfRef, pages *[]int, depth int) error {
+
+	if depth > 64 {
+		return ErrUnsupportedPdf
+	}
+
+	node, ok := doc.objects[ref.Number].(*pdfDict)
+
+	if !ok {
+		return ErrUnsupportedPdf
+	}
+
+	if nodeType, _ := node.values["Type"].(pdfName); nodeType == "Page" {
+		*pages = append(*pages, ref.Number)
+		return nil
+	}
+
+	kids, ok := doc.Resolve(node.values["Kids"]).(pdfArray)
+
+	if !ok {
+		return ErrUnsupportedPdf
+	}
+
+	for _, kid := range kids {
+		kidRef, ok := kid.(pdfRef)
+
+		if !ok {
+			return ErrUnsupportedPdf
+		}
+
+		err := doc.collectPages(kidRef, pages, depth+1)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Inherited looks up a page attribute, walking up the page tree when it is not set directly.
+func (doc *pdfDocument) Inherited(page *pdfDict, key string) interface{} {
+	node := page
+	for i := 0; i < 64 && node != nil; i++ {
+		if value, ok := node.values[key]; ok {
+			return doc.Resolve(value)
+		}
+		node, _ = doc.Resolve(node.values["Parent"]).(*pdfDict)
+	}
+	return nil
+}
+
+// Rect reads a box array in to its four coordinates.
+func (doc *pdfDocument) Rect(value interface{}) ([4]float64, bool) {
+	var rect [4]float64
+
+	array, ok := doc.Resolve(value).(pdfArray)
+
+	if !ok || len(array) != 4 {
+		return rect, false
+	}
+
+	for i, item := range array {
+		number, ok := doc.Resolve(item).(pdfNumber)
+		if !ok {
+			return rect, false
+		}
+		rect[i] = float64(number)
+	}
+
+	// Normalise so the first corner is always the lower left
+	if rect[0] > rect[2] {
+		rect[0], rect[2] = rect[2], rect[0]
+	}
+	if rect[1] > rect[3] {
+		rect[1], rect[3] = rect[3], rect[1]
+	}
+
+	return rect, true
+}
+
+// pdfUpdate collects objects to be written as an incremental update.
+type pdfUpdate struct {
+	doc     *pdfDocument
+	objects map[int][]byte
+	size    int
+}
+
+func (doc *pdfDocument) NewUpdate() *pdfUpdate {
+	size := 0
+	if value, ok := doc.trailer.values["Size"].(pdfNumber); ok {
+		size = int(value)
+	}
+	for number := range doc.objects {
+		if number >= size {
+			size = number + 1
+		}
+	}
+	return &pdfUpdate{doc: doc, objects: make(map[int][]byte), size: size}
+}
+
+func (update *pdfUpdate) Replace(number int, value interface{}) {
+	update.objects[number] = []byte(formatPdfValue(value))
+}
+
+func (update *pdfUpdate) AddStream(content string) pdfRef {
+	number := update.size
+	update.size++
+
+	update.objects[number] = []byte(fmt.Sprintf("<</Length %d>>\nstream\n%s\nendstream", len(content), content))
+
+	return pdfRef{Number: number}
+}
+
+// Bytes returns the original document with the update appended to it.
+func (update *pdfUpdate) Bytes() []byte {
+
+	var buffer bytes.Buffer
+	buffer.Write(update.doc.data)
+
+	if !bytes.HasSuffix(update.doc.data, []byte("\n")) {
+		buffer.WriteString("\n")
+	}
+
+	numbers := make([]int, 0, len(update.objects))
+	for number := range update.objects {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	offsets := make(map[int]int)
+	for _, number := range numbers {
+		offsets[number] = buffer.Len()
+		buffer.WriteString(fmt.Sprintf("%d 0 obj\n", number))
+		buffer.Write(update.objects[number])
+		buffer.WriteString("\nendobj\n")
+	}
+
+	if update.doc.xrefStream {
+		update.writeXrefStream(&buffer, numbers, offsets)
+		return buffer.Bytes()
+	}
+
+	xrefOffset := buffer.Len()
+	buffer.WriteString("xref\n")
+
+	// One subsection per run of consecutive object numbers
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		buffer.WriteString(fmt.Sprintf("%d %d\n", numbers[i], j-i+1))
+		for _, number := range numbers[i : j+1] {
+			buffer.WriteString(fmt.Sprintf("%010d 00000 n \n", offsets[number]))
+		}
+		i = j + 1
+	}
+
+	buffer.WriteString("trailer\n")
+	buffer.WriteString(formatPdfValue(update.trailer()))
+	buffer.WriteString(fmt.Sprintf("\nstartxref\n%d\n%%%%EOF\n", xrefOffset))
+
+	return buffer.Bytes()
+}
+
+// trailer carries over the document's trailer keys, pointing back at its cross references.
+func (update *pdfUpdate) trailer() *pdfDict {
+
+	trailer := newPdfDict()
+	trailer.Set("Size", pdfNumber(update.size))
+	trailer.Set("Root", update.doc.trailer.values["Root"])
+	if info, ok := update.doc.trailer.Get("Info"); ok {
+		trailer.Set("Info", info)
+	}
+	if id, ok := update.doc.trailer.Get("ID"); ok {
+		trailer.Set("ID", id)
+	}
+	trailer.Set("Prev", pdfNumber(update.doc.xref))
+
+	return trailer
+}
+
+// writeXrefStream ends the update with an uncompressed cross reference stream, as a classic table
+// can't follow a cross reference stream. The stream lists itself along with the updated objects.
+func (update *pdfUpdate) writeXrefStream(buffer *bytes.Buffer, numbers []int, offsets map[int]int) {
+
+	self := update.size
+	update.size++
+
+	offsets[self] = buffer.Len()
+	numbers = append(numbers, self)
+
+	index := make(pdfArray, 0)
+	var rows bytes.Buffer
+
+	// One subsection per run of consecutive object numbers
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		index = append(index, pdfNumber(numbers[i]), pdfNumber(j-i+1))
+		for _, number := range numbers[i : j+1] {
+			offset := offsets[number]
+			rows.Write([]byte{1, byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset), 0, 0})
+		}
+		i = j + 1
+	}
+
+	dict := update.trailer()
+	dict.Set("Type", pdfName("XRef"))
+	dict.Set("W", pdfArray{pdfNumber(1), pdfNumber(4), pdfNumber(2)})
+	dict.Set("Index", index)
+	dict.Set("Length", pdfNumber(rows.Len()))
+
+	buffer.WriteString(fmt.Sprintf("%d 0 obj\n", self))
+	buffer.WriteString(formatPdfValue(dict))
+	buffer.WriteString("\nstream\n")
+	buffer.Write(rows.Bytes())
+	buffer.WriteString("\nendstream\nendobj\n")
+	buffer.WriteString(fmt.Sprintf("startxref\n%d\n%%%%EOF\n", offsets[self]))
+}
+
+func formatPdfValue(value interface{}) string {
+	switch typed := value.(type) {
+	case pdfName:
+		return "/" + string(typed)
+	case pdfNumber:
+		return strconv.FormatFloat(float64(typed), 'f', -1, 64)
+	case pdfRef:
+		return fmt.Sprintf("%d %d R", typed.Number, typed.Generation)
+	case pdfRaw:
+		return string(typed)
+	case pdfArray:
+		items := make([]string, len(typed))
+		for i, item := range typed {
+			items[i] = formatPdfValue(item)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case *pdfDict:
+		var builder strings.Builder
+		builder.WriteString("<<")
+		for _, key := range typed.keys {
+			builder.WriteString("/" + key + " " + formatPdfValue(typed.values[key]))
+		}
+		builder.WriteString(">>")
+		return builder.String()
+	}
+	return "null"
+}
+
+type pdfParser struct {
+	data     []byte
+	position int
+}
+
+func isPdfWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (parser *pdfParser) skipWhitespace() {
+	for parser.position < len(parser.data) {
+		c := parser.data[parser.position]
+		if c == '%' {
+			for parser.position < len(parser.data) && parser.data[parser.position] != '\n' && parser.data[parser.position] != '\r' {
+				parser.position++
+			}
+			continue
+		}
+		if !isPdfWhitespace(c) {
+			return
+		}
+		parser.position++
+	}
+}
+
+func (parser *pdfParser) readToken() string {
+	start := parser.position
+	for parser.position < len(parser.data) {
+		c := parser.data[parser.position]
+		if isPdfWhitespace(c) || isPdfDelimiter(c) {
+			break
+		}
+		parser.position++
+	}
+	return string(parser.data[start:parser.position])
+}
+
+func (parser *pdfParser) parseObject() (interface{}, error) {
+
+	parser.skipWhitespace()
+
+	if parser.position >= len(parser.data) {
+		return nil, ErrUnsupportedPdf
+	}
+
+	c := parser.data[parser.position]
+
+	switch {
+	case c == '/':
+		parser.position++
+		return pdfName(parser.readToken()), nil
+	case c == '[':
+		parser.position++
+		array := make(pdfArray, 0)
+		for {
+			parser.skipWhitespace()
+			if parser.position >= len(parser.data) {
+				return nil, ErrUnsupportedPdf
+			}
+			if parser.data[parser.position] == ']' {
+				parser.position++
+				return array, nil
+			}
+			item, err := parser.parseObject()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, item)
+		}
+	case c == '<' && parser.position+1 < len(parser.data) && parser.data[parser.position+1] == '<':
+		parser.position += 2
+		dict := newPdfDict()
+		for {
+			parser.skipWhitespace()
+			if parser.position+1 >= len(parser.data) {
+				return nil, ErrUnsupportedPdf
+			}
+			if parser.data[parser.position] == '>' && parser.data[parser.position+1] == '>' {
+				parser.position += 2
+				return dict, nil
+			}
+			key, err := parser.parseObject()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, ErrUnsupportedPdf
+			}
+			value, err := parser.parseObject()
+			if err != nil {
+				return nil, err
+			}
+			dict.Set(string(name), value)
+		}
+	case c == '<':
+		end := bytes.IndexByte(parser.data[parser.position:], '>')
+		if end < 0 {
+			return nil, ErrUnsupportedPdf
+		}
+		raw := pdfRaw(parser.data[parser.position : parser.position+end+1])
+		parser.position += end + 1
+		return raw, nil
+	case c == '(':
+		start := parser.position
+		depth := 0
+		for parser.position < len(parser.data) {
+			switch parser.data[parser.position] {
+			case '\\':
+				parser.position++
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			parser.position++
+			if depth == 0 {
+				return pdfRaw(parser.data[start:parser.position]), nil
+			}
+		}
+		return nil, ErrUnsupportedPdf
+	}
+
+	token := parser.readToken()
+
+	if token == "" {
+		return nil, ErrUnsupportedPdf
+	}
+
+	number, err := strconv.ParseFloat(token, 64)
+
+	if err != nil {
+		// true, false, null and anything else we do not need to interpret
+		return pdfRaw(token), nil
+	}
+
+	// Look ahead for an indirect reference: "<number> <generation> R"
+	if !strings.ContainsAny(token, ".-+") {
+		saved := parser.position
+		parser.skipWhitespace()
+		generation := parser.readToken()
+		parser.skipWhitespace()
+		if _, err := strconv.Atoi(generation); err == nil && parser.readToken() == "R" {
+			generationNumber, _ := strconv.Atoi(generation)
+			return pdfRef{Number: int(number), Generation: generationNumber}, nil
+		}
+		parser.position = saved
+	}
+
+	return pdfNumber(number), nil
+}
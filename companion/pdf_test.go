@@ -0,0 +1,243 @@
+package companion
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func readSamplePdf(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile("../resources/sample.pdf")
+
+	if err != nil {
+		t.Fatalf("failed to read the sample pdf: %v", err)
+	}
+
+	return data
+}
+
+// packPdfObjects rewrites a classic PDF the way PDF 1.5 writers do, with every object that isn't a
+// stream packed into a compressed object stream and a cross reference stream using the PNG Up predictor.
+func packPdfObjects(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	doc, err := parsePdf(data)
+
+	if err != nil {
+		t.Fatalf("failed to parse the pdf to pack: %v", err)
+	}
+
+	numbers := make([]int, 0, len(doc.entries))
+	for number, entry := range doc.entries {
+		if !entry.free {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+
+	size := numbers[len(numbers)-1] + 1
+	objStm, xrefStm := size, size+1
+
+	offsets := make(map[int]int)
+	packed := make(map[int]int)
+
+	var header, body bytes.Buffer
+
+	for _, number := range numbers {
+		raw := rawPdfObject(t, data, doc.entries[number].offset)
+
+		if strings.Contains(raw, "stream") {
+			offsets[number] = buffer.Len()
+			buffer.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", number, raw))
+			continue
+		}
+
+		packed[number] = len(packed)
+		header.WriteString(fmt.Sprintf("%d %d ", number, body.Len()))
+		body.WriteString(raw + "\n")
+	}
+
+	compressed := deflate(t, append(header.Bytes(), body.Bytes()...))
+
+	offsets[objStm] = buffer.Len()
+	buffer.WriteString(fmt.Sprintf("%d 0 obj\n<</Type/ObjStm/N %d/First %d/Filter/FlateDecode/Length %d>>\nstream\n", objStm, len(packed), header.Len(), len(compressed)))
+	buffer.Write(compressed)
+	buffer.WriteString("\nendstream\nendobj\n")
+
+	offsets[xrefStm] = buffer.Len()
+
+	var rows bytes.Buffer
+	previous := make([]byte, 7)
+
+	for number := 0; number < size+2; number++ {
+		row := make([]byte, 7)
+
+		if index, ok := packed[number]; ok {
+			row = []byte{2, byte(objStm >> 24), byte(objStm >> 16), byte(objStm >> 8), byte(objStm), byte(index >> 8), byte(index)}
+		} else if offset, ok := offsets[number]; ok {
+			row = []byte{1, byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset), 0, 0}
+		}
+
+		rows.WriteByte(2)
+		for i := range row {
+			rows.WriteByte(row[i] - previous[i])
+		}
+		previous = row
+	}
+
+	compressed = deflate(t, rows.Bytes())
+
+	buffer.WriteString(fmt.Sprintf("%d 0 obj\n<</Type/XRef/Size %d/W[1 4 2]/Root %s/Info %s/ID %s/Filter/FlateDecode/DecodeParms<</Columns 7/Predictor 12>>/Length %d>>\nstream\n",
+		xrefStm, size+2, formatPdfValue(doc.trailer.values["Root"]), formatPdfValue(doc.trailer.values["Info"]), formatPdfValue(doc.trailer.values["ID"]), len(compressed)))
+	buffer.Write(compressed)
+	buffer.WriteString(fmt.Sprintf("\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", offsets[xrefStm]))
+
+	return buffer.Bytes()
+}
+
+// rawPdfObject is the text of the object at the offset, between its header and endobj.
+func rawPdfObject(t *testing.T, data []byte, offset int) string {
+	t.Helper()
+
+	start := bytes.Index(data[offset:], []byte("obj")) + offset + len("obj")
+	end := bytes.Index(data[start:], []byte("endobj"))
+
+	if end < 0 {
+		t.Fatalf("object at %d has no end", offset)
+	}
+
+	return strings.TrimSpace(string(data[start : start+end]))
+}
+
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestParsePdf(t *testing.T) {
+
+	sample := readSamplePdf(t)
+
+	packed := packPdfObjects(t, sample)
+
+	// Point startxref at the wrong place, the objects have to be found by scanning the file
+	broken := bytes.Replace(packed, []byte("startxref\n"), []byte("startxref\n1"), 1)
+
+	tests := []struct {
+		name           string
+		data           []byte
+		xrefStream     bool
+		compressedPage bool
+	}{
+		{name: "classic cross reference table", data: sample},
+		{name: "object & cross reference streams", data: packed, xrefStream: true, compressedPage: true},
+		{name: "broken cross references", data: broken, xrefStream: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			doc, err := parsePdf(test.data)
+
+			if err != nil {
+				t.Fatalf("parsePdf() error = %v", err)
+			}
+
+			if doc.xrefStream != test.xrefStream {
+				t.Errorf("xrefStream = %v, want %v", doc.xrefStream, test.xrefStream)
+			}
+
+			pages, err := doc.Pages()
+
+			if err != nil {
+				t.Fatalf("Pages() error = %v", err)
+			}
+
+			if len(pages) != 1 {
+				t.Fatalf("Pages() = %v, want 1 page", pages)
+			}
+
+			if entry := doc.entries[pages[0]]; entry.compressed != test.compressedPage {
+				t.Errorf("page entry = %+v, want compressed %v", entry, test.compressedPage)
+			}
+
+			page := doc.objects[pages[0]].(*pdfDict)
+			box, ok := doc.Rect(doc.Inherited(page, "MediaBox"))
+
+			if !ok || box != [4]float64{0, 0, 595.275590551181, 841.861417322835} {
+				t.Errorf("MediaBox = %v, want the A4 box of the sample", box)
+			}
+		})
+	}
+}
+
+func TestParsePdfRejects(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not a pdf", data: "hello"},
+		{name: "no startxref", data: "%PDF-1.4\n1 0 obj\n<</Type/Catalog>>\nendobj\n"},
+		{name: "encrypted", data: "%PDF-1.4\n1 0 obj\n<</Type/Catalog>>\nendobj\nxref\n0 2\n0000000000 65535 f \n0000000009 00000 n \ntrailer\n<</Size 2/Root 1 0 R/Encrypt<</Filter/Standard>>>>\nstartxref\n45\n%%EOF\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parsePdf([]byte(test.data)); err == nil {
+				t.Error("parsePdf() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestUnpredictPng(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{name: "none", data: []byte{0, 1, 2, 0, 3, 4}, want: []byte{1, 2, 3, 4}},
+		{name: "sub", data: []byte{1, 1, 1, 1, 5, 1}, want: []byte{1, 2, 5, 6}},
+		{name: "up", data: []byte{2, 1, 2, 2, 1, 1}, want: []byte{1, 2, 2, 3}},
+		{name: "average", data: []byte{3, 2, 2, 3, 1, 1}, want: []byte{2, 3, 2, 3}},
+		{name: "paeth", data: []byte{4, 1, 1, 4, 1, 1}, want: []byte{1, 2, 2, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := unpredictPng(test.data, 2, 1, 8)
+
+			if err != nil {
+				t.Fatalf("unpredictPng() error = %v", err)
+			}
+
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("unpredictPng() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
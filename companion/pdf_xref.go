@@ -0,0 +1,633 @@
+package companion
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"strconv"
+)
+
+/**
+Reading of the cross reference sections, both classic tables and the cross reference
+streams PDF 1.5 added, so objects packed into object streams can be found too.
+*/
+
+// pdfXrefEntry is where an object is stored, either at an offset in the file or as the
+// index'th object of an object stream.
+type pdfXrefEntry struct {
+	free       bool
+	offset     int
+	compressed bool
+	stream     int
+	index      int
+}
+
+// pdfStream is a stream object's dictionary with its data still encoded.
+type pdfStream struct {
+	dict *pdfDict
+	data []byte
+}
+
+// readXref follows the chain of cross reference sections from the newest, returning the
+// newest trailer. Entries in newer sections hide those in older ones.
+func (doc *pdfDocument) readXref() (*pdfDict, error) {
+
+	var newest *pdfDict
+
+	doc.entries = make(map[int]pdfXrefEntry)
+	visited := make(map[int]bool)
+	offsets := []int{doc.xref}
+
+	for len(offsets) > 0 {
+		offset := offsets[0]
+		offsets = offsets[1:]
+
+		if visited[offset] {
+			continue
+		}
+
+		visited[offset] = true
+
+		trailer, isStream, err := doc.readXrefSection(offset)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if newest == nil {
+			newest = trailer
+			doc.xrefStream = isStream
+		}
+
+		// Hybrid files keep the compressed objects in a stream alongside the classic table
+		if stm, ok := trailer.values["XRefStm"].(pdfNumber); ok {
+			offsets = append([]int{int(stm)}, offsets...)
+		}
+
+		if prev, ok := trailer.values["Prev"].(pdfNumber); ok {
+			offsets = append(offsets, int(prev))
+		}
+	}
+
+	return newest, nil
+}
+
+func (doc *pdfDocument) readXrefSection(offset int) (*pdfDict, bool, error) {
+
+	if offset <= 0 || offset >= len(doc.data) {
+		return nil, false, ErrUnsupportedPdf
+	}
+
+	if bytes.HasPrefix(doc.data[offset:], []byte("xref")) {
+		trailer, err := doc.readXrefTable(offset + len("xref"))
+		return trailer, false, err
+	}
+
+	trailer, err := doc.readXrefStream(offset)
+	return trailer, true, err
+}
+
+// readXrefTable reads the subsections of a classic table up to its trailer.
+func (doc *pdfDocument) readXrefTable(position int) (*pdfDict, error) {
+
+	parser := &pdfParser{data: doc.data, position: position}
+
+	for {
+		parser.skipWhitespace()
+		token := parser.readToken()
+
+		if token == "trailer" {
+			break
+		}
+
+		start, err := strconv.Atoi(token)
+
+		if err != nil {
+			return nil, ErrUnsupportedPdf
+		}
+
+		parser.skipWhitespace()
+		count, err := strconv.Atoi(parser.readToken())
+
+		if err != nil {
+			return nil, ErrUnsupportedPdf
+		}
+
+		for i := 0; i < count; i++ {
+			parser.skipWhitespace()
+			entryOffset, err := strconv.Atoi(parser.readToken())
+
+			if err != nil {
+				return nil, ErrUnsupportedPdf
+			}
+
+			parser.skipWhitespace()
+			parser.readToken()
+			parser.skipWhitespace()
+			kind := parser.readToken()
+
+			doc.addXrefEntry(start+i, pdfXrefEntry{free: kind != "n", offset: entryOffset})
+		}
+	}
+
+	value, err := parser.parseObject()
+
+	if err != nil {
+		return nil, err
+	}
+
+	trailer, ok := value.(*pdfDict)
+
+	if !ok {
+		return nil, ErrUnsupportedPdf
+	}
+
+	return trailer, nil
+}
+
+// readXrefStream reads the binary entries of a cross reference stream, whose dictionary is the trailer.
+func (doc *pdfDocument) readXrefStream(offset int) (*pdfDict, error) {
+
+	stream, err := doc.streamAt(offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kind, _ := stream.dict.values["Type"].(pdfName); kind != "XRef" {
+		return nil, ErrUnsupportedPdf
+	}
+
+	data, err := stream.decode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	widths, ok := stream.dict.values["W"].(pdfArray)
+
+	if !ok || len(widths) != 3 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	var w [3]int
+	for i, width := range widths {
+		number, ok := width.(pdfNumber)
+		if !ok || number < 0 || number > 8 {
+			return nil, ErrUnsupportedPdf
+		}
+		w[i] = int(number)
+	}
+
+	size, _ := stream.dict.values["Size"].(pdfNumber)
+	index := pdfArray{pdfNumber(0), size}
+
+	if value, ok := stream.dict.values["Index"].(pdfArray); ok {
+		index = value
+	}
+
+	rowLength := w[0] + w[1] + w[2]
+
+	if rowLength == 0 || len(index)%2 != 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	position := 0
+
+	for i := 0; i < len(index); i += 2 {
+		start, ok1 := index[i].(pdfNumber)
+		count, ok2 := index[i+1].(pdfNumber)
+
+		if !ok1 || !ok2 {
+			return nil, ErrUnsupportedPdf
+		}
+
+		for j := 0; j < int(count); j++ {
+			if position+rowLength > len(data) {
+				return nil, ErrUnsupportedPdf
+			}
+
+			row := data[position : position+rowLength]
+			position += rowLength
+
+			// The type defaults to 1 when it has no width
+			kind := 1
+			if w[0] > 0 {
+				kind = readXrefField(row[:w[0]])
+			}
+
+			field2 := readXrefField(row[w[0] : w[0]+w[1]])
+			field3 := readXrefField(row[w[0]+w[1]:])
+
+			var entry pdfXrefEntry
+
+			switch kind {
+			case 0:
+				entry = pdfXrefEntry{free: true}
+			case 1:
+				entry = pdfXrefEntry{offset: field2}
+			case 2:
+				entry = pdfXrefEntry{compressed: true, stream: field2, index: field3}
+			default:
+				// Unknown types are to be treated as references to the null object
+				entry = pdfXrefEntry{free: true}
+			}
+
+			doc.addXrefEntry(int(start)+j, entry)
+		}
+	}
+
+	return stream.dict, nil
+}
+
+func readXrefField(field []byte) int {
+	value := 0
+	for _, b := range field {
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+// addXrefEntry keeps the first entry seen for an object, which is the newest.
+func (doc *pdfDocument) addXrefEntry(number int, entry pdfXrefEntry) {
+	if _, ok := doc.entries[number]; !ok {
+		doc.entries[number] = entry
+	}
+}
+
+// loadXrefObjects reads every object the cross reference sections point at. Objects stored
+// directly are loaded first, so the lengths of object streams can be looked up.
+func (doc *pdfDocument) loadXrefObjects() error {
+
+	objects := make(map[int]interface{})
+
+	for number, entry := range doc.entries {
+		if entry.free || entry.compressed {
+			continue
+		}
+
+		value, err := doc.objectAt(entry.offset, number)
+
+		if err != nil {
+			return err
+		}
+
+		objects[number] = value
+	}
+
+	doc.objects = objects
+
+	streams := make(map[int][]interface{})
+
+	for number, entry := range doc.entries {
+		if entry.free || !entry.compressed {
+			continue
+		}
+
+		contained, ok := streams[entry.stream]
+
+		if !ok {
+			streamEntry, found := doc.entries[entry.stream]
+
+			if !found || streamEntry.free || streamEntry.compressed {
+				return ErrUnsupportedPdf
+			}
+
+			var err error
+			contained, err = doc.objectStream(streamEntry.offset)
+
+			if err != nil {
+				return err
+			}
+
+			streams[entry.stream] = contained
+		}
+
+		if entry.index >= len(contained) {
+			return ErrUnsupportedPdf
+		}
+
+		objects[number] = contained[entry.index]
+	}
+
+	return nil
+}
+
+// expandObjectStreams adds the objects packed in any object streams found by scanning the file,
+// for when the cross reference sections can't be read. Objects stored directly take precedence.
+func (doc *pdfDocument) expandObjectStreams(offsets map[int]int) {
+
+	for number, offset := range offsets {
+		dict, ok := doc.objects[number].(*pdfDict)
+
+		if !ok {
+			continue
+		}
+
+		if kind, _ := dict.values["Type"].(pdfName); kind != "ObjStm" {
+			continue
+		}
+
+		stream, err := doc.streamAt(offset)
+
+		if err != nil {
+			continue
+		}
+
+		numbers, contained, err := doc.parseObjectStream(stream)
+
+		if err != nil {
+			continue
+		}
+
+		for i, contained := range contained {
+			if _, defined := doc.objects[numbers[i]]; !defined {
+				doc.objects[numbers[i]] = contained
+			}
+		}
+	}
+}
+
+// objectAt parses the object whose header is at the offset, checking it is the object expected.
+func (doc *pdfDocument) objectAt(offset int, number int) (interface{}, error) {
+
+	if offset <= 0 || offset >= len(doc.data) {
+		return nil, ErrUnsupportedPdf
+	}
+
+	match := pdfObjectHeaderPattern.FindSubmatchIndex(doc.data[offset:])
+
+	if match == nil || match[0] != 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	if found, _ := strconv.Atoi(string(doc.data[offset+match[2] : offset+match[3]])); found != number {
+		return nil, ErrUnsupportedPdf
+	}
+
+	parser := &pdfParser{data: doc.data, position: offset + match[1]}
+
+	return parser.parseObject()
+}
+
+// objectStream reads the objects packed into the object stream at the offset, in order.
+func (doc *pdfDocument) objectStream(offset int) ([]interface{}, error) {
+
+	stream, err := doc.streamAt(offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kind, _ := stream.dict.values["Type"].(pdfName); kind != "ObjStm" {
+		return nil, ErrUnsupportedPdf
+	}
+
+	_, objects, err := doc.parseObjectStream(stream)
+
+	return objects, err
+}
+
+// parseObjectStream reads the header of object numbers & offsets, then each object after /First.
+func (doc *pdfDocument) parseObjectStream(stream *pdfStream) ([]int, []interface{}, error) {
+
+	data, err := stream.decode()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, ok1 := stream.dict.values["N"].(pdfNumber)
+	first, ok2 := stream.dict.values["First"].(pdfNumber)
+
+	if !ok1 || !ok2 || int(first) > len(data) {
+		return nil, nil, ErrUnsupportedPdf
+	}
+
+	header := &pdfParser{data: data[:int(first)]}
+	numbers := make([]int, int(count))
+	objects := make([]interface{}, int(count))
+
+	for i := 0; i < int(count); i++ {
+		header.skipWhitespace()
+		number, err1 := strconv.Atoi(header.readToken())
+		header.skipWhitespace()
+		offset, err2 := strconv.Atoi(header.readToken())
+
+		if err1 != nil || err2 != nil || int(first)+offset >= len(data) {
+			return nil, nil, ErrUnsupportedPdf
+		}
+
+		parser := &pdfParser{data: data, position: int(first) + offset}
+		value, err := parser.parseObject()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		numbers[i] = number
+		objects[i] = value
+	}
+
+	return numbers, objects, nil
+}
+
+// streamAt reads the stream object whose header is at the offset.
+func (doc *pdfDocument) streamAt(offset int) (*pdfStream, error) {
+
+	if offset <= 0 || offset >= len(doc.data) {
+		return nil, ErrUnsupportedPdf
+	}
+
+	match := pdfObjectHeaderPattern.FindSubmatchIndex(doc.data[offset:])
+
+	if match == nil || match[0] != 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	parser := &pdfParser{data: doc.data, position: offset + match[1]}
+	value, err := parser.parseObject()
+
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := value.(*pdfDict)
+
+	if !ok {
+		return nil, ErrUnsupportedPdf
+	}
+
+	parser.skipWhitespace()
+
+	if parser.readToken() != "stream" {
+		return nil, ErrUnsupportedPdf
+	}
+
+	// The data starts after the end of line following the keyword
+	start := parser.position
+	if start < len(doc.data) && doc.data[start] == '\r' {
+		start++
+	}
+	if start < len(doc.data) && doc.data[start] == '\n' {
+		start++
+	}
+
+	end := -1
+
+	if length, ok := doc.Resolve(dict.values["Length"]).(pdfNumber); ok && start+int(length) <= len(doc.data) {
+		end = start + int(length)
+	} else if index := bytes.Index(doc.data[start:], []byte("endstream")); index >= 0 {
+		end = start + index
+	}
+
+	if end < 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	return &pdfStream{dict: dict, data: doc.data[start:end]}, nil
+}
+
+// decode undoes the stream's filter. Only Flate, with or without PNG predictors, is understood.
+func (stream *pdfStream) decode() ([]byte, error) {
+
+	filter := stream.dict.values["Filter"]
+	params, _ := stream.dict.values["DecodeParms"].(*pdfDict)
+
+	if filters, ok := filter.(pdfArray); ok {
+		if len(filters) > 1 {
+			return nil, ErrUnsupportedPdf
+		}
+		if len(filters) == 1 {
+			filter = filters[0]
+		} else {
+			filter = nil
+		}
+
+		if paramsArray, ok := stream.dict.values["DecodeParms"].(pdfArray); ok && len(paramsArray) == 1 {
+			params, _ = paramsArray[0].(*pdfDict)
+		}
+	}
+
+	if filter == nil {
+		return stream.data, nil
+	}
+
+	if name, _ := filter.(pdfName); name != "FlateDecode" {
+		return nil, ErrUnsupportedPdf
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(stream.data))
+
+	if err != nil {
+		return nil, ErrUnsupportedPdf
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+
+	// Plenty of writers leave off the checksum, what was read is still good
+	if err != nil && len(data) == 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	if params == nil {
+		return data, nil
+	}
+
+	predictor, _ := params.values["Predictor"].(pdfNumber)
+
+	if predictor <= 1 {
+		return data, nil
+	}
+
+	if predictor < 10 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	columns := 1
+	if value, ok := params.values["Columns"].(pdfNumber); ok {
+		columns = int(value)
+	}
+
+	colors := 1
+	if value, ok := params.values["Colors"].(pdfNumber); ok {
+		colors = int(value)
+	}
+
+	bits := 8
+	if value, ok := params.values["BitsPerComponent"].(pdfNumber); ok {
+		bits = int(value)
+	}
+
+	return unpredictPng(data, columns, colors, bits)
+}
+
+// unpredictPng reverses the PNG row filters, each row starts with the filter type used for it.
+func unpredictPng(data []byte, columns int, colors int, bits int) ([]byte, error) {
+
+	pixel := (colors*bits + 7) / 8
+	rowLength := (columns*colors*bits + 7) / 8
+
+	if rowLength <= 0 || pixel <= 0 {
+		return nil, ErrUnsupportedPdf
+	}
+
+	output := make([]byte, 0, len(data))
+	previous := make([]byte, rowLength)
+
+	for position := 0; position+rowLength+1 <= len(data); position += rowLength + 1 {
+		kind := data[position]
+		row := append([]byte{}, data[position+1:position+1+rowLength]...)
+
+		for i := range row {
+			var left, upLeft byte
+			if i >= pixel {
+				left = row[i-pixel]
+				upLeft = previous[i-pixel]
+			}
+			up := previous[i]
+
+			switch kind {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			default:
+				return nil, ErrUnsupportedPdf
+			}
+		}
+
+		output = append(output, row...)
+		previous = row
+	}
+
+	return output, nil
+}
+
+func paeth(a byte, b byte, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
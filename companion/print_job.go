@@ -3,55 +3,223 @@ package companion
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	PrintJobStatusQueued          = "queued"
+	PrintJobStatusDownloading     = "downloading"
+	PrintJobStatusPrinting        = "printing"
+	PrintJobStatusSpooled         = "spooled"
+	PrintJobStatusComplete        = "complete"
+	PrintJobStatusError           = "error"
+	PrintJobStatusCancelRequested = "cancel_requested"
+	PrintJobStatusCancelled       = "cancelled"
+)
+
+const (
+	ContentTypePdf  = "application/pdf"
+	ContentTypeZpl  = "application/zpl"
+	ContentTypePng  = "image/png"
+	ContentTypeJpeg = "image/jpeg"
+	ContentTypeGif  = "image/gif"
+)
+
+// Firestore documents are limited to 1MiB so inline content has to be comfortably smaller
+const MaxInlineContentSize = 700 * 1024
+
+// Print job documents with this action reprint a previous job from the spool cache
+const PrintJobActionReprint = "reprint"
+
+// How often the spooler is asked whether a spooled job has finished
+const SpooledJobPollInterval = time.Second * 2
+
+var ErrPrintJobCancelled = errors.New("print job was cancelled")
+
+// NewReprintJob creates a job that prints a file from the spool cache again.
+func NewReprintJob(id string, entry SpoolEntry, printer *PrinterReference, cache *SpoolCache) *PrintJob {
+	return &PrintJob{
+		Id:          id,
+		PrinterType: entry.PrinterType,
+		Quantity:    entry.Quantity,
+		Created:     time.Now(),
+		Url:         entry.Url,
+		ContentType: entry.ContentType,
+		SourceDpi:   entry.SourceDpi,
+		Options:     entry.Options,
+		Status:      PrintJobStatusQueued,
+		Printer:     printer,
+		cache:       cache,
+		cached:      &entry,
+	}
+}
+
+// NormaliseContentType maps the content types we accept on to the ones we handle, defaulting to pdf.
+func NormaliseContentType(contentType string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(contentType)) {
+	case "", "pdf", ContentTypePdf:
+		return ContentTypePdf, nil
+	case "zpl", ContentTypeZpl, "application/x-zpl", "text/zpl", "text/x-zpl":
+		return ContentTypeZpl, nil
+	case "png", ContentTypePng:
+		return ContentTypePng, nil
+	case "jpg", "jpeg", ContentTypeJpeg:
+		return ContentTypeJpeg, nil
+	case "gif", ContentTypeGif:
+		return ContentTypeGif, nil
+	}
+	return "", fmt.Errorf("unsupported content type %q", contentType)
+}
+
 type PrintJob struct {
+	Id                 string                 `json:"id" firestore:"id"`
 	PrinterType        PrinterType            `json:"printer_type" firestore:"printer_type"`
 	Quantity           int                    `json:"quantity" firestore:"quantity"`
 	Created            time.Time              `json:"created" firestore:"created"`
 	Url                string                 `json:"url" firestore:"url"`
+	ContentType        string                 `json:"content_type" firestore:"content_type"`
+	Content            string                 `json:"-" firestore:"-"`
+	Template           string                 `json:"template" firestore:"template"`
+	Reference          string                 `json:"reference" firestore:"reference"`
+	SourceDpi          int                    `json:"source_dpi" firestore:"source_dpi"`
+	Fields             map[string]interface{} `json:"-" firestore:"-"`
+	Options            PrintOptions           `json:"options" firestore:"options"`
+	Status             string                 `json:"status" firestore:"status"`
+	SpoolId            string                 `json:"spool_id" firestore:"spool_id"`
 	File               *os.File               `json:"-" firestore:"-"`
 	Printer            *PrinterReference      `json:"-" firestore:"-"`
 	FirestoreReference *firestore.DocumentRef `json:"-" firestore:"-"`
+	templateSource     string
+	cache              *SpoolCache
+	cached             *SpoolEntry
+	history            *History
+	user               string
+	bay                string
+	network            *Printer
+	etag               string
+	lastModified       string
+	message            string
+	ctx                context.Context
+	cancel             context.CancelFunc
+	mutex              sync.Mutex
 }
 
 func (job *PrintJob) Handle() {
 
 	startPrintRoutineTime := time.Now()
 
+	var downloadDuration, normaliseDuration, printDuration time.Duration
+
+	// Always record the outcome in the local history. The printer is released once
+	// the job completes so keep hold of its name.
+	var printerName string
+	if job.Printer != nil {
+		printerName = job.Printer.Reference
+	}
+
+	defer func() {
+		job.recordHistory(startPrintRoutineTime, printerName, downloadDuration, normaliseDuration, printDuration)
+	}()
+
+	job.mutex.Lock()
+	if job.ctx == nil {
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+	}
+	job.mutex.Unlock()
+
 	// Always clean up at the end
 	defer job.clean()
 
 	// Get the File
-	downloadDuration, err := job.downloadFile()
+	if !job.setStatus(PrintJobStatusDownloading) {
+		log.Info().Str("Job", job.Id).Msg("Print job was cancelled before it was downloaded")
+		return
+	}
+
+	var err error
+	if job.cached != nil {
+		downloadDuration, err = job.copyFromCache()
+	} else if job.Template != "" {
+		downloadDuration, err = job.renderTemplate()
+	} else if job.Content != "" {
+		downloadDuration, err = job.writeContent()
+	} else {
+		downloadDuration, err = job.downloadFile()
+	}
+
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to download file")
+		if job.ctx.Err() != nil {
+			log.Info().Str("Job", job.Id).Msg("Print job was cancelled while downloading")
+			return
+		}
+
+		job.fail(err, "Failed to download file")
+		return
+	}
+
+	// Keep a copy so the job can be reprinted later
+	if job.cached == nil && job.cache != nil {
+		job.storeInCache()
+	}
+
+	// Fit the pages to the label size configured for the printer
+	if job.ContentType == ContentTypePdf {
+		normaliseDuration, err = job.normalise()
+	} else if job.isImage() {
+		normaliseDuration, err = job.convertImage()
+	}
+	if errors.Is(err, ErrUnsupportedPdf) {
+		log.Warn().Err(err).Msg("Could not normalise the pdf, printing the original file")
+	} else if err != nil {
+		job.fail(err, "Failed to normalise file")
 		return
 	}
 
 	// Print the File
-	printDuration, err := job.print()
+	printDuration, err = job.print()
+	if errors.Is(err, ErrPrintJobCancelled) {
+		log.Info().Str("Job", job.Id).Msg("Print job was cancelled before it was sent to the printer")
+		return
+	}
+
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to print file")
+		job.fail(err, "Failed to print file")
 		return
 	}
 
-	log.Debug().Dur("Download (ms)", downloadDuration).Dur("Print (ms)", printDuration).Dur("Total Time Taken (ms)", time.Now().Sub(startPrintRoutineTime)).Msg("Completed print request")
+	log.Debug().Dur("Download (ms)", downloadDuration).Dur("Normalise (ms)", normaliseDuration).Dur("Print (ms)", printDuration).Dur("Total Time Taken (ms)", time.Now().Sub(startPrintRoutineTime)).Msg("Completed print request")
 
-	_, err = job.FirestoreReference.Delete(context.Background())
+	// Blade can still cancel the job while it waits in the spooler
+	if !job.waitUntilPrinted() {
+		log.Info().Str("Job", job.Id).Msg("Print job was cancelled while spooled")
+		return
+	}
 
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to remove the print job from firestore")
+	// Once complete the removal of the document must not be treated as a cancellation
+	if !job.setStatus(PrintJobStatusComplete) {
 		return
 	}
 
-	log.Info().Msg("Print job removed from firestore")
+	if job.FirestoreReference != nil {
+		_, err = job.FirestoreReference.Delete(context.Background())
+
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to remove the print job from firestore")
+			return
+		}
+
+		log.Info().Msg("Print job removed from firestore")
+	}
 
 	job.FirestoreReference = nil
 	job.File = nil
@@ -64,7 +232,30 @@ func (job *PrintJob) downloadFile() (time.Duration, error) {
 
 	startDownload := time.Now()
 
-	resp, err := http.Get(job.Url)
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodGet, job.Url, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// The same url has been printed recently, only download it again if it has changed
+	var cached *SpoolEntry
+
+	if job.cache != nil {
+		if entry, err := job.cache.FindByUrl(job.Url); err == nil && (entry.ETag != "" || entry.LastModified != "") {
+			cached = &entry
+
+			if entry.ETag != "" {
+				req.Header.Set("If-None-Match", entry.ETag)
+			}
+
+			if entry.LastModified != "" {
+				req.Header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 
 	if err != nil {
 		return 0, err
@@ -73,7 +264,24 @@ func (job *PrintJob) downloadFile() (time.Duration, error) {
 	//goland:noinspection GoUnhandledErrorResult
 	defer resp.Body.Close()
 
-	file, err := ioutil.TempFile("", "print_job_*.pdf")
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		log.Info().Str("Hash", cached.Hash).Msg("File is unchanged, using the spool cache instead of downloading")
+
+		job.etag = cached.ETag
+		job.lastModified = cached.LastModified
+
+		return job.copyFile(job.cache.Path(*cached))
+	}
+
+	// Error pages, such as an expired signed url, must never be printed or cached
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("failed to download the file, the server responded with http status %d", resp.StatusCode)
+	}
+
+	job.etag = resp.Header.Get("ETag")
+	job.lastModified = resp.Header.Get("Last-Modified")
+
+	file, err := ioutil.TempFile("", job.tempFilePattern())
 
 	if err != nil {
 		return 0, err
@@ -93,20 +301,452 @@ func (job *PrintJob) downloadFile() (time.Duration, error) {
 	return time.Now().Sub(startDownload), nil
 }
 
+func (job *PrintJob) normalise() (time.Duration, error) {
+
+	startNormalise := time.Now()
+
+	if job.Printer == nil || job.Printer.NormaliseTo == "" {
+		return 0, nil
+	}
+
+	log.Info().Str("Media Size", job.Printer.NormaliseTo).Msg("Normalising the pdf pages")
+
+	normalised, err := NormalisePdfFile(job.File, job.Printer.NormaliseTo)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if normalised == nil {
+		log.Info().Msg("Pages already match the media size")
+		return time.Now().Sub(startNormalise), nil
+	}
+
+	job.clean()
+	job.File = normalised
+
+	return time.Now().Sub(startNormalise), nil
+}
+
+// copyFromCache spools the cached copy of a previous job.
+func (job *PrintJob) copyFromCache() (time.Duration, error) {
+
+	log.Info().Str("Hash", job.cached.Hash).Msg("Reprinting file from the spool cache")
+
+	return job.copyFile(job.cache.Path(*job.cached))
+}
+
+func (job *PrintJob) copyFile(path string) (time.Duration, error) {
+
+	startCopy := time.Now()
+
+	source, err := os.Open(path)
+
+	if err != nil {
+		return 0, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer source.Close()
+
+	file, err := ioutil.TempFile("", job.tempFilePattern())
+
+	if err != nil {
+		return 0, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	job.File = file
+
+	_, err = io.Copy(file, source)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Now().Sub(startCopy), nil
+}
+
+func (job *PrintJob) storeInCache() {
+
+	entry := SpoolEntry{
+		JobId:        job.Id,
+		Url:          job.Url,
+		ContentType:  job.ContentType,
+		PrinterType:  job.PrinterType,
+		Quantity:     job.Quantity,
+		Options:      job.Options,
+		SourceDpi:    job.SourceDpi,
+		ETag:         job.etag,
+		LastModified: job.lastModified,
+	}
+
+	if job.Printer != nil {
+		entry.Printer = *job.Printer
+	}
+
+	_, err := job.cache.Store(entry, job.File)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to store the print job in the spool cache")
+	}
+}
+
+// writeContent spools content that was sent inline with the job, avoiding a download.
+func (job *PrintJob) writeContent() (time.Duration, error) {
+
+	log.Info().Str("Content Type", job.ContentType).Msg("Writing inline content to print")
+
+	startWrite := time.Now()
+
+	if base64.StdEncoding.DecodedLen(len(job.Content)) > MaxInlineContentSize {
+		return 0, fmt.Errorf("inline content is larger than the %d byte limit", MaxInlineContentSize)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(job.Content)
+
+	if err != nil {
+		return 0, fmt.Errorf("inline content is not valid base64: %w", err)
+	}
+
+	file, err := ioutil.TempFile("", job.tempFilePattern())
+
+	if err != nil {
+		return 0, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	job.File = file
+
+	_, err = file.Write(data)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// The decoded copy is on disk now, no need to hold on to it
+	job.Content = ""
+
+	return time.Now().Sub(startWrite), nil
+}
+
+// renderTemplate fills the job's label template with its fields and spools the ZPL.
+func (job *PrintJob) renderTemplate() (time.Duration, error) {
+
+	log.Info().Str("Template", job.Template).Msg("Rendering label template")
+
+	startRender := time.Now()
+
+	data, err := RenderZplTemplate(job.Template, job.templateSource, job.Fields)
+
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := ioutil.TempFile("", job.tempFilePattern())
+
+	if err != nil {
+		return 0, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	job.File = file
+
+	_, err = file.Write(data)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Now().Sub(startRender), nil
+}
+
+// convertImage turns an image label in to ZPL so it can be printed raw.
+func (job *PrintJob) convertImage() (time.Duration, error) {
+
+	log.Info().Str("Content Type", job.ContentType).Msg("Converting image to ZPL")
+
+	startConvert := time.Now()
+
+	source, err := os.Open(job.File.Name())
+
+	if err != nil {
+		return 0, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer source.Close()
+
+	data, err := ConvertImageToZpl(source, job.Printer.ZplImage, job.Printer.NormaliseTo, job.SourceDpi)
+
+	if err != nil {
+		return 0, err
+	}
+
+	job.clean()
+	job.ContentType = ContentTypeZpl
+
+	file, err := ioutil.TempFile("", job.tempFilePattern())
+
+	if err != nil {
+		return 0, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	job.File = file
+
+	_, err = file.Write(data)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Now().Sub(startConvert), nil
+}
+
+func (job *PrintJob) isImage() bool {
+	return job.ContentType == ContentTypePng || job.ContentType == ContentTypeJpeg || job.ContentType == ContentTypeGif
+}
+
+func (job *PrintJob) tempFilePattern() string {
+	switch job.ContentType {
+	case ContentTypeZpl:
+		return "print_job_*.zpl"
+	case ContentTypePng:
+		return "print_job_*.png"
+	case ContentTypeJpeg:
+		return "print_job_*.jpg"
+	case ContentTypeGif:
+		return "print_job_*.gif"
+	}
+	return "print_job_*.pdf"
+}
+
 func (job *PrintJob) print() (time.Duration, error) {
 
 	log.Info().Msg("Send the print command")
 
 	startPrintTime := time.Now()
 
-	err := PrintFile(job.Printer.Reference, job.Printer.Tray, job.File, job.Quantity)
+	// Hold the lock while spooling so a cancellation either stops the job
+	// beforehand or waits until there is a spooled job to cancel.
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.Status == PrintJobStatusCancelled {
+		return 0, ErrPrintJobCancelled
+	}
+
+	job.Status = PrintJobStatusPrinting
+
+	var spoolId string
+	var err error
+	if job.network != nil {
+		spoolId, err = PrintNetworkFile(*job.network, job.File, job.Quantity, job.ContentType, job.Options)
+	} else if job.ContentType == ContentTypeZpl {
+		spoolId, err = PrintRawFile(job.Printer.Reference, job.File, job.Quantity)
+	} else {
+		spoolId, err = PrintFile(job.Printer.Reference, job.Printer.Tray, job.File, job.Quantity, job.Options)
+	}
+
 	if err != nil {
 		return 0, err
 	}
 
+	job.SpoolId = spoolId
+	job.Status = PrintJobStatusSpooled
+
 	return time.Now().Sub(startPrintTime), nil
 }
 
+// waitUntilPrinted keeps the job spooled until the spooler has finished with it, so it can
+// still be cancelled. It returns false when the job was cancelled in the meantime.
+func (job *PrintJob) waitUntilPrinted() bool {
+
+	if job.SpoolId == "" {
+		return true
+	}
+
+	if job.FirestoreReference != nil {
+		_, err := job.FirestoreReference.Update(context.Background(), []firestore.Update{
+			{
+				Path:  "status",
+				Value: PrintJobStatusSpooled,
+			},
+			{
+				Path:  "spool_id",
+				Value: job.SpoolId,
+			},
+		})
+
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to save the spooled status back to firestore")
+		}
+	}
+
+	for {
+		var pending bool
+		var err error
+
+		if job.network != nil {
+			pending, err = NetworkPrintJobPending(*job.network, job.SpoolId)
+		} else {
+			pending, err = SpooledJobPending(job.Printer.Reference, job.SpoolId)
+		}
+
+		// Without the spooler's word the job is treated as printed, as it was handed over okay
+		if err != nil {
+			log.Warn().Err(err).Str("Job", job.Id).Msg("Failed to check on the spooled print job")
+			return true
+		}
+
+		if !pending {
+			return true
+		}
+
+		select {
+		case <-job.ctx.Done():
+			return false
+		case <-time.After(SpooledJobPollInterval):
+		}
+	}
+}
+
+// Snapshot copies the job under its lock, so it can be written to firestore while it prints.
+func (job *PrintJob) Snapshot() *PrintJob {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return &PrintJob{
+		Id:          job.Id,
+		PrinterType: job.PrinterType,
+		Quantity:    job.Quantity,
+		Created:     job.Created,
+		Url:         job.Url,
+		ContentType: job.ContentType,
+		Template:    job.Template,
+		Reference:   job.Reference,
+		SourceDpi:   job.SourceDpi,
+		Options:     job.Options,
+		Status:      job.Status,
+		SpoolId:     job.SpoolId,
+		cached:      job.cached,
+	}
+}
+
+// fail marks the job as errored and reports the reason back on the job document.
+func (job *PrintJob) fail(err error, message string) {
+
+	job.setStatus(PrintJobStatusError)
+	job.message = err.Error()
+
+	log.Error().Err(err).Str("Job", job.Id).Msg(message)
+
+	if job.FirestoreReference == nil {
+		return
+	}
+
+	_, updateErr := job.FirestoreReference.Update(context.Background(), []firestore.Update{
+		{
+			Path:  "message",
+			Value: err.Error(),
+		},
+		{
+			Path:  "status",
+			Value: PrintJobStatusError,
+		},
+	})
+
+	if updateErr != nil {
+		log.Error().Err(updateErr).Msg("Failed to save the print job error back to firestore")
+	}
+}
+
+func (job *PrintJob) recordHistory(started time.Time, printerName string, download time.Duration, process time.Duration, print time.Duration) {
+
+	if job.history == nil {
+		return
+	}
+
+	record := HistoryRecord{
+		Kind:        HistoryKindPrint,
+		JobId:       job.Id,
+		Reference:   job.Reference,
+		Started:     started,
+		Role:        job.PrinterType.String(),
+		Printer:     printerName,
+		Quantity:    job.Quantity,
+		ContentType: job.ContentType,
+		User:        job.user,
+		Bay:         job.bay,
+		Outcome:     job.Status,
+		Message:     job.message,
+		DownloadMs:  download.Milliseconds(),
+		ProcessMs:   process.Milliseconds(),
+		PrintMs:     print.Milliseconds(),
+		TotalMs:     time.Now().Sub(started).Milliseconds(),
+	}
+
+	err := job.history.Record(record)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to record the print job in the local history")
+	}
+}
+
+// setStatus moves the job on to the given status. It returns false when the
+// job has already been cancelled and should not continue.
+func (job *PrintJob) setStatus(status string) bool {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.Status == PrintJobStatusCancelled {
+		return false
+	}
+
+	job.Status = status
+
+	return true
+}
+
+// Cancel stops the job. Queued or downloading jobs are dropped and jobs
+// already handed to the print spooler are cancelled there.
+func (job *PrintJob) Cancel() error {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	switch job.Status {
+	case PrintJobStatusComplete, PrintJobStatusError, PrintJobStatusCancelled:
+		return nil
+	}
+
+	previousStatus := job.Status
+	job.Status = PrintJobStatusCancelled
+
+	if job.cancel != nil {
+		job.cancel()
+	}
+
+	if previousStatus != PrintJobStatusSpooled {
+		log.Info().Str("Job", job.Id).Str("Status", previousStatus).Msg("Dropped print job before it was printed")
+		return nil
+	}
+
+	if job.network != nil {
+		return CancelNetworkPrintFile(*job.network, job.SpoolId)
+	}
+
+	return CancelPrintFile(job.Printer.Reference, job.SpoolId)
+}
+
 func (job *PrintJob) clean() {
 
 	if job.File != nil {
@@ -0,0 +1,236 @@
+package companion
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFile(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		// A copy of the url is already in the cache
+		cached   bool
+		want     string
+		wantErr  bool
+		wantEtag string
+	}{
+		{name: "downloads", status: http.StatusOK, body: "%PDF-1.4 new", want: "%PDF-1.4 new", wantEtag: `"v2"`},
+		{name: "reuses the unchanged cached copy", status: http.StatusNotModified, cached: true, want: "%PDF-1.4 cached", wantEtag: `"v1"`},
+		{name: "downloads a changed file", status: http.StatusOK, body: "%PDF-1.4 new", cached: true, want: "%PDF-1.4 new", wantEtag: `"v2"`},
+		{name: "refuses a missing file", status: http.StatusNotFound, body: "Not Found", wantErr: true},
+		{name: "refuses an expired signed url", status: http.StatusForbidden, body: "<Error><Code>ExpiredToken</Code></Error>", cached: true, wantErr: true},
+		{name: "refuses a server error", status: http.StatusInternalServerError, body: "oops", wantErr: true},
+		{name: "refuses not modified without a cached copy", status: http.StatusNotModified, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if test.status == http.StatusOK {
+					res.Header().Set("ETag", `"v2"`)
+				}
+				res.WriteHeader(test.status)
+				_, _ = res.Write([]byte(test.body))
+			}))
+
+			defer server.Close()
+
+			cache := &SpoolCache{dir: t.TempDir(), maxSize: DefaultSpoolCacheMaxSizeMb * 1024 * 1024, maxAge: time.Hour}
+
+			if test.cached {
+				storeSpoolFile(t, cache, SpoolEntry{JobId: "earlier", Url: server.URL, ETag: `"v1"`}, "%PDF-1.4 cached")
+			}
+
+			job := &PrintJob{Id: "job", Url: server.URL, ContentType: ContentTypePdf, cache: cache, ctx: context.Background()}
+
+			defer job.clean()
+
+			_, err := job.downloadFile()
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("downloadFile() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if test.wantErr {
+				if job.File != nil {
+					t.Errorf("downloadFile() kept the error page in %s", job.File.Name())
+				}
+				return
+			}
+
+			got, err := ioutil.ReadFile(job.File.Name())
+
+			if err != nil || string(got) != test.want {
+				t.Errorf("downloaded %q, %v, want %q", got, err, test.want)
+			}
+
+			if job.etag != test.wantEtag {
+				t.Errorf("etag = %q, want %q", job.etag, test.wantEtag)
+			}
+		})
+	}
+}
+
+func TestPrintJobCancel(t *testing.T) {
+
+	// Stands in for a discovered printer, recording the IPP requests it is sent
+	var cancelled []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		request, err := decodeIppResponse(data)
+
+		// The request has the same layout as a response, with the operation in place of the status
+		if err == nil && request.Status == ippOperationCancelJob {
+			cancelled = append(cancelled, request.Value("job-id"))
+		}
+
+		_, _ = res.Write([]byte{1, 1, 0, 0, 0, 0, 0, 1, ippTagEnd})
+	}))
+
+	defer server.Close()
+
+	ipp := &Printer{Name: "Office", Capabilities: &PrinterCapabilities{DeviceUri: "ipp" + strings.TrimPrefix(server.URL, "http") + "/ipp/print"}, Discovered: true}
+	socket := &Printer{Name: "Labels", Capabilities: &PrinterCapabilities{DeviceUri: "socket://10.0.0.9:9100"}, Discovered: true}
+
+	tests := []struct {
+		name    string
+		status  string
+		network *Printer
+		// The job is stopped, rather than left as it was
+		wantStopped   bool
+		wantCancelled []string
+		wantErr       bool
+	}{
+		{name: "queued", status: PrintJobStatusQueued, wantStopped: true},
+		{name: "downloading", status: PrintJobStatusDownloading, wantStopped: true},
+		{name: "spooled over ipp", status: PrintJobStatusSpooled, network: ipp, wantStopped: true, wantCancelled: []string{"42"}},
+		{name: "spooled to a raw socket", status: PrintJobStatusSpooled, network: socket, wantStopped: true, wantErr: true},
+		{name: "complete", status: PrintJobStatusComplete},
+		{name: "failed", status: PrintJobStatusError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cancelled = nil
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			job := &PrintJob{Id: "job", Status: test.status, SpoolId: "42", network: test.network, ctx: ctx, cancel: cancel}
+
+			err := job.Cancel()
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Cancel() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if stopped := job.Status == PrintJobStatusCancelled; stopped != test.wantStopped {
+				t.Errorf("status = %s, want stopped %v", job.Status, test.wantStopped)
+			}
+
+			if stopped := ctx.Err() != nil; stopped != test.wantStopped {
+				t.Errorf("context cancelled = %v, want %v", stopped, test.wantStopped)
+			}
+
+			if strings.Join(cancelled, ",") != strings.Join(test.wantCancelled, ",") {
+				t.Errorf("the printer cancelled %v, want %v", cancelled, test.wantCancelled)
+			}
+
+			// Nothing more is printed once cancelled, and a second cancellation does nothing
+			if test.wantStopped {
+				if job.setStatus(PrintJobStatusPrinting) {
+					t.Error("setStatus() moved the cancelled job on")
+				}
+
+				if _, err := job.print(); !errors.Is(err, ErrPrintJobCancelled) {
+					t.Errorf("print() error = %v, want %v", err, ErrPrintJobCancelled)
+				}
+
+				if err := job.Cancel(); err != nil || len(cancelled) != len(test.wantCancelled) {
+					t.Errorf("second Cancel() = %v, the printer cancelled %v", err, cancelled)
+				}
+			}
+		})
+	}
+}
+
+func TestPrintJobCancelWhileDownloading(t *testing.T) {
+
+	started := make(chan struct{})
+
+	// The download never finishes by itself
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-req.Context().Done()
+	}))
+
+	defer server.Close()
+
+	job := &PrintJob{Id: "job", Url: server.URL, ContentType: ContentTypePdf, Status: PrintJobStatusQueued}
+
+	handled := make(chan struct{})
+
+	go func() {
+		job.Handle()
+		close(handled)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the job did not start downloading")
+	}
+
+	if err := job.Cancel(); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handle() did not stop once cancelled")
+	}
+
+	if job.Status != PrintJobStatusCancelled || job.File != nil {
+		t.Errorf("status = %s, file = %v, want cancelled without a file", job.Status, job.File)
+	}
+}
+
+// storeSpoolFile caches the content as though it was printed earlier.
+func storeSpoolFile(t *testing.T, cache *SpoolCache, entry SpoolEntry, content string) SpoolEntry {
+	t.Helper()
+
+	file, err := ioutil.TempFile("", "spool_test_*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := cache.Store(entry, file)
+
+	if err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+
+	return stored
+}
@@ -0,0 +1,264 @@
+package companion
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DuplexSimplex   = "simplex"
+	DuplexLongEdge  = "long_edge"
+	DuplexShortEdge = "short_edge"
+
+	OrientationPortrait  = "portrait"
+	OrientationLandscape = "landscape"
+)
+
+var pageRangesPattern = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+
+// Media names are single keywords, e.g. iso_a4_210x297mm or Custom.4x6in. CUPS splits an option on
+// spaces so anything else could add options of its own.
+var mediaNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// sumatraPapers are the named paper sizes SumatraPDF accepts, with the media names for them.
+// Any other size would be silently ignored by Sumatra.
+var sumatraPapers = map[string]string{
+	"a2":                   "A2",
+	"iso_a2_420x594mm":     "A2",
+	"a3":                   "A3",
+	"iso_a3_297x420mm":     "A3",
+	"a4":                   "A4",
+	"iso_a4_210x297mm":     "A4",
+	"a5":                   "A5",
+	"iso_a5_148x210mm":     "A5",
+	"a6":                   "A6",
+	"iso_a6_105x148mm":     "A6",
+	"letter":               "letter",
+	"na_letter_8.5x11in":   "letter",
+	"legal":                "legal",
+	"na_legal_8.5x14in":    "legal",
+	"tabloid":              "tabloid",
+	"ledger":               "tabloid",
+	"na_ledger_11x17in":    "tabloid",
+	"statement":            "statement",
+	"na_invoice_5.5x8.5in": "statement",
+}
+
+// PrintOptions are the optional settings for a print. Empty values are left
+// to the printer's own defaults.
+type PrintOptions struct {
+	Duplex      string `json:"duplex,omitempty" firestore:"duplex,omitempty"`
+	Orientation string `json:"orientation,omitempty" firestore:"orientation,omitempty"`
+	PageRanges  string `json:"page_ranges,omitempty" firestore:"page_ranges,omitempty"`
+	MediaSize   string `json:"media_size,omitempty" firestore:"media_size,omitempty"`
+	FitToPage   *bool  `json:"fit_to_page,omitempty" firestore:"fit_to_page,omitempty"`
+}
+
+// ParsePrintOptions reads & validates the options map from a raw firestore job document.
+func ParsePrintOptions(raw interface{}) (PrintOptions, error) {
+
+	var options PrintOptions
+
+	if raw == nil {
+		return options, nil
+	}
+
+	data, err := json.Marshal(raw)
+
+	if err != nil {
+		return options, err
+	}
+
+	err = json.Unmarshal(data, &options)
+
+	if err != nil {
+		return options, err
+	}
+
+	// Rejected before the job starts so the document says why
+	return options, options.Validate()
+}
+
+// Merge returns the options with any values set on the overrides replacing them.
+func (options PrintOptions) Merge(overrides PrintOptions) PrintOptions {
+
+	if overrides.Duplex != "" {
+		options.Duplex = overrides.Duplex
+	}
+
+	if overrides.Orientation != "" {
+		options.Orientation = overrides.Orientation
+	}
+
+	if overrides.PageRanges != "" {
+		options.PageRanges = overrides.PageRanges
+	}
+
+	if overrides.MediaSize != "" {
+		options.MediaSize = overrides.MediaSize
+	}
+
+	if overrides.FitToPage != nil {
+		options.FitToPage = overrides.FitToPage
+	}
+
+	return options
+}
+
+func (options PrintOptions) Validate() error {
+
+	switch options.Duplex {
+	case "", DuplexSimplex, DuplexLongEdge, DuplexShortEdge:
+	default:
+		return fmt.Errorf("unsupported duplex option %q", options.Duplex)
+	}
+
+	switch options.Orientation {
+	case "", OrientationPortrait, OrientationLandscape:
+	default:
+		return fmt.Errorf("unsupported orientation option %q", options.Orientation)
+	}
+
+	if options.PageRanges != "" && !pageRangesPattern.MatchString(options.PageRanges) {
+		return fmt.Errorf("invalid page ranges %q", options.PageRanges)
+	}
+
+	if options.MediaSize != "" && !mediaNamePattern.MatchString(options.MediaSize) {
+		return fmt.Errorf("invalid media size %q", options.MediaSize)
+	}
+
+	return nil
+}
+
+// Equal compares the options by value, including whether to fit to the page.
+func (options PrintOptions) Equal(compare PrintOptions) bool {
+
+	if options.Duplex != compare.Duplex || options.Orientation != compare.Orientation || options.PageRanges != compare.PageRanges || options.MediaSize != compare.MediaSize {
+		return false
+	}
+
+	if options.FitToPage == nil || compare.FitToPage == nil {
+		return options.FitToPage == nil && compare.FitToPage == nil
+	}
+
+	return *options.FitToPage == *compare.FitToPage
+}
+
+// LpArguments maps the options onto the arguments accepted by the CUPS lp command.
+func (options PrintOptions) LpArguments() []string {
+
+	args := make([]string, 0)
+
+	switch options.Duplex {
+	case DuplexSimplex:
+		args = append(args, "-o", "sides=one-sided")
+	case DuplexLongEdge:
+		args = append(args, "-o", "sides=two-sided-long-edge")
+	case DuplexShortEdge:
+		args = append(args, "-o", "sides=two-sided-short-edge")
+	}
+
+	// IPP orientation-requested: 3 == portrait, 4 == landscape
+	switch options.Orientation {
+	case OrientationPortrait:
+		args = append(args, "-o", "orientation-requested=3")
+	case OrientationLandscape:
+		args = append(args, "-o", "orientation-requested=4")
+	}
+
+	if options.PageRanges != "" {
+		args = append(args, "-o", fmt.Sprintf("page-ranges=%s", options.PageRanges))
+	}
+
+	if options.MediaSize != "" {
+		args = append(args, "-o", fmt.Sprintf("media=%s", options.MediaSize))
+	}
+
+	if options.FitToPage != nil {
+		if *options.FitToPage {
+			args = append(args, "-o", "print-scaling=fit")
+		} else {
+			args = append(args, "-o", "print-scaling=none")
+		}
+	}
+
+	return args
+}
+
+// SumatraSettings maps the options onto SumatraPDF -print-settings values. Sumatra only
+// knows named paper sizes, so other media sizes are rejected rather than ignored.
+func (options PrintOptions) SumatraSettings() ([]string, error) {
+
+	settings := make([]string, 0)
+
+	switch options.Duplex {
+	case DuplexSimplex:
+		settings = append(settings, "simplex")
+	case DuplexLongEdge:
+		settings = append(settings, "duplexlong")
+	case DuplexShortEdge:
+		settings = append(settings, "duplexshort")
+	}
+
+	switch options.Orientation {
+	case OrientationPortrait:
+		settings = append(settings, "portrait")
+	case OrientationLandscape:
+		settings = append(settings, "landscape")
+	}
+
+	if options.PageRanges != "" {
+		settings = append(settings, options.PageRanges)
+	}
+
+	if options.MediaSize != "" {
+		paper, ok := sumatraPapers[strings.ToLower(options.MediaSize)]
+
+		if !ok {
+			return nil, fmt.Errorf("the media size %q can not be printed on windows, SumatraPDF only supports A2, A3, A4, A5, A6, letter, legal, tabloid & statement paper", options.MediaSize)
+		}
+
+		settings = append(settings, fmt.Sprintf("paper=%s", paper))
+	}
+
+	if options.FitToPage != nil {
+		if *options.FitToPage {
+			settings = append(settings, "fit")
+		} else {
+			settings = append(settings, "noscale")
+		}
+	}
+
+	return settings, nil
+}
+
+// ippJobAttributes maps the options onto IPP job template attributes, for printers sent jobs directly.
+func (options PrintOptions) ippJobAttributes() []ippAttribute {
+
+	attributes := make([]ippAttribute, 0)
+
+	for _, arg := range options.LpArguments() {
+		parts := strings.SplitN(arg, "=", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		tag := ippTagKeyword
+
+		switch parts[0] {
+		case "orientation-requested":
+			tag = ippTagEnum
+		case "page-ranges":
+			// Each range is a separate value
+			attributes = append(attributes, ippAttribute{tag: ippTagRange, name: parts[0], values: strings.Split(parts[1], ",")})
+			continue
+		}
+
+		attributes = append(attributes, ippAttribute{tag: tag, name: parts[0], values: []string{parts[1]}})
+	}
+
+	return attributes
+}
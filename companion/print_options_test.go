@@ -0,0 +1,79 @@
+package companion
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrintOptionsValidate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		options PrintOptions
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "everything", options: PrintOptions{Duplex: DuplexLongEdge, Orientation: OrientationLandscape, PageRanges: "1-3,5", MediaSize: "iso_a4_210x297mm"}},
+		{name: "custom media", options: PrintOptions{MediaSize: "Custom.4x6in"}},
+		{name: "unknown duplex", options: PrintOptions{Duplex: "both"}, wantErr: true},
+		{name: "unknown orientation", options: PrintOptions{Orientation: "upside_down"}, wantErr: true},
+		{name: "invalid page ranges", options: PrintOptions{PageRanges: "1-3 5"}, wantErr: true},
+		{name: "media adding an option", options: PrintOptions{MediaSize: "A4 job-hold-until=indefinite"}, wantErr: true},
+		{name: "media with an equals", options: PrintOptions{MediaSize: "A4,sides=two-sided-long-edge"}, wantErr: true},
+		{name: "media with a quote", options: PrintOptions{MediaSize: "A4'"}, wantErr: true},
+		{name: "media with a newline", options: PrintOptions{MediaSize: "A4\n"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.options.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParsePrintOptions(t *testing.T) {
+
+	fit := true
+
+	tests := []struct {
+		name    string
+		raw     interface{}
+		want    PrintOptions
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "options", raw: map[string]interface{}{"duplex": "long_edge", "media_size": "A4", "fit_to_page": true}, want: PrintOptions{Duplex: DuplexLongEdge, MediaSize: "A4", FitToPage: &fit}},
+		{name: "injected media", raw: map[string]interface{}{"media_size": "A4 job-hold-until=indefinite"}, wantErr: true},
+		{name: "wrong type", raw: map[string]interface{}{"duplex": 2}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := ParsePrintOptions(test.raw)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParsePrintOptions() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if !test.wantErr && !got.Equal(test.want) {
+				t.Errorf("ParsePrintOptions() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrintOptionsLpArguments(t *testing.T) {
+
+	fit := false
+
+	got := PrintOptions{Duplex: DuplexShortEdge, Orientation: OrientationPortrait, PageRanges: "2-4", MediaSize: "na_letter_8.5x11in", FitToPage: &fit}.LpArguments()
+
+	want := []string{"-o", "sides=two-sided-short-edge", "-o", "orientation-requested=3", "-o", "page-ranges=2-4", "-o", "media=na_letter_8.5x11in", "-o", "print-scaling=none"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LpArguments() = %q, want %q", got, want)
+	}
+}
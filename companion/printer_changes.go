@@ -0,0 +1,220 @@
+package companion
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const DefaultPrinterPollIntervalSeconds = 15
+
+const AppWarningPrinterMissing = "printer_missing"
+
+// AppWarning is a problem with the app's setup that Blade should show to the packer.
+type AppWarning struct {
+	Code    string    `json:"code" firestore:"code"`
+	Role    string    `json:"role" firestore:"role"`
+	Printer string    `json:"printer" firestore:"printer"`
+	Message string    `json:"message" firestore:"message"`
+	Since   time.Time `json:"since" firestore:"since"`
+}
+
+// PrinterChange lists what changed on a printer that exists before and after.
+type PrinterChange struct {
+	Name   string
+	Fields []string
+}
+
+// PrinterChanges is the difference between two lists of available printers.
+type PrinterChanges struct {
+	Added   []string
+	Removed []string
+	Changed []PrinterChange
+}
+
+func (changes PrinterChanges) IsEmpty() bool {
+	return len(changes.Added) == 0 && len(changes.Removed) == 0 && len(changes.Changed) == 0
+}
+
+func (changes PrinterChanges) String() string {
+
+	parts := make([]string, 0)
+
+	if len(changes.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(changes.Added, ", "))
+	}
+
+	if len(changes.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(changes.Removed, ", "))
+	}
+
+	for _, change := range changes.Changed {
+		parts = append(parts, fmt.Sprintf("%s changed %s", change.Name, strings.Join(change.Fields, ", ")))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// DiffPrinters compares every field of the printers, matching them by name.
+func DiffPrinters(previous []Printer, current []Printer) PrinterChanges {
+
+	changes := PrinterChanges{
+		Added:   make([]string, 0),
+		Removed: make([]string, 0),
+		Changed: make([]PrinterChange, 0),
+	}
+
+	before := make(map[string]Printer, len(previous))
+	for _, printer := range previous {
+		before[printer.Name] = printer
+	}
+
+	after := make(map[string]Printer, len(current))
+	for _, printer := range current {
+		after[printer.Name] = printer
+	}
+
+	for _, printer := range current {
+		old, ok := before[printer.Name]
+
+		if !ok {
+			changes.Added = append(changes.Added, printer.Name)
+			continue
+		}
+
+		fields := make([]string, 0)
+
+		if !equalTrays(old.Trays, printer.Trays) {
+			fields = append(fields, "trays")
+		}
+
+		if !equalCapabilities(old.Capabilities, printer.Capabilities) {
+			fields = append(fields, "capabilities")
+		}
+
+		if !old.Health.Equal(printer.Health) {
+			fields = append(fields, "health")
+		}
+
+		if len(fields) > 0 {
+			changes.Changed = append(changes.Changed, PrinterChange{Name: printer.Name, Fields: fields})
+		}
+	}
+
+	for _, printer := range previous {
+		if _, ok := after[printer.Name]; !ok {
+			changes.Removed = append(changes.Removed, printer.Name)
+		}
+	}
+
+	return changes
+}
+
+func equalTrays(a []Tray, b []Tray) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalCapabilities(a *PrinterCapabilities, b *PrinterCapabilities) bool {
+
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.MakeAndModel == b.MakeAndModel &&
+		a.DeviceUri == b.DeviceUri &&
+		a.Duplex == b.Duplex &&
+		a.Colour == b.Colour &&
+		equalStrings(a.MediaSizes, b.MediaSizes) &&
+		equalStrings(a.Resolutions, b.Resolutions) &&
+		equalStrings(a.DocumentFormats, b.DocumentFormats)
+}
+
+func equalStrings(a []string, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// printerWarnings raises a warning for each role whose printer is not available. Warnings
+// that were already raised keep the time they were first seen.
+func (app *App) printerWarnings(printers []Printer) []AppWarning {
+
+	available := make(map[string]bool, len(printers))
+	for _, printer := range printers {
+		available[printer.Name] = true
+	}
+
+	warnings := make([]AppWarning, 0)
+
+	for _, printerType := range []PrinterType{Document, LabelSmall, LabelLarge, GiftNote} {
+		reference, err := app.getPrinterReference(printerType)
+
+		// Forwarded printers are not ours to check
+		if err != nil || reference.Forwarding != "" || available[reference.Reference] {
+			continue
+		}
+
+		warning := AppWarning{
+			Code:    AppWarningPrinterMissing,
+			Role:    printerType.String(),
+			Printer: reference.Reference,
+			Message: fmt.Sprintf("The %s printer %s is no longer available", printerType.String(), reference.Reference),
+			Since:   time.Now(),
+		}
+
+		for _, existing := range app.Warnings {
+			if existing.Code == warning.Code && existing.Role == warning.Role && existing.Printer == warning.Printer {
+				warning.Since = existing.Since
+				warning.Message = existing.Message
+			}
+		}
+
+		warnings = append(warnings, warning)
+	}
+
+	return warnings
+}
+
+func equalWarnings(a []AppWarning, b []AppWarning) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !containsWarning(b, a[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsWarning(warnings []AppWarning, warning AppWarning) bool {
+	for _, existing := range warnings {
+		if existing.Code == warning.Code && existing.Role == warning.Role && existing.Printer == warning.Printer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package companion
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	PrinterCommandCreate = "create"
+	PrinterCommandUpdate = "update"
+	PrinterCommandRemove = "remove"
+
+	PrinterDriverEverywhere = "everywhere"
+	PrinterDriverRaw        = "raw"
+
+	PrinterCommandStatusComplete = "complete"
+	PrinterCommandStatusError    = "error"
+)
+
+// lpadminPath can be pointed at a stub to check the arguments without touching CUPS.
+var lpadminPath = "lpadmin"
+
+// PrinterCommand asks the app to set up a CUPS queue, so a new bay can be configured from Blade.
+type PrinterCommand struct {
+	Id          string `json:"id" firestore:"id"`
+	Action      string `json:"action" firestore:"action"`
+	Name        string `json:"name" firestore:"name"`
+	DeviceUri   string `json:"device_uri" firestore:"device_uri"`
+	Driver      string `json:"driver" firestore:"driver"`
+	Description string `json:"description" firestore:"description"`
+	Location    string `json:"location" firestore:"location"`
+	Media       string `json:"media" firestore:"media"`
+	Darkness    string `json:"darkness" firestore:"darkness"`
+	Resolution  string `json:"resolution" firestore:"resolution"`
+	Created     int64  `json:"created" firestore:"created"`
+	// Any other default options, e.g. sides-default=two-sided-long-edge
+	Options            map[string]string      `json:"options" firestore:"options"`
+	Status             string                 `json:"status" firestore:"status"`
+	Message            string                 `json:"message" firestore:"message"`
+	FirestoreReference *firestore.DocumentRef `json:"-" firestore:"-"`
+}
+
+// Validate checks the command before anything is run. CUPS rejects queue names with
+// spaces, slashes, quotes or hashes.
+func (command PrinterCommand) Validate() error {
+
+	switch command.Action {
+	case PrinterCommandCreate, PrinterCommandUpdate, PrinterCommandRemove:
+	default:
+		return fmt.Errorf("unknown printer command action %q", command.Action)
+	}
+
+	if command.Name == "" || len(command.Name) > 127 {
+		return errors.New("a queue name of up to 127 characters is required")
+	}
+
+	if strings.IndexFunc(command.Name, func(r rune) bool { return r <= ' ' || r == 127 || strings.ContainsRune("/\\?'\"#", r) }) >= 0 {
+		return fmt.Errorf("invalid queue name %q", command.Name)
+	}
+
+	if command.Action == PrinterCommandRemove {
+		return nil
+	}
+
+	if command.Action == PrinterCommandCreate && command.DeviceUri == "" {
+		return errors.New("a device uri is required to create a queue")
+	}
+
+	if command.DeviceUri != "" {
+		parsed, err := url.Parse(command.DeviceUri)
+		if err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("invalid device uri %q", command.DeviceUri)
+		}
+	}
+
+	if command.Driver != "" && command.Driver != PrinterDriverEverywhere && command.Driver != PrinterDriverRaw {
+		return fmt.Errorf("unknown printer driver %q", command.Driver)
+	}
+
+	for name, value := range command.Options {
+		if name == "" || strings.ContainsAny(name, "= ") || strings.ContainsAny(value, "\n\r") {
+			return fmt.Errorf("invalid default option %q", name)
+		}
+	}
+
+	return nil
+}
+
+// LpadminArguments maps the command onto the arguments for lpadmin.
+func (command PrinterCommand) LpadminArguments() []string {
+
+	if command.Action == PrinterCommandRemove {
+		return []string{"-x", command.Name}
+	}
+
+	arguments := []string{"-p", command.Name, "-E"}
+
+	if command.DeviceUri != "" {
+		arguments = append(arguments, "-v", command.DeviceUri)
+	}
+
+	driver := command.Driver
+
+	// New queues are driverless unless asked otherwise, updates keep their driver
+	if driver == "" && command.Action == PrinterCommandCreate {
+		driver = PrinterDriverEverywhere
+	}
+
+	if driver != "" {
+		arguments = append(arguments, "-m", driver)
+	}
+
+	if command.Description != "" {
+		arguments = append(arguments, "-D", command.Description)
+	}
+
+	if command.Location != "" {
+		arguments = append(arguments, "-L", command.Location)
+	}
+
+	defaults := map[string]string{}
+
+	for name, value := range command.Options {
+		defaults[name] = value
+	}
+
+	if command.Media != "" {
+		defaults["media-default"] = command.Media
+	}
+
+	if command.Darkness != "" {
+		defaults["print-darkness-default"] = command.Darkness
+	}
+
+	if command.Resolution != "" {
+		defaults["printer-resolution-default"] = command.Resolution
+	}
+
+	names := make([]string, 0, len(defaults))
+	for name := range defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		arguments = append(arguments, "-o", name+"="+defaults[name])
+	}
+
+	return arguments
+}
+
+// Run applies the command with lpadmin. Only CUPS queues can be provisioned.
+func (command PrinterCommand) Run() error {
+
+	if runtime.GOOS == "windows" {
+		return errors.New("printer queues can only be provisioned on linux & mac")
+	}
+
+	err := command.Validate()
+
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(lpadminPath, command.LpadminArguments()...)
+
+	log.Info().Str("Command", cmd.String()).Str("Printer", command.Name).Msg("About to run lpadmin")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			message = err.Error()
+		}
+		log.Error().Err(err).Str("Output", message).Msg("lpadmin failed")
+		return errors.New(message)
+	}
+
+	return nil
+}
+
+func (command *PrinterCommand) saveResult(status string, message string) {
+
+	command.Status = status
+	command.Message = message
+
+	if command.FirestoreReference == nil {
+		return
+	}
+
+	_, err := command.FirestoreReference.Update(context.Background(), []firestore.Update{
+		{
+			Path:  "status",
+			Value: status,
+		},
+		{
+			Path:  "message",
+			Value: message,
+		},
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save the printer command result back to firestore")
+	}
+}
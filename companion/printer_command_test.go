@@ -0,0 +1,193 @@
+package companion
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPrinterCommandValidate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		command PrinterCommand
+		wantErr bool
+	}{
+		{name: "create", command: PrinterCommand{Action: PrinterCommandCreate, Name: "Zebra_Bay_1", DeviceUri: "socket://10.0.0.9:9100", Driver: PrinterDriverRaw}},
+		{name: "update without a uri", command: PrinterCommand{Action: PrinterCommandUpdate, Name: "Zebra_Bay_1", Media: "oe_4x6-label_4x6in"}},
+		{name: "remove", command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra_Bay_1"}},
+		{name: "unknown action", command: PrinterCommand{Action: "rename", Name: "Zebra_Bay_1"}, wantErr: true},
+		{name: "no name", command: PrinterCommand{Action: PrinterCommandRemove}, wantErr: true},
+		{name: "name too long", command: PrinterCommand{Action: PrinterCommandRemove, Name: strings.Repeat("a", 128)}, wantErr: true},
+		{name: "name with a space", command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra Bay"}, wantErr: true},
+		{name: "name with a slash", command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra/Bay"}, wantErr: true},
+		{name: "name with a hash", command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra#1"}, wantErr: true},
+		{name: "create without a uri", command: PrinterCommand{Action: PrinterCommandCreate, Name: "Zebra_Bay_1"}, wantErr: true},
+		{name: "uri without a scheme", command: PrinterCommand{Action: PrinterCommandCreate, Name: "Zebra_Bay_1", DeviceUri: "10.0.0.9"}, wantErr: true},
+		{name: "unknown driver", command: PrinterCommand{Action: PrinterCommandCreate, Name: "Zebra_Bay_1", DeviceUri: "socket://10.0.0.9", Driver: "gutenprint"}, wantErr: true},
+		{name: "option with an equals", command: PrinterCommand{Action: PrinterCommandUpdate, Name: "Zebra_Bay_1", Options: map[string]string{"a=b": "c"}}, wantErr: true},
+		{name: "option value with a newline", command: PrinterCommand{Action: PrinterCommandUpdate, Name: "Zebra_Bay_1", Options: map[string]string{"sides-default": "one\ntwo"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.command.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrinterCommandLpadminArguments(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		command PrinterCommand
+		want    []string
+	}{
+		{
+			name:    "create defaults to driverless",
+			command: PrinterCommand{Action: PrinterCommandCreate, Name: "Office", DeviceUri: "ipp://10.0.0.5/ipp/print"},
+			want:    []string{"-p", "Office", "-E", "-v", "ipp://10.0.0.5/ipp/print", "-m", "everywhere"},
+		},
+		{
+			name: "create with every option",
+			command: PrinterCommand{
+				Action:      PrinterCommandCreate,
+				Name:        "Zebra_Bay_1",
+				DeviceUri:   "socket://10.0.0.9:9100",
+				Driver:      PrinterDriverRaw,
+				Description: "Bay 1 labels",
+				Location:    "Warehouse",
+				Media:       "oe_4x6-label_4x6in",
+				Darkness:    "20",
+				Resolution:  "203dpi",
+				Options:     map[string]string{"sides-default": "one-sided"},
+			},
+			want: []string{"-p", "Zebra_Bay_1", "-E", "-v", "socket://10.0.0.9:9100", "-m", "raw", "-D", "Bay 1 labels", "-L", "Warehouse",
+				"-o", "media-default=oe_4x6-label_4x6in", "-o", "print-darkness-default=20", "-o", "printer-resolution-default=203dpi", "-o", "sides-default=one-sided"},
+		},
+		{
+			name:    "update keeps the driver",
+			command: PrinterCommand{Action: PrinterCommandUpdate, Name: "Zebra_Bay_1", Media: "oe_4x6-label_4x6in"},
+			want:    []string{"-p", "Zebra_Bay_1", "-E", "-o", "media-default=oe_4x6-label_4x6in"},
+		},
+		{
+			name:    "the named fields win over options",
+			command: PrinterCommand{Action: PrinterCommandUpdate, Name: "Zebra_Bay_1", Media: "na_letter_8.5x11in", Options: map[string]string{"media-default": "iso_a4_210x297mm"}},
+			want:    []string{"-p", "Zebra_Bay_1", "-E", "-o", "media-default=na_letter_8.5x11in"},
+		},
+		{
+			name:    "remove",
+			command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra_Bay_1", DeviceUri: "socket://10.0.0.9:9100"},
+			want:    []string{"-x", "Zebra_Bay_1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.command.LpadminArguments(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("LpadminArguments() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// stubLpadmin points lpadminPath at a script that records its arguments, one per line, then runs the script.
+func stubLpadmin(t *testing.T, script string) string {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("printer queues are only provisioned on linux & mac")
+	}
+
+	directory := t.TempDir()
+	recorded := filepath.Join(directory, "arguments")
+	stub := filepath.Join(directory, "lpadmin")
+
+	err := ioutil.WriteFile(stub, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > '"+recorded+"'\n"+script+"\n"), 0755)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := lpadminPath
+	lpadminPath = stub
+	t.Cleanup(func() { lpadminPath = previous })
+
+	return recorded
+}
+
+func TestPrinterCommandRun(t *testing.T) {
+
+	recorded := stubLpadmin(t, "exit 0")
+
+	command := PrinterCommand{Action: PrinterCommandCreate, Name: "Zebra_Bay_1", DeviceUri: "socket://10.0.0.9:9100", Driver: PrinterDriverRaw, Description: "Bay 1 labels"}
+
+	if err := command.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	arguments, err := ioutil.ReadFile(recorded)
+
+	if err != nil {
+		t.Fatalf("lpadmin was not run: %v", err)
+	}
+
+	// Each argument is passed as it is, without a shell splitting the description
+	if got, want := strings.Split(strings.TrimSuffix(string(arguments), "\n"), "\n"), command.LpadminArguments(); !reflect.DeepEqual(got, want) {
+		t.Errorf("lpadmin arguments = %q, want %q", got, want)
+	}
+}
+
+func TestPrinterCommandRunFails(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		script  string
+		command PrinterCommand
+		wantErr string
+		wantRun bool
+	}{
+		{
+			name:    "reports the lpadmin output",
+			script:  "echo 'lpadmin: Unable to connect to server' >&2\nexit 1",
+			command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra_Bay_1"},
+			wantErr: "lpadmin: Unable to connect to server",
+			wantRun: true,
+		},
+		{
+			name:    "reports the exit status without output",
+			script:  "exit 2",
+			command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra_Bay_1"},
+			wantErr: "exit status 2",
+			wantRun: true,
+		},
+		{
+			name:    "invalid commands are not run",
+			script:  "exit 0",
+			command: PrinterCommand{Action: PrinterCommandRemove, Name: "Zebra Bay 1"},
+			wantErr: "invalid queue name",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			recorded := stubLpadmin(t, test.script)
+
+			err := test.command.Run()
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Run() error = %v, want %q", err, test.wantErr)
+			}
+
+			if _, statErr := ioutil.ReadFile(recorded); (statErr == nil) != test.wantRun {
+				t.Errorf("lpadmin run = %v, want %v", statErr == nil, test.wantRun)
+			}
+		})
+	}
+}
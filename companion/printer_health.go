@@ -0,0 +1,310 @@
+package companion
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PrinterStateIdle       = "idle"
+	PrinterStateProcessing = "processing"
+	PrinterStateStopped    = "stopped"
+	PrinterStateUnknown    = "unknown"
+)
+
+// PrinterHealth is the state of a printer's queue, so Blade can warn packers before they print.
+// Reasons use the IPP printer-state-reasons keywords without their severity, e.g. media-empty.
+type PrinterHealth struct {
+	Healthy       bool      `json:"healthy" firestore:"healthy"`
+	State         string    `json:"state" firestore:"state"`
+	AcceptingJobs bool      `json:"accepting_jobs" firestore:"accepting_jobs"`
+	Reasons       []string  `json:"reasons" firestore:"reasons"`
+	QueueLength   int       `json:"queue_length" firestore:"queue_length"`
+	Since         time.Time `json:"since" firestore:"since"`
+}
+
+// Equal compares everything except when the health was last changed.
+func (health *PrinterHealth) Equal(compare *PrinterHealth) bool {
+
+	if health == nil || compare == nil {
+		return health == compare
+	}
+
+	if health.Healthy != compare.Healthy || health.State != compare.State || health.AcceptingJobs != compare.AcceptingJobs || health.QueueLength != compare.QueueLength {
+		return false
+	}
+
+	if len(health.Reasons) != len(compare.Reasons) {
+		return false
+	}
+
+	for i := range health.Reasons {
+		if health.Reasons[i] != compare.Reasons[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PrinterHealthProbeTimeout is how long a printer has to answer, so one unreachable printer can't hold up the rest.
+const PrinterHealthProbeTimeout = time.Second * 5
+
+// maxHealthProbes is how many printers are checked at once.
+const maxHealthProbes = 8
+
+// ProbePrinterHealth asks the print system for the state of the printer and its queue.
+func ProbePrinterHealth(printerName string) (*PrinterHealth, error) {
+
+	if printerName == "" {
+		return nil, errors.New("no printer name specified")
+	}
+
+	return Printer{Name: printerName}.ProbeHealth()
+}
+
+// ProbeHealth checks an installed printer's queue, or asks a discovered printer directly. It
+// gives up after PrinterHealthProbeTimeout.
+func (printer Printer) ProbeHealth() (*PrinterHealth, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), PrinterHealthProbeTimeout)
+	defer cancel()
+
+	type probe struct {
+		health *PrinterHealth
+		err    error
+	}
+
+	// The Windows spooler can't be cancelled, so don't wait on it past the timeout either
+	result := make(chan probe, 1)
+
+	go func() {
+		health, err := printer.probeHealth(ctx)
+		result <- probe{health: health, err: err}
+	}()
+
+	select {
+	case probed := <-result:
+		return probed.health, probed.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("printer %s did not answer within %s", printer.Name, PrinterHealthProbeTimeout)
+	}
+}
+
+func (printer Printer) probeHealth(ctx context.Context) (*PrinterHealth, error) {
+
+	if printer.Discovered {
+		return networkPrinterHealth(ctx, printer)
+	}
+
+	var health *PrinterHealth
+	var err error
+
+	if runtime.GOOS == "windows" {
+		health, err = printerHealth(printer.Name)
+	} else {
+		health, err = cupsPrinterHealth(ctx, printer.Name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	health.Since = time.Now()
+
+	return health, nil
+}
+
+// ProbePrintersHealth checks every printer at once, the results are in the same order as the printers.
+func ProbePrintersHealth(printers []Printer) ([]*PrinterHealth, []error) {
+
+	healths := make([]*PrinterHealth, len(printers))
+	errs := make([]error, len(printers))
+
+	probeConcurrently(len(printers), func(i int) {
+		healths[i], errs[i] = printers[i].ProbeHealth()
+	})
+
+	return healths, errs
+}
+
+// probeConcurrently calls probe for each index, at most maxHealthProbes at a time, and waits for them all.
+func probeConcurrently(count int, probe func(i int)) {
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxHealthProbes)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			probe(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func cupsPrinterHealth(ctx context.Context, printerName string) (*PrinterHealth, error) {
+
+	output, err := runCupsCommandContext(ctx, "lpoptions", "-p", printerName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	health := ippPrinterHealth(parseLpOptions(output))
+
+	queue, err := runCupsCommandContext(ctx, "lpstat", "-o", printerName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(queue, "\n") {
+		if strings.TrimSpace(line) != "" {
+			health.QueueLength++
+		}
+	}
+
+	return health, nil
+}
+
+// ippPrinterHealth reads the IPP printer-state, printer-state-reasons & printer-is-accepting-jobs attributes.
+func ippPrinterHealth(attributes map[string]string) *PrinterHealth {
+
+	health := &PrinterHealth{
+		State:         PrinterStateUnknown,
+		AcceptingJobs: attributes["printer-is-accepting-jobs"] == "true",
+		Reasons:       make([]string, 0),
+	}
+
+	// IPP printer-state enum
+	switch attributes["printer-state"] {
+	case "3":
+		health.State = PrinterStateIdle
+	case "4":
+		health.State = PrinterStateProcessing
+	case "5":
+		health.State = PrinterStateStopped
+	}
+
+	healthy := health.AcceptingJobs && health.State != PrinterStateStopped && health.State != PrinterStateUnknown
+
+	for _, reason := range strings.Split(attributes["printer-state-reasons"], ",") {
+		reason = strings.TrimSpace(reason)
+
+		if reason == "" || reason == "none" {
+			continue
+		}
+
+		// Reports & warnings such as toner-low still print
+		switch {
+		case strings.HasSuffix(reason, "-report"):
+			reason = strings.TrimSuffix(reason, "-report")
+		case strings.HasSuffix(reason, "-warning"):
+			reason = strings.TrimSuffix(reason, "-warning")
+		default:
+			reason = strings.TrimSuffix(reason, "-error")
+			healthy = false
+		}
+
+		health.Reasons = append(health.Reasons, reason)
+	}
+
+	health.Healthy = healthy
+
+	return health
+}
+
+func runCupsCommand(name string, args ...string) (string, error) {
+	return runCupsCommandContext(context.Background(), name, args...)
+}
+
+// runCupsCommandContext kills the command once the context is done.
+func runCupsCommandContext(ctx context.Context, name string, args ...string) (string, error) {
+
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	var errBuff bytes.Buffer
+	cmd.Stderr = &errBuff
+
+	output, err := cmd.Output()
+
+	if err != nil {
+		message := strings.TrimSpace(errBuff.String())
+		if message != "" {
+			return "", errors.New(message)
+		}
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// parseLpOptions reads the name=value pairs printed by lpoptions. Values containing
+// spaces are quoted or backslash escaped.
+func parseLpOptions(output string) map[string]string {
+
+	options := make(map[string]string)
+
+	var name strings.Builder
+	var value strings.Builder
+	inValue := false
+	var quote rune
+
+	flush := func() {
+		if name.Len() > 0 {
+			options[name.String()] = value.String()
+		}
+		name.Reset()
+		value.Reset()
+		inValue = false
+	}
+
+	runes := []rune(output)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+
+		switch {
+		case c == '\\' && i+1 < len(runes):
+			i++
+			c = runes[i]
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				continue
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+			continue
+		case c == '=' && !inValue:
+			inValue = true
+			continue
+		}
+
+		if inValue {
+			value.WriteRune(c)
+		} else {
+			name.WriteRune(c)
+		}
+	}
+
+	flush()
+
+	return options
+}
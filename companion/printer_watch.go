@@ -0,0 +1,55 @@
+package companion
+
+import (
+	"os"
+	"time"
+)
+
+// How often CUPS's configuration is checked for changes, a stat of each path is cheap enough to do often.
+const printerWatchInterval = 2 * time.Second
+
+// cupsConfigPaths change whenever a queue is added, changed or removed. The ppd directory changes straight
+// away, printers.conf once cupsd has written its changes out.
+var cupsConfigPaths = []string{"/etc/cups/printers.conf", "/etc/cups/ppd"}
+
+// watchModTimes calls changed whenever any of the paths is modified, created or removed, until stopped.
+func watchModTimes(paths []string, interval time.Duration, stop <-chan struct{}, changed func()) {
+
+	last := modTimes(paths)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := modTimes(paths)
+
+		for _, path := range paths {
+			if !current[path].Equal(last[path]) {
+				changed()
+				break
+			}
+		}
+
+		last = current
+	}
+}
+
+// modTimes are when each path was last modified, the zero time for paths that don't exist.
+func modTimes(paths []string) map[string]time.Time {
+
+	times := make(map[string]time.Time, len(paths))
+
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			times[path] = info.ModTime()
+		}
+	}
+
+	return times
+}
@@ -0,0 +1,64 @@
+package companion
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchModTimes(t *testing.T) {
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "printers.conf")
+	ppd := filepath.Join(dir, "ppd")
+
+	if err := ioutil.WriteFile(conf, []byte("<Printer Office>\n</Printer>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go watchModTimes([]string{conf, ppd}, 10*time.Millisecond, stop, func() { changed <- struct{}{} })
+
+	expectChange := func(name string, want bool) {
+		t.Helper()
+
+		select {
+		case <-changed:
+			if !want {
+				t.Errorf("%s: changed, want no change", name)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Errorf("%s: no change, want one", name)
+			}
+		}
+	}
+
+	expectChange("untouched", false)
+
+	later := time.Now().Add(time.Minute)
+
+	if err := os.Chtimes(conf, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	expectChange("printers.conf rewritten", true)
+	expectChange("nothing since", false)
+
+	if err := os.Mkdir(ppd, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	expectChange("ppd directory created", true)
+
+	if err := os.Remove(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	expectChange("printers.conf removed", true)
+}
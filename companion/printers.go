@@ -6,14 +6,31 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
+// lp reports the spooled job as "request id is <printer>-<number> (1 file(s))"
+var lpRequestIdPattern = regexp.MustCompile(`request id is (\S+)`)
+
 func ListAvailablePrinters() ([]Printer, error) {
 
+	// CUPS can be asked directly, the jar is only needed when it can not
+	if runtime.GOOS != "windows" {
+		printers, err := listCupsPrinters()
+
+		if err == nil {
+			return printers, nil
+		}
+
+		log.Warn().Err(err).Msg("Failed to list the printers from CUPS, falling back to PrinterTools")
+	}
+
 	dir, err := GetConfigDirectory()
 
 	if err != nil {
@@ -39,21 +56,31 @@ func ListAvailablePrinters() ([]Printer, error) {
 	var printers []Printer
 	err = json.Unmarshal(output, &printers)
 
+	discoverCapabilities(printers)
+
 	return printers, nil
 }
 
-func PrintFile(printerName string, printerTray string, file *os.File, quantity int) error {
+// PrintFile sends the file to the printer. On Unix the CUPS job id of the
+// spooled job is returned so it can be cancelled later.
+func PrintFile(printerName string, printerTray string, file *os.File, quantity int, options PrintOptions) (string, error) {
 
 	if printerName == "" {
-		return errors.New("no printer name specified")
+		return "", errors.New("no printer name specified")
 	}
 
 	if quantity <= 0 {
-		return errors.New("invalid print quantity specified")
+		return "", errors.New("invalid print quantity specified")
 	}
 
 	if file == nil {
-		return errors.New("no file to print specified")
+		return "", errors.New("no file to print specified")
+	}
+
+	err := options.Validate()
+
+	if err != nil {
+		return "", err
 	}
 
 	var cmd *exec.Cmd
@@ -65,24 +92,36 @@ func PrintFile(printerName string, printerTray string, file *os.File, quantity i
 		dir, err := GetConfigDirectory()
 
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		// Specify the print quantity
-		settings := fmt.Sprintf("%dx", quantity)
+		settings := []string{fmt.Sprintf("%dx", quantity)}
 
 		// Do we have a specific print tray?
 		if printerTray != "" {
-			settings += fmt.Sprintf(" bin=%s", printerTray)
+			settings = append(settings, fmt.Sprintf("bin=%s", printerTray))
 		}
 
+		sumatraSettings, err := options.SumatraSettings()
+
+		if err != nil {
+			return "", err
+		}
+
+		settings = append(settings, sumatraSettings...)
+
 		// Generate the print command
-		cmd = exec.Command(fmt.Sprintf("%s\\SumatraPDF.exe", dir), "-print-to", fmt.Sprintf("%s", printerName), "-print-settings", settings, fmt.Sprintf("%s", file.Name()))
+		cmd = exec.Command(fmt.Sprintf("%s\\SumatraPDF.exe", dir), "-print-to", fmt.Sprintf("%s", printerName), "-print-settings", strings.Join(settings, ","), fmt.Sprintf("%s", file.Name()))
 	} else {
 
 		log.Info().Msg("Unix runtime detected. Printing via lp")
 
-		cmd = exec.Command("lp", "-d", printerName, "-n", strconv.Itoa(quantity), file.Name())
+		args := []string{"-d", printerName, "-n", strconv.Itoa(quantity)}
+		args = append(args, options.LpArguments()...)
+		args = append(args, file.Name())
+
+		cmd = exec.Command("lp", args...)
 
 	}
 
@@ -98,15 +137,137 @@ func PrintFile(printerName string, printerTray string, file *os.File, quantity i
 
 	if err != nil {
 		log.Error().Str("Error Output", errBuff.String()).Msg("Could not printer")
+		return "", err
+	}
+
+	matches := lpRequestIdPattern.FindStringSubmatch(string(output))
+
+	if len(matches) < 2 {
+		return "", nil
+	}
+
+	return matches[1], nil
+}
+
+// PrintRawFile sends the file to the printer without any driver processing.
+// Used for printer languages such as ZPL.
+func PrintRawFile(printerName string, file *os.File, quantity int) (string, error) {
+
+	if printerName == "" {
+		return "", errors.New("no printer name specified")
+	}
+
+	if quantity <= 0 {
+		return "", errors.New("invalid print quantity specified")
+	}
+
+	if file == nil {
+		return "", errors.New("no file to print specified")
+	}
+
+	if runtime.GOOS == "windows" {
+
+		log.Info().Msg("Windows Runtime detected. Printing raw via the spooler")
+
+		data, err := ioutil.ReadFile(file.Name())
+
+		if err != nil {
+			return "", err
+		}
+
+		return printRaw(printerName, data, quantity)
+	}
+
+	log.Info().Msg("Unix runtime detected. Printing raw via lp")
+
+	cmd := exec.Command("lp", "-d", printerName, "-n", strconv.Itoa(quantity), "-o", "raw", file.Name())
+
+	log.Info().Str("Command", cmd.String()).Msg("About to run raw print command")
+
+	var errBuff bytes.Buffer
+	cmd.Stderr = &errBuff
+
+	output, err := cmd.Output()
+
+	log.Info().Str("output", string(output)).Msg("Read the printer output")
+
+	if err != nil {
+		log.Error().Str("Error Output", errBuff.String()).Msg("Could not print raw file")
+		return "", err
+	}
+
+	matches := lpRequestIdPattern.FindStringSubmatch(string(output))
+
+	if len(matches) < 2 {
+		return "", nil
+	}
+
+	return matches[1], nil
+}
+
+// CancelPrintFile removes a job that has already been spooled to CUPS.
+func CancelPrintFile(printerName string, spoolId string) error {
+
+	if runtime.GOOS == "windows" {
+		return errors.New("cancelling spooled print jobs is not supported on windows")
+	}
+
+	if spoolId == "" {
+		return errors.New("no spooled job id was recorded for the print job")
+	}
+
+	cmd := exec.Command("cancel", spoolId)
+
+	log.Info().Str("Command", cmd.String()).Str("Printer", printerName).Msg("About to cancel spooled print job")
+
+	var errBuff bytes.Buffer
+	cmd.Stderr = &errBuff
+
+	err := cmd.Run()
+
+	if err != nil {
+		log.Error().Str("Error Output", errBuff.String()).Msg("Could not cancel the spooled print job")
 		return err
 	}
 
 	return nil
 }
 
+// SpooledJobPending reports whether a job spooled to CUPS is still queued or printing. Spooled
+// jobs can only be cancelled through CUPS, so there is nothing to wait for on windows.
+func SpooledJobPending(printerName string, spoolId string) (bool, error) {
+
+	if runtime.GOOS == "windows" || spoolId == "" {
+		return false, nil
+	}
+
+	output, err := runCupsCommand("lpstat", "-W", "not-completed", "-o", printerName)
+
+	if err != nil {
+		return false, err
+	}
+
+	return lpstatListsJob(output, spoolId), nil
+}
+
+// lpstatListsJob looks for the job in lpstat -o output, e.g. "Zebra-12 user 1024 Mon 01 Jan 2024"
+func lpstatListsJob(output string, spoolId string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == spoolId {
+			return true
+		}
+	}
+	return false
+}
+
 type Printer struct {
-	Name  string `json:"name" firestore:"name"`
-	Trays []Tray `json:"trays" firestore:"trays"`
+	Name         string               `json:"name" firestore:"name"`
+	Trays        []Tray               `json:"trays" firestore:"trays"`
+	Capabilities *PrinterCapabilities `json:"capabilities" firestore:"capabilities"`
+	Health       *PrinterHealth       `json:"health" firestore:"health"`
+	// Discovered printers were found on the network but are not installed, they are
+	// printed to directly at their device uri
+	Discovered bool `json:"discovered" firestore:"discovered"`
 }
 
 type Tray struct {
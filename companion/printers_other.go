@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package companion
+
+import "errors"
+
+// printRaw is only needed on windows, other platforms print raw files via lp.
+func printRaw(printerName string, data []byte, quantity int) (string, error) {
+	return "", errors.New("raw printing via the spooler api is only supported on windows")
+}
+
+// printerHealth is only needed on windows, other platforms ask CUPS.
+func printerHealth(printerName string) (*PrinterHealth, error) {
+	return nil, errors.New("reading the printer status via the spooler api is only supported on windows")
+}
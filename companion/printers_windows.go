@@ -0,0 +1,234 @@
+//go:build windows
+// +build windows
+
+package companion
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	winspool             = syscall.NewLazyDLL("winspool.drv")
+	procOpenPrinter      = winspool.NewProc("OpenPrinterW")
+	procClosePrinter     = winspool.NewProc("ClosePrinter")
+	procStartDocPrinter  = winspool.NewProc("StartDocPrinterW")
+	procEndDocPrinter    = winspool.NewProc("EndDocPrinter")
+	procStartPagePrinter = winspool.NewProc("StartPagePrinter")
+	procEndPagePrinter   = winspool.NewProc("EndPagePrinter")
+	procWritePrinter     = winspool.NewProc("WritePrinter")
+	procGetPrinter       = winspool.NewProc("GetPrinterW")
+)
+
+// PRINTER_STATUS_* flags from the winspool api, mapped on to the IPP reasons CUPS uses
+var windowsPrinterStatusReasons = []struct {
+	flag    uint32
+	reason  string
+	isError bool
+}{
+	{0x00000001, "paused", true},
+	{0x00000002, "other", true},
+	{0x00000004, "deleting", true},
+	{0x00000008, "media-jam", true},
+	{0x00000010, "media-empty", true},
+	{0x00000020, "media-needed", true},
+	{0x00000040, "media-jam", true},
+	{0x00000080, "offline", true},
+	{0x00000800, "output-area-full", true},
+	{0x00001000, "offline", true},
+	{0x00020000, "toner-low", false},
+	{0x00040000, "toner-empty", true},
+	{0x00100000, "other", true},
+	{0x00200000, "other", true},
+	{0x00400000, "door-open", true},
+}
+
+const (
+	printerStatusPaused          = 0x00000001
+	printerStatusPendingDeletion = 0x00000004
+	printerStatusBusy            = 0x00000200
+	printerStatusPrinting        = 0x00000400
+	printerStatusProcessing      = 0x00004000
+	printerAttributeWorkOffline  = 0x00000400
+)
+
+// PRINTER_INFO_2 from the winspool api
+type printerInfo2 struct {
+	ServerName         *uint16
+	PrinterName        *uint16
+	ShareName          *uint16
+	PortName           *uint16
+	DriverName         *uint16
+	Comment            *uint16
+	Location           *uint16
+	DevMode            uintptr
+	SepFile            *uint16
+	PrintProcessor     *uint16
+	Datatype           *uint16
+	Parameters         *uint16
+	SecurityDescriptor uintptr
+	Attributes         uint32
+	Priority           uint32
+	DefaultPriority    uint32
+	StartTime          uint32
+	UntilTime          uint32
+	Status             uint32
+	Jobs               uint32
+	AveragePPM         uint32
+}
+
+// DOC_INFO_1 from the winspool api
+type docInfo1 struct {
+	DocName    *uint16
+	OutputFile *uint16
+	Datatype   *uint16
+}
+
+// printRaw writes the data straight to the printer with the RAW datatype, bypassing the driver.
+func printRaw(printerName string, data []byte, quantity int) (string, error) {
+
+	if len(data) == 0 {
+		return "", errors.New("no data to print")
+	}
+
+	name, err := syscall.UTF16PtrFromString(printerName)
+
+	if err != nil {
+		return "", err
+	}
+
+	var handle syscall.Handle
+
+	result, _, err := procOpenPrinter.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&handle)), 0)
+
+	if result == 0 {
+		return "", err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer procClosePrinter.Call(uintptr(handle))
+
+	docName, _ := syscall.UTF16PtrFromString("Companion App Label")
+	dataType, _ := syscall.UTF16PtrFromString("RAW")
+
+	info := docInfo1{DocName: docName, Datatype: dataType}
+
+	jobId, _, err := procStartDocPrinter.Call(uintptr(handle), 1, uintptr(unsafe.Pointer(&info)))
+
+	if jobId == 0 {
+		return "", err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer procEndDocPrinter.Call(uintptr(handle))
+
+	result, _, err = procStartPagePrinter.Call(uintptr(handle))
+
+	if result == 0 {
+		return "", err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer procEndPagePrinter.Call(uintptr(handle))
+
+	for i := 0; i < quantity; i++ {
+		var written uint32
+
+		result, _, err = procWritePrinter.Call(uintptr(handle), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), uintptr(unsafe.Pointer(&written)))
+
+		if result == 0 {
+			return "", err
+		}
+
+		if int(written) != len(data) {
+			return "", errors.New("printer did not accept all of the data")
+		}
+	}
+
+	return strconv.Itoa(int(jobId)), nil
+}
+
+// printerHealth reads the status flags & job count of the printer from the spooler.
+func printerHealth(printerName string) (*PrinterHealth, error) {
+
+	name, err := syscall.UTF16PtrFromString(printerName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var handle syscall.Handle
+
+	result, _, err := procOpenPrinter.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&handle)), 0)
+
+	if result == 0 {
+		return nil, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer procClosePrinter.Call(uintptr(handle))
+
+	// The first call tells us how much space the strings need
+	var needed uint32
+	_, _, _ = procGetPrinter.Call(uintptr(handle), 2, 0, 0, uintptr(unsafe.Pointer(&needed)))
+
+	if needed == 0 {
+		return nil, errors.New("could not read the printer status")
+	}
+
+	buffer := make([]byte, needed)
+
+	result, _, err = procGetPrinter.Call(uintptr(handle), 2, uintptr(unsafe.Pointer(&buffer[0])), uintptr(needed), uintptr(unsafe.Pointer(&needed)))
+
+	if result == 0 {
+		return nil, err
+	}
+
+	info := (*printerInfo2)(unsafe.Pointer(&buffer[0]))
+
+	health := &PrinterHealth{
+		Healthy:       true,
+		State:         PrinterStateIdle,
+		AcceptingJobs: info.Status&printerStatusPendingDeletion == 0,
+		Reasons:       make([]string, 0),
+		QueueLength:   int(info.Jobs),
+	}
+
+	if info.Status&(printerStatusBusy|printerStatusPrinting|printerStatusProcessing) != 0 {
+		health.State = PrinterStateProcessing
+	}
+
+	if info.Status&printerStatusPaused != 0 {
+		health.State = PrinterStateStopped
+	}
+
+	seen := make(map[string]bool)
+
+	addReason := func(reason string, isError bool) {
+		if isError {
+			health.Healthy = false
+		}
+		if !seen[reason] {
+			seen[reason] = true
+			health.Reasons = append(health.Reasons, reason)
+		}
+	}
+
+	if info.Attributes&printerAttributeWorkOffline != 0 {
+		addReason("offline", true)
+	}
+
+	for _, status := range windowsPrinterStatusReasons {
+		if info.Status&status.flag != 0 {
+			addReason(status.reason, status.isError)
+		}
+	}
+
+	if !health.AcceptingJobs {
+		health.Healthy = false
+	}
+
+	return health, nil
+}
@@ -0,0 +1,280 @@
+package companion
+
+import (
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	RoleRuleModePropose = "propose"
+	RoleRuleModeAssign  = "assign"
+
+	RoleDecisionProposed = "proposed"
+	RoleDecisionAssigned = "assigned"
+
+	RoleDecisionStatusPending   = "pending"
+	RoleDecisionStatusConfirmed = "confirmed"
+	RoleDecisionStatusRejected  = "rejected"
+
+	maxRoleDecisions = 50
+)
+
+// RoleRule matches newly discovered printers to a role. Every pattern given must match.
+// Rules from the app document are checked before those in the local config.
+type RoleRule struct {
+	Role         string `json:"role" firestore:"role"`
+	NamePattern  string `json:"name_pattern" firestore:"name_pattern"`
+	ModelPattern string `json:"model_pattern" firestore:"model_pattern"`
+	MediaSize    string `json:"media_size" firestore:"media_size"`
+	Tray         string `json:"tray" firestore:"tray"`
+	// propose (the default) records the match for an admin, assign sets the role when it is free
+	Mode string `json:"mode" firestore:"mode"`
+}
+
+// RoleDecision records what a rule did so an admin can confirm or override it.
+// Admins change the status in Blade, the app never changes it after the decision is made.
+type RoleDecision struct {
+	Printer  string    `json:"printer" firestore:"printer"`
+	Role     string    `json:"role" firestore:"role"`
+	Action   string    `json:"action" firestore:"action"`
+	Status   string    `json:"status" firestore:"status"`
+	Rule     RoleRule  `json:"rule" firestore:"rule"`
+	Reason   string    `json:"reason" firestore:"reason"`
+	Previous string    `json:"previous" firestore:"previous"`
+	Created  time.Time `json:"created" firestore:"created"`
+}
+
+// ParsePrinterType reads a role name as used in the rules & history.
+func ParsePrinterType(role string) (PrinterType, error) {
+	for _, printerType := range []PrinterType{Document, LabelSmall, LabelLarge, GiftNote} {
+		if printerType.String() == role {
+			return printerType, nil
+		}
+	}
+	return Document, fmt.Errorf("unknown printer role %q", role)
+}
+
+// Validate checks the role, mode and patterns of the rule.
+func (rule RoleRule) Validate() error {
+
+	if _, err := ParsePrinterType(rule.Role); err != nil {
+		return err
+	}
+
+	if rule.Mode != "" && rule.Mode != RoleRuleModePropose && rule.Mode != RoleRuleModeAssign {
+		return fmt.Errorf("unknown role rule mode %q", rule.Mode)
+	}
+
+	if rule.NamePattern == "" && rule.ModelPattern == "" && rule.MediaSize == "" {
+		return fmt.Errorf("role rule for %s does not match on anything", rule.Role)
+	}
+
+	for _, pattern := range []string{rule.NamePattern, rule.ModelPattern} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid role rule pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// compiledRoleRule is a valid rule with its patterns compiled, so they aren't compiled for every printer.
+type compiledRoleRule struct {
+	RoleRule
+	name  *regexp.Regexp
+	model *regexp.Regexp
+}
+
+// compileRoleRules validates & compiles the rules when they're loaded, invalid rules are logged and left out.
+func compileRoleRules(rules []RoleRule) []compiledRoleRule {
+
+	compiled := make([]compiledRoleRule, 0, len(rules))
+
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			log.Warn().Err(err).Msg("Ignoring invalid role rule")
+			continue
+		}
+
+		compiled = append(compiled, compiledRoleRule{
+			RoleRule: rule,
+			name:     compilePattern(rule.NamePattern),
+			model:    compilePattern(rule.ModelPattern),
+		})
+	}
+
+	return compiled
+}
+
+// Patterns are case insensitive as printer names are rarely consistent. Empty patterns match anything.
+func compilePattern(pattern string) *regexp.Regexp {
+
+	if pattern == "" {
+		return nil
+	}
+
+	return regexp.MustCompile("(?i)" + pattern)
+}
+
+// Matches reports whether the printer meets every condition of the rule.
+func (rule compiledRoleRule) Matches(printer Printer) bool {
+
+	if rule.name != nil && !rule.name.MatchString(printer.Name) {
+		return false
+	}
+
+	capabilities := printer.Capabilities
+	if capabilities == nil {
+		capabilities = &PrinterCapabilities{}
+	}
+
+	if rule.model != nil && !rule.model.MatchString(capabilities.MakeAndModel) {
+		return false
+	}
+
+	if rule.MediaSize != "" {
+		found := false
+		for _, size := range capabilities.MediaSizes {
+			if strings.Contains(strings.ToLower(size), strings.ToLower(rule.MediaSize)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// applyRoleRules checks the new printers against the rules, assigning or proposing roles.
+// It returns true when any decision was made.
+func (app *App) applyRoleRules(printers []Printer, added []string) bool {
+
+	if len(added) == 0 {
+		return false
+	}
+
+	rules := append(append([]compiledRoleRule{}, app.roleRules...), app.localRoleRules...)
+
+	if len(rules) == 0 {
+		return false
+	}
+
+	isNew := make(map[string]bool, len(added))
+	for _, name := range added {
+		isNew[name] = true
+	}
+
+	decided := false
+
+	for _, printer := range printers {
+		if !isNew[printer.Name] {
+			continue
+		}
+
+		for _, rule := range rules {
+			if !rule.Matches(printer) {
+				continue
+			}
+
+			// A printer that drops off & comes back has already been decided
+			if app.hasRoleDecision(printer.Name, rule.Role) {
+				break
+			}
+
+			decision := app.decideRole(printer, rule.RoleRule)
+			decided = true
+
+			log.Info().Str("Printer", decision.Printer).Str("Role", decision.Role).Str("Action", decision.Action).Msg(decision.Reason)
+
+			app.RoleDecisions = append(app.RoleDecisions, decision)
+
+			// The first matching rule decides
+			break
+		}
+	}
+
+	if decided {
+		app.RoleDecisions = trimRoleDecisions(app.RoleDecisions, printers)
+	}
+
+	return decided
+}
+
+// trimRoleDecisions drops the oldest decisions once there are too many, but only for printers that have
+// gone. Dropping the decision for a printer that is still here would decide it again next time it drops off.
+func trimRoleDecisions(decisions []RoleDecision, printers []Printer) []RoleDecision {
+
+	excess := len(decisions) - maxRoleDecisions
+
+	if excess <= 0 {
+		return decisions
+	}
+
+	available := make(map[string]bool, len(printers))
+	for _, printer := range printers {
+		available[printer.Name] = true
+	}
+
+	kept := make([]RoleDecision, 0, len(decisions))
+
+	for _, decision := range decisions {
+		if excess > 0 && !available[decision.Printer] {
+			excess--
+			continue
+		}
+		kept = append(kept, decision)
+	}
+
+	return kept
+}
+
+func (app *App) decideRole(printer Printer, rule RoleRule) RoleDecision {
+
+	printerType, _ := ParsePrinterType(rule.Role)
+	reference := app.printerReferenceFor(printerType)
+
+	decision := RoleDecision{
+		Printer:  printer.Name,
+		Role:     rule.Role,
+		Action:   RoleDecisionProposed,
+		Status:   RoleDecisionStatusPending,
+		Rule:     rule,
+		Previous: reference.Reference,
+		Created:  time.Now(),
+	}
+
+	if rule.Mode != RoleRuleModeAssign {
+		decision.Reason = fmt.Sprintf("Printer %s matches the rule for %s", printer.Name, rule.Role)
+		return decision
+	}
+
+	// Never take a role away from a printer someone has already chosen
+	if reference.Reference != "" || reference.Forwarding != "" {
+		decision.Reason = fmt.Sprintf("Printer %s matches the rule for %s, but the role is already assigned", printer.Name, rule.Role)
+		return decision
+	}
+
+	reference.Reference = printer.Name
+	reference.Name = printer.Name
+	reference.Tray = rule.Tray
+
+	decision.Action = RoleDecisionAssigned
+	decision.Reason = fmt.Sprintf("Assigned printer %s to %s", printer.Name, rule.Role)
+
+	return decision
+}
+
+func (app *App) hasRoleDecision(printerName string, role string) bool {
+	for _, decision := range app.RoleDecisions {
+		if decision.Printer == printerName && decision.Role == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package companion
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// Scale job actions, read is the default when a job has none
+const (
+	ScaleActionRead      = "read"
+	ScaleActionTare      = "tare"
+	ScaleActionZero      = "zero"
+	ScaleActionClearTare = "clear_tare"
+)
+
+var scaleActionMessages = map[string]string{
+	ScaleActionTare:      "The scale was tared.",
+	ScaleActionZero:      "The scale was zeroed.",
+	ScaleActionClearTare: "The tare was cleared.",
+}
+
+// errScaleActionUnsupported is returned when the scale or its driver can't carry out an action.
+var errScaleActionUnsupported = errors.New("the scale does not support this action")
+
+// scaleCommander is a connection that can send commands as well as read the weight.
+type scaleCommander interface {
+	Command(action string, timeout time.Duration) error
+}
+
+// validateScaleAction checks the action is one the app knows, an empty action is a read.
+func validateScaleAction(action string) error {
+	switch action {
+	case "", ScaleActionRead, ScaleActionTare, ScaleActionZero, ScaleActionClearTare:
+		return nil
+	}
+
+	return fmt.Errorf("unknown scale action %q, expected %s, %s, %s or %s", action, ScaleActionRead, ScaleActionTare, ScaleActionZero, ScaleActionClearTare)
+}
+
+// runScaleCommand sends the action over the connection when it supports commands.
+func runScaleCommand(connection scaleConnection, action string, timeout time.Duration) error {
+
+	commander, ok := connection.(scaleCommander)
+
+	if !ok {
+		return fmt.Errorf("%w: %s is not supported when the scale is read through ScaleTools", errScaleActionUnsupported, action)
+	}
+
+	log.Info().Str("Action", action).Msg("Sending a command to the scale")
+
+	return commander.Command(action, timeout)
+}
+
+// RunScaleCommand connects to the configured scale just long enough to carry out the action.
+func RunScaleCommand(scale Scale, action string, timeout time.Duration) error {
+
+	connection, err := openScale(scale)
+
+	if err != nil {
+		return err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer connection.Close()
+
+	return runScaleCommand(connection, action, timeout)
+}
@@ -0,0 +1,313 @@
+package companion
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const DefaultScalePollIntervalSeconds = 5
+
+const (
+	DefaultScaleStableReadings  = 3
+	DefaultScaleToleranceGrams  = 2
+	DefaultScaleTimeoutSeconds  = 10
+	scaleReadTimeoutWithoutData = time.Second
+)
+
+// errScaleReadTimeout is returned when the scale sent nothing, many only report when the weight changes.
+var errScaleReadTimeout = errors.New("timed out waiting for the scales")
+
+// scaleConnection is an open scale that readings can be taken from one after another.
+type scaleConnection interface {
+	Read(timeout time.Duration) (ScaleReading, error)
+	Close() error
+}
+
+// StableOptions decides when the weight has settled.
+type StableOptions struct {
+	// How many readings in a row must agree
+	Readings int
+	// How far apart in grams readings can be and still agree
+	ToleranceGrams float64
+	Timeout        time.Duration
+}
+
+// StableReading is the settled weight, or the last one read when it never settled.
+type StableReading struct {
+	ScaleReading
+	Samples int
+	Settle  time.Duration
+}
+
+// StableOptions applies the defaults to anything not configured.
+func (config ScalesConfiguration) StableOptions() StableOptions {
+
+	options := StableOptions{
+		Readings:       config.StableReadings,
+		ToleranceGrams: config.ToleranceGrams,
+		Timeout:        time.Duration(config.TimeoutSeconds * float64(time.Second)),
+	}
+
+	if options.Readings <= 0 {
+		options.Readings = DefaultScaleStableReadings
+	}
+
+	if options.ToleranceGrams <= 0 {
+		options.ToleranceGrams = DefaultScaleToleranceGrams
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultScaleTimeoutSeconds * time.Second
+	}
+
+	return options
+}
+
+// PollInterval is how often the attached scales are listed, the default when not configured.
+func (config ScalesConfiguration) PollInterval() time.Duration {
+
+	if config.PollIntervalSeconds <= 0 {
+		return DefaultScalePollIntervalSeconds * time.Second
+	}
+
+	return time.Duration(config.PollIntervalSeconds) * time.Second
+}
+
+// openScale connects to the configured scale with its driver.
+func openScale(scale Scale) (scaleConnection, error) {
+
+	switch scale.Driver {
+	case "", ScaleDriverHid:
+		return openHidScale(scale)
+	case ScaleDriverContinuous, ScaleDriverMtSics, ScaleDriverRegex:
+		return openSerialScale(scale)
+	}
+
+	return nil, fmt.Errorf("unknown scale driver %q", scale.Driver)
+}
+
+// openHidScale connects to a USB scale, directly where possible or through ScaleTools.
+func openHidScale(scale Scale) (scaleConnection, error) {
+
+	model := scaleModelFor(scale)
+
+	log.Info().Str("Model", model.Name).Msg("Connecting to the scales")
+
+	if runtime.GOOS == "linux" {
+		connection, err := openHidrawScale(scale)
+
+		if err == nil {
+			return connection, nil
+		}
+
+		log.Warn().Err(err).Msg("Failed to open the scales natively, falling back to ScaleTools")
+	}
+
+	return openScaleToolsConnection(model, scale.Name)
+}
+
+// scaleToolsConnection keeps one ScaleTools running for as long as the scale is open, it sends a
+// line of JSON for every report the scale sends.
+type scaleToolsConnection struct {
+	model  ScaleModel
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	lines  chan []byte
+	exited chan struct{}
+	err    error
+}
+
+func openScaleToolsConnection(model ScaleModel, name string) (scaleConnection, error) {
+
+	cmd, err := scaleToolsCommand("--stream", strconv.Itoa(model.VendorId), strconv.Itoa(model.ProductId), name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// ScaleTools stops when its input is closed, so it never outlives the app
+	stdin, err := cmd.StdinPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+
+	if err != nil {
+		return nil, err
+	}
+
+	connection := &scaleToolsConnection{
+		model:  model,
+		cmd:    cmd,
+		stdin:  stdin,
+		lines:  make(chan []byte, 1),
+		exited: make(chan struct{}),
+	}
+
+	go connection.scan(stdout)
+
+	return connection, nil
+}
+
+// scan passes on each line of output, only the latest is kept when they aren't read fast enough.
+func (connection *scaleToolsConnection) scan(stdout io.Reader) {
+
+	scanner := bufio.NewScanner(stdout)
+
+	for scanner.Scan() {
+		line := append([]byte{}, scanner.Bytes()...)
+
+		select {
+		case <-connection.lines:
+		default:
+		}
+
+		connection.lines <- line
+	}
+
+	connection.err = connection.cmd.Wait()
+
+	if connection.err == nil {
+		connection.err = errors.New("ScaleTools stopped sending readings")
+	}
+
+	close(connection.exited)
+}
+
+func (connection *scaleToolsConnection) Read(timeout time.Duration) (ScaleReading, error) {
+
+	select {
+	case line := <-connection.lines:
+		return decodeScalesOutput(line, connection.model)
+	case <-connection.exited:
+		// The last thing it said is usually why it stopped
+		select {
+		case line := <-connection.lines:
+			return decodeScalesOutput(line, connection.model)
+		default:
+		}
+		return ScaleReading{}, connection.err
+	case <-time.After(timeout):
+		return ScaleReading{}, errScaleReadTimeout
+	}
+}
+
+func (connection *scaleToolsConnection) Close() error {
+
+	_ = connection.stdin.Close()
+
+	select {
+	case <-connection.exited:
+	case <-time.After(time.Second * 2):
+		_ = connection.cmd.Process.Kill()
+		<-connection.exited
+	}
+
+	return nil
+}
+
+// readStable samples the scale until enough readings in a row are stable and within the
+// tolerance of each other. On timeout the last reading is returned with why it wasn't used.
+func readStable(connection scaleConnection, options StableOptions) (StableReading, error) {
+
+	started := time.Now()
+	deadline := started.Add(options.Timeout)
+
+	var result StableReading
+	var interrupted error
+	tracker := stabilityTracker{options: options}
+
+	for {
+		remaining := time.Until(deadline)
+
+		if remaining <= 0 {
+			break
+		}
+
+		if remaining > scaleReadTimeoutWithoutData {
+			remaining = scaleReadTimeoutWithoutData
+		}
+
+		reading, err := connection.Read(remaining)
+
+		// Only what the scale reports counts towards the weight settling, silence is never another reading
+		if errors.Is(err, errScaleReadTimeout) || errors.Is(err, errScaleBusy) {
+			continue
+		}
+
+		// The stream reconnects by itself, start agreeing again with the readings after it
+		if errors.Is(err, errScaleStreamInterrupted) {
+			interrupted = err
+			tracker = stabilityTracker{options: options}
+			continue
+		}
+
+		if err != nil {
+			return result, err
+		}
+
+		result.ScaleReading = reading
+		result.Samples++
+
+		if tracker.Add(reading) {
+			result.Settle = time.Since(started)
+			log.Info().Str("Weight", reading.String()).Int("Samples", result.Samples).Dur("Settle", result.Settle).Msg("The weight has settled")
+			return result, nil
+		}
+	}
+
+	result.Settle = time.Since(started)
+
+	if result.Samples == 0 && interrupted != nil {
+		return result, interrupted
+	}
+
+	if result.Samples == 0 {
+		return result, errScaleReadTimeout
+	}
+
+	reason := result.Err()
+	if reason == nil {
+		reason = errors.New("the readings did not agree")
+	}
+
+	return result, fmt.Errorf("the weight did not settle within %s, last read %s: %w", options.Timeout, result.String(), reason)
+}
+
+// stabilityTracker counts how many readings in a row are stable and agree with each other.
+type stabilityTracker struct {
+	options  StableOptions
+	first    ScaleReading
+	agreeing int
+}
+
+// Add returns true once enough readings have agreed.
+func (tracker *stabilityTracker) Add(reading ScaleReading) bool {
+
+	if !reading.IsStable() {
+		tracker.agreeing = 0
+	} else if tracker.agreeing == 0 || math.Abs(reading.Grams-tracker.first.Grams) > tracker.options.ToleranceGrams {
+		tracker.first = reading
+		tracker.agreeing = 1
+	} else {
+		tracker.agreeing++
+	}
+
+	return tracker.agreeing >= tracker.options.Readings
+}
@@ -0,0 +1,140 @@
+package companion
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedScale replays readings, a nil reading being a read that timed out.
+type scriptedScale struct {
+	readings []*ScaleReading
+}
+
+func (scale *scriptedScale) Read(timeout time.Duration) (ScaleReading, error) {
+
+	if len(scale.readings) == 0 {
+		time.Sleep(timeout)
+		return ScaleReading{}, errScaleReadTimeout
+	}
+
+	reading := scale.readings[0]
+	scale.readings = scale.readings[1:]
+
+	if reading == nil {
+		return ScaleReading{}, errScaleReadTimeout
+	}
+
+	return *reading, nil
+}
+
+func (scale *scriptedScale) Close() error {
+	return nil
+}
+
+func stableGrams(grams float64) *ScaleReading {
+	return &ScaleReading{Unit: "g", Grams: grams, Status: ScaleStatusStable}
+}
+
+func movingGrams(grams float64) *ScaleReading {
+	return &ScaleReading{Unit: "g", Grams: grams, Status: ScaleStatusInMotion}
+}
+
+func TestStabilityTracker(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		readings []*ScaleReading
+		// The reading the weight settles on, 0 when it never does
+		want int
+	}{
+		{name: "agreeing", readings: []*ScaleReading{stableGrams(1000), stableGrams(1001), stableGrams(999)}, want: 3},
+		{name: "on the tolerance", readings: []*ScaleReading{stableGrams(1000), stableGrams(1002), stableGrams(998)}, want: 3},
+		{name: "drifting", readings: []*ScaleReading{stableGrams(1000), stableGrams(1002), stableGrams(1004), stableGrams(1005), stableGrams(1005)}, want: 5},
+		{name: "a jump starts again", readings: []*ScaleReading{stableGrams(1000), stableGrams(1000), stableGrams(1500), stableGrams(1500), stableGrams(1500)}, want: 5},
+		{name: "in motion starts again", readings: []*ScaleReading{stableGrams(1000), stableGrams(1000), movingGrams(1000), stableGrams(1000), stableGrams(1000), stableGrams(1000)}, want: 6},
+		{name: "never still", readings: []*ScaleReading{movingGrams(1000), movingGrams(1000), movingGrams(1000), movingGrams(1000)}},
+		{name: "overweight", readings: []*ScaleReading{{Status: ScaleStatusOverweight}, {Status: ScaleStatusOverweight}, {Status: ScaleStatusOverweight}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			tracker := stabilityTracker{options: StableOptions{Readings: 3, ToleranceGrams: 2}}
+			got := 0
+
+			for i, reading := range test.readings {
+				if tracker.Add(*reading) {
+					got = i + 1
+					break
+				}
+			}
+
+			if got != test.want {
+				t.Errorf("settled on reading %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadStable(t *testing.T) {
+
+	options := StableOptions{Readings: 3, ToleranceGrams: 2, Timeout: 300 * time.Millisecond}
+
+	tests := []struct {
+		name        string
+		readings    []*ScaleReading
+		wantGrams   float64
+		wantSamples int
+		wantErr     string
+	}{
+		{name: "settles", readings: []*ScaleReading{movingGrams(800), stableGrams(1000), stableGrams(1001), stableGrams(1000)}, wantGrams: 1000, wantSamples: 4},
+		{name: "silence in between", readings: []*ScaleReading{stableGrams(1000), nil, nil, stableGrams(1000), nil, stableGrams(1000)}, wantGrams: 1000, wantSamples: 3},
+		// A scale that goes quiet hasn't reported the same weight again
+		{name: "silence isn't agreement", readings: []*ScaleReading{stableGrams(1000), nil, nil, nil, nil}, wantErr: "did not settle", wantSamples: 1},
+		{name: "silent scale", wantErr: errScaleReadTimeout.Error()},
+		{name: "moving until the timeout", readings: []*ScaleReading{movingGrams(1000), movingGrams(1010)}, wantErr: "still settling", wantSamples: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := readStable(&scriptedScale{readings: test.readings}, options)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("readStable() error = %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("readStable() error = %v", err)
+			}
+
+			if got.Samples != test.wantSamples {
+				t.Errorf("readStable() samples = %d, want %d", got.Samples, test.wantSamples)
+			}
+
+			if err == nil && got.Grams != test.wantGrams {
+				t.Errorf("readStable() = %s, want %gg", got.String(), test.wantGrams)
+			}
+		})
+	}
+}
+
+// Readings the stream repeats while the scale is silent are only for the watchers.
+func TestStreamConnectionSkipsRepeats(t *testing.T) {
+
+	connection := &streamConnection{subscriber: &scaleSubscriber{readings: make(chan LiveReading, 1)}}
+
+	connection.subscriber.readings <- LiveReading{ScaleReading: *stableGrams(1000)}
+
+	if _, err := connection.Read(time.Second); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	connection.subscriber.readings <- LiveReading{ScaleReading: *stableGrams(1000), repeated: true}
+
+	if _, err := connection.Read(time.Second); !errors.Is(err, errScaleReadTimeout) {
+		t.Errorf("Read() error = %v for a repeat, want %v", err, errScaleReadTimeout)
+	}
+}
@@ -8,28 +8,68 @@ import (
 )
 
 type ScaleJob struct {
+	Id                 string                 `json:"id" firestore:"id"`
+	Reference          string                 `json:"reference" firestore:"reference"`
+	Action             string                 `json:"action" firestore:"action"`
 	Created            time.Time              `json:"created" firestore:"created"`
 	Message            string                 `json:"message" firestore:"message"`
 	Status             string                 `json:"status" firestore:"status"`
 	Weight             float64                `json:"weight" firestore:"weight"`
+	Reading            *ScaleReading          `json:"reading" firestore:"reading"`
+	SettleMs           int64                  `json:"settle_ms" firestore:"settle_ms"`
+	Samples            int                    `json:"samples" firestore:"samples"`
+	ExpectedWeight     float64                `json:"expected_weight" firestore:"expected_weight"`
+	Tolerance          float64                `json:"tolerance" firestore:"tolerance"`
+	ToleranceType      string                 `json:"tolerance_type" firestore:"tolerance_type"`
+	Verdict            string                 `json:"verdict" firestore:"verdict"`
+	Variance           float64                `json:"variance" firestore:"variance"`
+	VariancePercent    float64                `json:"variance_percent" firestore:"variance_percent"`
 	FirestoreReference *firestore.DocumentRef `json:"-" firestore:"-"`
+	history            *History
+	scale              Scale
+	options            StableOptions
+	stream             *ScaleStream
+	user               string
+	bay                string
 }
 
 type ScalesOutput struct {
 	Error  string `json:"error"`
 	Weight int    `json:"weight"`
+	Report []int  `json:"report"`
 }
 
 func (job *ScaleJob) Handle() {
 
+	if job.Action != "" && job.Action != ScaleActionRead {
+		job.handleCommand()
+		return
+	}
+
 	startRoutineTime := time.Now()
 
-	// Get the File
-	grams, err := job.readScales()
+	check := job.checkWeigh()
+
+	err := check.Validate()
+
+	var reading StableReading
+
+	if err == nil {
+		reading, err = job.readScales()
+	}
 
 	if err != nil {
+		var failed *CheckWeighResult
+
+		// Keep the failed check in the history, the parcel still hasn't been checked
+		if job.ExpectedWeight != 0 {
+			failed = &CheckWeighResult{Verdict: CheckWeighError}
+		}
+
+		job.recordHistory(startRoutineTime, "error", err.Error(), reading.Grams, failed)
 		log.Error().Err(err).Msg("Failed to read scales")
-		_, _ = job.FirestoreReference.Update(context.Background(), []firestore.Update{
+
+		updates := []firestore.Update{
 			{
 				Path:  "message",
 				Value: err.Error(),
@@ -38,17 +78,44 @@ func (job *ScaleJob) Handle() {
 				Path:  "status",
 				Value: "error",
 			},
-		})
+		}
+
+		// The scale answered, let Blade see the last weight & why it couldn't be used
+		if reading.Samples > 0 {
+			updates = append(updates, job.readingUpdates(reading)...)
+		}
+
+		if failed != nil {
+			updates = append(updates, firestore.Update{Path: "verdict", Value: CheckWeighError})
+		}
+
+		_, _ = job.FirestoreReference.Update(context.Background(), updates)
 
 		return
 	}
 
 	log.Debug().Dur("Total Time Taken (ms)", time.Now().Sub(startRoutineTime)).Msg("Completed scale request")
 
-	_, err = job.FirestoreReference.Update(context.Background(), []firestore.Update{
+	message := "Value read okay."
+	updates := job.readingUpdates(reading)
+
+	var result *CheckWeighResult
+
+	if check.IsSet() {
+		checked := check.Check(reading.Grams)
+		result = &checked
+		message = checked.Message(check)
+		updates = append(updates, job.checkWeighUpdates(checked)...)
+
+		log.Info().Str("Verdict", checked.Verdict).Float64("Variance", checked.VarianceGrams).Msg("Check weighed the parcel")
+	}
+
+	job.recordHistory(startRoutineTime, "complete", "", reading.Grams, result)
+
+	_, err = job.FirestoreReference.Update(context.Background(), append([]firestore.Update{
 		{
 			Path:  "message",
-			Value: "Value read okay.",
+			Value: message,
 		},
 		{
 			Path:  "error",
@@ -60,15 +127,165 @@ func (job *ScaleJob) Handle() {
 		},
 		{
 			Path:  "weight",
-			Value: grams,
+			Value: reading.Grams,
 		},
-	})
+	}, updates...))
 
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to save the weight back to firestore")
 	}
 }
 
-func (job *ScaleJob) readScales() (int, error) {
-	return ReadScales()
+// handleCommand tares or zeroes the scale, reporting the outcome like a read.
+func (job *ScaleJob) handleCommand() {
+
+	startRoutineTime := time.Now()
+
+	err := validateScaleAction(job.Action)
+
+	if err == nil {
+		err = job.runCommand()
+	}
+
+	if err != nil {
+		job.recordHistory(startRoutineTime, "error", err.Error(), 0, nil)
+		log.Error().Err(err).Str("Action", job.Action).Msg("Failed to run the scale command")
+
+		_, _ = job.FirestoreReference.Update(context.Background(), []firestore.Update{
+			{
+				Path:  "message",
+				Value: err.Error(),
+			},
+			{
+				Path:  "status",
+				Value: "error",
+			},
+		})
+
+		return
+	}
+
+	message := scaleActionMessages[job.Action]
+
+	log.Debug().Dur("Total Time Taken (ms)", time.Now().Sub(startRoutineTime)).Str("Action", job.Action).Msg("Completed scale command")
+
+	job.recordHistory(startRoutineTime, "complete", message, 0, nil)
+
+	_, err = job.FirestoreReference.Update(context.Background(), []firestore.Update{
+		{
+			Path:  "message",
+			Value: message,
+		},
+		{
+			Path:  "error",
+			Value: "",
+		},
+		{
+			Path:  "status",
+			Value: "complete",
+		},
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save the scale command result back to firestore")
+	}
+}
+
+func (job *ScaleJob) runCommand() error {
+
+	if job.stream != nil {
+		return job.stream.Command(job.Action, job.options.Timeout)
+	}
+
+	return RunScaleCommand(job.scale, job.Action, job.options.Timeout)
+}
+
+func (job *ScaleJob) readScales() (StableReading, error) {
+
+	// Share the connection with anyone watching the live weight, the scale is only opened once between them
+	if job.stream != nil {
+		log.Info().Msg("Reading the scales through the scale stream")
+		return job.stream.ReadStable(job.options)
+	}
+
+	return ReadScales(job.scale, job.options)
+}
+
+func (job *ScaleJob) readingUpdates(reading StableReading) []firestore.Update {
+	return []firestore.Update{
+		{
+			Path:  "reading",
+			Value: reading.ScaleReading,
+		},
+		{
+			Path:  "settle_ms",
+			Value: reading.Settle.Milliseconds(),
+		},
+		{
+			Path:  "samples",
+			Value: reading.Samples,
+		},
+	}
+}
+
+// checkWeigh is the weight the job expects, when it has one.
+func (job *ScaleJob) checkWeigh() CheckWeigh {
+	return CheckWeigh{
+		ExpectedGrams: job.ExpectedWeight,
+		Tolerance:     job.Tolerance,
+		ToleranceType: job.ToleranceType,
+	}
+}
+
+func (job *ScaleJob) checkWeighUpdates(result CheckWeighResult) []firestore.Update {
+	return []firestore.Update{
+		{
+			Path:  "verdict",
+			Value: result.Verdict,
+		},
+		{
+			Path:  "variance",
+			Value: result.VarianceGrams,
+		},
+		{
+			Path:  "variance_percent",
+			Value: result.VariancePercent,
+		},
+		{
+			Path:  "allowed_variance",
+			Value: result.AllowedGrams,
+		},
+	}
+}
+
+func (job *ScaleJob) recordHistory(started time.Time, outcome string, message string, weight float64, check *CheckWeighResult) {
+
+	if job.history == nil {
+		return
+	}
+
+	record := HistoryRecord{
+		Kind:      HistoryKindScale,
+		JobId:     job.Id,
+		Reference: job.Reference,
+		Started:   started,
+		Weight:    weight,
+		User:      job.user,
+		Bay:       job.bay,
+		Outcome:   outcome,
+		Message:   message,
+		TotalMs:   time.Now().Sub(started).Milliseconds(),
+	}
+
+	if check != nil {
+		record.ExpectedWeight = job.ExpectedWeight
+		record.Verdict = check.Verdict
+		record.Variance = check.VarianceGrams
+	}
+
+	err := job.history.Record(record)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to record the scale job in the local history")
+	}
 }
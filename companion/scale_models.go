@@ -0,0 +1,103 @@
+package companion
+
+import "fmt"
+
+// ScaleModel describes how a USB HID POS scale reports its weight. Most scales follow the
+// HID POS usage tables, the quirks cover the ones that don't.
+type ScaleModel struct {
+	Name      string
+	VendorId  int
+	ProductId int
+	// Scales without numbered reports send the status first, with no report ID
+	NoReportId bool
+	// ReportId is the report the weight is sent in, others such as battery or config reports are skipped.
+	// 0 reads every report
+	ReportId byte
+	// Maps the scale's own unit codes onto the HID POS ones
+	UnitCodes map[byte]byte
+	// Feature reports that tare, zero or clear the tare, starting with the report ID. HID POS only has a
+	// control to zero the scale, which is found in the report descriptor when the model doesn't list one
+	Commands map[string][]byte
+}
+
+// hidPosWeightReport is the report ID HID POS scales send the weight in.
+const hidPosWeightReport = 3
+
+// KnownScaleModels are the scales that have been used with the app. They all send the weight in
+// report 3 with the HID POS unit codes, NoReportId & UnitCodes are for models that don't.
+var KnownScaleModels = []ScaleModel{
+	{Name: "DYMO M10", VendorId: 0x0922, ProductId: 0x8003, ReportId: hidPosWeightReport},
+	{Name: "DYMO M25", VendorId: 0x0922, ProductId: 0x8004, ReportId: hidPosWeightReport},
+	{Name: "DYMO S250", VendorId: 0x0922, ProductId: 0x8009, ReportId: hidPosWeightReport},
+	{Name: "SANFORD DYMO 10 lb", VendorId: 0x6096, ProductId: 0x0158, ReportId: hidPosWeightReport},
+	{Name: "Fairbanks Ultegra", VendorId: 0x0b67, ProductId: 0x555e, ReportId: hidPosWeightReport},
+	{Name: "Stamps.com Stainless Steel 5 lb", VendorId: 0x1446, ProductId: 0x6a73, ReportId: hidPosWeightReport},
+	{Name: "Stamps.com Stainless Steel 35 lb", VendorId: 0x1446, ProductId: 0x6a7a, ReportId: hidPosWeightReport},
+	{Name: "Pitney Bowes 10 lb", VendorId: 0x2474, ProductId: 0x0550, ReportId: hidPosWeightReport},
+	{Name: "Pitney Bowes 35 lb", VendorId: 0x2474, ProductId: 0x3550, ReportId: hidPosWeightReport},
+	{Name: "Mettler Toledo PS60", VendorId: 0x0eb8, ProductId: 0xf000, ReportId: hidPosWeightReport},
+}
+
+// FindScaleModel looks up the model for the ids, unknown scales are assumed to follow the spec and
+// send the weight in report 3.
+func FindScaleModel(vendorId int, productId int) ScaleModel {
+
+	if model, ok := knownScaleModel(vendorId, productId); ok {
+		return model
+	}
+
+	return ScaleModel{
+		Name:      fmt.Sprintf("Unknown scale %04x:%04x", vendorId, productId),
+		VendorId:  vendorId,
+		ProductId: productId,
+		ReportId:  hidPosWeightReport,
+	}
+}
+
+func knownScaleModel(vendorId int, productId int) (ScaleModel, bool) {
+	for _, model := range KnownScaleModels {
+		if model.VendorId == vendorId && model.ProductId == productId {
+			return model, true
+		}
+	}
+	return ScaleModel{}, false
+}
+
+// scaleModelFor is the model of the configured scale, the DYMO ScaleTools has always used when none is set.
+func scaleModelFor(scale Scale) ScaleModel {
+
+	if scale.VendorId == 0 && scale.ProductId == 0 {
+		return FindScaleModel(DefaultScaleVendorId, DefaultScaleProductId)
+	}
+
+	return FindScaleModel(scale.VendorId, scale.ProductId)
+}
+
+// normaliseReport strips the report ID & maps the units, leaving status, unit, scaling, LSB & MSB.
+func (model ScaleModel) normaliseReport(report []byte) ([]byte, error) {
+
+	if len(report) == 0 {
+		return nil, fmt.Errorf("scale report is empty")
+	}
+
+	switch {
+	// A report one byte short has no report ID, whatever the model says
+	case model.NoReportId || len(report) == scaleReportLength-1:
+	case model.ReportId != 0 && report[0] != model.ReportId:
+		return nil, fmt.Errorf("%w: skipped report %d, the weight is sent in report %d", errScaleBusy, report[0], model.ReportId)
+	default:
+		report = report[1:]
+	}
+
+	if len(report) < scaleReportLength-1 {
+		return nil, fmt.Errorf("scale report is too short, %d bytes", len(report))
+	}
+
+	normalised := append([]byte{}, report[:scaleReportLength-1]...)
+
+	if unit, ok := model.UnitCodes[normalised[1]]; ok {
+		normalised[1] = unit
+	}
+
+	return normalised, nil
+}
@@ -0,0 +1,74 @@
+package companion
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestScaleModelNormaliseReport(t *testing.T) {
+
+	spec := FindScaleModel(0x1234, 0x5678)
+
+	tests := []struct {
+		name    string
+		model   ScaleModel
+		report  []byte
+		want    []byte
+		wantErr error
+	}{
+		{name: "weight report", model: spec, report: []byte{3, 4, 2, 0, 0xe8, 0x03}, want: []byte{4, 2, 0, 0xe8, 0x03}},
+		{name: "padded report", model: spec, report: []byte{3, 4, 12, 0xff, 0x19, 0x00, 0, 0}, want: []byte{4, 12, 0xff, 0x19, 0x00}},
+		{name: "another report", model: spec, report: []byte{5, 0, 0, 0, 0, 0}, wantErr: errScaleBusy},
+		{name: "report without an id", model: spec, report: []byte{4, 2, 0, 0xe8, 0x03}, want: []byte{4, 2, 0, 0xe8, 0x03}},
+		{name: "model without report ids", model: ScaleModel{NoReportId: true}, report: []byte{4, 2, 0, 0xe8, 0x03, 0}, want: []byte{4, 2, 0, 0xe8, 0x03}},
+		{name: "every report", model: ScaleModel{}, report: []byte{5, 4, 2, 0, 0xe8, 0x03}, want: []byte{4, 2, 0, 0xe8, 0x03}},
+		{name: "own unit codes", model: ScaleModel{ReportId: hidPosWeightReport, UnitCodes: map[byte]byte{0x01: 0x0c}}, report: []byte{3, 4, 1, 0, 0x19, 0}, want: []byte{4, 12, 0, 0x19, 0}},
+		{name: "unmapped unit", model: ScaleModel{ReportId: hidPosWeightReport, UnitCodes: map[byte]byte{0x01: 0x0c}}, report: []byte{3, 4, 11, 0, 0x19, 0}, want: []byte{4, 11, 0, 0x19, 0}},
+		{name: "too short", model: spec, report: []byte{3, 4, 2}},
+		{name: "empty", model: spec, report: []byte{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := test.model.normaliseReport(test.report)
+
+			if test.want == nil {
+				if err == nil || (test.wantErr != nil && !errors.Is(err, test.wantErr)) {
+					t.Fatalf("normaliseReport() = %v, %v, want error %v", got, err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("normaliseReport() = %v, %v, want %v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestFindScaleModel(t *testing.T) {
+
+	if got := FindScaleModel(0x0922, 0x8003); got.Name != "DYMO M10" {
+		t.Errorf("FindScaleModel() = %q, want the DYMO M10", got.Name)
+	}
+
+	got := FindScaleModel(0x1234, 0x5678)
+
+	if got.ReportId != hidPosWeightReport || got.NoReportId || got.UnitCodes != nil {
+		t.Errorf("FindScaleModel() = %+v for an unknown scale, want the HID POS weight report", got)
+	}
+
+	seen := make(map[[2]int]string)
+
+	for _, model := range KnownScaleModels {
+		ids := [2]int{model.VendorId, model.ProductId}
+
+		if other, ok := seen[ids]; ok {
+			t.Errorf("%s has the same ids as %s", model.Name, other)
+		}
+
+		seen[ids] = model.Name
+	}
+}
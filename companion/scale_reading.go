@@ -0,0 +1,136 @@
+package companion
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// HID POS scale status codes
+const (
+	ScaleStatusFault               = 1
+	ScaleStatusStableZero          = 2
+	ScaleStatusInMotion            = 3
+	ScaleStatusStable              = 4
+	ScaleStatusUnderZero           = 5
+	ScaleStatusOverweight          = 6
+	ScaleStatusRequiresCalibration = 7
+	ScaleStatusRequiresRezeroing   = 8
+)
+
+var scaleStates = map[int]string{
+	ScaleStatusFault:               "fault",
+	ScaleStatusStableZero:          "stable_zero",
+	ScaleStatusInMotion:            "in_motion",
+	ScaleStatusStable:              "stable",
+	ScaleStatusUnderZero:           "under_zero",
+	ScaleStatusOverweight:          "overweight",
+	ScaleStatusRequiresCalibration: "requires_calibration",
+	ScaleStatusRequiresRezeroing:   "requires_rezeroing",
+}
+
+var scaleStatusMessages = map[int]string{
+	ScaleStatusFault:               "The scale has reported a fault.",
+	ScaleStatusStableZero:          "There is nothing on the scale.",
+	ScaleStatusInMotion:            "The weight is still settling, try again once the parcel is still.",
+	ScaleStatusUnderZero:           "The weight is under zero, the scale needs zeroing.",
+	ScaleStatusOverweight:          "The weight is over the scale's capacity.",
+	ScaleStatusRequiresCalibration: "The scale needs calibrating.",
+	ScaleStatusRequiresRezeroing:   "The scale needs re-zeroing.",
+}
+
+// scaleUnit is a HID POS weight unit, with how many grams are in one.
+type scaleUnit struct {
+	Symbol string
+	Grams  float64
+}
+
+var scaleUnits = map[byte]scaleUnit{
+	1:  {Symbol: "mg", Grams: 0.001},
+	2:  {Symbol: "g", Grams: 1},
+	3:  {Symbol: "kg", Grams: 1000},
+	4:  {Symbol: "ct", Grams: 0.2},
+	5:  {Symbol: "tael", Grams: 37.799364167},
+	6:  {Symbol: "gr", Grams: 0.06479891},
+	7:  {Symbol: "dwt", Grams: 1.55517384},
+	8:  {Symbol: "t", Grams: 1000000},
+	9:  {Symbol: "ton", Grams: 907184.74},
+	10: {Symbol: "ozt", Grams: 31.1034768},
+	11: {Symbol: "oz", Grams: 28.349523125},
+	12: {Symbol: "lb", Grams: 453.59237},
+}
+
+// ScaleReading is everything the scale reported, so Blade can show the weight as the scale did
+// and explain why it couldn't be used.
+type ScaleReading struct {
+	// Value is the weight in the scale's unit, Raw * 10^Scaling
+	Value   float64 `json:"value" firestore:"value"`
+	Unit    string  `json:"unit" firestore:"unit"`
+	Scaling int     `json:"scaling" firestore:"scaling"`
+	Raw     int     `json:"raw" firestore:"raw"`
+	Grams   float64 `json:"grams" firestore:"grams"`
+	// Status is the HID POS status code, State its name e.g. in_motion or overweight
+	Status    int       `json:"status" firestore:"status"`
+	State     string    `json:"state" firestore:"state"`
+	Timestamp time.Time `json:"timestamp" firestore:"timestamp"`
+}
+
+func newScaleReading(status int, unitCode byte, scaling int, raw int) (ScaleReading, error) {
+
+	unit, ok := scaleUnits[unitCode]
+
+	if !ok {
+		return ScaleReading{}, fmt.Errorf("unknown scale unit code %d", unitCode)
+	}
+
+	value := float64(raw) * math.Pow10(scaling)
+
+	state, ok := scaleStates[status]
+
+	if !ok {
+		state = "unknown"
+	}
+
+	return ScaleReading{
+		Value:     value,
+		Unit:      unit.Symbol,
+		Scaling:   scaling,
+		Raw:       raw,
+		Grams:     value * unit.Grams,
+		Status:    status,
+		State:     state,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// IsStable is true when the weight can be used.
+func (reading ScaleReading) IsStable() bool {
+	return reading.Status == ScaleStatusStable
+}
+
+// Err explains why the weight can't be used, nil when it is stable.
+func (reading ScaleReading) Err() error {
+
+	if reading.IsStable() {
+		return nil
+	}
+
+	if message, ok := scaleStatusMessages[reading.Status]; ok {
+		return errors.New(message)
+	}
+
+	return fmt.Errorf("the scale reported an unknown status %d", reading.Status)
+}
+
+// String is the weight to the scale's precision, e.g. 1.25 kg
+func (reading ScaleReading) String() string {
+
+	decimals := 0
+	if reading.Scaling < 0 {
+		decimals = -reading.Scaling
+	}
+
+	return strconv.FormatFloat(reading.Value, 'f', decimals, 64) + " " + reading.Unit
+}
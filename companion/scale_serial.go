@@ -0,0 +1,409 @@
+package companion
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScaleDriverHid        = "hid"
+	ScaleDriverContinuous = "continuous"
+	ScaleDriverMtSics     = "mt_sics"
+	ScaleDriverRegex      = "regex"
+
+	SerialParityNone = "none"
+	SerialParityEven = "even"
+	SerialParityOdd  = "odd"
+
+	DefaultSerialBaudRate = 9600
+
+	// MT-SICS "send immediately", the weight whether it is stable or not
+	mtSicsWeightRequest = "SI\r\n"
+)
+
+// mtSicsCommands are the MT-SICS commands for each scale action.
+var mtSicsCommands = map[string]string{
+	ScaleActionTare:      "T",
+	ScaleActionZero:      "Z",
+	ScaleActionClearTare: "TAC",
+}
+
+// DefaultContinuousPattern reads the lines most continuous output scales send, e.g. "ST,GS,+  1.234kg"
+// with ST, US or OL saying whether the weight is stable, unstable or overloaded.
+const DefaultContinuousPattern = `(?i)^\s*(?:(?P<overload>OL)|(?P<unstable>US)|ST)?[^-+\d]*(?P<value>[-+]?\s*\d+(?:\.\d+)?)\s*(?P<unit>kg|g|lb|oz)?`
+
+// errScaleBusy is returned when the scale couldn't give a weight this time but may next time.
+var errScaleBusy = errors.New("the scale is busy")
+
+// SerialScale is how to talk to a scale on a serial port.
+type SerialScale struct {
+	// e.g. /dev/ttyUSB0 or COM3
+	Port     string `json:"port" firestore:"port"`
+	BaudRate int    `json:"baud_rate" firestore:"baud_rate"`
+	DataBits int    `json:"data_bits" firestore:"data_bits"`
+	Parity   string `json:"parity" firestore:"parity"`
+	StopBits int    `json:"stop_bits" firestore:"stop_bits"`
+	// Sent to ask for the weight by the regex driver, e.g. "W\r\n"
+	Request string `json:"request" firestore:"request"`
+	// Reads the weight from each line, with value, unit, unstable & overload named groups
+	Pattern string `json:"pattern" firestore:"pattern"`
+	// The unit when the scale doesn't send one
+	Unit string `json:"unit" firestore:"unit"`
+	// Sent to tare, zero or clear the tare by the continuous & regex drivers, e.g. "T\r\n"
+	TareCommand      string `json:"tare_command" firestore:"tare_command"`
+	ZeroCommand      string `json:"zero_command" firestore:"zero_command"`
+	ClearTareCommand string `json:"clear_tare_command" firestore:"clear_tare_command"`
+}
+
+func (config SerialScale) baudRate() int {
+	if config.BaudRate <= 0 {
+		return DefaultSerialBaudRate
+	}
+	return config.BaudRate
+}
+
+// scaleLineParser reads a weight from a line the scale sent.
+type scaleLineParser func(line string) (ScaleReading, error)
+
+// serialScaleConnection reads a line at a time, asking for each one when there is a request.
+type serialScaleConnection struct {
+	port     *serialPort
+	driver   string
+	request  string
+	commands map[string]string
+	parse    scaleLineParser
+	buffer   []byte
+}
+
+func openSerialScale(scale Scale) (scaleConnection, error) {
+
+	config := scale.Serial
+
+	if config.Port == "" {
+		return nil, errors.New("no serial port is configured for the scale")
+	}
+
+	connection := &serialScaleConnection{
+		driver: scale.Driver,
+		commands: map[string]string{
+			ScaleActionTare:      config.TareCommand,
+			ScaleActionZero:      config.ZeroCommand,
+			ScaleActionClearTare: config.ClearTareCommand,
+		},
+	}
+
+	switch scale.Driver {
+	case ScaleDriverContinuous:
+		parser, err := regexScaleParser(defaultString(config.Pattern, DefaultContinuousPattern), config.Unit)
+		if err != nil {
+			return nil, err
+		}
+		connection.parse = parser
+	case ScaleDriverMtSics:
+		connection.request = mtSicsWeightRequest
+		connection.parse = parseMtSicsWeight
+	case ScaleDriverRegex:
+		if config.Request == "" || config.Pattern == "" {
+			return nil, errors.New("the regex scale driver needs a request and a pattern")
+		}
+		parser, err := regexScaleParser(config.Pattern, config.Unit)
+		if err != nil {
+			return nil, err
+		}
+		connection.request = unescapeRequest(config.Request)
+		connection.parse = parser
+	default:
+		return nil, fmt.Errorf("unknown serial scale driver %q", scale.Driver)
+	}
+
+	log.Info().Str("Port", config.Port).Str("Driver", scale.Driver).Int("Baud Rate", config.baudRate()).Msg("Connecting to the serial scale")
+
+	port, err := openSerialPort(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	connection.port = port
+
+	return connection, nil
+}
+
+func (connection *serialScaleConnection) Read(timeout time.Duration) (ScaleReading, error) {
+
+	if connection.request != "" {
+		// Anything left over is an answer to an earlier request
+		connection.buffer = connection.buffer[:0]
+
+		if _, err := connection.port.Write([]byte(connection.request)); err != nil {
+			return ScaleReading{}, err
+		}
+	}
+
+	line, err := connection.readLine(timeout)
+
+	if err != nil {
+		return ScaleReading{}, err
+	}
+
+	log.Debug().Str("Line", line).Msg("Read a line from the serial scale")
+
+	return connection.parse(line)
+}
+
+// readLine waits for the next non empty line, ended by CR, LF or both.
+func (connection *serialScaleConnection) readLine(timeout time.Duration) (string, error) {
+
+	deadline := time.Now().Add(timeout)
+	chunk := make([]byte, 256)
+
+	for {
+		if end := strings.IndexAny(string(connection.buffer), "\r\n"); end >= 0 {
+			line := strings.TrimSpace(string(connection.buffer[:end]))
+			connection.buffer = connection.buffer[end+1:]
+
+			if line != "" {
+				return line, nil
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return "", errScaleReadTimeout
+		}
+
+		n, err := connection.port.Read(chunk)
+
+		if err != nil {
+			return "", err
+		}
+
+		connection.buffer = append(connection.buffer, chunk[:n]...)
+	}
+}
+
+// Command tares or zeroes the scale. MT-SICS scales confirm the command, for the other drivers
+// the configured command is sent and the scale is trusted to carry it out.
+func (connection *serialScaleConnection) Command(action string, timeout time.Duration) error {
+
+	if connection.driver == ScaleDriverMtSics {
+		return connection.mtSicsCommand(mtSicsCommands[action], timeout)
+	}
+
+	command := connection.commands[action]
+
+	if command == "" {
+		return fmt.Errorf("%w: no %s command is configured for the serial scale", errScaleActionUnsupported, strings.ReplaceAll(action, "_", " "))
+	}
+
+	_, err := connection.port.Write([]byte(unescapeRequest(command)))
+
+	return err
+}
+
+// mtSicsCommand sends the command and waits for its answer, e.g. "Z A" or "T S 100.00 g".
+// The scale only answers once it is stable, so this can take a while.
+func (connection *serialScaleConnection) mtSicsCommand(command string, timeout time.Duration) error {
+
+	connection.buffer = connection.buffer[:0]
+
+	if _, err := connection.port.Write([]byte(command + "\r\n")); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		line, err := connection.readLine(time.Until(deadline))
+
+		if err != nil {
+			return fmt.Errorf("no answer from the scale to %s: %w", command, err)
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "E") {
+			return fmt.Errorf("the scale rejected the command: %s", line)
+		}
+
+		// Skip anything left over from reading the weight
+		if len(fields) < 2 || fields[0] != command {
+			continue
+		}
+
+		switch fields[1] {
+		case "A", "S":
+			return nil
+		case "I":
+			return errors.New("the scale could not carry out the command, it may be busy or the weight may not be stable")
+		case "L":
+			return fmt.Errorf("%w: the scale does not accept %s", errScaleActionUnsupported, command)
+		case "+":
+			return errors.New("the weight is over the scale's range")
+		case "-":
+			return errors.New("the weight is under the scale's range")
+		}
+
+		return fmt.Errorf("unexpected MT-SICS response %q", line)
+	}
+}
+
+func (connection *serialScaleConnection) Close() error {
+	return connection.port.Close()
+}
+
+// parseMtSicsWeight reads the answer to SI, e.g. "S S     100.00 g" when stable or "S D" while moving.
+func parseMtSicsWeight(line string) (ScaleReading, error) {
+
+	fields := strings.Fields(line)
+
+	if len(fields) < 2 || fields[0] != "S" {
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "E") {
+			return ScaleReading{}, fmt.Errorf("the scale rejected the command: %s", line)
+		}
+		return ScaleReading{}, fmt.Errorf("unexpected MT-SICS response %q", line)
+	}
+
+	switch fields[1] {
+	case "I":
+		return ScaleReading{}, errScaleBusy
+	case "+":
+		return newScaleReading(ScaleStatusOverweight, scaleUnitGrams, 0, 0)
+	case "-":
+		return newScaleReading(ScaleStatusUnderZero, scaleUnitGrams, 0, 0)
+	}
+
+	if len(fields) < 4 {
+		return ScaleReading{}, fmt.Errorf("unexpected MT-SICS response %q", line)
+	}
+
+	reading, err := parseWeight(fields[2], fields[3])
+
+	if err != nil {
+		return ScaleReading{}, err
+	}
+
+	if fields[1] == "D" {
+		reading.Status = ScaleStatusInMotion
+		reading.State = scaleStates[ScaleStatusInMotion]
+	}
+
+	return reading, nil
+}
+
+// regexScaleParser reads lines with a pattern. The value group is the weight, unit its unit,
+// and anything matched by unstable or overload marks the weight as moving or over capacity.
+func regexScaleParser(pattern string, defaultUnit string) (scaleLineParser, error) {
+
+	expression, err := regexp.Compile(pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid scale pattern: %w", err)
+	}
+
+	if expression.SubexpIndex("value") < 0 {
+		return nil, errors.New("the scale pattern needs a value group, e.g. (?P<value>[-+]?\\d+(?:\\.\\d+)?)")
+	}
+
+	return func(line string) (ScaleReading, error) {
+
+		match := expression.FindStringSubmatch(line)
+
+		if match == nil {
+			return ScaleReading{}, fmt.Errorf("unexpected line from the scale %q", line)
+		}
+
+		group := func(name string) string {
+			if index := expression.SubexpIndex(name); index >= 0 {
+				return match[index]
+			}
+			return ""
+		}
+
+		if group("overload") != "" {
+			return newScaleReading(ScaleStatusOverweight, scaleUnitGrams, 0, 0)
+		}
+
+		reading, err := parseWeight(group("value"), defaultString(group("unit"), defaultUnit))
+
+		if err != nil {
+			return ScaleReading{}, err
+		}
+
+		if group("unstable") != "" {
+			reading.Status = ScaleStatusInMotion
+			reading.State = scaleStates[ScaleStatusInMotion]
+		}
+
+		return reading, nil
+	}, nil
+}
+
+// parseWeight turns a decimal weight in to a reading, keeping the scale's precision. Grams are
+// assumed when there is no unit.
+func parseWeight(value string, unit string) (ScaleReading, error) {
+
+	value = strings.NewReplacer(" ", "", "+", "").Replace(value)
+
+	scaling := 0
+	if point := strings.Index(value, "."); point >= 0 {
+		scaling = -(len(value) - point - 1)
+		value = value[:point] + value[point+1:]
+	}
+
+	raw, err := strconv.Atoi(value)
+
+	if err != nil {
+		return ScaleReading{}, fmt.Errorf("invalid weight %q", value)
+	}
+
+	unitCode := byte(scaleUnitGrams)
+
+	if unit != "" {
+		found := false
+		for code, known := range scaleUnits {
+			if strings.EqualFold(known.Symbol, unit) {
+				unitCode = code
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ScaleReading{}, fmt.Errorf("unknown weight unit %q", unit)
+		}
+	}
+
+	status := ScaleStatusStable
+
+	if raw < 0 {
+		status = ScaleStatusUnderZero
+	} else if raw == 0 {
+		status = ScaleStatusStableZero
+	}
+
+	return newScaleReading(status, unitCode, scaling, raw)
+}
+
+// unescapeRequest allows requests to be written with escapes, e.g. W\r\n
+func unescapeRequest(request string) string {
+
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(request, `"`, `\"`) + `"`)
+
+	if err != nil {
+		return request
+	}
+
+	return unquoted
+}
+
+func defaultString(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,288 @@
+//go:build linux
+// +build linux
+
+package companion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openPty opens a pseudo-terminal to stand in for the scale's serial port. The app opens the slave by
+// its path as it would a real port, the test plays the scale on the master.
+func openPty(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+
+	if err != nil {
+		t.Skipf("pseudo-terminals are not available: %v", err)
+	}
+
+	t.Cleanup(func() { master.Close() })
+
+	var number uint32
+	var ioctlErr error
+
+	// Using the raw connection rather than Fd keeps the master non blocking, so reads can time out
+	raw, err := master.SyscallConn()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = raw.Control(func(fd uintptr) {
+		var unlock int32
+
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+			ioctlErr = errno
+			return
+		}
+
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); errno != 0 {
+			ioctlErr = errno
+		}
+	})
+
+	if err == nil {
+		err = ioctlErr
+	}
+
+	if err != nil {
+		t.Skipf("pseudo-terminals can not be unlocked: %v", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", number)
+}
+
+// serialStep is one exchange with the scale: what the app should send, what the scale replies and
+// what the app should make of it. No reply leaves the app to time out.
+type serialStep struct {
+	name string
+	// An empty action reads the weight
+	action  string
+	expect  string
+	reply   string
+	want    ScaleReading
+	wantErr error
+	// For errors that are only described, not typed
+	wantErrText string
+}
+
+// playScale expects the request on the master, then sends the reply, reporting what went wrong on the channel.
+func playScale(master *os.File, expect string, reply string) <-chan error {
+
+	done := make(chan error, 1)
+
+	go func() {
+		received := make([]byte, 0, len(expect))
+		chunk := make([]byte, 64)
+
+		_ = master.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		for len(received) < len(expect) {
+			n, err := master.Read(chunk)
+
+			if err != nil {
+				done <- fmt.Errorf("the scale received %q before %v, want %q", received, err, expect)
+				return
+			}
+
+			received = append(received, chunk[:n]...)
+		}
+
+		if string(received) != expect {
+			done <- fmt.Errorf("the scale received %q, want %q", received, expect)
+			return
+		}
+
+		if reply != "" {
+			if _, err := master.Write([]byte(reply)); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	return done
+}
+
+func runSerialSteps(t *testing.T, master *os.File, connection scaleConnection, steps []serialStep) {
+	t.Helper()
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+
+			played := playScale(master, step.expect, step.reply)
+
+			timeout := time.Second
+			if step.wantErr == errScaleReadTimeout {
+				timeout = 200 * time.Millisecond
+			}
+
+			var got ScaleReading
+			var err error
+
+			if step.action == "" {
+				got, err = connection.Read(timeout)
+			} else {
+				err = runScaleCommand(connection, step.action, timeout)
+			}
+
+			if playErr := <-played; playErr != nil {
+				t.Fatal(playErr)
+			}
+
+			switch {
+			case step.wantErr != nil:
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("error = %v, want %v", err, step.wantErr)
+				}
+			case step.wantErrText != "":
+				if err == nil || !strings.Contains(err.Error(), step.wantErrText) {
+					t.Fatalf("error = %v, want %q", err, step.wantErrText)
+				}
+			case err != nil:
+				t.Fatalf("error = %v", err)
+			case step.action == "":
+				checkScaleReading(t, got, step.want)
+			}
+		})
+	}
+}
+
+func openPtyScale(t *testing.T, driver string, config SerialScale) (*os.File, scaleConnection) {
+	t.Helper()
+
+	master, port := openPty(t)
+	config.Port = port
+
+	connection, err := openSerialScale(Scale{Driver: driver, Serial: config})
+
+	if err != nil {
+		t.Fatalf("openSerialScale() error = %v", err)
+	}
+
+	t.Cleanup(func() { connection.Close() })
+
+	return master, connection
+}
+
+func TestContinuousSerialScale(t *testing.T) {
+
+	master, connection := openPtyScale(t, ScaleDriverContinuous, SerialScale{TareCommand: `T\r\n`})
+
+	runSerialSteps(t, master, connection, []serialStep{
+		{name: "stable", reply: "ST,GS,+  1.234kg\r\n", want: ScaleReading{Raw: 1234, Scaling: -3, Unit: "kg", Grams: 1234, Status: ScaleStatusStable}},
+		{name: "skips blank lines", reply: "\r\n\r\nUS,GS,+  0.500kg\n", want: ScaleReading{Raw: 500, Scaling: -3, Unit: "kg", Grams: 500, Status: ScaleStatusInMotion}},
+		{name: "overload", reply: "OL,GS,+  9.999kg\r\n", want: ScaleReading{Unit: "g", Status: ScaleStatusOverweight}},
+		{name: "garbage", reply: "ERR,garbage\r\n", wantErrText: "unexpected line from the scale"},
+		{name: "silent", wantErr: errScaleReadTimeout},
+		{name: "partial line", reply: "ST,GS,+  2.0", wantErr: errScaleReadTimeout},
+		{name: "rest of the line", reply: "00kg\r\n", want: ScaleReading{Raw: 2000, Scaling: -3, Unit: "kg", Grams: 2000, Status: ScaleStatusStable}},
+		{name: "tare", action: ScaleActionTare, expect: "T\r\n"},
+		{name: "zero without a command", action: ScaleActionZero, wantErr: errScaleActionUnsupported},
+	})
+}
+
+func TestMtSicsSerialScale(t *testing.T) {
+
+	master, connection := openPtyScale(t, ScaleDriverMtSics, SerialScale{BaudRate: 19200})
+
+	runSerialSteps(t, master, connection, []serialStep{
+		{name: "stable", expect: "SI\r\n", reply: "S S     100.00 g\r\n", want: ScaleReading{Raw: 10000, Scaling: -2, Unit: "g", Grams: 100, Status: ScaleStatusStable}},
+		{name: "moving", expect: "SI\r\n", reply: "S D      1.250 kg\r\n", want: ScaleReading{Raw: 1250, Scaling: -3, Unit: "kg", Grams: 1250, Status: ScaleStatusInMotion}},
+		{name: "busy", expect: "SI\r\n", reply: "S I\r\n", wantErr: errScaleBusy},
+		{name: "rejected", expect: "SI\r\n", reply: "ES\r\n", wantErrText: "the scale rejected the command"},
+		{name: "garbage", expect: "SI\r\n", reply: "\x00\x7f?\r\n", wantErrText: "unexpected MT-SICS response"},
+		{name: "no answer", expect: "SI\r\n", wantErr: errScaleReadTimeout},
+		// The weight answering the last request is still to come when the scale is tared
+		{name: "tare", action: ScaleActionTare, expect: "T\r\n", reply: "S S     100.00 g\r\nT S     100.00 g\r\n"},
+		{name: "zero", action: ScaleActionZero, expect: "Z\r\n", reply: "Z A\r\n"},
+		{name: "zero not stable", action: ScaleActionZero, expect: "Z\r\n", reply: "Z I\r\n", wantErrText: "could not carry out the command"},
+		{name: "clear tare not supported", action: ScaleActionClearTare, expect: "TAC\r\n", reply: "TAC L\r\n", wantErr: errScaleActionUnsupported},
+		{name: "clear tare not known", action: ScaleActionClearTare, expect: "TAC\r\n", reply: "ES\r\n", wantErrText: "the scale rejected the command"},
+		{name: "tare no answer", action: ScaleActionTare, expect: "T\r\n", wantErr: errScaleReadTimeout},
+	})
+}
+
+func TestRegexSerialScale(t *testing.T) {
+
+	master, connection := openPtyScale(t, ScaleDriverRegex, SerialScale{
+		Request: `W\r\n`,
+		Pattern: `(?P<unstable>M)?\s*(?P<value>\d+\.\d+)\s*(?P<unit>kg|lb)?`,
+		Unit:    "lb",
+	})
+
+	runSerialSteps(t, master, connection, []serialStep{
+		{name: "default unit", expect: "W\r\n", reply: "  2.25\r\n", want: ScaleReading{Raw: 225, Scaling: -2, Unit: "lb", Grams: 1020.583, Status: ScaleStatusStable}},
+		{name: "moving", expect: "W\r\n", reply: "M 1.50 kg\r", want: ScaleReading{Raw: 150, Scaling: -2, Unit: "kg", Grams: 1500, Status: ScaleStatusInMotion}},
+		// A late answer to the last request is dropped when the next is sent
+		{name: "no answer", expect: "W\r\n", wantErr: errScaleReadTimeout},
+		{name: "garbage", expect: "W\r\n", reply: "?\r\n", wantErrText: "unexpected line from the scale"},
+		{name: "tare without a command", action: ScaleActionTare, wantErr: errScaleActionUnsupported},
+	})
+}
+
+func TestConfigureSerialPort(t *testing.T) {
+
+	_, connection := openPtyScale(t, ScaleDriverContinuous, SerialScale{BaudRate: 19200, StopBits: 2})
+
+	var termios syscall.Termios
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(connection.(*serialScaleConnection).port.fd), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	// CBAUD isn't in the syscall package
+	if baud := termios.Cflag & 0x100f; baud != syscall.B19200 {
+		t.Errorf("baud = %#x, want B19200", baud)
+	}
+
+	// Ptys always have 8 data bits & no parity, leaving the stop bits to check the line settings were applied
+	if termios.Cflag&syscall.CSTOPB == 0 {
+		t.Errorf("control flags = %#x, want 2 stop bits", termios.Cflag)
+	}
+
+	// Raw mode, nothing the scale sends is echoed back or translated
+	if termios.Lflag != 0 || termios.Iflag != 0 || termios.Oflag != 0 {
+		t.Errorf("flags = %#x, %#x, %#x, want raw mode", termios.Lflag, termios.Iflag, termios.Oflag)
+	}
+}
+
+func TestOpenSerialScaleRejects(t *testing.T) {
+
+	_, port := openPty(t)
+
+	tests := []struct {
+		name   string
+		driver string
+		config SerialScale
+	}{
+		{name: "baud rate", driver: ScaleDriverContinuous, config: SerialScale{Port: port, BaudRate: 12345}},
+		{name: "data bits", driver: ScaleDriverContinuous, config: SerialScale{Port: port, DataBits: 6}},
+		{name: "parity", driver: ScaleDriverContinuous, config: SerialScale{Port: port, Parity: "mark"}},
+		{name: "stop bits", driver: ScaleDriverContinuous, config: SerialScale{Port: port, StopBits: 3}},
+		{name: "regex without a request", driver: ScaleDriverRegex, config: SerialScale{Port: port, Pattern: `(?P<value>\d+)`}},
+		{name: "unknown driver", driver: "modbus", config: SerialScale{Port: port}},
+		{name: "no port", driver: ScaleDriverMtSics},
+		{name: "missing port", driver: ScaleDriverMtSics, config: SerialScale{Port: "/dev/pts/missing"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if connection, err := openSerialScale(Scale{Driver: test.driver, Serial: test.config}); err == nil {
+				connection.Close()
+				t.Error("openSerialScale() succeeded, want an error")
+			}
+		})
+	}
+}
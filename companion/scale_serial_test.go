@@ -0,0 +1,178 @@
+package companion
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// checkScaleReading compares everything but the timestamp, with the grams allowed to differ by rounding.
+func checkScaleReading(t *testing.T, got ScaleReading, want ScaleReading) {
+	t.Helper()
+
+	if got.Raw != want.Raw || got.Scaling != want.Scaling || got.Unit != want.Unit || got.Status != want.Status || got.State != scaleStates[want.Status] {
+		t.Errorf("reading = %+v, want %+v", got, want)
+	}
+
+	if math.Abs(got.Grams-want.Grams) > 0.001 {
+		t.Errorf("grams = %v, want %v", got.Grams, want.Grams)
+	}
+}
+
+func TestParseWeight(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		value   string
+		unit    string
+		want    ScaleReading
+		wantErr bool
+	}{
+		{name: "keeps the precision", value: "1.234", unit: "kg", want: ScaleReading{Raw: 1234, Scaling: -3, Unit: "kg", Grams: 1234, Status: ScaleStatusStable}},
+		{name: "grams without a unit", value: "+ 12", want: ScaleReading{Raw: 12, Unit: "g", Grams: 12, Status: ScaleStatusStable}},
+		{name: "units in any case", value: "2", unit: "OZ", want: ScaleReading{Raw: 2, Unit: "oz", Grams: 56.699, Status: ScaleStatusStable}},
+		{name: "under zero", value: "-0.5", unit: "lb", want: ScaleReading{Raw: -5, Scaling: -1, Unit: "lb", Grams: -226.796, Status: ScaleStatusUnderZero}},
+		{name: "zero", value: "0.00", unit: "g", want: ScaleReading{Scaling: -2, Unit: "g", Status: ScaleStatusStableZero}},
+		{name: "not a number", value: "abc", unit: "g", wantErr: true},
+		{name: "unknown unit", value: "1", unit: "stone", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := parseWeight(test.value, test.unit)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseWeight() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if !test.wantErr {
+				checkScaleReading(t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMtSicsWeight(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		line    string
+		want    ScaleReading
+		wantErr error
+	}{
+		{name: "stable", line: "S S     100.00 g", want: ScaleReading{Raw: 10000, Scaling: -2, Unit: "g", Grams: 100, Status: ScaleStatusStable}},
+		{name: "moving", line: "S D      1.250 kg", want: ScaleReading{Raw: 1250, Scaling: -3, Unit: "kg", Grams: 1250, Status: ScaleStatusInMotion}},
+		{name: "nothing on the scale", line: "S S      0.000 kg", want: ScaleReading{Scaling: -3, Unit: "kg", Status: ScaleStatusStableZero}},
+		{name: "over capacity", line: "S +", want: ScaleReading{Unit: "g", Status: ScaleStatusOverweight}},
+		{name: "under zero", line: "S -", want: ScaleReading{Unit: "g", Status: ScaleStatusUnderZero}},
+		{name: "busy", line: "S I", wantErr: errScaleBusy},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := parseMtSicsWeight(test.line)
+
+			if err != test.wantErr {
+				t.Fatalf("parseMtSicsWeight() error = %v, want %v", err, test.wantErr)
+			}
+
+			if err == nil {
+				checkScaleReading(t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMtSicsWeightRejects(t *testing.T) {
+
+	for _, line := range []string{"ES", "EL", "S S", "", "I4 A \"0123456789\"", "S S 1.0 stone"} {
+		t.Run(line, func(t *testing.T) {
+
+			_, err := parseMtSicsWeight(line)
+
+			if err == nil || errors.Is(err, errScaleBusy) {
+				t.Errorf("parseMtSicsWeight() error = %v, want it to fail", err)
+			}
+		})
+	}
+}
+
+func TestRegexScaleParser(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		pattern     string
+		defaultUnit string
+		line        string
+		want        ScaleReading
+		wantErr     bool
+	}{
+		{name: "default stable", pattern: DefaultContinuousPattern, line: "ST,GS,+  1.234kg", want: ScaleReading{Raw: 1234, Scaling: -3, Unit: "kg", Grams: 1234, Status: ScaleStatusStable}},
+		{name: "default unstable", pattern: DefaultContinuousPattern, line: "US,GS,+  0.500kg", want: ScaleReading{Raw: 500, Scaling: -3, Unit: "kg", Grams: 500, Status: ScaleStatusInMotion}},
+		{name: "default overload", pattern: DefaultContinuousPattern, line: "OL,GS,+  9.999kg", want: ScaleReading{Unit: "g", Status: ScaleStatusOverweight}},
+		{name: "default net under zero", pattern: DefaultContinuousPattern, line: "ST,NT,-  0.010kg", want: ScaleReading{Raw: -10, Scaling: -3, Unit: "kg", Grams: -10, Status: ScaleStatusUnderZero}},
+		{name: "default without a status", pattern: DefaultContinuousPattern, line: "   12.5 G", want: ScaleReading{Raw: 125, Scaling: -1, Unit: "g", Grams: 12.5, Status: ScaleStatusStable}},
+		{name: "default without a unit", pattern: DefaultContinuousPattern, defaultUnit: "lb", line: "ST 2", want: ScaleReading{Raw: 2, Unit: "lb", Grams: 907.185, Status: ScaleStatusStable}},
+		{name: "default garbage", pattern: DefaultContinuousPattern, line: "ST,GS,----kg", wantErr: true},
+		{name: "custom unstable", pattern: `(?P<unstable>M)?\s*(?P<value>\d+\.\d+)\s*(?P<unit>kg|lb)?`, line: "M 1.50 kg", want: ScaleReading{Raw: 150, Scaling: -2, Unit: "kg", Grams: 1500, Status: ScaleStatusInMotion}},
+		{name: "custom default unit", pattern: `(?P<unstable>M)?\s*(?P<value>\d+\.\d+)\s*(?P<unit>kg|lb)?`, defaultUnit: "lb", line: "2.25", want: ScaleReading{Raw: 225, Scaling: -2, Unit: "lb", Grams: 1020.583, Status: ScaleStatusStable}},
+		{name: "custom no match", pattern: `^W(?P<value>\d+)$`, line: "X12", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			parse, err := regexScaleParser(test.pattern, test.defaultUnit)
+
+			if err != nil {
+				t.Fatalf("regexScaleParser() error = %v", err)
+			}
+
+			got, err := parse(test.line)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse(%q) error = %v, wantErr %v", test.line, err, test.wantErr)
+			}
+
+			if !test.wantErr {
+				checkScaleReading(t, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegexScaleParserRejects(t *testing.T) {
+
+	for _, pattern := range []string{`(`, `\d+`, `(?P<weight>\d+)`} {
+		t.Run(pattern, func(t *testing.T) {
+			if _, err := regexScaleParser(pattern, ""); err == nil {
+				t.Error("regexScaleParser() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestUnescapeRequest(t *testing.T) {
+
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{request: `W\r\n`, want: "W\r\n"},
+		{request: `SI`, want: "SI"},
+		{request: `\x1bP\r`, want: "\x1bP\r"},
+		{request: `say "W"\n`, want: "say \"W\"\n"},
+		// Invalid escapes are sent as they are
+		{request: `W\q`, want: `W\q`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.request, func(t *testing.T) {
+			if got := unescapeRequest(test.request); got != test.want {
+				t.Errorf("unescapeRequest() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
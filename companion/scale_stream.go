@@ -0,0 +1,298 @@
+package companion
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultScaleStreamIntervalMs = 250
+	// MinScaleStreamIntervalMs stops watchers asking for readings faster than the scale can give them
+	MinScaleStreamIntervalMs = 50
+)
+
+// errScaleStreamInterrupted is returned when the stream lost the scale, it keeps trying to reconnect.
+var errScaleStreamInterrupted = errors.New("the scale stream was interrupted")
+
+// LiveReading is a reading sent to everyone watching the scale.
+type LiveReading struct {
+	ScaleReading
+	// Stable is what the scale says, Settled is when enough readings agree for the weight to be used
+	Stable  bool   `json:"stable"`
+	Settled bool   `json:"settled"`
+	Error   string `json:"error,omitempty"`
+	// repeated is the last reading sent again while the scale is silent, it isn't a new report
+	repeated bool
+}
+
+type scaleSubscriber struct {
+	readings chan LiveReading
+	interval time.Duration
+	lastSent time.Time
+}
+
+// ScaleStream keeps the scale open while anyone is watching it and shares every reading.
+// Scale jobs read & send commands through it too, so the scale is only ever opened once.
+type ScaleStream struct {
+	scale       func() Scale
+	options     StableOptions
+	subscribers map[*scaleSubscriber]bool
+	commands    chan scaleCommand
+	running     bool
+	mutex       sync.Mutex
+}
+
+// scaleCommand is an action for the stream to send between readings.
+type scaleCommand struct {
+	action   string
+	deadline time.Time
+	result   chan error
+}
+
+// StreamInterval is how often live readings are sent, the default when not configured.
+func (config ScalesConfiguration) StreamInterval() time.Duration {
+
+	if config.StreamIntervalMs <= 0 {
+		return DefaultScaleStreamIntervalMs * time.Millisecond
+	}
+
+	if config.StreamIntervalMs < MinScaleStreamIntervalMs {
+		return MinScaleStreamIntervalMs * time.Millisecond
+	}
+
+	return time.Duration(config.StreamIntervalMs) * time.Millisecond
+}
+
+func NewScaleStream(scale func() Scale, options StableOptions) *ScaleStream {
+	return &ScaleStream{
+		scale:       scale,
+		options:     options,
+		subscribers: make(map[*scaleSubscriber]bool),
+		commands:    make(chan scaleCommand),
+	}
+}
+
+// Subscribe starts receiving readings, at most once per interval. The scale is opened for the first subscriber.
+func (stream *ScaleStream) Subscribe(interval time.Duration) *scaleSubscriber {
+
+	subscriber := &scaleSubscriber{readings: make(chan LiveReading, 1), interval: interval}
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.subscribers[subscriber] = true
+
+	if !stream.running {
+		stream.running = true
+		go stream.run()
+	}
+
+	return subscriber
+}
+
+// Unsubscribe stops the readings. The scale is closed once nobody is subscribed.
+func (stream *ScaleStream) Unsubscribe(subscriber *scaleSubscriber) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	delete(stream.subscribers, subscriber)
+}
+
+// ReadStable waits for the weight to settle using the shared connection, opening the scale when nobody is watching it.
+func (stream *ScaleStream) ReadStable(options StableOptions) (StableReading, error) {
+
+	subscriber := stream.Subscribe(0)
+	defer stream.Unsubscribe(subscriber)
+
+	return readStable(&streamConnection{subscriber: subscriber}, options)
+}
+
+// Command tares or zeroes the scale over the shared connection.
+func (stream *ScaleStream) Command(action string, timeout time.Duration) error {
+
+	subscriber := stream.Subscribe(0)
+	defer stream.Unsubscribe(subscriber)
+
+	command := scaleCommand{action: action, deadline: time.Now().Add(timeout), result: make(chan error, 1)}
+	// Unbuffered, so the command is only sent once the stream has the scale open & takes it
+	commands := stream.commands
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case commands <- command:
+			commands = nil
+		case err := <-command.result:
+			return err
+		case reading := <-subscriber.readings:
+			// The scale couldn't be opened to send the command
+			if reading.Error != "" && commands != nil {
+				return errors.New(reading.Error)
+			}
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for the scale to %s", strings.ReplaceAll(action, "_", " "))
+		}
+	}
+}
+
+func (stream *ScaleStream) run() {
+
+	var connection scaleConnection
+	var opened Scale
+	var last *LiveReading
+	tracker := stabilityTracker{options: stream.options}
+
+	for !stream.stopWhenUnwatched(connection) {
+		scale := stream.scale()
+
+		// Reconnect when the scale is changed in Blade
+		if connection != nil && scale != opened {
+			_ = connection.Close()
+			connection = nil
+		}
+
+		if connection == nil {
+			var err error
+			connection, err = openScale(scale)
+
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to open the scale for streaming")
+				stream.broadcast(LiveReading{Error: err.Error()})
+				time.Sleep(time.Second)
+				continue
+			}
+
+			opened = scale
+			last = nil
+			tracker = stabilityTracker{options: stream.options}
+		}
+
+		select {
+		case command := <-stream.commands:
+			// Whoever sent it has already given up
+			if time.Now().After(command.deadline) {
+				command.result <- errScaleReadTimeout
+				continue
+			}
+
+			command.result <- runScaleCommand(connection, command.action, time.Until(command.deadline))
+
+			// The weight will have changed
+			last = nil
+			tracker = stabilityTracker{options: stream.options}
+			continue
+		default:
+		}
+
+		reading, err := connection.Read(scaleReadTimeoutWithoutData)
+
+		// Nothing new means the weight hasn't changed, keep the watchers up to date without it counting towards settling
+		if errors.Is(err, errScaleReadTimeout) && last != nil {
+			repeat := *last
+			repeat.Timestamp = time.Now()
+			repeat.repeated = true
+			stream.broadcast(repeat)
+			continue
+		}
+
+		if errors.Is(err, errScaleReadTimeout) || errors.Is(err, errScaleBusy) {
+			continue
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to read the scale for streaming")
+			stream.broadcast(LiveReading{Error: err.Error()})
+			_ = connection.Close()
+			connection = nil
+			time.Sleep(time.Second)
+			continue
+		}
+
+		live := LiveReading{
+			ScaleReading: reading,
+			Stable:       reading.IsStable(),
+			Settled:      tracker.Add(reading),
+		}
+
+		last = &live
+		stream.broadcast(live)
+	}
+}
+
+// stopWhenUnwatched closes the scale & marks the stream as stopped once nobody is subscribed, so the next
+// subscriber starts it again. Both happen under the lock so the next stream can't open the scale before
+// this one has closed it.
+func (stream *ScaleStream) stopWhenUnwatched(connection scaleConnection) bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if len(stream.subscribers) > 0 {
+		return false
+	}
+
+	if connection != nil {
+		_ = connection.Close()
+		log.Info().Msg("Closed the scale stream")
+	}
+
+	stream.running = false
+
+	return true
+}
+
+// broadcast sends the reading to each subscriber that is due one. Slow subscribers get the
+// latest reading rather than a backlog.
+func (stream *ScaleStream) broadcast(reading LiveReading) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	for subscriber := range stream.subscribers {
+		if reading.Error == "" && time.Since(subscriber.lastSent) < subscriber.interval {
+			continue
+		}
+
+		select {
+		case <-subscriber.readings:
+		default:
+		}
+
+		subscriber.readings <- reading
+		subscriber.lastSent = time.Now()
+	}
+}
+
+// streamConnection reads from the stream as if it were the scale.
+type streamConnection struct {
+	subscriber *scaleSubscriber
+	// Whether the stream has sent a weight yet, an error before then means the scale couldn't be opened
+	received bool
+}
+
+func (connection *streamConnection) Read(timeout time.Duration) (ScaleReading, error) {
+
+	select {
+	case reading := <-connection.subscriber.readings:
+		if reading.Error != "" && !connection.received {
+			return ScaleReading{}, errors.New(reading.Error)
+		}
+		if reading.Error != "" {
+			return ScaleReading{}, fmt.Errorf("%w: %s", errScaleStreamInterrupted, reading.Error)
+		}
+		// Jobs only count what the scale reports, as they do reading the scale directly
+		if reading.repeated {
+			return ScaleReading{}, errScaleReadTimeout
+		}
+		connection.received = true
+		return reading.ScaleReading, nil
+	case <-time.After(timeout):
+		return ScaleReading{}, errScaleReadTimeout
+	}
+}
+
+func (connection *streamConnection) Close() error {
+	return nil
+}
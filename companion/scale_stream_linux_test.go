@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package companion
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// ptyScaleStream streams a continuous serial scale played on the pty master.
+func ptyScaleStream(t *testing.T) (*os.File, *ScaleStream) {
+	t.Helper()
+
+	master, port := openPty(t)
+	scale := Scale{Driver: ScaleDriverContinuous, Serial: SerialScale{Port: port, TareCommand: `T\r\n`}}
+
+	return master, NewScaleStream(func() Scale { return scale }, StableOptions{Readings: 2, ToleranceGrams: 2, Timeout: 2 * time.Second})
+}
+
+// waitForStreamToStop fails unless the stream has closed the scale once nobody is subscribed.
+func waitForStreamToStop(t *testing.T, stream *ScaleStream) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+
+	for time.Now().Before(deadline) {
+		stream.mutex.Lock()
+		running := stream.running
+		stream.mutex.Unlock()
+
+		if !running {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("the stream is still running without subscribers")
+}
+
+func TestScaleStreamReadStable(t *testing.T) {
+
+	master, stream := ptyScaleStream(t)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				_, _ = master.Write([]byte("ST,GS,+  1.234kg\r\n"))
+			}
+		}
+	}()
+
+	reading, err := stream.ReadStable(stream.options)
+
+	if err != nil {
+		t.Fatalf("ReadStable() error = %v", err)
+	}
+
+	if reading.Grams != 1234 {
+		t.Errorf("ReadStable() = %s, want 1234g", reading.String())
+	}
+
+	waitForStreamToStop(t, stream)
+}
+
+func TestScaleStreamCommand(t *testing.T) {
+
+	master, stream := ptyScaleStream(t)
+
+	played := playScale(master, "T\r\n", "")
+
+	if err := stream.Command(ScaleActionTare, 2*time.Second); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+
+	if err := <-played; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.Command(ScaleActionZero, 2*time.Second); !errors.Is(err, errScaleActionUnsupported) {
+		t.Errorf("Command() error = %v, want %v", err, errScaleActionUnsupported)
+	}
+
+	waitForStreamToStop(t, stream)
+}
+
+// Jobs read through the stream even when nobody is watching, so a scale that can't be opened must fail
+// them straight away as opening it directly would.
+func TestScaleStreamWithoutTheScale(t *testing.T) {
+
+	scale := Scale{Driver: ScaleDriverContinuous, Serial: SerialScale{Port: "/dev/pts/missing"}}
+	stream := NewScaleStream(func() Scale { return scale }, StableOptions{Readings: 2, ToleranceGrams: 2, Timeout: 5 * time.Second})
+
+	started := time.Now()
+
+	if _, err := stream.ReadStable(stream.options); err == nil || errors.Is(err, errScaleReadTimeout) {
+		t.Errorf("ReadStable() error = %v, want why the scale couldn't be opened", err)
+	}
+
+	if err := stream.Command(ScaleActionTare, 5*time.Second); err == nil {
+		t.Error("Command() succeeded without a scale")
+	}
+
+	if elapsed := time.Since(started); elapsed > 4*time.Second {
+		t.Errorf("took %s to fail, want it to fail as soon as the scale couldn't be opened", elapsed)
+	}
+
+	waitForStreamToStop(t, stream)
+}
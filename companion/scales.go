@@ -9,40 +9,223 @@ import (
 	"runtime"
 )
 
-func ReadScales() (int, error) {
-	log.Info().Msg("Sending the read scales command")
+// The Dymo scale ScaleTools has always looked for
+const (
+	DefaultScaleVendorId  = 0x0922
+	DefaultScaleProductId = 0x8003
+)
 
-	dir, err := GetConfigDirectory()
+const (
+	scaleReportLength = 6
+	scaleUnitGrams    = 2
+)
 
-	if err != nil {
-		return 0, err
+// AvailableScale is an attached USB scale that can be selected by its name, serial or path.
+type AvailableScale struct {
+	Name      string `json:"name" firestore:"name"`
+	Product   string `json:"product" firestore:"product"`
+	VendorId  int    `json:"vendor_id" firestore:"vendor_id"`
+	ProductId int    `json:"product_id" firestore:"product_id"`
+	Serial    string `json:"serial" firestore:"serial"`
+	Path      string `json:"path" firestore:"path"`
+}
+
+// newAvailableScale names the scale after its product, with the serial or path to tell
+// identical scales apart.
+func newAvailableScale(product string, vendorId int, productId int, serial string, path string) AvailableScale {
+
+	if product == "" {
+		product = FindScaleModel(vendorId, productId).Name
 	}
 
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.Command("java", "-jar", fmt.Sprintf("%s\\ScaleTools.jar", dir))
-	} else {
-		cmd = exec.Command("java", "-jar", fmt.Sprintf("%s/ScaleTools.jar", dir))
+	identifier := serial
+	if identifier == "" {
+		identifier = path
+	}
+
+	return AvailableScale{
+		Name:      fmt.Sprintf("%s (%s)", product, identifier),
+		Product:   product,
+		VendorId:  vendorId,
+		ProductId: productId,
+		Serial:    serial,
+		Path:      path,
+	}
+}
+
+// Matches reports whether the name given in Blade is this scale's name, serial or path.
+func (available AvailableScale) Matches(name string) bool {
+	return name != "" && (name == available.Name || name == available.Serial || name == available.Path)
+}
+
+// ListAvailableScales lists the attached USB scales. ScaleTools is used where the
+// devices can't be listed directly.
+func ListAvailableScales() ([]AvailableScale, error) {
+
+	if runtime.GOOS == "linux" {
+		scales, err := listHidrawScales()
+
+		if err == nil {
+			return scales, nil
+		}
+
+		log.Warn().Err(err).Msg("Failed to list the scales natively, falling back to ScaleTools")
+	}
+
+	return listScaleTools()
+}
+
+// selectScale picks the configured scale from those attached. Scales were named before they
+// could be selected, so when nothing has the configured name the ids decide.
+func selectScale(scales []AvailableScale, scale Scale) (AvailableScale, error) {
+
+	model := scaleModelFor(scale)
+	idsConfigured := scale.VendorId != 0 || scale.ProductId != 0
+
+	if scale.Name != "" {
+		for _, available := range scales {
+			if available.Matches(scale.Name) && (!idsConfigured || (available.VendorId == model.VendorId && available.ProductId == model.ProductId)) {
+				return available, nil
+			}
+		}
+	}
+
+	for _, available := range scales {
+		if available.VendorId == model.VendorId && available.ProductId == model.ProductId {
+			if scale.Name != "" {
+				log.Warn().Str("Name", scale.Name).Str("Scale", available.Name).Msg("No scale has the configured name, using the first with the configured ids")
+			}
+			return available, nil
+		}
+	}
+
+	return AvailableScale{}, fmt.Errorf("no scale found for %04x:%04x", model.VendorId, model.ProductId)
+}
+
+func equalScales(a []AvailableScale, b []AvailableScale) bool {
+
+	if len(a) != len(b) {
+		return false
 	}
 
-	output, err := cmd.Output()
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ReadScales waits for the configured scale to settle, reading the DYMO ScaleTools has always used
+// when none is set. The last reading is returned alongside the error whenever the scale answered,
+// so its status can be shown.
+func ReadScales(scale Scale, options StableOptions) (StableReading, error) {
+
+	log.Info().Msg("Sending the read scales command")
+
+	connection, err := openScale(scale)
+
 	if err != nil {
-		return 0, err
+		return StableReading{}, err
 	}
 
-	log.Info().Str("output", string(output)).Msg("Read the scales")
+	//goland:noinspection GoUnhandledErrorResult
+	defer connection.Close()
+
+	return readStable(connection, options)
+}
+
+// decodeScalesOutput reads a line of ScaleTools output, which has the raw report when it could read one.
+func decodeScalesOutput(output []byte, model ScaleModel) (ScaleReading, error) {
 
 	var result ScalesOutput
-	err = json.Unmarshal(output, &result)
+	err := json.Unmarshal(output, &result)
 
 	if err != nil {
-		log.Error().Msg("Could not run command")
-		return 0, err
+		log.Error().Str("output", string(output)).Msg("Could not read the ScaleTools output")
+		return ScaleReading{}, err
+	}
+
+	if len(result.Report) > 0 {
+		report := make([]byte, len(result.Report))
+		for i, value := range result.Report {
+			report[i] = byte(value)
+		}
+		return decodeScaleReport(report, model)
 	}
 
 	if result.Error != "" {
-		return 0, errors.New("Failed to get weight: " + result.Error)
+		return ScaleReading{}, errors.New("Failed to get weight: " + result.Error)
+	}
+
+	// Older versions only give the weight in grams
+	return newScaleReading(ScaleStatusStable, scaleUnitGrams, 0, result.Weight)
+}
+
+func listScaleTools() ([]AvailableScale, error) {
+
+	output, err := runScaleTools("--list")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var scales []AvailableScale
+	err = json.Unmarshal(output, &scales)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, scale := range scales {
+		scales[i] = newAvailableScale(scale.Product, scale.VendorId, scale.ProductId, scale.Serial, scale.Path)
+	}
+
+	return scales, nil
+}
+
+func runScaleTools(arguments ...string) ([]byte, error) {
+
+	cmd, err := scaleToolsCommand(arguments...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd.Output()
+}
+
+func scaleToolsCommand(arguments ...string) (*exec.Cmd, error) {
+
+	dir, err := GetConfigDirectory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if runtime.GOOS == "windows" {
+		return exec.Command("java", append([]string{"-jar", fmt.Sprintf("%s\\ScaleTools.jar", dir)}, arguments...)...), nil
+	}
+
+	return exec.Command("java", append([]string{"-jar", fmt.Sprintf("%s/ScaleTools.jar", dir)}, arguments...)...), nil
+}
+
+// decodeScaleReport reads everything from a USB HID POS scale report.
+// Once the model's quirks are dealt with the report is:
+//
+// Byte 0 == Scale Status (1 == Fault, 2 == Stable @ 0, 3 == In Motion, 4 == Stable, 5 == Under 0, 6 == Over Weight, 7 == Requires Calibration, 8 == Requires Re-Zeroing)
+// Byte 1 == Weight Unit
+// Byte 2 == Data Scaling (decimal placement, signed)
+// Byte 3 == Weight LSB
+// Byte 4 == Weight MSB
+func decodeScaleReport(report []byte, model ScaleModel) (ScaleReading, error) {
+
+	report, err := model.normaliseReport(report)
+
+	if err != nil {
+		return ScaleReading{}, err
 	}
 
-	return result.Weight, nil
+	return newScaleReading(int(report[0]), report[1], int(int8(report[2])), int(report[3])+256*int(report[4]))
 }
@@ -0,0 +1,40 @@
+//go:build darwin
+// +build darwin
+
+package companion
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// configureSerialPort puts the port in raw mode with the scale's line settings.
+func configureSerialPort(fd int, config SerialScale) error {
+
+	flags, err := config.controlFlags()
+
+	if err != nil {
+		return err
+	}
+
+	var termios syscall.Termios
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGETA, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return errno
+	}
+
+	termios.Iflag = 0
+	termios.Oflag = 0
+	termios.Lflag = 0
+	termios.Cflag = uint64(flags)
+	termios.Ispeed = uint64(config.baudRate())
+	termios.Ospeed = uint64(config.baudRate())
+	termios.Cc[syscall.VMIN] = 0
+	termios.Cc[syscall.VTIME] = 1
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSETA, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package companion
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var linuxBaudRates = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// configureSerialPort puts the port in raw mode with the scale's line settings.
+func configureSerialPort(fd int, config SerialScale) error {
+
+	baud, ok := linuxBaudRates[config.baudRate()]
+
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", config.baudRate())
+	}
+
+	flags, err := config.controlFlags()
+
+	if err != nil {
+		return err
+	}
+
+	var termios syscall.Termios
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return errno
+	}
+
+	termios.Iflag = 0
+	termios.Oflag = 0
+	termios.Lflag = 0
+	termios.Cflag = uint32(flags) | baud
+	termios.Ispeed = baud
+	termios.Ospeed = baud
+	termios.Cc[syscall.VMIN] = 0
+	termios.Cc[syscall.VTIME] = 1
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
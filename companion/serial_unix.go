@@ -0,0 +1,114 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package companion
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// serialPort is an open serial device. Reads give up after a tenth of a second so
+// callers can apply their own timeouts.
+type serialPort struct {
+	fd int
+}
+
+func openSerialPort(config SerialScale) (*serialPort, error) {
+
+	// Opening non blocking stops the open waiting for a carrier the scale will never raise
+	fd, err := syscall.Open(config.Port, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = configureSerialPort(fd, config)
+
+	if err == nil {
+		err = syscall.SetNonblock(fd, false)
+	}
+
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+
+	return &serialPort{fd: fd}, nil
+}
+
+func (port *serialPort) Read(p []byte) (int, error) {
+	for {
+		n, err := syscall.Read(port.fd, p)
+
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if n < 0 {
+			n = 0
+		}
+
+		return n, err
+	}
+}
+
+func (port *serialPort) Write(p []byte) (int, error) {
+
+	written := 0
+
+	for written < len(p) {
+		n, err := syscall.Write(port.fd, p[written:])
+
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return written, err
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+func (port *serialPort) Close() error {
+	return syscall.Close(port.fd)
+}
+
+// controlFlags are the termios control flags for the data bits, parity & stop bits.
+func (config SerialScale) controlFlags() (uint64, error) {
+
+	flags := uint64(syscall.CREAD | syscall.CLOCAL)
+
+	switch config.DataBits {
+	case 0, 8:
+		flags |= syscall.CS8
+	case 7:
+		flags |= syscall.CS7
+	default:
+		return 0, fmt.Errorf("unsupported data bits %d", config.DataBits)
+	}
+
+	switch config.Parity {
+	case "", SerialParityNone:
+	case SerialParityEven:
+		flags |= syscall.PARENB
+	case SerialParityOdd:
+		flags |= syscall.PARENB | syscall.PARODD
+	default:
+		return 0, fmt.Errorf("unsupported parity %q", config.Parity)
+	}
+
+	switch config.StopBits {
+	case 0, 1:
+	case 2:
+		flags |= syscall.CSTOPB
+	default:
+		return 0, fmt.Errorf("unsupported stop bits %d", config.StopBits)
+	}
+
+	return flags, nil
+}
@@ -0,0 +1,175 @@
+//go:build windows
+// +build windows
+
+package companion
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32            = syscall.NewLazyDLL("kernel32.dll")
+	procGetCommState    = kernel32.NewProc("GetCommState")
+	procSetCommState    = kernel32.NewProc("SetCommState")
+	procSetCommTimeouts = kernel32.NewProc("SetCommTimeouts")
+)
+
+const (
+	dcbBinary       = 0x00000001
+	dcbParity       = 0x00000002
+	dcbDtrControl   = 0x00000010
+	dcbRtsControl   = 0x00001000
+	windowsNoParity = 0
+	windowsOdd      = 1
+	windowsEven     = 2
+	windowsOneStop  = 0
+	windowsTwoStop  = 2
+	maxDword        = 0xffffffff
+)
+
+// DCB from the comm api
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+// COMMTIMEOUTS from the comm api
+type commTimeouts struct {
+	ReadIntervalTimeout         uint32
+	ReadTotalTimeoutMultiplier  uint32
+	ReadTotalTimeoutConstant    uint32
+	WriteTotalTimeoutMultiplier uint32
+	WriteTotalTimeoutConstant   uint32
+}
+
+// serialPort is an open serial device. Reads give up after a tenth of a second so
+// callers can apply their own timeouts.
+type serialPort struct {
+	handle syscall.Handle
+}
+
+func openSerialPort(config SerialScale) (*serialPort, error) {
+
+	// COM10 and above are only reachable through the device namespace
+	path := config.Port
+	if !strings.HasPrefix(path, `\\.\`) {
+		path = `\\.\` + path
+	}
+
+	name, err := syscall.UTF16PtrFromString(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port := &serialPort{handle: handle}
+
+	err = port.configure(config)
+
+	if err != nil {
+		_ = port.Close()
+		return nil, err
+	}
+
+	return port, nil
+}
+
+func (port *serialPort) configure(config SerialScale) error {
+
+	var state dcb
+	state.DCBlength = uint32(unsafe.Sizeof(state))
+
+	if result, _, err := procGetCommState.Call(uintptr(port.handle), uintptr(unsafe.Pointer(&state))); result == 0 {
+		return err
+	}
+
+	state.BaudRate = uint32(config.baudRate())
+	state.Flags = dcbBinary | dcbDtrControl | dcbRtsControl
+
+	switch config.DataBits {
+	case 0, 8:
+		state.ByteSize = 8
+	case 7:
+		state.ByteSize = 7
+	default:
+		return fmt.Errorf("unsupported data bits %d", config.DataBits)
+	}
+
+	switch config.Parity {
+	case "", SerialParityNone:
+		state.Parity = windowsNoParity
+	case SerialParityEven:
+		state.Parity = windowsEven
+		state.Flags |= dcbParity
+	case SerialParityOdd:
+		state.Parity = windowsOdd
+		state.Flags |= dcbParity
+	default:
+		return fmt.Errorf("unsupported parity %q", config.Parity)
+	}
+
+	switch config.StopBits {
+	case 0, 1:
+		state.StopBits = windowsOneStop
+	case 2:
+		state.StopBits = windowsTwoStop
+	default:
+		return fmt.Errorf("unsupported stop bits %d", config.StopBits)
+	}
+
+	if result, _, err := procSetCommState.Call(uintptr(port.handle), uintptr(unsafe.Pointer(&state))); result == 0 {
+		return err
+	}
+
+	// Return as soon as anything arrives, or after 100ms with nothing
+	timeouts := commTimeouts{
+		ReadIntervalTimeout:        maxDword,
+		ReadTotalTimeoutMultiplier: maxDword,
+		ReadTotalTimeoutConstant:   100,
+		WriteTotalTimeoutConstant:  1000,
+	}
+
+	if result, _, err := procSetCommTimeouts.Call(uintptr(port.handle), uintptr(unsafe.Pointer(&timeouts))); result == 0 {
+		return err
+	}
+
+	return nil
+}
+
+func (port *serialPort) Read(p []byte) (int, error) {
+	var n uint32
+	err := syscall.ReadFile(port.handle, p, &n, nil)
+	return int(n), err
+}
+
+func (port *serialPort) Write(p []byte) (int, error) {
+	var n uint32
+	err := syscall.WriteFile(port.handle, p, &n, nil)
+	return int(n), err
+}
+
+func (port *serialPort) Close() error {
+	return syscall.CloseHandle(port.handle)
+}
@@ -0,0 +1,309 @@
+package companion
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultSpoolCacheMaxSizeMb = 256
+const DefaultSpoolCacheMaxAgeHours = 24 * 7
+
+// Files that aren't in the index are only removed once they are this old, another process
+// such as a CLI reprint may be part way through storing them.
+const spoolOrphanGracePeriod = time.Hour
+
+var ErrSpoolEntryNotFound = errors.New("print job could not be found in the spool cache")
+
+// SpoolCache keeps a copy of every file we print so jobs can be reprinted without Blade.
+// Files are stored once by their content hash and an index maps jobs and urls on to them.
+type SpoolCache struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	mutex   sync.Mutex
+}
+
+type SpoolEntry struct {
+	JobId       string           `json:"job_id"`
+	Url         string           `json:"url"`
+	Hash        string           `json:"hash"`
+	ContentType string           `json:"content_type"`
+	Size        int64            `json:"size"`
+	PrinterType PrinterType      `json:"printer_type"`
+	Printer     PrinterReference `json:"printer"`
+	Quantity    int              `json:"quantity"`
+	Options     PrintOptions     `json:"options"`
+	SourceDpi   int              `json:"source_dpi"`
+	Created     time.Time        `json:"created"`
+	// Validators from the download, so the url can be checked for changes before the copy is reused
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// OpenSpoolCache opens the cache in the config directory, creating it when required.
+func OpenSpoolCache(config SpoolCacheConfiguration) (*SpoolCache, error) {
+
+	dir, err := GetConfigDirectory()
+
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &SpoolCache{
+		dir:     filepath.Join(dir, "spool"),
+		maxSize: int64(config.MaxSizeMb) * 1024 * 1024,
+		maxAge:  time.Duration(config.MaxAgeHours) * time.Hour,
+	}
+
+	if cache.maxSize <= 0 {
+		cache.maxSize = DefaultSpoolCacheMaxSizeMb * 1024 * 1024
+	}
+
+	if cache.maxAge <= 0 {
+		cache.maxAge = DefaultSpoolCacheMaxAgeHours * time.Hour
+	}
+
+	err = os.MkdirAll(cache.dir, os.ModePerm)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+// Store copies the file in to the cache and records the job against it.
+func (cache *SpoolCache) Store(entry SpoolEntry, file *os.File) (SpoolEntry, error) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	source, err := os.Open(file.Name())
+
+	if err != nil {
+		return entry, err
+	}
+
+	//goland:noinspection GoUnhandledErrorResult
+	defer source.Close()
+
+	temp, err := ioutil.TempFile(cache.dir, "incoming_*")
+
+	if err != nil {
+		return entry, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), source)
+	_ = temp.Close()
+
+	if err != nil {
+		_ = os.Remove(temp.Name())
+		return entry, err
+	}
+
+	entry.Hash = hex.EncodeToString(hash.Sum(nil))
+	entry.Size = size
+
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+
+	// Identical content is only kept once
+	if _, err := os.Stat(cache.Path(entry)); err == nil {
+		_ = os.Remove(temp.Name())
+	} else if err = os.Rename(temp.Name(), cache.Path(entry)); err != nil {
+		_ = os.Remove(temp.Name())
+		return entry, err
+	}
+
+	entries, err := cache.readIndex()
+
+	if err != nil {
+		return entry, err
+	}
+
+	entries = append(entries, entry)
+
+	entries = cache.prune(entries)
+
+	return entry, cache.writeIndex(entries)
+}
+
+// FindByJob returns the cached entry for a print job id.
+func (cache *SpoolCache) FindByJob(jobId string) (SpoolEntry, error) {
+	return cache.find(func(entry SpoolEntry) bool {
+		return entry.JobId == jobId
+	})
+}
+
+// FindByUrl returns the most recent entry downloaded from the url.
+func (cache *SpoolCache) FindByUrl(url string) (SpoolEntry, error) {
+	return cache.find(func(entry SpoolEntry) bool {
+		return url != "" && entry.Url == url
+	})
+}
+
+// Latest returns the most recently printed entry.
+func (cache *SpoolCache) Latest() (SpoolEntry, error) {
+	return cache.find(func(entry SpoolEntry) bool {
+		return true
+	})
+}
+
+// Entries lists everything in the cache, newest first.
+func (cache *SpoolCache) Entries() ([]SpoolEntry, error) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entries, err := cache.readIndex()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.After(entries[j].Created)
+	})
+
+	return entries, nil
+}
+
+// Path is where the content for the entry is stored.
+func (cache *SpoolCache) Path(entry SpoolEntry) string {
+	return filepath.Join(cache.dir, entry.Hash)
+}
+
+func (cache *SpoolCache) find(match func(entry SpoolEntry) bool) (SpoolEntry, error) {
+
+	entries, err := cache.Entries()
+
+	if err != nil {
+		return SpoolEntry{}, err
+	}
+
+	for _, entry := range entries {
+		if !match(entry) || time.Now().Sub(entry.Created) > cache.maxAge {
+			continue
+		}
+
+		if _, err := os.Stat(cache.Path(entry)); err != nil {
+			continue
+		}
+
+		return entry, nil
+	}
+
+	return SpoolEntry{}, ErrSpoolEntryNotFound
+}
+
+// prune drops entries older than the max age, then the oldest entries until the
+// content fits within the max size. The files of dropped entries are removed, other files
+// that aren't in the index only once they are past the grace period.
+func (cache *SpoolCache) prune(entries []SpoolEntry) []SpoolEntry {
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.After(entries[j].Created)
+	})
+
+	kept := make([]SpoolEntry, 0, len(entries))
+	sizes := make(map[string]int64)
+	indexed := make(map[string]bool)
+	var total int64
+
+	for _, entry := range entries {
+		indexed[entry.Hash] = true
+
+		if time.Now().Sub(entry.Created) > cache.maxAge {
+			continue
+		}
+
+		if _, counted := sizes[entry.Hash]; !counted {
+			if total+entry.Size > cache.maxSize && len(kept) > 0 {
+				continue
+			}
+			sizes[entry.Hash] = entry.Size
+			total += entry.Size
+		}
+
+		kept = append(kept, entry)
+	}
+
+	files, err := ioutil.ReadDir(cache.dir)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read the spool cache directory")
+		return kept
+	}
+
+	for _, file := range files {
+		if _, ok := sizes[file.Name()]; ok || file.Name() == "index.json" || file.IsDir() {
+			continue
+		}
+
+		if !indexed[file.Name()] && time.Now().Sub(file.ModTime()) < spoolOrphanGracePeriod {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(cache.dir, file.Name()))
+
+		if err != nil {
+			log.Warn().Err(err).Str("File", file.Name()).Msg("Failed to remove file from the spool cache")
+		}
+	}
+
+	return kept
+}
+
+func (cache *SpoolCache) readIndex() ([]SpoolEntry, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(cache.dir, "index.json"))
+
+	if os.IsNotExist(err) {
+		return make([]SpoolEntry, 0), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []SpoolEntry
+	err = json.Unmarshal(data, &entries)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Spool cache index is corrupt, starting a new one")
+		return make([]SpoolEntry, 0), nil
+	}
+
+	return entries, nil
+}
+
+func (cache *SpoolCache) writeIndex(entries []SpoolEntry) error {
+
+	data, err := json.Marshal(entries)
+
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(cache.dir, "index.json")
+
+	err = ioutil.WriteFile(path+".tmp", data, os.ModePerm)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
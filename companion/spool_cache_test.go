@@ -0,0 +1,62 @@
+package companion
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolCachePrune(t *testing.T) {
+
+	cache := &SpoolCache{dir: t.TempDir(), maxSize: DefaultSpoolCacheMaxSizeMb * 1024 * 1024, maxAge: time.Hour}
+
+	expired := storeSpoolFile(t, cache, SpoolEntry{JobId: "expired", Created: time.Now().Add(-2 * time.Hour)}, "expired")
+
+	// Another process storing a file, and one that gave up part way through long ago
+	writing := filepath.Join(cache.dir, "incoming_writing")
+	abandoned := filepath.Join(cache.dir, "incoming_abandoned")
+
+	for _, path := range []string{writing, abandoned} {
+		if err := ioutil.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-spoolOrphanGracePeriod - time.Minute)
+
+	if err := os.Chtimes(abandoned, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	current := storeSpoolFile(t, cache, SpoolEntry{JobId: "current"}, "current")
+
+	exists := map[string]bool{
+		"current":   true,
+		"writing":   true,
+		"expired":   false,
+		"abandoned": false,
+		"index":     true,
+	}
+
+	paths := map[string]string{
+		"current":   cache.Path(current),
+		"writing":   writing,
+		"expired":   cache.Path(expired),
+		"abandoned": abandoned,
+		"index":     filepath.Join(cache.dir, "index.json"),
+	}
+
+	for name, want := range exists {
+		if _, err := os.Stat(paths[name]); (err == nil) != want {
+			t.Errorf("%s file exists = %v, want %v", name, err == nil, want)
+		}
+	}
+
+	entries, err := cache.Entries()
+
+	if err != nil || len(entries) != 1 || entries[0].JobId != "current" {
+		t.Errorf("Entries() = %+v, %v, want only the current entry", entries, err)
+	}
+}
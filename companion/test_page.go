@@ -0,0 +1,254 @@
+package companion
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTestPageSize is used for document printers, label printers use their configured media size.
+const DefaultTestPageSize = "A4"
+
+// TestPageInfo is the setup printed on a diagnostic test page.
+type TestPageInfo struct {
+	PrinterName string
+	Tray        string
+	Role        string
+	AppId       string
+	Bay         string
+	Hostname    string
+	Version     string
+	Timestamp   time.Time
+}
+
+// GenerateTestPage builds a single page PDF describing the setup, with alignment marks
+// and a Code 128 barcode so print quality and calibration can be checked.
+func GenerateTestPage(info TestPageInfo, size MediaSize) ([]byte, error) {
+
+	width := size.Width
+	height := size.Height
+
+	// Continuous media needs a length, make it a typical label shape
+	if size.IsContinuous() {
+		height = math.Max(width*1.5, 216)
+	}
+
+	if width < 72 || height < 72 {
+		return nil, fmt.Errorf("test page size of %.0fx%.0fpt is too small", width, height)
+	}
+
+	if info.Timestamp.IsZero() {
+		info.Timestamp = time.Now()
+	}
+
+	var content strings.Builder
+
+	// Everything is relative to the shortest side so labels and documents both fit
+	shortest := math.Min(width, height)
+	fontSize := math.Max(5, math.Min(12, shortest/24))
+	lineHeight := fontSize * 1.4
+	margin := math.Max(9, shortest/16)
+
+	writeTestPageMarks(&content, width, height)
+
+	// Details
+	y := height - margin - fontSize
+	writePdfText(&content, margin, y, fontSize*1.4, "Companion App Test Page")
+	y -= lineHeight * 1.8
+
+	lines := [][2]string{
+		{"Printer", info.PrinterName},
+		{"Tray", info.Tray},
+		{"Role", info.Role},
+		{"Bay", info.Bay},
+		{"App Id", info.AppId},
+		{"Hostname", info.Hostname},
+		{"Version", info.Version},
+		{"Printed", info.Timestamp.Format("2006-01-02 15:04:05 MST")},
+		{"Page Size", fmt.Sprintf("%.1f x %.1f mm", width/pointsPerMillimetre, height/pointsPerMillimetre)},
+	}
+
+	for _, line := range lines {
+		value := line[1]
+		if value == "" {
+			value = "-"
+		}
+		writePdfText(&content, margin, y, fontSize, fmt.Sprintf("%s: %s", line[0], value))
+		y -= lineHeight
+	}
+
+	// Test barcode, sized to fit the page width
+	barcodeValue := fmt.Sprintf("TP%d", info.Timestamp.Unix())
+	modules, err := code128Modules(barcodeValue)
+
+	if err != nil {
+		return nil, err
+	}
+
+	quietZone := 10.0
+	moduleWidth := math.Min(1.5, (width-margin*2)/float64(len(modules)+int(quietZone*2)))
+	barcodeHeight := math.Min(shortest/5, 72)
+	barcodeWidth := moduleWidth * float64(len(modules))
+	barcodeX := (width - barcodeWidth) / 2
+	barcodeY := margin + fontSize*2
+
+	if barcodeY+barcodeHeight < y {
+		for i, bar := range modules {
+			if bar {
+				content.WriteString(fmt.Sprintf("%s %s %s %s re f\n",
+					pdfPoints(barcodeX+float64(i)*moduleWidth), pdfPoints(barcodeY), pdfPoints(moduleWidth), pdfPoints(barcodeHeight)))
+			}
+		}
+
+		writePdfText(&content, barcodeX, barcodeY-fontSize*1.4, fontSize, barcodeValue)
+	}
+
+	return buildSinglePagePdf(width, height, content.String()), nil
+}
+
+// writeTestPageMarks draws a border, corner crop marks 1/4in from each edge, a centre
+// cross and a millimetre ruler along the bottom edge.
+func writeTestPageMarks(content *strings.Builder, width float64, height float64) {
+
+	content.WriteString("0.5 w\n")
+
+	// Border 1/8in in from the edge
+	inset := pointsPerInch / 8
+	content.WriteString(fmt.Sprintf("%s %s %s %s re S\n", pdfPoints(inset), pdfPoints(inset), pdfPoints(width-inset*2), pdfPoints(height-inset*2)))
+
+	// Corner marks
+	corner := pointsPerInch / 4
+	length := pointsPerInch / 8
+	for _, point := range [][2]float64{{corner, corner}, {width - corner, corner}, {corner, height - corner}, {width - corner, height - corner}} {
+		writePdfLine(content, point[0]-length, point[1], point[0]+length, point[1])
+		writePdfLine(content, point[0], point[1]-length, point[0], point[1]+length)
+	}
+
+	// Centre cross
+	writePdfLine(content, width/2-length*2, height/2, width/2+length*2, height/2)
+	writePdfLine(content, width/2, height/2-length*2, width/2, height/2+length*2)
+
+	// Ruler, ticks every millimetre with longer ticks every 5 & 10mm
+	for mm := 0; float64(mm)*pointsPerMillimetre <= width-inset*2; mm++ {
+		x := inset + float64(mm)*pointsPerMillimetre
+		tick := 2.0
+		if mm%10 == 0 {
+			tick = 6
+		} else if mm%5 == 0 {
+			tick = 4
+		}
+		writePdfLine(content, x, inset, x, inset+tick)
+	}
+}
+
+func writePdfLine(content *strings.Builder, x1 float64, y1 float64, x2 float64, y2 float64) {
+	content.WriteString(fmt.Sprintf("%s %s m %s %s l S\n", pdfPoints(x1), pdfPoints(y1), pdfPoints(x2), pdfPoints(y2)))
+}
+
+func writePdfText(content *strings.Builder, x float64, y float64, size float64, text string) {
+	content.WriteString(fmt.Sprintf("BT /F1 %s Tf %s %s Td (%s) Tj ET\n", pdfPoints(size), pdfPoints(x), pdfPoints(y), escapePdfText(text)))
+}
+
+// escapePdfText escapes a literal string. Characters outside ASCII are replaced as the
+// standard fonts are not embedded.
+func escapePdfText(text string) string {
+	var builder strings.Builder
+	for _, c := range text {
+		switch {
+		case c == '\\' || c == '(' || c == ')':
+			builder.WriteRune('\\')
+			builder.WriteRune(c)
+		case c < 0x20 || c > 0x7e:
+			builder.WriteRune('?')
+		default:
+			builder.WriteRune(c)
+		}
+	}
+	return builder.String()
+}
+
+func pdfPoints(value float64) string {
+	return strconv.FormatFloat(roundPoints(value), 'f', -1, 64)
+}
+
+// buildSinglePagePdf writes a PDF with one page using the content stream and Helvetica.
+func buildSinglePagePdf(width float64, height float64, content string) []byte {
+
+	objects := []string{
+		"<</Type /Catalog /Pages 2 0 R>>",
+		"<</Type /Pages /Kids [3 0 R] /Count 1>>",
+		fmt.Sprintf("<</Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources <</Font <</F1 4 0 R>>>> /Contents 5 0 R>>", pdfPoints(width), pdfPoints(height)),
+		"<</Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding>>",
+		fmt.Sprintf("<</Length %d>>\nstream\n%s\nendstream", len(content), content),
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buffer.Len()
+		buffer.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", i+1, object))
+	}
+
+	xref := buffer.Len()
+	buffer.WriteString(fmt.Sprintf("xref\n0 %d\n0000000000 65535 f \n", len(objects)+1))
+	for _, offset := range offsets {
+		buffer.WriteString(fmt.Sprintf("%010d 00000 n \n", offset))
+	}
+
+	buffer.WriteString(fmt.Sprintf("trailer\n<</Size %d /Root 1 0 R>>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref))
+
+	return buffer.Bytes()
+}
+
+// Bar and space widths for each Code 128 symbol value, the last entry is the stop pattern.
+var code128Patterns = []string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const code128StartB = 104
+const code128Stop = 106
+
+// code128Modules encodes the value with code set B, returning true for each black module.
+func code128Modules(value string) ([]bool, error) {
+
+	symbols := []int{code128StartB}
+	checksum := code128StartB
+
+	for i, c := range []byte(value) {
+		if c < 32 || c > 126 {
+			return nil, fmt.Errorf("code128 value %q contains unsupported characters", value)
+		}
+		symbol := int(c) - 32
+		symbols = append(symbols, symbol)
+		checksum += symbol * (i + 1)
+	}
+
+	symbols = append(symbols, checksum%103, code128Stop)
+
+	modules := make([]bool, 0)
+	for _, symbol := range symbols {
+		for i, width := range code128Patterns[symbol] {
+			for j := 0; j < int(width-'0'); j++ {
+				// Patterns alternate bar, space, bar...
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+
+	return modules, nil
+}
@@ -0,0 +1,392 @@
+package companion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	DitherFloydSteinberg = "floyd_steinberg"
+	DitherThreshold      = "threshold"
+
+	DefaultPrinterDpi = 203
+	DefaultThreshold  = 128
+)
+
+// maxZplImagePixels stops a huge image (or a tiny file claiming huge dimensions) using up the
+// memory, every pixel is held as a float while it is converted.
+const maxZplImagePixels = 40 * 1000 * 1000
+
+// ZplImageOptions control how images are converted for printers that only understand ZPL.
+type ZplImageOptions struct {
+	Dpi       int    `json:"dpi" firestore:"dpi"`
+	Dither    string `json:"dither" firestore:"dither"`
+	Threshold int    `json:"threshold" firestore:"threshold"`
+}
+
+func (options ZplImageOptions) withDefaults() ZplImageOptions {
+	if options.Dpi <= 0 {
+		options.Dpi = DefaultPrinterDpi
+	}
+	if options.Dither == "" {
+		options.Dither = DitherFloydSteinberg
+	}
+	if options.Threshold <= 0 || options.Threshold > 255 {
+		options.Threshold = DefaultThreshold
+	}
+	return options
+}
+
+// ConvertImageToZpl turns an image in to a ZPL label holding a single ^GF graphic field.
+// When a media size is given the image is rotated and scaled to fit the label, otherwise
+// it is scaled from the source dpi to the printer dpi. A zero source dpi prints 1:1.
+func ConvertImageToZpl(reader io.Reader, options ZplImageOptions, mediaSize string, sourceDpi int) ([]byte, error) {
+
+	options = options.withDefaults()
+
+	if options.Dither != DitherFloydSteinberg && options.Dither != DitherThreshold {
+		return nil, fmt.Errorf("unsupported dither option %q", options.Dither)
+	}
+
+	// Check the size from the header before decoding, then decode what was read again with the rest
+	var header bytes.Buffer
+
+	config, _, err := image.DecodeConfig(io.TeeReader(reader, &header))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	if err := checkZplImageSize(config.Width, config.Height); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&header, reader))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	gray := toGrayscale(img)
+
+	if gray.width == 0 || gray.height == 0 {
+		return nil, errors.New("image is empty")
+	}
+
+	targetWidth, targetHeight := gray.width, gray.height
+
+	if mediaSize != "" {
+		size, err := ParseMediaSize(mediaSize)
+
+		if err != nil {
+			return nil, err
+		}
+
+		labelWidth := int(math.Round(size.Width / pointsPerInch * float64(options.Dpi)))
+		labelHeight := int(math.Round(size.Height / pointsPerInch * float64(options.Dpi)))
+
+		// Turn the image when its orientation does not match the label
+		if !size.IsContinuous() && (gray.width > gray.height) != (labelWidth > labelHeight) && gray.width != gray.height {
+			gray = gray.rotate()
+		}
+
+		scale := float64(labelWidth) / float64(gray.width)
+		if !size.IsContinuous() {
+			scale = math.Min(scale, float64(labelHeight)/float64(gray.height))
+		}
+
+		targetWidth = int(math.Round(float64(gray.width) * scale))
+		targetHeight = int(math.Round(float64(gray.height) * scale))
+	} else if sourceDpi > 0 {
+		scale := float64(options.Dpi) / float64(sourceDpi)
+		targetWidth = int(math.Round(float64(gray.width) * scale))
+		targetHeight = int(math.Round(float64(gray.height) * scale))
+	}
+
+	if targetWidth <= 0 || targetHeight <= 0 {
+		return nil, errors.New("image is too small to print")
+	}
+
+	if err := checkZplImageSize(targetWidth, targetHeight); err != nil {
+		return nil, err
+	}
+
+	if targetWidth != gray.width || targetHeight != gray.height {
+		gray = gray.resize(targetWidth, targetHeight)
+	}
+
+	var bits *monochromeImage
+	if options.Dither == DitherThreshold {
+		bits = gray.threshold(options.Threshold)
+	} else {
+		bits = gray.floydSteinberg(options.Threshold)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("^XA^FO0,0")
+	buffer.WriteString(bits.graphicField())
+	buffer.WriteString("^FS^XZ\n")
+
+	return buffer.Bytes(), nil
+}
+
+func checkZplImageSize(width int, height int) error {
+	if width > 0 && height > maxZplImagePixels/width {
+		return fmt.Errorf("image is too large to print, %dx%d is over %d pixels", width, height, maxZplImagePixels)
+	}
+	return nil
+}
+
+// grayscaleImage holds luminance values from 0 (black) to 255 (white).
+type grayscaleImage struct {
+	width  int
+	height int
+	pixels []float64
+}
+
+func toGrayscale(img image.Image) *grayscaleImage {
+
+	bounds := img.Bounds()
+	gray := &grayscaleImage{
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+		pixels: make([]float64, bounds.Dx()*bounds.Dy()),
+	}
+
+	for y := 0; y < gray.height; y++ {
+		for x := 0; x < gray.width; x++ {
+			r, g, b, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+
+			// Colours are alpha premultiplied, so compositing on white adds the missing coverage
+			luminance := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			luminance += 0xffff - float64(a)
+
+			gray.pixels[y*gray.width+x] = luminance / 0xffff * 255
+		}
+	}
+
+	return gray
+}
+
+func (gray *grayscaleImage) at(x int, y int) float64 {
+	return gray.pixels[y*gray.width+x]
+}
+
+// rotate turns the image 90 degrees clockwise.
+func (gray *grayscaleImage) rotate() *grayscaleImage {
+
+	rotated := &grayscaleImage{
+		width:  gray.height,
+		height: gray.width,
+		pixels: make([]float64, len(gray.pixels)),
+	}
+
+	for y := 0; y < gray.height; y++ {
+		for x := 0; x < gray.width; x++ {
+			rotated.pixels[x*rotated.width+(gray.height-1-y)] = gray.at(x, y)
+		}
+	}
+
+	return rotated
+}
+
+// resize scales the image with bilinear sampling.
+func (gray *grayscaleImage) resize(width int, height int) *grayscaleImage {
+
+	resized := &grayscaleImage{
+		width:  width,
+		height: height,
+		pixels: make([]float64, width*height),
+	}
+
+	scaleX := float64(gray.width) / float64(width)
+	scaleY := float64(gray.height) / float64(height)
+
+	for y := 0; y < height; y++ {
+		sourceY := math.Max(0, (float64(y)+0.5)*scaleY-0.5)
+		y0 := int(sourceY)
+		y1 := minInt(y0+1, gray.height-1)
+		fy := sourceY - float64(y0)
+
+		for x := 0; x < width; x++ {
+			sourceX := math.Max(0, (float64(x)+0.5)*scaleX-0.5)
+			x0 := int(sourceX)
+			x1 := minInt(x0+1, gray.width-1)
+			fx := sourceX - float64(x0)
+
+			top := gray.at(x0, y0)*(1-fx) + gray.at(x1, y0)*fx
+			bottom := gray.at(x0, y1)*(1-fx) + gray.at(x1, y1)*fx
+
+			resized.pixels[y*width+x] = top*(1-fy) + bottom*fy
+		}
+	}
+
+	return resized
+}
+
+func (gray *grayscaleImage) threshold(threshold int) *monochromeImage {
+
+	bits := newMonochromeImage(gray.width, gray.height)
+
+	for y := 0; y < gray.height; y++ {
+		for x := 0; x < gray.width; x++ {
+			if gray.at(x, y) < float64(threshold) {
+				bits.setBlack(x, y)
+			}
+		}
+	}
+
+	return bits
+}
+
+// floydSteinberg dithers the image, spreading the rounding error on to neighbouring pixels.
+func (gray *grayscaleImage) floydSteinberg(threshold int) *monochromeImage {
+
+	bits := newMonochromeImage(gray.width, gray.height)
+	pixels := make([]float64, len(gray.pixels))
+	copy(pixels, gray.pixels)
+
+	spread := func(x int, y int, amount float64) {
+		if x >= 0 && x < gray.width && y < gray.height {
+			pixels[y*gray.width+x] += amount
+		}
+	}
+
+	for y := 0; y < gray.height; y++ {
+		for x := 0; x < gray.width; x++ {
+			value := pixels[y*gray.width+x]
+
+			output := 255.0
+			if value < float64(threshold) {
+				output = 0
+				bits.setBlack(x, y)
+			}
+
+			remainder := value - output
+			spread(x+1, y, remainder*7/16)
+			spread(x-1, y+1, remainder*3/16)
+			spread(x, y+1, remainder*5/16)
+			spread(x+1, y+1, remainder*1/16)
+		}
+	}
+
+	return bits
+}
+
+// monochromeImage is packed one bit per dot, most significant bit first, 1 == black.
+type monochromeImage struct {
+	width       int
+	height      int
+	bytesPerRow int
+	data        []byte
+}
+
+func newMonochromeImage(width int, height int) *monochromeImage {
+	bytesPerRow := (width + 7) / 8
+	return &monochromeImage{
+		width:       width,
+		height:      height,
+		bytesPerRow: bytesPerRow,
+		data:        make([]byte, bytesPerRow*height),
+	}
+}
+
+func (bits *monochromeImage) setBlack(x int, y int) {
+	bits.data[y*bits.bytesPerRow+x/8] |= 0x80 >> uint(x%8)
+}
+
+// graphicField encodes the image as a ^GFA command using ZPL's ASCII compression.
+func (bits *monochromeImage) graphicField() string {
+
+	var builder strings.Builder
+	total := len(bits.data)
+
+	builder.WriteString(fmt.Sprintf("^GFA,%d,%d,%d,", total, total, bits.bytesPerRow))
+
+	previous := ""
+	for y := 0; y < bits.height; y++ {
+		row := fmt.Sprintf("%X", bits.data[y*bits.bytesPerRow:(y+1)*bits.bytesPerRow])
+
+		// A colon repeats the previous row
+		if row == previous {
+			builder.WriteString(":")
+			continue
+		}
+		previous = row
+
+		builder.WriteString(compressZplRow(row))
+	}
+
+	return builder.String()
+}
+
+// compressZplRow run length encodes a row of hex. Trailing zeros become "," and trailing ones "!".
+func compressZplRow(row string) string {
+
+	var builder strings.Builder
+
+	trimmed := strings.TrimRight(row, "0")
+	suffix := ","
+	if trimmed == row {
+		trimmed = strings.TrimRight(row, "F")
+		suffix = "!"
+		if trimmed == row {
+			suffix = ""
+		}
+	}
+
+	for i := 0; i < len(trimmed); {
+		j := i
+		for j < len(trimmed) && trimmed[j] == trimmed[i] {
+			j++
+		}
+		builder.WriteString(zplRepeatCount(j - i))
+		builder.WriteByte(trimmed[i])
+		i = j
+	}
+
+	builder.WriteString(suffix)
+
+	return builder.String()
+}
+
+// zplRepeatCount encodes a run length: G-Y are 1-19 and g-z are multiples of 20 up to 400.
+func zplRepeatCount(count int) string {
+
+	if count == 1 {
+		return ""
+	}
+
+	var builder strings.Builder
+
+	for count >= 400 {
+		builder.WriteByte('z')
+		count -= 400
+	}
+
+	if count >= 20 {
+		builder.WriteByte(byte('f' + count/20))
+		count %= 20
+	}
+
+	if count > 0 {
+		builder.WriteByte(byte('F' + count))
+	}
+
+	return builder.String()
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
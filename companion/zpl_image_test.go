@@ -0,0 +1,125 @@
+package companion
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestZplRepeatCount(t *testing.T) {
+
+	tests := []struct {
+		count int
+		want  string
+	}{
+		{count: 1, want: ""},
+		{count: 2, want: "H"},
+		{count: 19, want: "Y"},
+		{count: 20, want: "g"},
+		{count: 21, want: "gG"},
+		{count: 40, want: "h"},
+		{count: 399, want: "yY"},
+		{count: 400, want: "z"},
+		{count: 401, want: "zG"},
+		{count: 820, want: "zzg"},
+	}
+
+	for _, test := range tests {
+		if got := zplRepeatCount(test.count); got != test.want {
+			t.Errorf("zplRepeatCount(%d) = %q, want %q", test.count, got, test.want)
+		}
+	}
+}
+
+func TestCompressZplRow(t *testing.T) {
+
+	tests := []struct {
+		row  string
+		want string
+	}{
+		{row: "0000", want: ","},
+		{row: "FFFF", want: "!"},
+		{row: "12", want: "12"},
+		{row: "A0", want: "A,"},
+		{row: "ABFF", want: "AB!"},
+		{row: "AAAB", want: "IAB"},
+		{row: "AAF0", want: "HAF,"},
+		{row: strings.Repeat("C", 25) + "00", want: "gKC,"},
+	}
+
+	for _, test := range tests {
+		if got := compressZplRow(test.row); got != test.want {
+			t.Errorf("compressZplRow(%q) = %q, want %q", test.row, got, test.want)
+		}
+	}
+}
+
+func TestConvertImageToZpl(t *testing.T) {
+
+	img := image.NewGray(image.Rect(0, 0, 16, 2))
+
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 16; x++ {
+			if x >= 8 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	var encoded bytes.Buffer
+
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ConvertImageToZpl(&encoded, ZplImageOptions{Dither: DitherThreshold}, "", 0)
+
+	if err != nil {
+		t.Fatalf("ConvertImageToZpl() error = %v", err)
+	}
+
+	// Black then white, the second row repeats the first
+	if want := "^XA^FO0,0^GFA,4,4,2,HF,:^FS^XZ\n"; string(got) != want {
+		t.Errorf("ConvertImageToZpl() = %q, want %q", got, want)
+	}
+}
+
+func TestConvertImageToZplRejectsLargeImages(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		image     []byte
+		mediaSize string
+	}{
+		// Only the header is needed for a GIF to claim its size, 65535 x 65535
+		{name: "header", image: []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")},
+		// A single dot stretched across 1m wide media is scaled to 7992 x 7992
+		{name: "scaled up", image: onePixelPng(t), mediaSize: "1000mm"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			_, err := ConvertImageToZpl(bytes.NewReader(test.image), ZplImageOptions{}, test.mediaSize, 0)
+
+			if err == nil || !strings.Contains(err.Error(), "too large") {
+				t.Errorf("ConvertImageToZpl() error = %v, want too large", err)
+			}
+		})
+	}
+}
+
+func onePixelPng(t *testing.T) []byte {
+	t.Helper()
+
+	var encoded bytes.Buffer
+
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Bytes()
+}
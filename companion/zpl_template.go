@@ -0,0 +1,283 @@
+package companion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+/**
+Label templates are ZPL documents using Go template actions for their data, e.g.
+
+	^XA^FO50,50^A0N,40,40^FD{{.sku}}^FS^FO50,100{{code128 .barcode}}^XZ
+
+Every ^FD is given a ^FH so field values can be hex escaped. This stops data such
+as "^XZ" being interpreted as a ZPL command.
+*/
+
+var templateNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ZplTemplateError is a problem with the template or the data sent to it.
+type ZplTemplateError struct {
+	Template string
+	Reason   string
+}
+
+func (err *ZplTemplateError) Error() string {
+	return fmt.Sprintf("label template %q: %s", err.Template, err.Reason)
+}
+
+// zplField is a field value. It is escaped whenever it is written in to the template.
+type zplField string
+
+func (field zplField) String() string {
+	return escapeZpl(string(field))
+}
+
+// zplEscaped is output that has already been escaped by a helper.
+type zplEscaped string
+
+// escapeZpl hex encodes anything that could be read as a ZPL command or the ^FH indicator.
+func escapeZpl(value string) string {
+	var builder strings.Builder
+	for _, c := range []byte(value) {
+		if c == '^' || c == '~' || c == '_' || c < 0x20 || c == 0x7f {
+			builder.WriteString(fmt.Sprintf("_%02X", c))
+			continue
+		}
+		builder.WriteByte(c)
+	}
+	return builder.String()
+}
+
+// LoadZplTemplate finds a template by name, preferring templates synced from firestore
+// over those stored in the config directory.
+func LoadZplTemplate(name string, synced map[string]string) (string, error) {
+
+	if !templateNamePattern.MatchString(name) {
+		return "", &ZplTemplateError{Template: name, Reason: "invalid template name"}
+	}
+
+	if source, ok := synced[name]; ok && source != "" {
+		return source, nil
+	}
+
+	dir, err := GetConfigDirectory()
+
+	if err != nil {
+		return "", err
+	}
+
+	source, err := ioutil.ReadFile(filepath.Join(dir, "templates", name+".zpl"))
+
+	if os.IsNotExist(err) {
+		return "", &ZplTemplateError{Template: name, Reason: "template does not exist"}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(source), nil
+}
+
+// RenderZplTemplate fills the template with the fields.
+func RenderZplTemplate(name string, source string, fields map[string]interface{}) ([]byte, error) {
+
+	prepared, err := prepareZplTemplate(name, source)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(zplTemplateFunctions).Parse(prepared)
+
+	if err != nil {
+		return nil, &ZplTemplateError{Template: name, Reason: err.Error()}
+	}
+
+	data := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		data[key] = toZplField(value)
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, data)
+
+	if err != nil {
+		return nil, &ZplTemplateError{Template: name, Reason: err.Error()}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// prepareZplTemplate adds ^FH to every ^FD and escapes the static field data, leaving the
+// template actions untouched.
+func prepareZplTemplate(name string, source string) (string, error) {
+
+	if strings.Contains(strings.ToUpper(source), "^FH") {
+		return "", &ZplTemplateError{Template: name, Reason: "templates must not use ^FH, it is added automatically"}
+	}
+
+	var builder strings.Builder
+	inFieldData := false
+
+	for len(source) > 0 {
+		// Copy template actions as they are
+		if strings.HasPrefix(source, "{{") {
+			end := strings.Index(source, "}}")
+			if end < 0 {
+				return "", &ZplTemplateError{Template: name, Reason: "unclosed template action"}
+			}
+			builder.WriteString(source[:end+2])
+			source = source[end+2:]
+			continue
+		}
+
+		upper := strings.ToUpper(source)
+
+		switch {
+		case strings.HasPrefix(upper, "^FD"):
+			builder.WriteString("^FH_")
+			builder.WriteString(source[:3])
+			source = source[3:]
+			inFieldData = true
+			continue
+		case strings.HasPrefix(upper, "^FS"):
+			inFieldData = false
+		case inFieldData && source[0] == '_':
+			builder.WriteString("_5F")
+			source = source[1:]
+			continue
+		}
+
+		builder.WriteByte(source[0])
+		source = source[1:]
+	}
+
+	return builder.String(), nil
+}
+
+func toZplField(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case string:
+		return zplField(typed)
+	case map[string]interface{}:
+		nested := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			nested[key] = toZplField(item)
+		}
+		return nested
+	case []interface{}:
+		items := make([]interface{}, len(typed))
+		for i, item := range typed {
+			items[i] = toZplField(item)
+		}
+		return items
+	case nil:
+		return zplField("")
+	}
+	return zplField(fmt.Sprint(value))
+}
+
+var zplTemplateFunctions = template.FuncMap{
+	"code128": zplCode128,
+	"ean13":   zplEan13,
+	"upca":    zplUpcA,
+	"qrcode":  zplQrCode,
+	"upper": func(value zplField) zplField {
+		return zplField(strings.ToUpper(string(value)))
+	},
+	"truncate": func(length int, value zplField) zplField {
+		runes := []rune(string(value))
+		if len(runes) > length {
+			runes = runes[:length]
+		}
+		return zplField(runes)
+	},
+	"default": func(fallback string, value interface{}) interface{} {
+		if field, ok := value.(zplField); ok && field != "" {
+			return field
+		}
+		return zplField(fallback)
+	},
+}
+
+// zplCode128 writes a Code 128 barcode field, 100 dots high with interpretation line.
+func zplCode128(value zplField) (zplEscaped, error) {
+	for _, c := range []byte(value) {
+		if c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("code128 value %q contains unsupported characters", string(value))
+		}
+	}
+	if value == "" {
+		return "", errors.New("code128 value is empty")
+	}
+	return zplEscaped("^BCN,100,Y,N,N^FH_^FD" + value.String() + "^FS"), nil
+}
+
+// zplEan13 writes an EAN-13 barcode field. The check digit is validated when supplied.
+func zplEan13(value zplField) (zplEscaped, error) {
+	digits, err := checkDigitValue(string(value), 12)
+	if err != nil {
+		return "", fmt.Errorf("ean13 %w", err)
+	}
+	return zplEscaped("^BEN,100,Y,N^FD" + digits + "^FS"), nil
+}
+
+// zplUpcA writes a UPC-A barcode field. The check digit is validated when supplied.
+func zplUpcA(value zplField) (zplEscaped, error) {
+	digits, err := checkDigitValue(string(value), 11)
+	if err != nil {
+		return "", fmt.Errorf("upca %w", err)
+	}
+	return zplEscaped("^BUN,100,Y,N,Y^FD" + digits + "^FS"), nil
+}
+
+// zplQrCode writes a QR code field with automatic data encoding.
+func zplQrCode(value zplField) (zplEscaped, error) {
+	if value == "" {
+		return "", errors.New("qrcode value is empty")
+	}
+	return zplEscaped("^BQN,2,5^FH_^FDQA," + value.String() + "^FS"), nil
+}
+
+// checkDigitValue returns the digits without their check digit, which the printer adds itself.
+func checkDigitValue(value string, length int) (string, error) {
+
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("value %q must only contain digits", value)
+		}
+	}
+
+	if len(value) != length && len(value) != length+1 {
+		return "", fmt.Errorf("value %q must be %d or %d digits", value, length, length+1)
+	}
+
+	if len(value) == length {
+		return value, nil
+	}
+
+	// GS1 check digit: weights of 3 and 1 alternate from the right of the data digits
+	sum := 0
+	for i := 0; i < length; i++ {
+		digit := int(value[length-1-i] - '0')
+		if i%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+
+	if int(value[length]-'0') != (10-sum%10)%10 {
+		return "", fmt.Errorf("value %q has an invalid check digit", value)
+	}
+
+	return value[:length], nil
+}
@@ -0,0 +1,152 @@
+package companion
+
+import (
+	"testing"
+)
+
+func TestEscapeZpl(t *testing.T) {
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "SKU-123 Blue", want: "SKU-123 Blue"},
+		{value: "^XZ", want: "_5EXZ"},
+		{value: "~JR", want: "_7EJR"},
+		{value: "under_score", want: "under_5Fscore"},
+		{value: "line\r\nbreak\ttab", want: "line_0D_0Abreak_09tab"},
+		{value: "\x00\x1f\x7f", want: "_00_1F_7F"},
+		{value: "Café", want: "Café"},
+		{value: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if got := escapeZpl(test.value); got != test.want {
+				t.Errorf("escapeZpl() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrepareZplTemplate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		source  string
+		want    string
+		wantErr bool
+	}{
+		{name: "every field", source: "^XA^FO50,50^FD{{.sku}}^FS^FO50,100^fdStatic^FS^XZ", want: "^XA^FO50,50^FH_^FD{{.sku}}^FS^FO50,100^FH_^fdStatic^FS^XZ"},
+		{name: "static underscores", source: "^FDa_b^FS_c", want: "^FH_^FDa_5Fb^FS_c"},
+		{name: "actions left alone", source: "^FD{{default \"n_a\" .sku}}^FS", want: "^FH_^FD{{default \"n_a\" .sku}}^FS"},
+		{name: "no fields", source: "^XA^XZ", want: "^XA^XZ"},
+		{name: "already hex escaped", source: "^XA^FH^FD_5E^FS^XZ", wantErr: true},
+		{name: "lower case hex escape", source: "^fh\\^FDx^FS", wantErr: true},
+		{name: "unclosed action", source: "^FD{{.sku^FS", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := prepareZplTemplate("test", test.source)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("prepareZplTemplate() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("prepareZplTemplate() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderZplTemplate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		source  string
+		fields  map[string]interface{}
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "field data can't end the label",
+			source: "^XA^FO50,50^FD{{.sku}}^FS^XZ",
+			fields: map[string]interface{}{"sku": "A1^FS^XZ~JR"},
+			want:   "^XA^FO50,50^FH_^FDA1_5EFS_5EXZ_7EJR^FS^XZ",
+		},
+		{
+			name:   "helpers",
+			source: "^XA^FD{{upper .name}} {{truncate 3 .code}} {{default \"none\" .missing}}^FS{{code128 .barcode}}^XZ",
+			fields: map[string]interface{}{"name": "blue_box", "code": "ABCDEF", "missing": nil, "barcode": "12^34"},
+			want:   "^XA^FH_^FDBLUE_5FBOX ABC none^FS^BCN,100,Y,N,N^FH_^FD12_5E34^FS^XZ",
+		},
+		{
+			name:   "numbers & nested fields",
+			source: "^FD{{.quantity}} x {{.item.sku}}^FS",
+			fields: map[string]interface{}{"quantity": int64(3), "item": map[string]interface{}{"sku": "S_1"}},
+			want:   "^FH_^FD3 x S_5F1^FS",
+		},
+		{name: "missing field", source: "^FD{{.sku}}^FS", fields: map[string]interface{}{}, wantErr: true},
+		{name: "invalid barcode", source: "{{ean13 .barcode}}", fields: map[string]interface{}{"barcode": "123"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := RenderZplTemplate("test", test.source, test.fields)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("RenderZplTemplate() error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if string(got) != test.want {
+				t.Errorf("RenderZplTemplate() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestZplBarcodes(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		helper  func(zplField) (zplEscaped, error)
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "code128", helper: zplCode128, value: "ORDER_1001", want: "^BCN,100,Y,N,N^FH_^FDORDER_5F1001^FS"},
+		{name: "code128 escapes", helper: zplCode128, value: "^XZ~", want: "^BCN,100,Y,N,N^FH_^FD_5EXZ_7E^FS"},
+		{name: "code128 control character", helper: zplCode128, value: "A\nB", wantErr: true},
+		{name: "code128 outside ascii", helper: zplCode128, value: "Café", wantErr: true},
+		{name: "code128 empty", helper: zplCode128, wantErr: true},
+		{name: "ean13 without check digit", helper: zplEan13, value: "400638133393", want: "^BEN,100,Y,N^FD400638133393^FS"},
+		{name: "ean13 with check digit", helper: zplEan13, value: "4006381333931", want: "^BEN,100,Y,N^FD400638133393^FS"},
+		{name: "ean13 wrong check digit", helper: zplEan13, value: "4006381333932", wantErr: true},
+		{name: "ean13 letters", helper: zplEan13, value: "40063813339A", wantErr: true},
+		{name: "ean13 too short", helper: zplEan13, value: "40063813339", wantErr: true},
+		{name: "upca with check digit", helper: zplUpcA, value: "036000291452", want: "^BUN,100,Y,N,Y^FD03600029145^FS"},
+		{name: "upca wrong check digit", helper: zplUpcA, value: "036000291453", wantErr: true},
+		{name: "upca too long", helper: zplUpcA, value: "0360002914521", wantErr: true},
+		{name: "qrcode", helper: zplQrCode, value: "https://example.com/o?id=1_2", want: "^BQN,2,5^FH_^FDQA,https://example.com/o?id=1_5F2^FS"},
+		{name: "qrcode empty", helper: zplQrCode, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := test.helper(zplField(test.value))
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+
+			if string(got) != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
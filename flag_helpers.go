@@ -1,7 +1,6 @@
 package main
 
 import (
-	_ "embed"
 	"fmt"
 	"github.com/olekukonko/tablewriter"
 	"github.com/rs/zerolog/log"
@@ -9,6 +8,7 @@ import (
 	"main/companion"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,9 +18,6 @@ This file contains some additional help functions that should ONLY be called fro
 the main.go flag options.
 */
 
-//go:embed resources/sample.pdf
-var samplePdf []byte
-
 func listPrinters() {
 
 	log.Info().Msg("Fetching the list of printers")
@@ -31,86 +28,352 @@ func listPrinters() {
 		log.Error().Caller().Err(err).Msg("Failed to list printers")
 	}
 
+	discovered, err := companion.DiscoverNetworkPrinters(companion.DefaultDiscoveryTimeout)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to discover network printers")
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Printer", "Trays"})
+	table.SetHeader([]string{"Printer", "Trays", "State", "Accepting Jobs", "Reasons", "Queue"})
+
+	printers = append(printers, discovered...)
+	healths, errs := companion.ProbePrintersHealth(printers)
+
+	for i, printer := range printers {
+		name := printer.Name
+		if printer.Discovered {
+			name += " (" + printer.Capabilities.DeviceUri + ")"
+		}
 
-	for _, printer := range printers {
 		trays := make([]string, 0)
 		for _, tray := range printer.Trays {
 			trays = append(trays, tray.Name)
 		}
-		table.Append([]string{printer.Name, strings.Join(trays, ", ")})
+
+		row := []string{name, strings.Join(trays, ", "), companion.PrinterStateUnknown, "", "", ""}
+
+		health, err := healths[i], errs[i]
+
+		if err != nil {
+			log.Warn().Err(err).Str("Printer", printer.Name).Msg("Failed to check the printer health")
+		} else if health != nil {
+			row[2] = health.State
+			row[3] = strconv.FormatBool(health.AcceptingJobs)
+			row[4] = strings.Join(health.Reasons, ", ")
+			row[5] = strconv.Itoa(health.QueueLength)
+		}
+
+		table.Append(row)
+	}
+	table.Render()
+}
+
+func listScales() {
+
+	log.Info().Msg("Fetching the list of scales")
+
+	scales, err := companion.ListAvailableScales()
+
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to list scales")
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Scale", "Vendor", "Product", "Serial", "Path"})
+
+	for _, scale := range scales {
+		table.Append([]string{scale.Name, fmt.Sprintf("%04x", scale.VendorId), fmt.Sprintf("%04x", scale.ProductId), scale.Serial, scale.Path})
 	}
 	table.Render()
 }
 
 func readScales() {
 
-	weight, err := companion.ReadScales()
+	var scale companion.Scale
+
+	cfg, err := companion.GetConfig()
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load the config, reading the default scale")
+	} else {
+		scale = configuredScale(cfg.AppId)
+	}
+
+	reading, err := companion.ReadScales(scale, cfg.Scales.StableOptions())
 
 	if err != nil {
 		log.Error().Caller().Err(err).Msg("Failed to read scale")
 	}
 
-	println(fmt.Sprintf("%dkg", weight))
+	if reading.Samples == 0 {
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s (%gg, %s) after %d readings in %s\n", reading.String(), reading.Grams, reading.State, reading.Samples, reading.Settle.Round(time.Millisecond))
+}
+
+// configuredScale is the scale set up for this app in Blade, empty when it can't be loaded
+// so the default scale is read.
+func configuredScale(appId string) companion.Scale {
+
+	client, err := getFirestoreClient()
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to connect to firestore, reading the default scale")
+		return companion.Scale{}
+	}
+
+	app, err := companion.FetchApp(client, appId)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load the app data, reading the default scale")
+		return companion.Scale{}
+	}
+
+	return app.Scale
 }
 
-func printTestPage(printerName string) {
+func printTestPage(printerName string, pageSize string) {
 
-	dir, err := companion.GetConfigDirectory()
+	printers, err := companion.ListAvailablePrinters()
 
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to copy the sample.pdf file")
+		log.Error().Caller().Err(err).Msg("Failed to list printers")
+		os.Exit(1)
+	}
+
+	found := false
+	for _, printer := range printers {
+		if printer.Name == printerName {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		log.Error().Msg("Printer name specified could not be found. Use --list-printers to find available printer names.")
 		os.Exit(1)
 	}
 
-	if runtime.GOOS == "windows" {
-		err = ioutil.WriteFile(fmt.Sprintf("%s\\sample.pdf", dir), samplePdf, os.ModePerm)
+	hostname, _ := os.Hostname()
+
+	info := companion.TestPageInfo{
+		PrinterName: printerName,
+		Hostname:    hostname,
+		Version:     companion.AppVersion,
+		Timestamp:   time.Now(),
+	}
+
+	cfg, err := companion.GetConfig()
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load the config, the test page will not include the app id")
 	} else {
-		err = ioutil.WriteFile(fmt.Sprintf("%s/sample.pdf", dir), samplePdf, os.ModePerm)
+		info.AppId = cfg.AppId
+	}
+
+	// Look up how the printer is set up in Blade, the test page is still useful without it
+	var reference *companion.PrinterReference
+
+	client, err := getFirestoreClient()
+
+	if err == nil && info.AppId != "" {
+		app, err := companion.FetchApp(client, info.AppId)
+
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to load the app data, the test page will not include the printer role")
+		} else {
+			info.Bay = app.Bay.Name
+
+			var printerType companion.PrinterType
+			printerType, reference = app.FindPrinterRole(printerName)
+
+			if reference != nil {
+				info.Role = printerType.String()
+				info.Tray = reference.Tray
+			}
+		}
+	}
+
+	// Label printers get a test page the size of their labels
+	if pageSize == "" && reference != nil && reference.NormaliseTo != "" {
+		pageSize = reference.NormaliseTo
+	}
+
+	if pageSize == "" {
+		pageSize = companion.DefaultTestPageSize
 	}
 
+	size, err := companion.ParseMediaSize(pageSize)
+
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to copy the sample.pdf file")
+		log.Error().Err(err).Msg("Invalid test page size")
 		os.Exit(1)
 	}
 
-	var file *os.File
-	if runtime.GOOS == "windows" {
-		file, err = os.Open(fmt.Sprintf("%s\\sample.pdf", dir))
-	} else {
-		file, err = os.Open(fmt.Sprintf("%s/sample.pdf", dir))
+	data, err := companion.GenerateTestPage(info, size)
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate the test page")
+		os.Exit(1)
 	}
 
+	file, err := ioutil.TempFile("", "test_page_*.pdf")
+
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to open the sample.pdf file")
+		log.Error().Err(err).Msg("Failed to create the test page file")
 		os.Exit(1)
 	}
 
-	printers, err := companion.ListAvailablePrinters()
+	//goland:noinspection GoUnhandledErrorResult
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	_ = file.Close()
 
 	if err != nil {
-		log.Error().Caller().Err(err).Msg("Failed to list printers")
+		log.Error().Err(err).Msg("Failed to write the test page file")
 		os.Exit(1)
 	}
 
-	for _, printer := range printers {
-		if printer.Name == printerName {
+	before := time.Now()
+	_, err = companion.PrintFile(printerName, info.Tray, file, 1, companion.PrintOptions{})
 
-			before := time.Now()
-			err := companion.PrintFile(printerName, "", file, 1)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("Failed to printer test page")
+		os.Exit(1)
+	}
 
-			if err != nil {
-				log.Error().Caller().Err(err).Msg("Failed to printer test page")
-				os.Exit(1)
-			}
+	log.Info().Msg(fmt.Sprintf("Test page printed successfully in %s", time.Now().Sub(before)))
+}
 
-			log.Info().Msg(fmt.Sprintf("Test page printed successfully in %s", time.Now().Sub(before)))
-			os.Exit(0)
-		}
+func reprint(jobId string) {
+
+	cfg, err := companion.GetConfig()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load the config")
+		os.Exit(1)
+	}
+
+	app := localApp(cfg.AppId)
+	app.OpenLocalStores(cfg)
+
+	if jobId == "last" {
+		jobId = ""
+	}
+
+	before := time.Now()
+
+	job, err := app.Reprint(jobId)
+
+	if err != nil {
+		log.Error().Err(err).Str("Job", jobId).Msg("Failed to find the print job")
+		os.Exit(1)
+	}
+
+	if job.Status != companion.PrintJobStatusComplete {
+		log.Error().Str("Job", job.Id).Msg("Failed to reprint the print job")
+		os.Exit(1)
+	}
+
+	log.Info().Msg(fmt.Sprintf("Reprinted job %s in %s", job.Id, time.Now().Sub(before)))
+}
+
+// localApp loads the app from firestore for its printers & user, or an empty app when it can't be reached.
+func localApp(appId string) *companion.App {
+
+	client, err := getFirestoreClient()
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to connect to firestore, using the printers recorded in the spool cache")
+		return &companion.App{Reference: appId}
+	}
+
+	app, err := companion.FetchApp(client, appId)
+
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load the app data, using the printers recorded in the spool cache")
+		return &companion.App{Reference: appId}
+	}
+
+	return app
+}
+
+func history(filters HistoryFlagOptions) {
+
+	cfg, err := companion.GetConfig()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load the config")
+		os.Exit(1)
+	}
+
+	ledger, err := companion.OpenHistoryReadOnly(cfg.History)
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open the local history")
+		os.Exit(1)
+	}
+
+	filter, err := companion.NewHistoryFilter(map[string]string{
+		"since":     filters.Since,
+		"until":     filters.Until,
+		"kind":      filters.Kind,
+		"job_id":    filters.Job,
+		"reference": filters.Reference,
+		"role":      filters.Role,
+		"printer":   filters.Printer,
+		"outcome":   filters.Outcome,
+		"verdict":   filters.Verdict,
+		"user":      filters.User,
+		"limit":     strconv.Itoa(filters.Limit),
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid history filter")
+		os.Exit(1)
 	}
 
-	log.Error().Msg("Printer name specified could not be found. Use --list-printers to find available printer names.")
+	records, err := ledger.Query(filter)
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read the local history")
+		os.Exit(1)
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Started", "Kind", "Job", "Reference", "Role", "Printer", "Quantity / Weight", "User", "Bay", "Outcome", "Total (ms)", "Message"})
+
+	for _, record := range records {
+		amount := strconv.Itoa(record.Quantity)
+		if record.Kind == companion.HistoryKindScale {
+			amount = fmt.Sprintf("%gg", record.Weight)
+
+			if record.Verdict == companion.CheckWeighError {
+				amount += fmt.Sprintf(" (%s, expected %gg)", record.Verdict, record.ExpectedWeight)
+			} else if record.Verdict != "" {
+				amount += fmt.Sprintf(" (%s %+gg of %gg)", record.Verdict, record.Variance, record.ExpectedWeight)
+			}
+		}
+
+		table.Append([]string{
+			record.Started.Local().Format("2006-01-02 15:04:05"),
+			record.Kind,
+			record.JobId,
+			record.Reference,
+			record.Role,
+			record.Printer,
+			amount,
+			record.User,
+			record.Bay,
+			record.Outcome,
+			strconv.FormatInt(record.TotalMs, 10),
+			record.Message,
+		})
+	}
+	table.Render()
 }
 
 func info() {
@@ -6,11 +6,12 @@ require (
 	cloud.google.com/go/firestore v1.5.0
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
 	github.com/google/uuid v1.3.0
-	github.com/jessevdk/go-flags v1.5.0 // indirect
-	github.com/kardianos/service v1.2.0 // indirect
-	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/jessevdk/go-flags v1.5.0
+	github.com/kardianos/service v1.2.0
+	github.com/olekukonko/tablewriter v0.0.5
 	github.com/rs/zerolog v1.23.0
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+	golang.org/x/net v0.0.0-20201224014010-6772e930b67b
 	google.golang.org/api v0.40.0
 	google.golang.org/grpc v1.35.0
 )
@@ -40,6 +40,11 @@ func main() {
 		return
 	}
 
+	if opts.ListScales {
+		listScales()
+		return
+	}
+
 	if opts.ReadScales {
 		readScales()
 		return
@@ -50,8 +55,18 @@ func main() {
 		return
 	}
 
+	if opts.History {
+		history(opts.HistoryFilters)
+		return
+	}
+
+	if opts.Reprint != "" {
+		reprint(opts.Reprint)
+		return
+	}
+
 	if opts.PrintTestPage != "" {
-		printTestPage(opts.PrintTestPage)
+		printTestPage(opts.PrintTestPage, opts.TestPageSize)
 		return
 	}
 
@@ -134,7 +149,27 @@ func main() {
 type FlagOptions struct {
 	Service       string `short:"s" long:"service" description:"Control the CompanionApp service." choice:"start" choice:"stop" choice:"status" choice:"restart" choice:"install" choice:"uninstall"`
 	ListPrinters  bool   `short:"l" long:"list-printers" description:"List the available printers."`
+	ListScales    bool   `long:"list-scales" description:"List the attached USB scales."`
 	ReadScales    bool   `short:"r" long:"read-scales" description:"Read the weight from attached USB scales."`
 	PrintTestPage string `short:"p" long:"print-test-page" description:"Print test page. Provide a printer name."`
+	TestPageSize  string `long:"test-page-size" description:"Size of the test page, e.g. A4, 4x6in or 62mm. Defaults to the label size configured for the printer, or A4."`
 	Info          bool   `short:"i" long:"info" description:"Get some info regarding the companion app's setup'."`
+	Reprint       string `long:"reprint" optional:"yes" optional-value:"last" description:"Reprint a recent print job from the spool cache. Provide a job id, or leave empty for the last job."`
+	History       bool   `long:"history" description:"List recent print & scale jobs from the local history."`
+
+	HistoryFilters HistoryFlagOptions `group:"History Filters"`
+}
+
+type HistoryFlagOptions struct {
+	Since     string `long:"since" description:"Only jobs after this time. Accepts RFC3339, 2006-01-02 or a duration such as 24h."`
+	Until     string `long:"until" description:"Only jobs before this time. Accepts RFC3339, 2006-01-02 or a duration such as 24h."`
+	Kind      string `long:"kind" description:"Only jobs of this kind." choice:"print" choice:"scale"`
+	Job       string `long:"job" description:"Only the job with this id."`
+	Reference string `long:"reference" description:"Only jobs whose reference contains this value, e.g. an order number."`
+	Role      string `long:"role" description:"Only jobs for this printer role." choice:"document" choice:"gift_note" choice:"label_small" choice:"label_large"`
+	Printer   string `long:"printer" description:"Only jobs sent to this printer."`
+	Outcome   string `long:"outcome" description:"Only jobs with this outcome, e.g. complete, error or cancelled."`
+	Verdict   string `long:"verdict" description:"Only scale jobs with this check weigh verdict." choice:"pass" choice:"under" choice:"over" choice:"error"`
+	User      string `long:"user" description:"Only jobs made by this user."`
+	Limit     int    `long:"limit" default:"50" description:"The maximum number of jobs to list."`
 }
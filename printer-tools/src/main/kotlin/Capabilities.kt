@@ -0,0 +1,11 @@
+import com.google.gson.annotations.SerializedName
+
+data class Capabilities(
+    @SerializedName("make_and_model") val makeAndModel: String,
+    @SerializedName("device_uri") val deviceUri: String,
+    @SerializedName("media_sizes") val mediaSizes: List<String>,
+    val resolutions: List<String>,
+    val duplex: Boolean,
+    val colour: Boolean,
+    @SerializedName("document_formats") val documentFormats: List<String>
+)
@@ -1,11 +1,18 @@
 import com.google.gson.Gson
 import javax.print.DocFlavor
+import javax.print.PrintService
 import javax.print.PrintServiceLookup
 import javax.print.attribute.AttributeSet
 import javax.print.attribute.HashAttributeSet
+import javax.print.attribute.standard.ColorSupported
 import javax.print.attribute.standard.Media
+import javax.print.attribute.standard.MediaSizeName
 import javax.print.attribute.standard.MediaTray
+import javax.print.attribute.standard.PrinterMakeAndModel
 import javax.print.attribute.standard.PrinterName
+import javax.print.attribute.standard.PrinterResolution
+import javax.print.attribute.standard.PrinterURI
+import javax.print.attribute.standard.Sides
 
 
 fun main(args: Array<String>) {
@@ -15,6 +22,7 @@ fun main(args: Array<String>) {
 
     for (printerService in printServices) {
         val trays = mutableListOf<Tray>()
+        val mediaSizes = mutableListOf<String>()
 
         val printName = printerService.name
         val aset: AttributeSet = HashAttributeSet()
@@ -28,13 +36,53 @@ fun main(args: Array<String>) {
                 for (media in o as Array<Media?>) {
                     if (media is MediaTray) {
                         trays.add(Tray(media.toString()))
+                    } else if (media is MediaSizeName) {
+                        mediaSizes.add(media.toString())
                     }
                 }
             }
         }
 
-        printers.add(Printer(printerService.name, trays))
+        printers.add(Printer(printerService.name, trays, capabilities(printerService, mediaSizes)))
     }
     val gson = Gson()
     print(gson.toJson(printers))
 }
+
+fun capabilities(service: PrintService, mediaSizes: List<String>): Capabilities {
+    val resolutions = mutableListOf<String>()
+    val o = service.getSupportedAttributeValues(PrinterResolution::class.java, null, null)
+    if (o != null && o.javaClass.isArray) {
+        for (resolution in o as Array<PrinterResolution?>) {
+            if (resolution != null) {
+                val crossFeed = resolution.getCrossFeedResolution(PrinterResolution.DPI)
+                val feed = resolution.getFeedResolution(PrinterResolution.DPI)
+                resolutions.add("${crossFeed}x${feed}dpi")
+            }
+        }
+    }
+
+    var duplex = false
+    val sides = service.getSupportedAttributeValues(Sides::class.java, null, null)
+    if (sides != null && sides.javaClass.isArray) {
+        for (side in sides as Array<Sides?>) {
+            if (side == Sides.TWO_SIDED_LONG_EDGE || side == Sides.TWO_SIDED_SHORT_EDGE) {
+                duplex = true
+            }
+        }
+    }
+
+    val formats = service.supportedDocFlavors
+        .map { "${it.mediaType}/${it.mediaSubtype}" }
+        .distinct()
+
+    return Capabilities(
+        service.getAttribute(PrinterMakeAndModel::class.java)?.value ?: "",
+        service.getAttribute(PrinterURI::class.java)?.uri?.toString() ?: "",
+        mediaSizes.distinct(),
+        resolutions.distinct(),
+        duplex,
+        service.getAttribute(ColorSupported::class.java) == ColorSupported.SUPPORTED,
+        formats
+    )
+}
@@ -1,4 +1,5 @@
 data class Printer(
     val name: String,
-    val trays: List<Tray>
+    val trays: List<Tray>,
+    val capabilities: Capabilities
 )
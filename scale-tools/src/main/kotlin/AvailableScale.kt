@@ -0,0 +1,9 @@
+import com.google.gson.annotations.SerializedName
+
+data class AvailableScale (
+    val product: String,
+    @SerializedName("vendor_id") val vendorId: Int,
+    @SerializedName("product_id") val productId: Int,
+    val serial: String,
+    val path: String
+)
@@ -7,32 +7,123 @@ import com.google.gson.Gson
 const val VENDOR_ID = 0x0922
 const val PRODUCT_ID = 0x8003
 const val DATA_MODE_GRAMS = 2
+const val USAGE_PAGE_SCALE = 0x8D
 
 fun main(args: Array<String>) {
 
     val hidServices = HidManager.getHidServices()
-    val scales = hidServices.getHidDevice(VENDOR_ID, PRODUCT_ID, null)
-
     val gson = Gson()
 
+    if (args.getOrNull(0) == "--list") {
+        print(gson.toJson(listScales(hidServices)))
+        hidServices.shutdown()
+        return
+    }
+
+    // Keeps the scale open and prints every report, so the companion app doesn't start a JVM per reading
+    if (args.getOrNull(0) == "--stream") {
+        streamReports(hidServices, gson, args.drop(1))
+        return
+    }
+
+    // The companion app passes the configured scale's vendor & product id, and optionally its name, serial or path
+    val vendorId = args.getOrNull(0)?.toIntOrNull() ?: VENDOR_ID
+    val productId = args.getOrNull(1)?.toIntOrNull() ?: PRODUCT_ID
+    val name = args.getOrNull(2) ?: ""
+
+    val scales = findScale(hidServices, vendorId, productId, name)
+
     if(scales == null) {
         print(gson.toJson(Result(error = "Failed to connect to USB scales.", weight = 0)))
         return
     }
 
+    var report: ByteArray? = null
+
     try {
-        val grams = getWeightInGrams(scales)
-        print(gson.toJson(Result(error = null, weight = grams)))
+        report = readReport(scales)
+        val grams = getWeightInGrams(report)
+        print(gson.toJson(Result(error = null, weight = grams, report = reportValues(report))))
         hidServices.shutdown()
         return
     } catch (e: Exception) {
         hidServices.shutdown()
-        print(gson.toJson(Result(error = e.message, weight = 0)))
+        // The companion app decodes the report itself to explain why there is no weight
+        print(gson.toJson(Result(error = e.message, weight = 0, report = report?.let { reportValues(it) })))
         exitProcess(1)
     }
 }
 
-fun getWeightInGrams(scales: HidDevice): Int {
+fun streamReports(hidServices: HidServices, gson: Gson, args: List<String>) {
+
+    val vendorId = args.getOrNull(0)?.toIntOrNull() ?: VENDOR_ID
+    val productId = args.getOrNull(1)?.toIntOrNull() ?: PRODUCT_ID
+    val name = args.getOrNull(2) ?: ""
+
+    val scales = findScale(hidServices, vendorId, productId, name)
+
+    if (scales == null || !(scales.isOpen || scales.open())) {
+        println(gson.toJson(Result(error = "Failed to connect to USB scales.", weight = 0)))
+        hidServices.shutdown()
+        exitProcess(1)
+    }
+
+    // The companion app closes our input when it is done with the scale
+    val watcher = Thread {
+        while (System.`in`.read() != -1) {
+            // Nothing is sent, only the end matters
+        }
+        scales.close()
+        hidServices.shutdown()
+        exitProcess(0)
+    }
+    watcher.isDaemon = true
+    watcher.start()
+
+    val message = ByteArray(6)
+
+    while (true) {
+        val read = scales.read(message, 1000)
+
+        if (read < 0) {
+            println(gson.toJson(Result(error = scales.lastErrorMessage ?: "Failed to read the scales.", weight = 0)))
+            scales.close()
+            hidServices.shutdown()
+            exitProcess(1)
+        }
+
+        // Scales only send a report when the weight changes, the companion app repeats the last one
+        if (read == 0) {
+            continue
+        }
+
+        val report = message.copyOf(read)
+        val grams = try { getWeightInGrams(report) } catch (e: Exception) { 0 }
+
+        println(gson.toJson(Result(error = null, weight = grams, report = reportValues(report))))
+        System.out.flush()
+    }
+}
+
+fun reportValues(report: ByteArray): List<Int> {
+    return report.map { it.toUByte().toInt() }
+}
+
+fun listScales(hidServices: HidServices): List<AvailableScale> {
+    return hidServices.attachedHidDevices
+        .filter { it.usagePage == USAGE_PAGE_SCALE || (it.vendorId == VENDOR_ID && it.productId == PRODUCT_ID) }
+        .map { AvailableScale(product = it.product ?: "", vendorId = it.vendorId, productId = it.productId, serial = it.serialNumber ?: "", path = it.path ?: "") }
+}
+
+fun findScale(hidServices: HidServices, vendorId: Int, productId: Int, name: String): HidDevice? {
+    val matching = hidServices.attachedHidDevices.filter { it.vendorId == vendorId && it.productId == productId }
+
+    // Fall back to the first with the ids when the name isn't a serial or path, the same as the companion app
+    return matching.firstOrNull { name != "" && (it.serialNumber == name || it.path == name || name == "${it.product} (${it.serialNumber ?: it.path})") }
+        ?: matching.firstOrNull()
+}
+
+fun readReport(scales: HidDevice): ByteArray {
 
     // Byte 0 == Report ID?
     // Byte 1 == Scale Status (1 == Fault, 2 == Stable @ 0, 3 == In Motion, 4 == Stable, 5 == Under 0, 6 == Over Weight, 7 == Requires Calibration, 8 == Requires Re-Zeroing)
@@ -53,6 +144,11 @@ fun getWeightInGrams(scales: HidDevice): Int {
     scales.read(message, 1000)
     scales.close()
 
+    return message
+}
+
+fun getWeightInGrams(message: ByteArray): Int {
+
     if(message[1].toInt() != 4) {
         throw java.lang.Exception("Could not get a positive stable weight.")
     }
@@ -1,4 +1,5 @@
 data class Result (
     val error: String?,
-    val weight: Int
+    val weight: Int,
+    val report: List<Int>? = null
 )